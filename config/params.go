@@ -4,9 +4,28 @@ import (
     "time"
 )
 
+// Quality of service and retain flag of published MQTT messages
+type MqttPublishOptions struct {
+    Qos byte
+    Retain bool
+}
+
 type Parameters struct {
     LogLevel string
     DOSInterval time.Duration
+    DOSBurst int
+    DOSIpInterval time.Duration
+    DOSIpBurst int
+    DOSMaxEntries int
+    TimeSkewPast time.Duration
+    TimeSkewFuture time.Duration
+    BatchMaxSize int
+    RegistrationPolicy string
+    RequireSealed bool
+    MqttWorkers int
+    MqttQueueSize int
+    MqttQueuePolicy string
+    MqttPublish map[string]MqttPublishOptions
     JwtTokenExpiration time.Duration
     JwtPassword string
     DbUri string
@@ -22,6 +41,24 @@ func NewParameters() *Parameters {
     p := &Parameters{
         LogLevel:       "INFO",
         DOSInterval:    1 * time.Second,
+        DOSBurst: 1,
+        DOSIpInterval: 100 * time.Millisecond,
+        DOSIpBurst: 20,
+        DOSMaxEntries: 10000,
+        TimeSkewPast: 7 * 24 * time.Hour,
+        TimeSkewFuture: 5 * time.Minute,
+        BatchMaxSize: 100,
+        RegistrationPolicy: "auto",
+        RequireSealed: false,
+        MqttWorkers: 4,
+        MqttQueueSize: 1000,
+        MqttQueuePolicy: "drop",
+        MqttPublish: map[string]MqttPublishOptions{
+            "availability": {Qos: 0, Retain: true},
+            "value": {Qos: 0, Retain: true},
+            "unit": {Qos: 0, Retain: false},
+            "net": {Qos: 0, Retain: false},
+        },
         JwtTokenExpiration: 5 * time.Hour,
         JwtPassword: "jwt-secret",
         DbUri: "",
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// limits of expressions, expressions are provided by users and evaluated for
+// each message, so their size is bounded
+const EXPRESSION_MAX_LENGTH = 1024
+const EXPRESSION_MAX_DEPTH = 32
+
+// max number of parsed expressions kept by cache
+const EXPRESSION_CACHE_SIZE = 1000
+
+// Resolves value of variable referenced by expression
+type ExpressionVars func(name string) (float64, error)
+
+type exprNode interface {
+	eval(vars ExpressionVars) (float64, error)
+}
+
+type exprNumber float64
+
+type exprVariable string
+
+type exprUnary struct {
+	op      byte
+	operand exprNode
+}
+
+type exprBinary struct {
+	op          byte
+	left, right exprNode
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+type exprFunction struct {
+	minArgs, maxArgs int
+	call             func(args []float64) float64
+}
+
+// functions available in expressions
+var exprFunctions = map[string]exprFunction{
+	"abs":   {1, 1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"ceil":  {1, 1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"floor": {1, 1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"sqrt":  {1, 1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"pow":   {2, 2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min":   {1, -1, func(a []float64) float64 { return exprFold(a, math.Min) }},
+	"max":   {1, -1, func(a []float64) float64 { return exprFold(a, math.Max) }},
+	"round": {1, 2, func(a []float64) float64 {
+		if len(a) == 1 {
+			return math.Round(a[0])
+		}
+		scale := math.Pow(10, math.Round(a[1]))
+		return math.Round(a[0]*scale) / scale
+	}},
+}
+
+func exprFold(values []float64, f func(a, b float64) float64) float64 {
+	result := values[0]
+	for _, v := range values[1:] {
+		result = f(result, v)
+	}
+	return result
+}
+
+// Arithmetic expression computing sensor value, e.g. value * 0.1 + 2 or
+// round((a.t + b.t) / 2, 1). Expressions support numbers, variables,
+// operators + - * / % with usual precedence, parentheses and functions abs,
+// ceil, floor, sqrt, pow, min, max and round. Variables are resolved by
+// caller, they are identifiers with dots (e.g. JSON paths). Expressions have
+// no side effects and their evaluation always terminates.
+type Expression struct {
+	source string
+	root   exprNode
+	vars   []string
+}
+
+// ParseExpression parses expression and checks its syntax, number of
+// arguments of functions and size limits
+func ParseExpression(source string) (*Expression, error) {
+	if len(source) > EXPRESSION_MAX_LENGTH {
+		return nil, fmt.Errorf("expression is longer than %d characters", EXPRESSION_MAX_LENGTH)
+	}
+
+	tokens, err := exprTokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseSum(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected \"%s\" in expression", p.tokens[p.pos].text)
+	}
+
+	return &Expression{source: source, root: root, vars: p.vars}, nil
+}
+
+// String returns source of expression
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Vars returns names of variables referenced by expression
+func (e *Expression) Vars() []string {
+	return e.vars
+}
+
+// Cache of parsed expressions by their source, so expressions are not parsed
+// for each evaluation. Expressions are immutable, they are shared by
+// concurrent evaluations. Cache is cleared once it is full (sources of
+// replaced expressions are not removed otherwise).
+type ExpressionCache struct {
+	mutex       sync.RWMutex
+	expressions map[string]*Expression
+}
+
+func NewExpressionCache() *ExpressionCache {
+	return &ExpressionCache{expressions: make(map[string]*Expression)}
+}
+
+// Get returns parsed expression of source, invalid sources are not cached
+func (c *ExpressionCache) Get(source string) (*Expression, error) {
+	c.mutex.RLock()
+	expression, ok := c.expressions[source]
+	c.mutex.RUnlock()
+
+	if ok {
+		return expression, nil
+	}
+
+	expression, err := ParseExpression(source)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.expressions) >= EXPRESSION_CACHE_SIZE {
+		c.expressions = make(map[string]*Expression)
+	}
+	c.expressions[source] = expression
+
+	return expression, nil
+}
+
+// Len returns number of cached expressions
+func (c *ExpressionCache) Len() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return len(c.expressions)
+}
+
+// Eval evaluates expression, it fails for results that are not finite
+// numbers (e.g. division by zero)
+func (e *Expression) Eval(vars ExpressionVars) (float64, error) {
+	result, err := e.root.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, errors.New("result of expression is not a number")
+	}
+
+	return result, nil
+}
+
+func (n exprNumber) eval(vars ExpressionVars) (float64, error) {
+	return float64(n), nil
+}
+
+func (n exprVariable) eval(vars ExpressionVars) (float64, error) {
+	return vars(string(n))
+}
+
+func (n *exprUnary) eval(vars ExpressionVars) (float64, error) {
+	operand, err := n.operand.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	if n.op == '-' {
+		return -operand, nil
+	}
+
+	return operand, nil
+}
+
+func (n *exprBinary) eval(vars ExpressionVars) (float64, error) {
+	left, err := n.left.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	right, err := n.right.eval(vars)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case '+':
+		return left + right, nil
+	case '-':
+		return left - right, nil
+	case '*':
+		return left * right, nil
+	case '/':
+		if right == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return left / right, nil
+	case '%':
+		if right == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return math.Mod(left, right), nil
+	}
+
+	return 0, fmt.Errorf("unknown operator %c", n.op)
+}
+
+func (n *exprCall) eval(vars ExpressionVars) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(vars)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = value
+	}
+
+	return exprFunctions[n.name].call(args), nil
+}
+
+/////////// Tokenizer
+
+const (
+	exprTokenNumber = iota
+	exprTokenIdent
+	exprTokenOperator
+)
+
+type exprToken struct {
+	kind int
+	text string
+}
+
+func exprIsIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func exprIsDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func exprTokenize(source string) ([]exprToken, error) {
+	tokens := []exprToken{}
+
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case exprIsDigit(c) || (c == '.' && i+1 < len(source) && exprIsDigit(source[i+1])):
+			start := i
+			for i < len(source) && (exprIsDigit(source[i]) || source[i] == '.') {
+				i++
+			}
+			// exponent
+			if i < len(source) && (source[i] == 'e' || source[i] == 'E') {
+				i++
+				if i < len(source) && (source[i] == '+' || source[i] == '-') {
+					i++
+				}
+				for i < len(source) && exprIsDigit(source[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, exprToken{exprTokenNumber, source[start:i]})
+		case exprIsIdentStart(c):
+			// identifiers can contain dots (paths in JSON payload)
+			start := i
+			for i < len(source) && (exprIsIdentStart(source[i]) || exprIsDigit(source[i]) || source[i] == '.') {
+				i++
+			}
+			ident := source[start:i]
+			if strings.HasSuffix(ident, ".") || strings.Contains(ident, "..") {
+				return nil, fmt.Errorf("invalid name \"%s\" in expression", ident)
+			}
+			tokens = append(tokens, exprToken{exprTokenIdent, ident})
+		case strings.IndexByte("+-*/%(),", c) >= 0:
+			tokens = append(tokens, exprToken{exprTokenOperator, string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' in expression", c)
+		}
+	}
+
+	return tokens, nil
+}
+
+/////////// Parser
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	vars   []string
+}
+
+func (p *exprParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == exprTokenOperator && p.tokens[p.pos].text == text
+}
+
+// sum = product { ("+" | "-") product }
+func (p *exprParser) parseSum(depth int) (exprNode, error) {
+	left, err := p.parseProduct(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("+") || p.peek("-") {
+		op := p.tokens[p.pos].text[0]
+		p.pos++
+		right, err := p.parseProduct(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op, left, right}
+	}
+
+	return left, nil
+}
+
+// product = unary { ("*" | "/" | "%") unary }
+func (p *exprParser) parseProduct(depth int) (exprNode, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek("*") || p.peek("/") || p.peek("%") {
+		op := p.tokens[p.pos].text[0]
+		p.pos++
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op, left, right}
+	}
+
+	return left, nil
+}
+
+// unary = ("+" | "-") unary | primary
+func (p *exprParser) parseUnary(depth int) (exprNode, error) {
+	if depth > EXPRESSION_MAX_DEPTH {
+		return nil, errors.New("expression is nested too deeply")
+	}
+
+	if p.peek("+") || p.peek("-") {
+		op := p.tokens[p.pos].text[0]
+		p.pos++
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op, operand}, nil
+	}
+
+	return p.parsePrimary(depth)
+}
+
+// primary = number | name | name "(" sum { "," sum } ")" | "(" sum ")"
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, errors.New("unexpected end of expression")
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch token.kind {
+	case exprTokenNumber:
+		value, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number \"%s\" in expression", token.text)
+		}
+		return exprNumber(value), nil
+
+	case exprTokenIdent:
+		if !p.peek("(") {
+			p.addVar(token.text)
+			return exprVariable(token.text), nil
+		}
+		p.pos++
+
+		function, ok := exprFunctions[token.text]
+		if !ok {
+			return nil, fmt.Errorf("unknown function \"%s\" in expression", token.text)
+		}
+
+		args := []exprNode{}
+		for !p.peek(")") {
+			if len(args) > 0 {
+				if !p.peek(",") {
+					return nil, fmt.Errorf("missing \",\" or \")\" in arguments of function \"%s\"", token.text)
+				}
+				p.pos++
+			}
+			arg, err := p.parseSum(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		p.pos++
+
+		if len(args) < function.minArgs || (function.maxArgs >= 0 && len(args) > function.maxArgs) {
+			return nil, fmt.Errorf("wrong number of arguments of function \"%s\"", token.text)
+		}
+
+		return &exprCall{token.text, args}, nil
+
+	case exprTokenOperator:
+		if token.text == "(" {
+			node, err := p.parseSum(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if !p.peek(")") {
+				return nil, errors.New("missing \")\" in expression")
+			}
+			p.pos++
+			return node, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected \"%s\" in expression", token.text)
+}
+
+func (p *exprParser) addVar(name string) {
+	for _, v := range p.vars {
+		if v == name {
+			return
+		}
+	}
+	p.vars = append(p.vars, name)
+}
@@ -0,0 +1,119 @@
+package main_test
+
+import (
+	"errors"
+	"fmt"
+	main "piot-server"
+	"strings"
+	"testing"
+)
+
+func evalExpression(t *testing.T, source string, vars map[string]float64) (float64, error) {
+	expression, err := main.ParseExpression(source)
+	Ok(t, err)
+
+	return expression.Eval(func(name string) (float64, error) {
+		value, ok := vars[name]
+		if !ok {
+			return 0, errors.New("unknown variable")
+		}
+		return value, nil
+	})
+}
+
+func TestExpressionEval(t *testing.T) {
+	vars := map[string]float64{"value": 120, "a.t": 20, "b.t": 23, "x_1": -2}
+
+	cases := map[string]float64{
+		"42":                     42,
+		"1.5e2":                  150,
+		".5":                     0.5,
+		"value * 0.1 + 2":        14,
+		"2 + value * 0.1":        14,
+		"(a.t + b.t) / 2":        21.5,
+		"-x_1":                   2,
+		"--x_1":                  -2,
+		"10 - 4 - 3":             3,
+		"7 % 4":                  3,
+		"2 * (3 + 4)":            14,
+		"abs(x_1)":               2,
+		"round(10 / 3)":          3,
+		"round(10 / 3, 2)":       3.33,
+		"floor(2.7) + ceil(2.1)": 5,
+		"min(a.t, b.t, value)":   20,
+		"max(a.t, b.t)":          23,
+		"pow(2, 10)":             1024,
+		"sqrt(16)":               4,
+	}
+
+	for source, expected := range cases {
+		result, err := evalExpression(t, source, vars)
+		Ok(t, err)
+		Assert(t, result == expected, "%s: expected %v, got %v", source, expected, result)
+	}
+
+	// runtime errors
+	_, err := evalExpression(t, "value / 0", vars)
+	Fail(t, err)
+	_, err = evalExpression(t, "value % 0", vars)
+	Fail(t, err)
+	_, err = evalExpression(t, "sqrt(x_1)", vars)
+	Fail(t, err)
+	_, err = evalExpression(t, "missing + 1", vars)
+	Fail(t, err)
+}
+
+func TestExpressionParse(t *testing.T) {
+	expression, err := main.ParseExpression("round((a.t + b.t) / 2 + a.t, 1)")
+	Ok(t, err)
+	Equals(t, []string{"a.t", "b.t"}, expression.Vars())
+
+	invalid := []string{
+		"",
+		"value *",
+		"(value + 1",
+		"value + 1)",
+		"value 1",
+		"1.2.3",
+		"a..t",
+		"a.",
+		"value = 1",
+		"value; 1",
+		"exec(value)",
+		"round()",
+		"round(1, 2, 3)",
+		"abs(1 2)",
+		strings.Repeat("(", 100) + "1" + strings.Repeat(")", 100),
+		strings.Repeat("1 + ", 300) + "1",
+	}
+
+	for _, source := range invalid {
+		_, err := main.ParseExpression(source)
+		Assert(t, err != nil, "expression %q shall be rejected", source)
+	}
+}
+
+func TestExpressionCache(t *testing.T) {
+	cache := main.NewExpressionCache()
+
+	expression, err := cache.Get("value * 0.1 + 2")
+	Ok(t, err)
+
+	// expression is parsed only once
+	cached, err := cache.Get("value * 0.1 + 2")
+	Ok(t, err)
+	Assert(t, expression == cached, "cached expression shall be reused")
+	Equals(t, 1, cache.Len())
+
+	// invalid expressions are not cached
+	_, err = cache.Get("value *")
+	Fail(t, err)
+	Equals(t, 1, cache.Len())
+
+	// size of cache is limited
+	for i := 0; i < main.EXPRESSION_CACHE_SIZE+10; i++ {
+		_, err := cache.Get(fmt.Sprintf("value + %d", i))
+		Ok(t, err)
+	}
+	Assert(t, cache.Len() <= main.EXPRESSION_CACHE_SIZE, "cache shall be bounded")
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"piot-server/config"
 
 	"github.com/op/go-logging"
 )
@@ -15,16 +14,37 @@ import (
 type Adapter struct {
 	log         *logging.Logger
 	piotDevices *PiotDevices
+	things      *Things
 	password    string
+	legacy      bool
+	sealedOnly  bool
+	ipLimiter   *RateLimiter
 }
 
-func NewAdapter(log *logging.Logger, piotDevices *PiotDevices, password string) *Adapter {
-	return &Adapter{log: log, piotDevices: piotDevices, password: password}
+func NewAdapter(log *logging.Logger, piotDevices *PiotDevices, things *Things, params *config.Parameters, password string, legacy bool) *Adapter {
+	a := &Adapter{log: log, piotDevices: piotDevices, things: things, password: password, legacy: legacy, sealedOnly: params.RequireSealed}
+	a.ipLimiter = NewRateLimiter(params.DOSIpInterval, params.DOSIpBurst, params.DOSMaxEntries)
+	return a
 }
 
-func (h *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// Counters of packets rejected by DOS protection
+type AdapterStatus struct {
+	// packets rejected by rate limit of source addresses
+	RejectedPackets uint64
+
+	// packets rejected by rate limit of devices
+	RejectedDevicePackets uint64
+}
 
-	const size = 16
+// Status returns counters of rejected packets
+func (h *Adapter) Status() AdapterStatus {
+	return AdapterStatus{
+		RejectedPackets:       h.ipLimiter.Rejected(),
+		RejectedDevicePackets: h.piotDevices.RejectedPackets(),
+	}
+}
+
+func (h *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	h.log.Debugf("Incoming packet")
 
@@ -35,16 +55,12 @@ func (h *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bodyLen := len(body)
-
-	h.log.Debugf("Packet body length: %d", bodyLen)
+	h.log.Debugf("Packet body length: %d", len(body))
 
 	// log message content in DEBUG mode
 	// get info of debug mode directly from logger
 	if h.log.IsEnabledFor(logging.DEBUG) {
-		reqStr := ioutil.NopCloser(bytes.NewBuffer(body))
-		h.log.Debugf("Request body: %s", reqStr)
-		r.Body = reqStr
+		h.log.Debugf("Request body: %s", body)
 	}
 
 	// check http method, POST is required
@@ -53,98 +69,291 @@ func (h *Adapter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// try to decode packet
-	var devicePacket PiotDevicePacket
-	if err := json.NewDecoder(r.Body).Decode(&devicePacket); err != nil {
+	// encoding of packet content (json, cbor, msgpack), response to device
+	// is sent in the same encoding
+	result, status, err := h.process(body, PiotContentType(r.Header.Get("Content-Type")), hostOf(r.RemoteAddr))
+	if err != nil {
+		if status == http.StatusInternalServerError {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		WriteErrorResponse(w, err, status)
+		return
+	}
 
-		h.log.Debugf("Raw data json decode failed, trying to decrypt")
+	h.deliverCommands(result)
 
-		if len(h.password) != 16 {
-			h.log.Error("Failed to decrypt, PIOT password not configured or doesn't have 16 chars")
-			WriteErrorResponse(w, errors.New("missing or wrong encryption configuration"), 500)
-			return
+	// reply only if there is something to be delivered to device
+	if !result.batch && len(result.commands) == 0 {
+		return
+	}
+
+	content, contentType, err := h.encodeResponse(result, result.response())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(content)
+}
+
+// Result of packet processing
+type adapterResult struct {
+
+	// encoding of packet content
+	contentType string
+
+	// device that sent the packet
+	device string
+
+	// device that sealed the packet by its key
+	authDevice string
+
+	// commands to be delivered to device
+	commands []PiotDeviceCommand
+
+	// batch processing summary
+	batch       bool
+	batchResult *PiotBatchResult
+}
+
+// response returns content of response to be sent to device
+func (r *adapterResult) response() interface{} {
+	if r.batch {
+		r.batchResult.Commands = r.commands
+		return r.batchResult
+	}
+
+	return &PiotDeviceResponse{Commands: r.commands}
+}
+
+// process decodes and processes packet regardless of transport it was
+// received by (http, udp). Empty content type means that encoding is
+// detected from packet content. Source is ip address of sender. Http status
+// code is returned together with error. Result is returned also for packets
+// that failed processing after they were decoded (e.g. replayed packets), it
+// is nil for packets rejected before decoding and authentication. Commands
+// waiting for delivery are not part of the result (see deliverCommands).
+func (h *Adapter) process(body []byte, contentType, source string) (*adapterResult, int, error) {
+
+	// DOS Protection of source addresses, it is checked before decryption
+	// which is the most expensive part of packet processing
+	if !h.ipLimiter.Allow(source) {
+		h.log.Warningf("Rejecting packet from %s, rate limit exceeded (rejected packets: %d)", source, h.ipLimiter.Rejected())
+		return nil, http.StatusTooManyRequests, ErrPiotRateLimit
+	}
+
+	devicePacket, authDevice, contentType, status, err := h.decodePacket(body, contentType)
+	if err != nil {
+		return nil, status, err
+	}
+
+	h.log.Debugf("Packet decoded %v", devicePacket)
+
+	result := &adapterResult{contentType: contentType, device: devicePacket.deviceId(), authDevice: authDevice}
+
+	// packet with buffered readings, reply with summary of processing
+	if len(devicePacket.Batch) > 0 || len(devicePacket.BatchShort) > 0 {
+		batchResult, err := h.piotDevices.ProcessBatch(*devicePacket)
+		if err != nil {
+			return result, processingStatus(err), err
 		}
 
-		// body shall have length which is multiplication of cipher size (size constant)
-		if bodyLen%size != 0 {
-			h.log.Errorf("Invalid length of body for decryption %d", bodyLen)
-			WriteErrorResponse(w, errors.New("invalid length of body for decryption"), http.StatusBadRequest)
-			return
+		result.batch = true
+		result.batchResult = batchResult
+	} else {
+		if err := h.piotDevices.ProcessPacket(*devicePacket); err != nil {
+			return result, processingStatus(err), err
 		}
+	}
+
+	return result, http.StatusOK, nil
+}
+
+// deliverCommands adds commands waiting for delivery to result of processed
+// packet, the commands are marked as delivered. Failure is not fatal since
+// the packet was already processed.
+func (h *Adapter) deliverCommands(result *adapterResult) {
+	commands, err := h.piotDevices.DeliverCommands(result.device)
+	if err != nil {
+		h.log.Errorf("Failed to get commands for device %s (%s)", result.device, err.Error())
+		return
+	}
 
-		// json decode from raw data failed => try to decrypt first
-		cipher, _ := aes.NewCipher([]byte(h.password))
+	result.commands = commands
+}
 
-		decrypted := make([]byte, bodyLen)
+// encodeResponse encodes response to device in encoding of the packet, the
+// response is sealed by device key if device sent sealed packet. Content
+// type of the response is returned together with content.
+func (h *Adapter) encodeResponse(result *adapterResult, response interface{}) ([]byte, string, error) {
 
-		// decrypt by individual blocks
-		decryptedLen := 0
-		for bs, be := 0, size; bs < bodyLen; bs, be = bs+size, be+size {
-			cipher.Decrypt(decrypted[bs:be], body[bs:be])
+	content, err := PiotEncode(result.contentType, response)
+	if err != nil {
+		return nil, "", err
+	}
 
-			// last block needs special attention due to padding that must be removed
-			// before json parsing
-			if bs+size == bodyLen {
-				// strip pkcs7 padding
-				stripped, err := pkcs7strip(decrypted[bs:be], size)
-				if err != nil {
-					h.log.Errorf("PKCS#7 padding stripping failed (%e)", err.Error())
-					WriteErrorResponse(w, errors.New("wrong PKCS#7 padding of encrypted content"), http.StatusBadRequest)
-				}
+	if result.authDevice == "" {
+		return content, result.contentType, nil
+	}
 
-				decryptedLen += len(stripped)
+	thing, err := h.things.FindPiot(result.authDevice)
+	if err != nil {
+		return nil, "", err
+	}
 
-			} else {
-				decryptedLen += size
-			}
+	key, err := PiotParseKey(thing.PiotKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sealed, err := PiotSeal(key, result.authDevice, content)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return sealed, "application/octet-stream", nil
+}
+
+// processingStatus maps error of packet processing to http status code
+func processingStatus(err error) int {
+	switch err {
+	case ErrPiotReplay:
+		return http.StatusConflict
+	case ErrPiotRateLimit:
+		return http.StatusTooManyRequests
+	case ErrPiotDevicePending, ErrPiotDeviceUnknown:
+		return http.StatusForbidden
+	}
+
+	return http.StatusInternalServerError
+}
+
+// decodePacket decodes packet from plain, sealed (AES-GCM with device key)
+// or legacy encrypted (AES-ECB with global password) content. Id of device
+// that sealed the packet (empty for other forms), encoding of the content
+// and http status code are returned together with packet. Plain packets of
+// devices without key are accepted regardless of legacy encryption, unless
+// only sealed packets are required (see verifyDevice).
+func (h *Adapter) decodePacket(body []byte, contentType string) (*PiotDevicePacket, string, string, int, error) {
+
+	var devicePacket PiotDevicePacket
+
+	// try to decode plain packet
+	plainType := contentType
+	if plainType == "" {
+		plainType = PiotDetectContentType(body)
+	}
+
+	if err := PiotDecode(plainType, body, &devicePacket); err == nil {
+		if err := h.verifyDevice(&devicePacket, ""); err != nil {
+			return nil, "", "", http.StatusUnauthorized, err
 		}
+		return &devicePacket, "", plainType, http.StatusOK, nil
+	}
 
-		h.log.Debugf("Decrypted message <%s>", decrypted[:decryptedLen])
-		h.log.Debugf("%s", hex.Dump(decrypted))
+	h.log.Debugf("Raw data decode failed, trying to decrypt")
 
-		// try to decode decrypted data
-		if err := json.Unmarshal(decrypted[:decryptedLen], &devicePacket); err != nil {
-			h.log.Debugf("Decrypted data json decode failed (%s)", err.Error())
+	decrypted, device, status, err := h.decrypt(body)
+	if err != nil {
+		return nil, "", "", status, err
+	}
 
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	h.log.Debugf("Decrypted message <%s>", decrypted)
+	h.log.Debugf("%s", hex.Dump(decrypted))
+
+	if contentType == "" {
+		contentType = PiotDetectContentType(decrypted)
+	}
+
+	// try to decode decrypted data
+	if err := PiotDecode(contentType, decrypted, &devicePacket); err != nil {
+		h.log.Debugf("Decrypted data decode failed (%s)", err.Error())
+		return nil, "", "", http.StatusBadRequest, err
+	}
+
+	if err := h.verifyDevice(&devicePacket, device); err != nil {
+		return nil, "", "", http.StatusUnauthorized, err
+	}
+
+	return &devicePacket, device, contentType, http.StatusOK, nil
+}
+
+// decrypt tries to decrypt sealed packet by key of the device identified
+// in cleartext prefix, falls back to legacy decryption if enabled. Id of
+// authenticated device is returned together with decrypted content.
+func (h *Adapter) decrypt(body []byte) ([]byte, string, int, error) {
+
+	if device, sealed, ok := PiotOpenEnvelope(body); ok {
+		thing, err := h.things.FindPiot(device)
+		if err == nil && thing.PiotKey != "" {
+			key, err := PiotParseKey(thing.PiotKey)
+			if err != nil {
+				h.log.Errorf("Failed to decrypt, key of device %s is invalid (%s)", device, err.Error())
+				return nil, "", http.StatusInternalServerError, errors.New("missing or wrong encryption configuration")
+			}
+
+			decrypted, err := PiotOpen(key, device, sealed)
+			if err != nil {
+				h.log.Warningf("Failed to decrypt packet from device %s (%s)", device, err.Error())
+				return nil, "", http.StatusUnauthorized, err
+			}
+
+			return decrypted, device, http.StatusOK, nil
 		}
+
+		h.log.Debugf("No key configured for device %s", device)
 	}
 
-	h.log.Debugf("Packet decoded %v", devicePacket)
+	if !h.legacy {
+		h.log.Warningf("Failed to decrypt, packet is not sealed by known device key and legacy encryption is disabled")
+		return nil, "", http.StatusBadRequest, errors.New("unknown device or encryption")
+	}
 
-	if err := h.piotDevices.ProcessPacket(devicePacket); err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	decrypted, err := PiotDecryptLegacy(h.password, body)
+	if err != nil {
+		h.log.Errorf("Legacy decryption failed (%s)", err.Error())
+		return nil, "", http.StatusBadRequest, err
 	}
+
+	return decrypted, "", http.StatusOK, nil
 }
 
-// pkcs7strip remove pkcs7 padding
-func pkcs7strip(data []byte, blockSize int) ([]byte, error) {
+// verifyDevice checks that packet is authenticated by key of the device
+// which is identified in the packet. Devices without key can send plain
+// or legacy encrypted packets, unless only sealed packets are accepted.
+func (h *Adapter) verifyDevice(packet *PiotDevicePacket, authDevice string) error {
 
-	length := len(data)
+	device := packet.deviceId()
 
-	// no empty blocks can exist
-	if length == 0 {
-		return nil, errors.New("pkcs7: data is empty")
+	if authDevice != "" {
+		if device != authDevice {
+			h.log.Warningf("Rejecting packet for device %s sealed by key of device %s", device, authDevice)
+			return errors.New("device doesn't match encryption key")
+		}
+		return nil
 	}
 
-	// all bytes are always filled (padding values are always non zero)
-	if length%blockSize != 0 {
-		return nil, errors.New("pkcs7: data is not block-aligned")
+	if h.sealedOnly {
+		h.log.Warningf("Rejecting packet for device %s that is not sealed, only sealed packets are accepted", device)
+		return errors.New("packet is not sealed by device key")
 	}
 
-	// get number of bytes used for padding from last block byte
-	padLen := int(data[length-1])
+	if thing, err := h.things.FindPiot(device); err == nil && thing.PiotKey != "" {
+		h.log.Warningf("Rejecting packet for device %s that is not sealed by device key", device)
+		return errors.New("device requires authenticated encryption")
+	}
 
-	// generate sequence of bytes that should match end of the block
-	ref := bytes.Repeat([]byte{byte(padLen)}, padLen)
+	return nil
+}
 
-	// check if padding is encoded correctly - it must be smaller than block size,
-	// non zero and match generated sequence
-	if padLen > blockSize || padLen == 0 || !bytes.HasSuffix(data, ref) {
-		return nil, errors.New("pkcs7: invalid padding")
+// hostOf returns host part of network address (ip:port)
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
 	}
 
-	return data[:length-padLen], nil
+	return host
 }
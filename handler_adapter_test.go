@@ -2,13 +2,21 @@ package main_test
 
 import (
     "bytes"
+    "context"
     "crypto/aes"
     "encoding/hex"
+    "encoding/json"
+    "fmt"
     "net/http"
     "net/http/httptest"
     "strings"
     "testing"
+    "time"
     "piot-server"
+
+    "github.com/fxamacker/cbor/v2"
+    "github.com/vmihailenco/msgpack/v5"
+    "go.mongodb.org/mongo-driver/bson"
 )
 
 func getAdapter(t *testing.T) *main.Adapter {
@@ -18,7 +26,34 @@ func getAdapter(t *testing.T) *main.Adapter {
     mqtt := GetMqtt(t, log)
     pdevices := GetPiotDevices(t, log, things, mqtt)
 
-    return main.NewAdapter(log, pdevices, "1234567890123456")
+    return main.NewAdapter(log, pdevices, things, GetConfig(), "1234567890123456", true)
+}
+
+func getSecureAdapter(t *testing.T) *main.Adapter {
+    log := GetLogger(t)
+    db := GetDb(t)
+    things := GetThings(t, log, db)
+    mqtt := GetMqtt(t, log)
+    pdevices := GetPiotDevices(t, log, things, mqtt)
+
+    return main.NewAdapter(log, pdevices, things, GetConfig(), "1234567890123456", false)
+}
+
+func postPacket(t *testing.T, adapter *main.Adapter, body []byte) *httptest.ResponseRecorder {
+    return postPacketType(t, adapter, "", body)
+}
+
+func postPacketType(t *testing.T, adapter *main.Adapter, contentType string, body []byte) *httptest.ResponseRecorder {
+    req, err := http.NewRequest("POST", "/", bytes.NewReader(body))
+    Ok(t, err)
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+
+    rr := httptest.NewRecorder()
+    adapter.ServeHTTP(rr, req)
+
+    return rr
 }
 
 /* GET method is not supported */
@@ -149,3 +184,290 @@ func TestPacketEncrypted(t *testing.T) {
     // TODO: Check if device is registered
 }
 
+
+/* Post batch of buffered readings in short notation */
+func TestAdapterPacketBatch(t *testing.T) {
+    db := GetDb(t)
+    CleanDb(t, db)
+
+    ts := time.Now().Add(-time.Hour).Unix()
+
+    deviceData := fmt.Sprintf(`
+    {
+        "d": "Device123",
+        "b": [
+            {"time": %d, "r": [{"a": "SensorXYZ", "t": 23}]},
+            {"time": %d, "r": [{"a": "SensorXYZ", "t": 24}]},
+            {"r": [{"a": "SensorXYZ", "t": 25}]}
+        ]
+    }`, ts, ts + 60)
+
+    req, err := http.NewRequest("POST", "/", strings.NewReader(deviceData))
+    Ok(t, err)
+
+    rr := httptest.NewRecorder()
+
+    adapter := getAdapter(t)
+    adapter.ServeHTTP(rr, req)
+
+    CheckStatusCode(t, rr, 200)
+
+    var result main.PiotBatchResult
+    Ok(t, json.Unmarshal(rr.Body.Bytes(), &result))
+    Equals(t, 3, result.Total)
+    Equals(t, 2, result.Accepted)
+    Equals(t, 1, result.Rejected)
+}
+
+/* Post data sealed by device key */
+func TestPacketSealed(t *testing.T) {
+    const KEY = "000102030405060708090a0b0c0d0e0f"
+
+    db := GetDb(t)
+    CleanDb(t, db)
+    thingId := CreateDevice(t, db, "Device123")
+    SetThingPiotKey(t, db, thingId, KEY)
+
+    key, err := main.PiotParseKey(KEY)
+    Ok(t, err)
+
+    raw := `{"device": "Device123", "readings": [{"address": "SensorXYZ", "t": 23}]}`
+
+    sealed, err := main.PiotSeal(key, "Device123", []byte(raw))
+    Ok(t, err)
+
+    adapter := getSecureAdapter(t)
+
+    // valid sealed packet is accepted
+    CheckStatusCode(t, postPacket(t, adapter, sealed), 200)
+
+    // tampered packet is rejected
+    tampered := append([]byte{}, sealed...)
+    tampered[len(tampered) - 1] ^= 0xff
+    CheckStatusCode(t, postPacket(t, adapter, tampered), 401)
+
+    // plain packet for device with key is rejected
+    CheckStatusCode(t, postPacket(t, adapter, []byte(raw)), 401)
+}
+
+/* Only sealed packets are accepted if required, even from devices without key */
+func TestPacketRequireSealed(t *testing.T) {
+    const KEY = "000102030405060708090a0b0c0d0e0f"
+
+    db := GetDb(t)
+    CleanDb(t, db)
+    thingId := CreateDevice(t, db, "Device123")
+    SetThingPiotKey(t, db, thingId, KEY)
+    CreateDevice(t, db, "Device456")
+
+    log := GetLogger(t)
+    things := GetThings(t, log, db)
+    params := GetConfig()
+    params.DOSInterval = 0
+    params.RequireSealed = true
+    pdevices := main.NewPiotDevices(log, things, GetMqtt(t, log), params, GetSensorClasses(t, log))
+    adapter := main.NewAdapter(log, pdevices, things, params, "1234567890123456", true)
+
+    key, err := main.PiotParseKey(KEY)
+    Ok(t, err)
+
+    sealed, err := main.PiotSeal(key, "Device123", []byte(`{"device": "Device123"}`))
+    Ok(t, err)
+    CheckStatusCode(t, postPacket(t, adapter, sealed), 200)
+
+    // device without key cannot send plain or legacy encrypted packets
+    CheckStatusCode(t, postPacket(t, adapter, []byte(`{"device": "Device456"}`)), 401)
+}
+
+/* Post data sealed by key of another device */
+func TestPacketSealedForeignDevice(t *testing.T) {
+    const KEY = "000102030405060708090a0b0c0d0e0f"
+
+    db := GetDb(t)
+    CleanDb(t, db)
+    thingId := CreateDevice(t, db, "Device123")
+    SetThingPiotKey(t, db, thingId, KEY)
+
+    key, err := main.PiotParseKey(KEY)
+    Ok(t, err)
+
+    raw := `{"device": "Device456"}`
+
+    sealed, err := main.PiotSeal(key, "Device123", []byte(raw))
+    Ok(t, err)
+
+    CheckStatusCode(t, postPacket(t, getSecureAdapter(t), sealed), 401)
+}
+
+/* Post legacy encrypted data when legacy mode is disabled */
+func TestPacketLegacyDisabled(t *testing.T) {
+    db := GetDb(t)
+    CleanDb(t, db)
+
+    cipher, err := aes.NewCipher([]byte("1234567890123456"))
+    Ok(t, err)
+
+    raw := []byte(`{"device": "Dev"}`)
+    raw = append(raw, bytes.Repeat([]byte{15}, 15)...)
+    encrypted := make([]byte, len(raw))
+    for bs := 0; bs < len(raw); bs += 16 {
+        cipher.Encrypt(encrypted[bs:bs + 16], raw[bs:bs + 16])
+    }
+
+    CheckStatusCode(t, postPacket(t, getSecureAdapter(t), encrypted), 400)
+    CheckStatusCode(t, postPacket(t, getAdapter(t), encrypted), 200)
+}
+
+/* Pending commands are delivered in response */
+func TestPacketCommandsResponse(t *testing.T) {
+    db := GetDb(t)
+    CleanDb(t, db)
+    thingId := CreateDevice(t, db, "Device123")
+
+    things := GetThings(t, GetLogger(t), db)
+    _, err := things.AddPiotCommand(thingId, main.PIOT_COMMAND_LED, "on")
+    Ok(t, err)
+
+    adapter := getAdapter(t)
+
+    rr := postPacket(t, adapter, []byte(`{"device": "Device123"}`))
+    CheckStatusCode(t, rr, 200)
+    Equals(t, "application/json", rr.Header().Get("Content-Type"))
+
+    var response main.PiotDeviceResponse
+    Ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+    Equals(t, 1, len(response.Commands))
+    Equals(t, main.PIOT_COMMAND_LED, response.Commands[0].Name)
+    Equals(t, "on", response.Commands[0].Value)
+
+    // command is delivered again until it is acknowledged (new adapter to
+    // avoid DOS protection)
+    rr = postPacket(t, getAdapter(t), []byte(`{"device": "Device123"}`))
+    CheckStatusCode(t, rr, 200)
+    Ok(t, json.Unmarshal(rr.Body.Bytes(), &response))
+    Equals(t, 1, len(response.Commands))
+
+    // nothing to deliver after acknowledgement, empty response
+    rr = postPacket(t, getAdapter(t), []byte(fmt.Sprintf(`{"device": "Device123", "ack": ["%s"]}`, response.Commands[0].Id)))
+    CheckStatusCode(t, rr, 200)
+    Equals(t, 0, rr.Body.Len())
+}
+
+/* Pending commands for device with key are sealed */
+func TestPacketCommandsResponseSealed(t *testing.T) {
+    const KEY = "000102030405060708090a0b0c0d0e0f"
+
+    db := GetDb(t)
+    CleanDb(t, db)
+    thingId := CreateDevice(t, db, "Device123")
+    SetThingPiotKey(t, db, thingId, KEY)
+
+    things := GetThings(t, GetLogger(t), db)
+    _, err := things.AddPiotCommand(thingId, main.PIOT_COMMAND_REBOOT, "")
+    Ok(t, err)
+
+    key, err := main.PiotParseKey(KEY)
+    Ok(t, err)
+
+    sealed, err := main.PiotSeal(key, "Device123", []byte(`{"device": "Device123"}`))
+    Ok(t, err)
+
+    rr := postPacket(t, getSecureAdapter(t), sealed)
+    CheckStatusCode(t, rr, 200)
+
+    device, content, ok := main.PiotOpenEnvelope(rr.Body.Bytes())
+    Assert(t, ok, "Response shall be sealed")
+    Equals(t, "Device123", device)
+
+    plain, err := main.PiotOpen(key, device, content)
+    Ok(t, err)
+
+    var response main.PiotDeviceResponse
+    Ok(t, json.Unmarshal(plain, &response))
+    Equals(t, 1, len(response.Commands))
+    Equals(t, main.PIOT_COMMAND_REBOOT, response.Commands[0].Name)
+}
+
+/* Post data encoded by CBOR */
+func TestPacketCbor(t *testing.T) {
+    db := GetDb(t)
+    CleanDb(t, db)
+
+    packet := map[string]interface{}{
+        "d": "Device123",
+        "r": []interface{}{map[string]interface{}{"a": "SensorXYZ", "t": 23}},
+    }
+
+    data, err := cbor.Marshal(packet)
+    Ok(t, err)
+
+    // binary content is not accepted as json
+    CheckStatusCode(t, postPacket(t, getSecureAdapter(t), data), 400)
+
+    CheckStatusCode(t, postPacketType(t, getSecureAdapter(t), main.PIOT_CONTENT_CBOR, data), 200)
+
+    // sensor is registered same way as for json packet
+    var thing main.Thing
+    err = db.Collection("things").FindOne(context.TODO(), bson.M{"name": "TSensorXYZ"}).Decode(&thing)
+    Ok(t, err)
+    Equals(t, "temperature", thing.Sensor.Class)
+}
+
+/* Post sealed data encoded by MessagePack, response is encoded same way */
+func TestPacketMsgpackSealed(t *testing.T) {
+    const KEY = "000102030405060708090a0b0c0d0e0f"
+
+    db := GetDb(t)
+    CleanDb(t, db)
+    thingId := CreateDevice(t, db, "Device123")
+    SetThingPiotKey(t, db, thingId, KEY)
+
+    things := GetThings(t, GetLogger(t), db)
+    _, err := things.AddPiotCommand(thingId, main.PIOT_COMMAND_INTERVAL, "300")
+    Ok(t, err)
+
+    key, err := main.PiotParseKey(KEY)
+    Ok(t, err)
+
+    data, err := msgpack.Marshal(map[string]interface{}{"d": "Device123"})
+    Ok(t, err)
+
+    sealed, err := main.PiotSeal(key, "Device123", data)
+    Ok(t, err)
+
+    rr := postPacketType(t, getSecureAdapter(t), main.PIOT_CONTENT_MSGPACK, sealed)
+    CheckStatusCode(t, rr, 200)
+
+    device, content, ok := main.PiotOpenEnvelope(rr.Body.Bytes())
+    Assert(t, ok, "Response shall be sealed")
+
+    plain, err := main.PiotOpen(key, device, content)
+    Ok(t, err)
+
+    var response main.PiotDeviceResponse
+    Ok(t, main.PiotDecode(main.PIOT_CONTENT_MSGPACK, plain, &response))
+    Equals(t, 1, len(response.Commands))
+    Equals(t, "300", response.Commands[0].Value)
+}
+
+/* Packets from single ip address exceeding allowed rate are rejected */
+func TestPacketIpRateLimit(t *testing.T) {
+    db := GetDb(t)
+    CleanDb(t, db)
+
+    log := GetLogger(t)
+    things := GetThings(t, log, db)
+    params := GetConfig()
+    params.DOSInterval = 0
+    params.DOSIpInterval = time.Hour
+    params.DOSIpBurst = 2
+    pdevices := main.NewPiotDevices(log, things, GetMqtt(t, log), params, GetSensorClasses(t, log))
+    adapter := main.NewAdapter(log, pdevices, things, params, "", false)
+
+    for i := 0; i < 2; i++ {
+        CheckStatusCode(t, postPacket(t, adapter, []byte(fmt.Sprintf(`{"device": "Device%d"}`, i))), 200)
+    }
+
+    CheckStatusCode(t, postPacket(t, adapter, []byte(`{"device": "Device3"}`)), 429)
+    Equals(t, uint64(1), adapter.Status().RejectedPackets)
+}
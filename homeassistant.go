@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Home Assistant entity components
+const HASS_COMPONENT_SENSOR = "sensor"
+const HASS_COMPONENT_BINARY_SENSOR = "binary_sensor"
+const HASS_COMPONENT_SWITCH = "switch"
+const HASS_COMPONENT_DEVICE_TRACKER = "device_tracker"
+
+// node id used in topics of discovery config messages
+const HASS_NODE_ID = "piot"
+
+// how often changes of things and orgs are checked
+const HASS_CHECK_INTERVAL = time.Second
+
+// sensor classes known to Home Assistant as device classes of sensors
+var hassSensorDeviceClasses = map[string]bool{
+	THING_CLASS_TEMPERATURE: true,
+	THING_CLASS_HUMIDITY:    true,
+	THING_CLASS_PRESSURE:    true,
+	THING_CLASS_CO2:         true,
+	THING_CLASS_ILLUMINANCE: true,
+	THING_CLASS_MOISTURE:    true,
+	THING_CLASS_VOLTAGE:     true,
+}
+
+// units with different notation in Home Assistant
+var hassUnits = map[string]string{
+	"C": "°C",
+	"F": "°F",
+}
+
+// gjson paths that can be expressed as Home Assistant templates (keys and
+// array indexes separated by dots)
+var hassPathRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9_-]+)*$`)
+
+type hassDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// Home Assistant discovery config of entity
+type hassEntity struct {
+	Name     string     `json:"name"`
+	UniqueId string     `json:"unique_id"`
+	Device   hassDevice `json:"device"`
+
+	AvailabilityTopic   string `json:"availability_topic,omitempty"`
+	PayloadAvailable    string `json:"payload_available,omitempty"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
+
+	StateTopic        string `json:"state_topic,omitempty"`
+	ValueTemplate     string `json:"value_template,omitempty"`
+	DeviceClass       string `json:"device_class,omitempty"`
+	StateClass        string `json:"state_class,omitempty"`
+	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+
+	// binary sensor
+	PayloadOn  string `json:"payload_on,omitempty"`
+	PayloadOff string `json:"payload_off,omitempty"`
+
+	// switch
+	CommandTopic string `json:"command_topic,omitempty"`
+	StateOn      string `json:"state_on,omitempty"`
+	StateOff     string `json:"state_off,omitempty"`
+
+	// device tracker
+	JsonAttributesTopic    string `json:"json_attributes_topic,omitempty"`
+	JsonAttributesTemplate string `json:"json_attributes_template,omitempty"`
+	SourceType             string `json:"source_type,omitempty"`
+}
+
+// Publishes Home Assistant MQTT discovery config messages for enabled things
+// assigned to orgs. Configs are republished as things or orgs are changed
+// (see Things.Changed, Orgs.Changed) and removed (empty retained message)
+// once things are deleted, disabled or unassigned from orgs. Configs are
+// published with identity of server.
+type HomeAssistant struct {
+	log     *logging.Logger
+	things  *Things
+	orgs    *Orgs
+	mqtt    IMqtt
+	classes *SensorClasses
+	prefix  string
+
+	// things of orgs without mqtt session are not published
+	orgSessions bool
+
+	mutex            sync.Mutex
+	published        map[string]string
+	synced           bool
+	thingsGeneration uint64
+	orgsGeneration   uint64
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+func NewHomeAssistant(log *logging.Logger, things *Things, orgs *Orgs, mqtt IMqtt, classes *SensorClasses, prefix string) *HomeAssistant {
+	return &HomeAssistant{
+		log:       log,
+		things:    things,
+		orgs:      orgs,
+		mqtt:      mqtt,
+		classes:   classes,
+		prefix:    prefix,
+		published: make(map[string]string),
+	}
+}
+
+// SetOrgSessions enables mode with sessions of orgs (see Mqtt), things of
+// orgs without mqtt credentials are not published in this mode since their
+// values are not published either
+func (h *HomeAssistant) SetOrgSessions(enabled bool) {
+	h.orgSessions = enabled
+}
+
+// Start publishes configs of all things and starts watching changes
+func (h *HomeAssistant) Start() {
+	if err := h.Sync(); err != nil {
+		h.log.Errorf("Publishing of Home Assistant discovery configs failed (%v)", err)
+	}
+
+	h.stop = make(chan bool)
+	h.wg.Add(1)
+	go h.watch()
+}
+
+// Stop stops watching changes, published configs are kept
+func (h *HomeAssistant) Stop() {
+	if h.stop != nil {
+		close(h.stop)
+		h.wg.Wait()
+		h.stop = nil
+	}
+}
+
+// Sync publishes configs of things changed since last sync and removes
+// configs of things that are not published anymore
+func (h *HomeAssistant) Sync() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	thingsGeneration := h.things.Generation()
+	orgsGeneration := h.orgs.Generation()
+	if h.synced && h.thingsGeneration == thingsGeneration && h.orgsGeneration == orgsGeneration {
+		return nil
+	}
+
+	configs, err := h.configs()
+	if err != nil {
+		return err
+	}
+
+	failed := false
+
+	for topic, config := range configs {
+		if published, ok := h.published[topic]; ok && published == config {
+			continue
+		}
+		h.log.Debugf("Publishing Home Assistant discovery config %s", topic)
+		if err := h.mqtt.Publish(topic, config, true); err != nil {
+			h.log.Errorf("Publishing of Home Assistant discovery config %s failed (%v)", topic, err)
+			failed = true
+			continue
+		}
+		h.published[topic] = config
+	}
+
+	for topic := range h.published {
+		if _, ok := configs[topic]; ok {
+			continue
+		}
+		h.log.Debugf("Removing Home Assistant discovery config %s", topic)
+		if err := h.mqtt.Publish(topic, "", true); err != nil {
+			h.log.Errorf("Removing of Home Assistant discovery config %s failed (%v)", topic, err)
+			failed = true
+			continue
+		}
+		delete(h.published, topic)
+	}
+
+	// failed messages are retried on next check
+	if !failed {
+		h.thingsGeneration = thingsGeneration
+		h.orgsGeneration = orgsGeneration
+		h.synced = true
+	}
+
+	return nil
+}
+
+func (h *HomeAssistant) watch() {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(HASS_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			if err := h.Sync(); err != nil {
+				h.log.Errorf("Publishing of Home Assistant discovery configs failed (%v)", err)
+			}
+		}
+	}
+}
+
+// configs returns discovery configs of all things by topic of config
+func (h *HomeAssistant) configs() (map[string]string, error) {
+	orgs, err := h.orgs.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	orgsById := make(map[primitive.ObjectID]*Org)
+	for _, org := range orgs {
+		if h.orgSessions && org.MqttUsername == "" {
+			continue
+		}
+		orgsById[org.Id] = org
+	}
+
+	things, err := h.things.GetFiltered(bson.M{"org_id": bson.M{"$ne": primitive.NilObjectID}, "enabled": true})
+	if err != nil {
+		return nil, err
+	}
+
+	thingsById := make(map[primitive.ObjectID]*Thing)
+	for _, thing := range things {
+		thingsById[thing.Id] = thing
+	}
+
+	result := make(map[string]string)
+
+	for _, thing := range things {
+		org, ok := orgsById[thing.OrgId]
+		if !ok {
+			continue
+		}
+
+		for component, entity := range h.entities(org, thing, thingsById[thing.ParentId]) {
+			payload, err := json.Marshal(entity)
+			if err != nil {
+				return nil, err
+			}
+
+			topic := fmt.Sprintf("%s/%s/%s/%s/config", h.prefix, component, HASS_NODE_ID, thing.Id.Hex())
+			result[topic] = string(payload)
+		}
+	}
+
+	return result, nil
+}
+
+// entities returns Home Assistant entities of thing by component, things
+// are grouped to devices by parent thing (e.g. sensors of PIOT device)
+func (h *HomeAssistant) entities(org *Org, thing *Thing, parent *Thing) map[string]hassEntity {
+	result := make(map[string]hassEntity)
+
+	topic := func(t string) string {
+		return fmt.Sprintf("%s/%s/%s", TOPIC_ROOT, org.Name, t)
+	}
+
+	device := hassDevice{
+		Identifiers:  []string{"piot_" + thing.Id.Hex()},
+		Name:         hassName(thing),
+		Manufacturer: "PIOT",
+		Model:        thing.Type,
+	}
+	if parent != nil {
+		device.Identifiers = []string{"piot_" + parent.Id.Hex()}
+		device.Name = hassName(parent)
+		device.Model = parent.Type
+	}
+
+	entity := func(component string) hassEntity {
+		e := hassEntity{
+			Name:     hassName(thing),
+			UniqueId: fmt.Sprintf("piot_%s_%s", thing.Id.Hex(), component),
+			Device:   device,
+		}
+		if thing.AvailabilityTopic != "" && !IsTopicPattern(thing.AvailabilityTopic) && component != HASS_COMPONENT_BINARY_SENSOR {
+			e.AvailabilityTopic = topic(thing.AvailabilityTopic)
+			e.PayloadAvailable = thing.AvailabilityYes
+			e.PayloadNotAvailable = thing.AvailabilityNo
+		}
+		return e
+	}
+
+	switch thing.Type {
+	case THING_TYPE_DEVICE:
+		// connectivity of device
+		if thing.AvailabilityTopic != "" && !IsTopicPattern(thing.AvailabilityTopic) {
+			e := entity(HASS_COMPONENT_BINARY_SENSOR)
+			e.StateTopic = topic(thing.AvailabilityTopic)
+			e.DeviceClass = "connectivity"
+			e.PayloadOn = thing.AvailabilityYes
+			e.PayloadOff = thing.AvailabilityNo
+			result[HASS_COMPONENT_BINARY_SENSOR] = e
+		}
+
+		if thing.LocationMqttTopic != "" && !IsTopicPattern(thing.LocationMqttTopic) && thing.LocationMqttLatValue != "" && thing.LocationMqttLngValue != "" {
+			lat, okLat := hassTemplateValue(thing.LocationMqttLatValue)
+			lng, okLng := hassTemplateValue(thing.LocationMqttLngValue)
+			if okLat && okLng {
+				e := entity(HASS_COMPONENT_DEVICE_TRACKER)
+				e.JsonAttributesTopic = topic(thing.LocationMqttTopic)
+				e.JsonAttributesTemplate = fmt.Sprintf(`{{ {"latitude": %s, "longitude": %s} | tojson }}`, lat, lng)
+				e.SourceType = "gps"
+				result[HASS_COMPONENT_DEVICE_TRACKER] = e
+			} else {
+				h.log.Debugf("Location of thing %s cannot be expressed as Home Assistant template", thing.Name)
+			}
+		}
+
+	case THING_TYPE_SENSOR:
+		// entity cannot be subscribed to topic of many things
+		if thing.Sensor.MeasurementTopic == "" || IsTopicPattern(thing.Sensor.MeasurementTopic) {
+			break
+		}
+
+		// computed values cannot be expressed as templates
+		value, ok := hassTemplateValue(thing.Sensor.MeasurementValue)
+		if !ok || thing.Sensor.MeasurementExpression != "" {
+			h.log.Debugf("Value of thing %s cannot be expressed as Home Assistant template", thing.Name)
+			break
+		}
+
+		e := entity(HASS_COMPONENT_SENSOR)
+		e.StateTopic = topic(thing.Sensor.MeasurementTopic)
+		if thing.Sensor.MeasurementValue != "" {
+			e.ValueTemplate = fmt.Sprintf("{{ %s }}", value)
+		}
+
+		unit := thing.Sensor.Unit
+		if h.classes != nil {
+			if class := h.classes.GetByName(thing.Sensor.Class); class != nil {
+				e.StateClass = "measurement"
+				if unit == "" {
+					unit = class.Unit
+				}
+			}
+		}
+		if hassSensorDeviceClasses[thing.Sensor.Class] {
+			e.DeviceClass = thing.Sensor.Class
+		}
+		if u, ok := hassUnits[unit]; ok {
+			unit = u
+		}
+		e.UnitOfMeasurement = unit
+
+		result[HASS_COMPONENT_SENSOR] = e
+
+	case THING_TYPE_SWITCH:
+		if thing.Switch.CommandTopic == "" {
+			break
+		}
+
+		e := entity(HASS_COMPONENT_SWITCH)
+		e.CommandTopic = topic(thing.Switch.CommandTopic)
+		e.PayloadOn = thing.Switch.CommandOn
+		e.PayloadOff = thing.Switch.CommandOff
+		if thing.Switch.StateTopic != "" {
+			e.StateTopic = topic(thing.Switch.StateTopic)
+			e.StateOn = thing.Switch.StateOn
+			e.StateOff = thing.Switch.StateOff
+		}
+
+		result[HASS_COMPONENT_SWITCH] = e
+	}
+
+	return result
+}
+
+func hassName(thing *Thing) string {
+	if thing.Alias != "" {
+		return thing.Alias
+	}
+
+	return thing.Name
+}
+
+// hassTemplateValue converts gjson path to Home Assistant template expression
+// (e.g. DS18B20.Temperature to value_json["DS18B20"]["Temperature"]), empty
+// path refers to whole payload. Returns false if path uses gjson features
+// that cannot be expressed (e.g. wildcards, queries).
+func hassTemplateValue(path string) (string, bool) {
+	if path == "" {
+		return "value", true
+	}
+
+	if !hassPathRegexp.MatchString(path) {
+		return "", false
+	}
+
+	var b strings.Builder
+	b.WriteString("value_json")
+	for _, part := range strings.Split(path, ".") {
+		if _, err := strconv.Atoi(part); err == nil {
+			fmt.Fprintf(&b, "[%s]", part)
+		} else {
+			fmt.Fprintf(&b, "[\"%s\"]", part)
+		}
+	}
+
+	return b.String(), true
+}
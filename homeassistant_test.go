@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	main "piot-server"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func hassTopic(component string, id primitive.ObjectID) string {
+	return fmt.Sprintf("homeassistant/%s/piot/%s/config", component, id.Hex())
+}
+
+// decodes payloads of published messages by topic
+func hassConfigs(t *testing.T, mqtt *MqttMock) map[string]map[string]interface{} {
+	result := make(map[string]map[string]interface{})
+	for _, call := range mqtt.Calls {
+		if call.Value == "" {
+			result[call.Topic] = nil
+			continue
+		}
+		var config map[string]interface{}
+		Ok(t, json.Unmarshal([]byte(call.Value), &config))
+		result[call.Topic] = config
+	}
+
+	return result
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	mqtt := GetMqtt(t, log)
+
+	CleanDb(t, db)
+	orgId := CreateOrg(t, db, "org1")
+
+	deviceId := CreateDevice(t, db, "device1")
+	Ok(t, things.SetAvailabilityTopic(deviceId, "device1/available"))
+	Ok(t, things.SetAvailabilityYesNo(deviceId, "yes", "no"))
+	AddOrgThing(t, db, orgId, "device1")
+
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "sensor1/value")
+	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{
+		"parent_id":                deviceId,
+		"sensor.measurement_value": "DS18B20.Temperature",
+	}})
+	Ok(t, err)
+	AddOrgThing(t, db, orgId, "sensor1")
+
+	switchId := CreateSwitch(t, db, "switch1")
+	AddOrgThing(t, db, orgId, "switch1")
+
+	CreateThing(t, db, "sensor2") // thing without org is not published
+
+	ha := main.NewHomeAssistant(log, things, GetOrgs(t, log, db), mqtt, GetSensorClasses(t, log), "homeassistant")
+	Ok(t, ha.Sync())
+
+	configs := hassConfigs(t, mqtt)
+	Equals(t, 3, len(configs))
+
+	device := configs[hassTopic("binary_sensor", deviceId)]
+	Equals(t, "connectivity", device["device_class"])
+	Equals(t, "org/org1/device1/available", device["state_topic"])
+	Equals(t, "yes", device["payload_on"])
+
+	sensor := configs[hassTopic("sensor", sensorId)]
+	Equals(t, "temperature", sensor["device_class"])
+	Equals(t, "°C", sensor["unit_of_measurement"])
+	Equals(t, "org/org1/sensor1/value", sensor["state_topic"])
+	Equals(t, `{{ value_json["DS18B20"]["Temperature"] }}`, sensor["value_template"])
+
+	// sensor belongs to device of its parent
+	Equals(t, device["device"], sensor["device"])
+
+	sw := configs[hassTopic("switch", switchId)]
+	Equals(t, "org/org1/cmnd", sw["command_topic"])
+	Equals(t, "org/org1/state", sw["state_topic"])
+	Equals(t, "ON", sw["payload_on"])
+
+	// nothing is published if things were not changed
+	mqtt.Calls = nil
+	Ok(t, ha.Sync())
+	Equals(t, 0, len(mqtt.Calls))
+
+	// changed sensor is republished, deleted switch is removed
+	Ok(t, things.SetSensorUnit(sensorId, "F"))
+	Ok(t, things.Delete(switchId))
+	Ok(t, ha.Sync())
+
+	configs = hassConfigs(t, mqtt)
+	Equals(t, 2, len(configs))
+	Equals(t, "°F", configs[hassTopic("sensor", sensorId)]["unit_of_measurement"])
+	Equals(t, map[string]interface{}(nil), configs[hassTopic("switch", switchId)])
+}
+
+// things of orgs without mqtt session are not published with sessions of orgs
+func TestHomeAssistantDiscoveryOrgSessions(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	mqtt := GetMqtt(t, log)
+
+	CleanDb(t, db)
+	org1Id := CreateOrg(t, db, "org1")
+	SetOrgMqttCredentials(t, db, org1Id, "user1", "pass1")
+	org2Id := CreateOrg(t, db, "org2")
+
+	switch1Id := CreateSwitch(t, db, "switch1")
+	AddOrgThing(t, db, org1Id, "switch1")
+	switch2Id := CreateSwitch(t, db, "switch2")
+	AddOrgThing(t, db, org2Id, "switch2")
+
+	ha := main.NewHomeAssistant(log, things, GetOrgs(t, log, db), mqtt, GetSensorClasses(t, log), "homeassistant")
+	ha.SetOrgSessions(true)
+	Ok(t, ha.Sync())
+
+	configs := hassConfigs(t, mqtt)
+	Equals(t, 1, len(configs))
+	_, ok := configs[hassTopic("switch", switch1Id)]
+	Assert(t, ok, "switch of org with session shall be published")
+	_, ok = configs[hassTopic("switch", switch2Id)]
+	Assert(t, !ok, "switch of org without session shall not be published")
+}
@@ -18,10 +18,11 @@ import (
 )
 
 type IInfluxDb interface {
-	PostMeasurement(thing *Thing, value string)
+	PostMeasurement(thing *Thing, value string, ts time.Time)
 	PostSwitchState(thing *Thing, value string)
 	PostLocation(thing *Thing, lat, lng float64, sat, ts int32)
 	PostBatteryLevel(thing *Thing, level int32)
+	PostTelemetry(thing *Thing, values []TelemetryValue, ts time.Time)
 }
 
 type InfluxDb struct {
@@ -65,8 +66,8 @@ func paramToString(name string, value interface{}) (string, error) {
 }
 */
 
-func (db *InfluxDb) PostMeasurement(thing *Thing, value string) {
-	db.log.Debugf("Posting measurement to InfluxDB, thing: %s, val: %s", thing.Name, value)
+func (db *InfluxDb) PostMeasurement(thing *Thing, value string, ts time.Time) {
+	db.log.Debugf("Posting measurement to InfluxDB, thing: %s, val: %s, ts: %s", thing.Name, value, ts)
 
 	// get thing org -> get influxdb assigned to org
 	org, err := db.orgs.Get(thing.OrgId)
@@ -94,7 +95,7 @@ func (db *InfluxDb) PostMeasurement(thing *Thing, value string) {
 	}
 	fields := map[string]interface{}{"value": valueFloat}
 	tags := map[string]string{"id": thing.Id.Hex(), "name": name, "class": thing.Sensor.Class}
-	rm := NewRowMetric("sensor", tags, fields, time.Now())
+	rm := NewRowMetric("sensor", tags, fields, ts)
 	body, err := rm.Encode()
 	if err != nil {
 		db.log.Errorf("Cannot encode tags and fields into InfluxDB line protocol format: %s", err.Error())
@@ -255,6 +256,55 @@ func (db *InfluxDb) PostBatteryLevel(thing *Thing, level int32) {
 	db.httpClient.PostString(url.String(), body.String(), &db.Username, &db.Password)
 }
 
+func (db *InfluxDb) PostTelemetry(thing *Thing, values []TelemetryValue, ts time.Time) {
+	db.log.Debugf("Posting thing telemetry to InfluxDB, thing: %s, values: %d", thing.Name, len(values))
+
+	if len(values) == 0 {
+		return
+	}
+
+	// get thing org -> get influxdb assigned to org
+	org, err := db.orgs.Get(thing.OrgId)
+	if err != nil {
+		return
+	}
+
+	db.log.Debugf("Going to post to InfluxDB %s as %s", org.InfluxDb, org.InfluxDbUsername)
+
+	// get thing name, use alias if set
+	name := thing.Name
+	if thing.Alias != "" {
+		name = thing.Alias
+	}
+
+	// fields keep types of telemetry fields
+	fields := make(map[string]interface{})
+	for i := range values {
+		fields[values[i].Name] = values[i].Typed()
+	}
+	tags := map[string]string{"id": thing.Id.Hex(), "name": name}
+	rm := NewRowMetric("telemetry", tags, fields, ts)
+	body, err := rm.Encode()
+	if err != nil {
+		db.log.Errorf("Cannot encode tags and fields into InfluxDB line protocol format: %s", err.Error())
+		return
+	}
+
+	url, err := url.Parse(db.Uri)
+	if err != nil {
+		db.log.Errorf("Cannot decode InfluxDB url from %s (%s)", db.Uri, err.Error())
+		return
+	}
+
+	url.Path = path.Join(url.Path, "write")
+
+	params := url.Query()
+	params.Add("db", org.InfluxDb)
+	url.RawQuery = params.Encode()
+
+	db.httpClient.PostString(url.String(), body.String(), &db.Username, &db.Password)
+}
+
 func NewRowMetric(
 	name string,
 	tags map[string]string,
@@ -3,6 +3,8 @@ package main_test
 import (
 	"fmt"
 	main "piot-server"
+	"strings"
+	"time"
 
 	"github.com/op/go-logging"
 )
@@ -10,6 +12,7 @@ import (
 type influxDbMockCall struct {
 	Thing *main.Thing
 	Value string
+	Time  time.Time
 }
 
 // implements IMqtt interface
@@ -18,22 +21,31 @@ type InfluxDbMock struct {
 	Calls []influxDbMockCall
 }
 
-func (db *InfluxDbMock) PostMeasurement(thing *main.Thing, value string) {
+func (db *InfluxDbMock) PostMeasurement(thing *main.Thing, value string, ts time.Time) {
 	db.Log.Debugf("Influxdb - post measurement, thing: %s, val: %s", thing.Name, value)
-	db.Calls = append(db.Calls, influxDbMockCall{thing, value})
+	db.Calls = append(db.Calls, influxDbMockCall{thing, value, ts})
 }
 
 func (db *InfluxDbMock) PostSwitchState(thing *main.Thing, value string) {
 	db.Log.Debugf("Influxdb - post switch state, thing: %s, val: %s", thing.Name, value)
-	db.Calls = append(db.Calls, influxDbMockCall{thing, value})
+	db.Calls = append(db.Calls, influxDbMockCall{Thing: thing, Value: value})
 }
 
 func (db *InfluxDbMock) PostLocation(thing *main.Thing, lat, lng float64, sat, ts int32) {
 	db.Log.Debugf("Influxdb - post location, thing: %s, val: %f %f %d %d", thing.Name, lat, lng, sat, ts)
-	db.Calls = append(db.Calls, influxDbMockCall{thing, fmt.Sprintf("lat:%f-lng:%f-sat:%d-ts:%d", lat, lng, sat, ts)})
+	db.Calls = append(db.Calls, influxDbMockCall{Thing: thing, Value: fmt.Sprintf("lat:%f-lng:%f-sat:%d-ts:%d", lat, lng, sat, ts)})
+}
+
+func (db *InfluxDbMock) PostTelemetry(thing *main.Thing, values []main.TelemetryValue, ts time.Time) {
+	db.Log.Debugf("Influxdb - post telemetry, thing: %s, values: %v", thing.Name, values)
+	pairs := []string{}
+	for _, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", v.Name, v.Value))
+	}
+	db.Calls = append(db.Calls, influxDbMockCall{Thing: thing, Value: fmt.Sprintf("telemetry:%s", strings.Join(pairs, ","))})
 }
 
 func (db *InfluxDbMock) PostBatteryLevel(thing *main.Thing, level int32) {
 	db.Log.Debugf("Influxdb - post battery level, thing: %s, val: %d", thing.Name, level)
-	db.Calls = append(db.Calls, influxDbMockCall{thing, fmt.Sprintf("level:%d", level)})
+	db.Calls = append(db.Calls, influxDbMockCall{Thing: thing, Value: fmt.Sprintf("level:%d", level)})
 }
@@ -38,7 +38,7 @@ func TestInfluxDbPushMeasurementForSensor(t *testing.T) {
 	Ok(t, err)
 
 	// push measurement for thing
-	influxdb.PostMeasurement(thing, "23")
+	influxdb.PostMeasurement(thing, "23", time.Now())
 
 	// check if http client was called
 	Equals(t, 1, len(httpClient.Calls))
@@ -80,7 +80,7 @@ func TestInfluxDbPushMeasurementForDevice(t *testing.T) {
 	thing.Type = main.THING_TYPE_DEVICE
 
 	// push measurement for thing
-	influxdb.PostMeasurement(thing, "23")
+	influxdb.PostMeasurement(thing, "23", time.Now())
 
 	// check if http client was NOT called
 	Equals(t, 0, len(httpClient.Calls))
@@ -165,6 +165,42 @@ func TestInfluxDbPushBatteryLevelForThing(t *testing.T) {
 	Equals(t, "pass", *httpClient.Calls[0].Password)
 }
 
+func TestInfluxDbPushTelemetryForThing(t *testing.T) {
+	const DEVICE = "device01"
+
+	db := GetDb(t)
+	logger := GetLogger(t)
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, DEVICE)
+	orgId := CreateOrg(t, db, "org1")
+	AddOrgThing(t, db, orgId, DEVICE)
+	httpClient := GetHttpClient(t, logger)
+	influxdb := getInfluxDb(t, db, httpClient)
+	things := GetThings(t, logger, db)
+
+	thing, err := things.Get(thingId)
+	Ok(t, err)
+
+	influxdb.PostTelemetry(thing, []main.TelemetryValue{
+		{Name: "uptime", Type: main.TELEMETRY_TYPE_INT, Value: "3600"},
+		{Name: "rssi", Type: main.TELEMETRY_TYPE_FLOAT, Value: "-60.5"},
+		{Name: "ssid", Type: main.TELEMETRY_TYPE_STRING, Value: "home"},
+		{Name: "sleep", Type: main.TELEMETRY_TYPE_BOOL, Value: "true"},
+	}, time.Unix(4444, 0))
+
+	Equals(t, 1, len(httpClient.Calls))
+	Equals(t, "http://uri/write?db=db", httpClient.Calls[0].Url)
+
+	// fields keep types of telemetry fields
+	Contains(t, httpClient.Calls[0].Body, "telemetry")
+	Contains(t, httpClient.Calls[0].Body, "name=device01")
+	Contains(t, httpClient.Calls[0].Body, "uptime=3600i")
+	Contains(t, httpClient.Calls[0].Body, "rssi=-60.5")
+	Contains(t, httpClient.Calls[0].Body, `ssid="home"`)
+	Contains(t, httpClient.Calls[0].Body, "sleep=true")
+	Contains(t, httpClient.Calls[0].Body, " 4444000000000")
+}
+
 func TestInfluxDbLineProtocolEncoding(t *testing.T) {
 	fields := map[string]interface{}{"memory": 1000}
 	tags := map[string]string{"hostname": "hal9000"}
@@ -1,16 +1,19 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"piot-server/config"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/op/go-logging"
 	"github.com/tidwall/gjson"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -32,14 +35,61 @@ const TOPIC_HUMIDITY = "humidity"
 
 const TOPIC_ROOT = "org"
 
+// variable of sensor expressions referring to value extracted from payload
+const SENSOR_EXPRESSION_VALUE = "value"
+
+// kinds of topics published on behalf of things, each kind has its own
+// quality of service and retain flag
+const MQTT_TOPIC_KIND_AVAILABILITY = "availability"
+const MQTT_TOPIC_KIND_VALUE = "value"
+const MQTT_TOPIC_KIND_UNIT = "unit"
+const MQTT_TOPIC_KIND_NET = "net"
+
+// timeout for confirmation of published message
+const MQTT_PUBLISH_TIMEOUT = 10 * time.Second
+
+// values of status field of server status messages
+const MQTT_SERVER_ONLINE = "online"
+const MQTT_SERVER_OFFLINE = "offline"
+
+// State of connection to broker, in mode with sessions of orgs the state
+// covers all sessions
+type MqttStatus struct {
+	Connected     bool
+	Sessions      int
+	Reconnects    int
+	LastError     string
+	LastErrorTime time.Time
+
+	// state of pipeline processing incoming messages (nil if not used)
+	Pipeline *MqttPipelineStats
+}
+
+// Server status published (retained) to status topic, offline status is
+// published by broker as Last Will and Testament if server disappears
+type mqttServerStatus struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Started int64  `json:"started"`
+	Uptime  int64  `json:"uptime,omitempty"`
+}
+
 type IMqtt interface {
-	PushThingData(thing *Thing, topic, value string) error
+	PushThingData(thing *Thing, topic, value string, ts time.Time) error
+	PushCommand(thing *Thing, topic, value string) error
+	Publish(topic, payload string, retain bool) error
 	ProcessMessage(topic, payload string)
 	Connect(subscribe bool) error
 	Disconnect() error
 	SetUsername(username string)
 	SetPassword(password string)
 	SetClient(id string)
+	SetTLSConfig(config *tls.Config)
+	SetOrgSessions(enabled bool)
+	SetPublishOptions(options map[string]config.MqttPublishOptions)
+	SetStatusTopic(topic string, interval time.Duration)
+	Status() MqttStatus
+	SetPipeline(pipeline *MqttPipeline)
 }
 
 type Mqtt struct {
@@ -48,16 +98,52 @@ type Mqtt struct {
 	orgs     *Orgs
 	influxDb IInfluxDb
 	mysqlDb  IMysqlDb
+	classes  *SensorClasses
+	index    *TopicIndex
+	pipeline *MqttPipeline
+
+	// parsed expressions of sensors
+	expressions *ExpressionCache
 
 	Uri      string
 	Username *string
 	Password *string
 	Client   *string
 	client   mqtt.Client
+
+	// guards client of server that is connected on demand in mode with
+	// sessions of orgs
+	clientMutex sync.Mutex
+
+	// TLS configuration used for brokers with tls:// (ssl://) scheme
+	tlsConfig *tls.Config
+
+	// sessions of orgs, used instead of single client if enabled
+	orgSessions bool
+	sessions    *MqttSessions
+
+	// options of messages published by PushThingData (by topic kind)
+	publishOptions map[string]config.MqttPublishOptions
+
+	// server status topic and interval of its updates
+	statusTopic    string
+	statusInterval time.Duration
+	started        time.Time
+	stopStatus     chan bool
+
+	// state of connection
+	stateMutex    sync.Mutex
+	reconnects    int
+	lastError     string
+	lastErrorTime time.Time
 }
 
-func NewMqtt(uri string, log *logging.Logger, things *Things, orgs *Orgs, influxDb IInfluxDb, mysqlDb IMysqlDb) IMqtt {
-	m := &Mqtt{log: log, Uri: uri, things: things, orgs: orgs, influxDb: influxDb, mysqlDb: mysqlDb}
+func NewMqtt(uri string, log *logging.Logger, things *Things, orgs *Orgs, influxDb IInfluxDb, mysqlDb IMysqlDb, classes *SensorClasses) IMqtt {
+	m := &Mqtt{log: log, Uri: uri, things: things, orgs: orgs, influxDb: influxDb, mysqlDb: mysqlDb, classes: classes}
+	m.index = NewTopicIndex(log, things, orgs)
+	m.expressions = NewExpressionCache()
+	m.publishOptions = config.NewParameters().MqttPublish
+	m.started = time.Now()
 
 	return m
 }
@@ -74,31 +160,138 @@ func (t *Mqtt) SetClient(id string) {
 	t.Client = &id
 }
 
+// SetTLSConfig sets TLS configuration of connection to broker (CA
+// certificates, client certificate), see NewMqttTLSConfig
+func (t *Mqtt) SetTLSConfig(config *tls.Config) {
+	t.tlsConfig = config
+}
+
+// SetOrgSessions enables mode with separate session for each org. Sessions
+// use MQTT credentials of orgs and they are limited to topics of orgs.
+func (t *Mqtt) SetOrgSessions(enabled bool) {
+	t.orgSessions = enabled
+}
+
+// SetPublishOptions sets quality of service and retain flag of messages
+// published by PushThingData for each kind of topic
+func (t *Mqtt) SetPublishOptions(options map[string]config.MqttPublishOptions) {
+	t.publishOptions = options
+}
+
+// SetStatusTopic sets topic for server status messages, the status is
+// republished with current uptime every interval (zero disables updates).
+// Copies of the status are published under root of each org (e.g.
+// org/<name>/piot/status), in mode with sessions of orgs the status is
+// published under org roots only.
+func (t *Mqtt) SetStatusTopic(topic string, interval time.Duration) {
+	t.statusTopic = topic
+	t.statusInterval = interval
+}
+
+// SetPipeline sets pipeline for concurrent processing of incoming messages,
+// messages are processed synchronously in subscription callback without it
+func (t *Mqtt) SetPipeline(pipeline *MqttPipeline) {
+	t.pipeline = pipeline
+}
+
 func (t *Mqtt) Connect(subscribe bool) error {
+	if t.orgSessions {
+		t.log.Infof("Connecting to MQTT broker %s with sessions of orgs", t.Uri)
+		t.sessions = NewMqttSessions(t.log, t.orgs, *t.Client, subscribe, t.statusTopic, t.connectClient)
+		if err := t.sessions.Start(); err != nil {
+			return err
+		}
+	} else {
+		topic := ""
+		if subscribe {
+			topic = fmt.Sprintf("%s/#", TOPIC_ROOT)
+		}
+
+		client, err := t.connectClient(*t.Client, t.Username, t.Password, topic, t.statusTopic)
+		if err != nil {
+			return err
+		}
+		t.client = client
+
+		// status of main topic is published on connection
+		if t.statusTopic != "" {
+			for statusTopic, client := range t.statusClients() {
+				if statusTopic != t.statusTopic {
+					t.publishStatus(client, statusTopic, MQTT_SERVER_ONLINE)
+				}
+			}
+		}
+	}
+
+	if t.statusTopic != "" && t.statusInterval > 0 {
+		t.stopStatus = make(chan bool)
+		go t.updateStatus(t.stopStatus)
+	}
+
+	return nil
+}
+
+// connectClient creates client connected to broker, client subscribes to
+// topic (if not empty) on each connection. Server status is published to
+// status topic (if not empty) and it is also configured as Last Will.
+func (t *Mqtt) connectClient(clientId string, username, password *string, topic, statusTopic string) (mqtt.Client, error) {
 	t.log.Infof("Connecting to MQTT broker %s", t.Uri)
 
 	// create a ClientOptions struct setting the broker address, clientid, turn
 	// off trace output and set the default message handler
 	opts := mqtt.NewClientOptions().AddBroker(t.Uri)
-	opts.SetClientID(*t.Client)
-	if t.Username != nil {
-		opts.SetUsername(*t.Username)
+	opts.SetClientID(clientId)
+	if username != nil {
+		opts.SetUsername(*username)
+	}
+	if password != nil {
+		opts.SetPassword(*password)
 	}
-	if t.Password != nil {
-		opts.SetPassword(*t.Password)
+	if t.tlsConfig != nil {
+		opts.SetTLSConfig(t.tlsConfig)
 	}
+	if statusTopic != "" {
+		opts.SetWill(statusTopic, t.serverStatus(MQTT_SERVER_OFFLINE), 1, true)
+	}
+
+	connects := 0
 
 	opts.OnConnect = func(client mqtt.Client) {
 
 		t.log.Infof("Connectedt to MQTT broker %s", t.Uri)
-		if subscribe {
 
-			topic := fmt.Sprintf("%s/#", TOPIC_ROOT)
+		connects++
+		if connects > 1 {
+			t.stateMutex.Lock()
+			t.reconnects++
+			t.stateMutex.Unlock()
+		}
+
+		// status is published on each connection, broker could publish
+		// last will in meantime
+		if statusTopic != "" {
+			t.publishStatus(client, statusTopic, MQTT_SERVER_ONLINE)
+		}
+
+		if topic != "" {
 
 			// subscribe for all topcis
-			t.log.Infof("Subscribing to topic #")
+			t.log.Infof("Subscribing to topic %s", topic)
 			token := client.Subscribe(topic, 0, func(_ mqtt.Client, msg mqtt.Message) {
-				//processUpdate(msg.Topic(), string(msg.Payload()))
+				if msg.Retained() && !processRetained(msg.Topic()) {
+					t.log.Debugf("Ignoring retained MQTT message (topic: %s)", msg.Topic())
+					return
+				}
+				// values of piot things were processed when they were
+				// published by server
+				if t.index.IsPiotTopic(msg.Topic()) {
+					t.log.Debugf("Ignoring MQTT message published by server (topic: %s)", msg.Topic())
+					return
+				}
+				if t.pipeline != nil {
+					t.pipeline.Submit(msg.Topic(), string(msg.Payload()))
+					return
+				}
 				t.ProcessMessage(msg.Topic(), string(msg.Payload()))
 			})
 			if !token.WaitTimeout(10 * time.Second) {
@@ -114,25 +307,195 @@ func (t *Mqtt) Connect(subscribe bool) error {
 
 	opts.OnConnectionLost = func(client mqtt.Client, err error) {
 		t.log.Infof("Error: Connection to MQTT broker %s lost (%s)", t.Uri, err.Error())
+		t.setError(err)
 	}
 
 	// create and start a client using the above ClientOptions
-	t.client = mqtt.NewClient(opts)
-	if token := t.client.Connect(); token.Wait() && token.Error() != nil {
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
 		t.log.Infof("Connection failed (%s)", token.Error())
-		return token.Error()
+		t.setError(token.Error())
+		return nil, token.Error()
 	}
 
 	t.log.Infof("Connected to MQTT broker")
-	return nil
+	return client, nil
 }
 
 func (t *Mqtt) Disconnect() error {
 	t.log.Infof("Disconnecting from MQTT broker")
-	t.client.Disconnect(250)
+
+	if t.stopStatus != nil {
+		close(t.stopStatus)
+		t.stopStatus = nil
+	}
+
+	// last will is not published by broker on regular disconnection
+	if t.statusTopic != "" {
+		for topic, client := range t.statusClients() {
+			t.publishStatus(client, topic, MQTT_SERVER_OFFLINE)
+		}
+	}
+
+	if t.sessions != nil {
+		t.sessions.Stop()
+	}
+
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	if t.client != nil {
+		t.client.Disconnect(250)
+	}
+
 	return nil
 }
 
+// Status returns state of connection to broker
+func (t *Mqtt) Status() MqttStatus {
+	var clients []mqtt.Client
+	if t.sessions != nil {
+		clients = t.sessions.Clients()
+	} else if t.client != nil {
+		clients = []mqtt.Client{t.client}
+	}
+
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+
+	status := MqttStatus{
+		Connected:     len(clients) > 0,
+		Sessions:      len(clients),
+		Reconnects:    t.reconnects,
+		LastError:     t.lastError,
+		LastErrorTime: t.lastErrorTime,
+	}
+	if t.pipeline != nil {
+		stats := t.pipeline.Counters()
+		status.Pipeline = &stats
+	}
+	for _, client := range clients {
+		if !client.IsConnectionOpen() {
+			status.Connected = false
+		}
+	}
+
+	return status
+}
+
+func (t *Mqtt) setError(err error) {
+	t.stateMutex.Lock()
+	defer t.stateMutex.Unlock()
+
+	t.lastError = err.Error()
+	t.lastErrorTime = time.Now()
+}
+
+// serverStatus returns payload of server status message
+func (t *Mqtt) serverStatus(status string) string {
+	s := mqttServerStatus{Status: status, Version: config.VersionString(), Started: t.started.Unix()}
+	if status == MQTT_SERVER_ONLINE {
+		s.Uptime = int64(time.Since(t.started) / time.Second)
+	}
+
+	payload, _ := json.Marshal(s)
+
+	return string(payload)
+}
+
+func (t *Mqtt) publishStatus(client mqtt.Client, topic, status string) {
+	token := client.Publish(topic, 1, true, t.serverStatus(status))
+	if !token.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
+		t.log.Errorf("Timeout publishing server status to topic %s", topic)
+		return
+	}
+	if err := token.Error(); err != nil {
+		t.log.Errorf("Publishing server status to topic %s failed (%v)", topic, err)
+	}
+}
+
+// statusClients returns clients by their status topics
+func (t *Mqtt) statusClients() map[string]mqtt.Client {
+	if t.sessions != nil {
+		return t.sessions.StatusClients()
+	}
+
+	if t.client == nil {
+		return nil
+	}
+
+	clients := map[string]mqtt.Client{t.statusTopic: t.client}
+
+	// copies of status are published by main session to topics of orgs, so
+	// clients subscribed to topics of their org see it (without last will)
+	if t.orgs != nil {
+		orgs, err := t.orgs.GetAll()
+		if err != nil {
+			t.log.Errorf("Fetching of orgs for server status failed (%v)", err)
+		}
+		for _, org := range orgs {
+			clients[fmt.Sprintf("%s/%s/%s", TOPIC_ROOT, org.Name, t.statusTopic)] = t.client
+		}
+	}
+
+	return clients
+}
+
+// updateStatus periodically publishes server status with current uptime
+func (t *Mqtt) updateStatus(stop chan bool) {
+	ticker := time.NewTicker(t.statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for topic, client := range t.statusClients() {
+				if client.IsConnectionOpen() {
+					t.publishStatus(client, topic, MQTT_SERVER_ONLINE)
+				}
+			}
+		}
+	}
+}
+
+// serverClient returns client authenticated by credentials of server. In
+// mode with sessions of orgs the client is connected on first use, it is not
+// subscribed to any topic.
+func (t *Mqtt) serverClient() (mqtt.Client, error) {
+	t.clientMutex.Lock()
+	defer t.clientMutex.Unlock()
+
+	if t.client == nil {
+		if t.sessions == nil {
+			return nil, errors.New("not connected to mqtt broker")
+		}
+
+		client, err := t.connectClient(*t.Client, t.Username, t.Password, "", "")
+		if err != nil {
+			return nil, err
+		}
+		t.client = client
+	}
+
+	return t.client, nil
+}
+
+// orgClient returns client for publishing to topics of org
+func (t *Mqtt) orgClient(orgId primitive.ObjectID) (mqtt.Client, error) {
+	if t.sessions == nil {
+		return t.client, nil
+	}
+
+	client := t.sessions.Client(orgId)
+	if client == nil {
+		return nil, fmt.Errorf("org %s has no mqtt session", orgId.Hex())
+	}
+
+	return client, nil
+}
+
 func (t *Mqtt) GetThingTopic(thing *Thing, topic string) (string, error) {
 	// get thing org
 	org, err := t.orgs.Get(thing.OrgId)
@@ -143,7 +506,12 @@ func (t *Mqtt) GetThingTopic(thing *Thing, topic string) (string, error) {
 	return fmt.Sprintf("%s/%s/%s/%s", TOPIC_ROOT, org.Name, thing.Name, topic), nil
 }
 
-func (t *Mqtt) PushThingData(thing *Thing, topic, value string) error {
+// PushThingData publishes value to thing topic. The ts parameter holds
+// time of the value, zero value means the value is current. Published value
+// is processed (e.g. stored to persistent storages) directly with its time,
+// the message received back through subscription is ignored (see
+// TopicIndex.IsPiotTopic).
+func (t *Mqtt) PushThingData(thing *Thing, topic, value string, ts time.Time) error {
 	t.log.Debugf("Push thing data to mqtt broker: %s", thing.Name)
 
 	// post data to MQTT if device is enabled
@@ -153,23 +521,167 @@ func (t *Mqtt) PushThingData(thing *Thing, topic, value string) error {
 		return err
 	}
 
-	mqttTopic, err := t.GetThingTopic(thing, topic)
+	org, err := t.orgs.Get(thing.OrgId)
 	if err != nil {
 		return err
 	}
 
+	thingTopic := fmt.Sprintf("%s/%s", thing.Name, topic)
+	mqttTopic := fmt.Sprintf("%s/%s/%s", TOPIC_ROOT, org.Name, thingTopic)
+
 	t.log.Debugf("MQTT Publish, topic: \"%s\", value: \"%s\"", mqttTopic, value)
 
-	token := t.client.Publish(mqttTopic, 0, false, value)
-	token.Wait()
+	client, err := t.orgClient(thing.OrgId)
+	if err != nil {
+		return err
+	}
+
+	options := t.publishOptions[MqttTopicKind(topic)]
+
+	token := client.Publish(mqttTopic, options.Qos, options.Retain, value)
+	if !token.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
+		return fmt.Errorf("timeout publishing to topic %s", mqttTopic)
+	}
+	if err := token.Error(); err != nil {
+		t.log.Errorf("Publishing to topic %s failed (%v)", mqttTopic, err)
+		return fmt.Errorf("publishing to topic %s failed (%v)", mqttTopic, err)
+	}
+
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+
+	t.processOrgMessage(org, thingTopic, value, ts)
+
 	return nil
 }
 
+// MqttTopicKind returns kind of thing topic (e.g. net/ip is network
+// information, temperature/unit is unit of value)
+func MqttTopicKind(topic string) string {
+	switch {
+	case topic == TOPIC_AVAILABLE:
+		return MQTT_TOPIC_KIND_AVAILABILITY
+	case topic == TOPIC_NET || strings.HasPrefix(topic, TOPIC_NET+"/"):
+		return MQTT_TOPIC_KIND_NET
+	case topic == TOPIC_UNIT || strings.HasSuffix(topic, "/"+TOPIC_UNIT):
+		return MQTT_TOPIC_KIND_UNIT
+	}
+
+	return MQTT_TOPIC_KIND_VALUE
+}
+
+// processRetained checks if retained message delivered on subscription is
+// processed. Retained values (e.g. measurements published by server) were
+// processed when they were published, processing them again on each
+// reconnection would store duplicate points with current time. Other kinds
+// (e.g. availability) carry state that could change while server was not
+// connected.
+func processRetained(topic string) bool {
+	parts := strings.SplitN(topic, "/", 3)
+	if len(parts) < 3 || parts[0] != TOPIC_ROOT {
+		return false
+	}
+
+	return MqttTopicKind(parts[2]) != MQTT_TOPIC_KIND_VALUE
+}
+
+// ParseMqttPublishOptions updates options of topic kinds from comma separated
+// list of kind:qos[:retain] items (e.g. "value:1:retain,net:0")
+func ParseMqttPublishOptions(spec string, options map[string]config.MqttPublishOptions) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("invalid mqtt publish options %s", item)
+		}
+
+		switch parts[0] {
+		case MQTT_TOPIC_KIND_AVAILABILITY, MQTT_TOPIC_KIND_VALUE, MQTT_TOPIC_KIND_UNIT, MQTT_TOPIC_KIND_NET:
+		default:
+			return fmt.Errorf("unknown mqtt topic kind %s", parts[0])
+		}
+
+		qos, err := strconv.Atoi(parts[1])
+		if err != nil || qos < 0 || qos > 2 {
+			return fmt.Errorf("invalid mqtt qos %s of topic kind %s", parts[1], parts[0])
+		}
+
+		retain := false
+		if len(parts) == 3 {
+			if parts[2] != "retain" {
+				return fmt.Errorf("invalid mqtt publish flag %s of topic kind %s", parts[2], parts[0])
+			}
+			retain = true
+		}
+
+		options[parts[0]] = config.MqttPublishOptions{Qos: byte(qos), Retain: retain}
+	}
+
+	return nil
+}
+
+// PushCommand publishes command to topic of thing organization (e.g. command
+// topic of switch), the topic is relative to organization root
+func (t *Mqtt) PushCommand(thing *Thing, topic, value string) error {
+	t.log.Debugf("Push command to mqtt broker: %s", thing.Name)
+
+	if thing.OrgId == primitive.NilObjectID {
+		return fmt.Errorf("rejecting command due to missing organization assignment of thing \"%s\"", thing.Name)
+	}
+
+	org, err := t.orgs.Get(thing.OrgId)
+	if err != nil {
+		return err
+	}
+
+	mqttTopic := fmt.Sprintf("%s/%s/%s", TOPIC_ROOT, org.Name, topic)
+
+	client, err := t.orgClient(thing.OrgId)
+	if err != nil {
+		return err
+	}
+
+	t.log.Debugf("MQTT Publish, topic: \"%s\", value: \"%s\"", mqttTopic, value)
+
+	// commands are not retained, they are confirmed by broker so that
+	// lost command is reported to the caller
+	token := client.Publish(mqttTopic, 1, false, value)
+	if !token.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
+		return fmt.Errorf("timeout publishing to topic %s", mqttTopic)
+	}
+
+	return token.Error()
+}
+
+// Publish publishes message to topic outside of org topics (e.g. discovery
+// configs of other systems) with identity of server, org sessions cannot
+// publish outside of org topics
+func (t *Mqtt) Publish(topic, payload string, retain bool) error {
+	t.log.Debugf("MQTT Publish, topic: \"%s\", value: \"%s\"", topic, payload)
+
+	client, err := t.serverClient()
+	if err != nil {
+		return err
+	}
+
+	token := client.Publish(topic, 1, retain, payload)
+	if !token.WaitTimeout(MQTT_PUBLISH_TIMEOUT) {
+		return fmt.Errorf("timeout publishing to topic %s", topic)
+	}
+
+	return token.Error()
+}
+
 func (t *Mqtt) ProcessAll(org *Org, topic, payload string) {
 	t.log.Debugf("Processing MQTT message with topic \"%s\" for all things in org \"%s\"", topic, org.Name)
 
 	// update battery level
-	things, err := t.things.GetFiltered(bson.M{"org_id": org.Id, "battery_mqtt_topic": topic})
+	things, err := t.index.Things(org.Id, topic, TOPIC_ROLE_BATTERY)
 	if err != nil {
 		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
 		return
@@ -220,7 +732,7 @@ func (t *Mqtt) ProcessDevices(org *Org, topic, payload string) {
 	t.log.Debugf("Processing MQTT message with topic \"%s\" for devices in org \"%s\"", topic, org.Name)
 
 	// update availability
-	devices, err := t.things.GetFiltered(bson.M{"org_id": org.Id, "type": THING_TYPE_DEVICE, "availability_topic": topic})
+	devices, err := t.index.Things(org.Id, topic, TOPIC_ROLE_AVAILABILITY)
 	if err != nil {
 		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
 		return
@@ -229,15 +741,33 @@ func (t *Mqtt) ProcessDevices(org *Org, topic, payload string) {
 
 		thing := devices[i]
 
-		// update sensor last seen status
-		err = t.things.TouchThing(thing.Id)
-		if err != nil {
+		// message saying that device is not available (e.g. last will
+		// published by broker) doesn't mean that device was seen
+		if payload != thing.AvailabilityNo {
+			err = t.things.TouchThing(thing.Id)
+			if err != nil {
+				t.log.Errorf("MQTT processing error: %s", err.Error())
+			}
+		}
+
+		var available bool
+		switch payload {
+		case thing.AvailabilityYes:
+			available = true
+		case thing.AvailabilityNo:
+			available = false
+		default:
+			t.log.Warningf("Ignoring MQTT availability message for device %s (\"%s\") due to unknown value \"%s\"", thing.Name, org.Name, payload)
+			continue
+		}
+
+		if _, err := t.things.SetAvailable(thing.Id, available); err != nil {
 			t.log.Errorf("MQTT processing error: %s", err.Error())
 		}
 	}
 
 	// update telemetry
-	devices, err = t.things.GetFiltered(bson.M{"org_id": org.Id, "type": THING_TYPE_DEVICE, "telemetry_topic": topic})
+	devices, err = t.index.Things(org.Id, topic, TOPIC_ROLE_TELEMETRY)
 	if err != nil {
 		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
 		return
@@ -256,10 +786,36 @@ func (t *Mqtt) ProcessDevices(org *Org, topic, payload string) {
 		if err != nil {
 			t.log.Errorf("MQTT processing error: %s", err.Error())
 		}
+
+		if len(thing.TelemetryFields) == 0 {
+			continue
+		}
+
+		// extract structured values, fields that cannot be extracted are
+		// skipped
+		values, err := ExtractTelemetryValues(thing.TelemetryFields, payload)
+		if err != nil {
+			t.log.Warningf("Incomplete MQTT telemetry message for device %s (\"%s\"): %s", thing.Name, org.Name, err.Error())
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		ts := time.Now()
+
+		err = t.things.SetTelemetryValues(thing.Id, values, ts, thing.TelemetryHistory)
+		if err != nil {
+			t.log.Errorf("MQTT processing error: %s", err.Error())
+		}
+
+		// store -> time series in influxdb
+		if thing.TelemetryTracking {
+			t.influxDb.PostTelemetry(thing, values, ts)
+		}
 	}
 
 	// update location
-	devices, err = t.things.GetFiltered(bson.M{"org_id": org.Id, "type": THING_TYPE_DEVICE, "loc_mqtt_topic": topic})
+	devices, err = t.index.Things(org.Id, topic, TOPIC_ROLE_LOCATION)
 	if err != nil {
 		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" devices: %s", org.Name, err.Error())
 		return
@@ -359,11 +915,16 @@ func (t *Mqtt) ProcessDevices(org *Org, topic, payload string) {
 	}
 }
 
-func (t *Mqtt) ProcessSensors(org *Org, topic, payload string) {
+func (t *Mqtt) ProcessSensors(org *Org, topic, payload string, ts time.Time) {
 	t.log.Debugf("Processing MQTT message with topic \"%s\" for sensors in org \"%s\"", topic, org.Name)
 
+	// unit of values published to measurement topic
+	if strings.HasSuffix(topic, "/"+TOPIC_UNIT) {
+		t.processSensorsUnit(org, strings.TrimSuffix(topic, "/"+TOPIC_UNIT), payload)
+	}
+
 	// look for sensors attached to this topic from active org
-	sensors, err := t.things.GetFiltered(bson.M{"org_id": org.Id, "type": THING_TYPE_SENSOR, "sensor.measurement_topic": topic})
+	sensors, err := t.index.Things(org.Id, topic, TOPIC_ROLE_SENSOR)
 	if err != nil {
 		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" sensors: %s", org.Name, err.Error())
 		return
@@ -381,10 +942,10 @@ func (t *Mqtt) ProcessSensors(org *Org, topic, payload string) {
 		if thing.Sensor.MeasurementValue != "" {
 			parsedValue := gjson.Get(payload, thing.Sensor.MeasurementValue)
 			if !parsedValue.Exists() {
-				value = ""
-			} else {
-				value = parsedValue.String()
+				t.log.Warningf("Ignoring MQTT sensor message for sensor %s (\"%s\"), value \"%s\" not found in payload", thing.Name, org.Name, thing.Sensor.MeasurementValue)
+				continue
 			}
+			value = parsedValue.String()
 		}
 
 		// update sensor last seen status
@@ -393,31 +954,149 @@ func (t *Mqtt) ProcessSensors(org *Org, topic, payload string) {
 			t.log.Errorf("MQTT processing error: %s", err.Error())
 		}
 
+		// compute value (e.g. scaling, calibration) if sensor has expression
+		if thing.Sensor.MeasurementExpression != "" {
+			value, err = t.sensorExpressionValue(thing, payload, value)
+			if err != nil {
+				t.log.Warningf("Ignoring MQTT sensor message for sensor %s (\"%s\"): %s", thing.Name, org.Name, err.Error())
+				continue
+			}
+		}
+
+		// persistent storages keep values in canonical unit of sensor class
+		canonical, err := t.sensorValue(thing, value)
+		if err != nil {
+			t.log.Warningf("Ignoring MQTT sensor message for sensor %s (\"%s\"): %s", thing.Name, org.Name, err.Error())
+			continue
+		}
+
 		// set value to one from incoming payload
-		err = t.things.SetSensorValue(thing.Id, value)
+		err = t.things.SetSensorValue(thing.Id, value, ts)
 		if err != nil {
 			// report error, but don't interrupt processing
 			t.log.Errorf("MQTT processing error: %s", err.Error())
 		}
 
+		value = canonical
+
 		// store it to influx db if configured
 		if thing.StoreInfluxDb {
-			t.influxDb.PostMeasurement(thing, value)
+			t.influxDb.PostMeasurement(thing, value, ts)
 		}
 
 		// store it to mysql db if configured
 		if thing.StoreMysqlDb {
-			t.mysqlDb.StoreMeasurement(thing, value)
+			t.mysqlDb.StoreMeasurement(thing, value, ts)
+		}
+
+	}
+}
+
+// processSensorsUnit stores unit of values published to measurement topic
+func (t *Mqtt) processSensorsUnit(org *Org, measurementTopic, unit string) {
+	if unit == "" {
+		return
+	}
+
+	sensors, err := t.index.Things(org.Id, measurementTopic, TOPIC_ROLE_SENSOR)
+	if err != nil {
+		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" sensors: %s", org.Name, err.Error())
+		return
+	}
+
+	for _, thing := range sensors {
+		if thing.Sensor.Unit == unit {
+			continue
+		}
+
+		if err := t.things.SetSensorUnit(thing.Id, unit); err != nil {
+			t.log.Errorf("MQTT processing error: %s", err.Error())
+		}
+	}
+}
+
+// sensorExpressionValue evaluates expression of sensor, variable value
+// refers to value extracted from payload, other variables are paths in JSON
+// payload
+func (t *Mqtt) sensorExpressionValue(thing *Thing, payload, value string) (string, error) {
+	expression, err := t.expressions.Get(thing.Sensor.MeasurementExpression)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := expression.Eval(func(name string) (float64, error) {
+		raw := value
+		if name != SENSOR_EXPRESSION_VALUE {
+			parsedValue := gjson.Get(payload, name)
+			if !parsedValue.Exists() {
+				return 0, fmt.Errorf("value \"%s\" of expression not found in payload", name)
+			}
+			raw = parsedValue.String()
 		}
 
+		number, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return 0, fmt.Errorf("value \"%s\" of expression is not a number", name)
+		}
+
+		return number, nil
+	})
+	if err != nil {
+		return "", err
 	}
+
+	return strconv.FormatFloat(result, 'f', -1, 64), nil
+}
+
+// sensorValue validates sensor value and returns it converted to canonical
+// unit of sensor class. Values of known classes must be numbers within range
+// of the class, values of unknown classes are accepted as they are. Value is
+// not converted if conversion is not possible (e.g. unit is not known).
+func (t *Mqtt) sensorValue(thing *Thing, value string) (string, error) {
+	if value == "" {
+		return "", errors.New("empty value")
+	}
+
+	if t.classes == nil {
+		return value, nil
+	}
+
+	class := t.classes.GetByName(thing.Sensor.Class)
+	if class == nil {
+		return value, nil
+	}
+
+	valueFloat, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return "", fmt.Errorf("%s value \"%s\" is not a number", class.Name, value)
+	}
+
+	if thing.Sensor.Unit == "" || class.Unit == "" || class.Unit == thing.Sensor.Unit {
+		if !class.InRange(valueFloat) {
+			return "", fmt.Errorf("%s value %v is out of range", class.Name, valueFloat)
+		}
+		return value, nil
+	}
+
+	converted, err := ConvertUnit(valueFloat, thing.Sensor.Unit, class.Unit)
+	if err != nil {
+		// range of class is defined in canonical unit, it cannot be checked
+		t.log.Warningf("Storing value of sensor %s without conversion to %s (%s)", thing.Name, class.Unit, err.Error())
+		return value, nil
+	}
+
+	if !class.InRange(converted) {
+		return "", fmt.Errorf("%s value %v %s is out of range", class.Name, valueFloat, thing.Sensor.Unit)
+	}
+
+	return strconv.FormatFloat(converted, 'f', -1, 64), nil
 }
 
 func (t *Mqtt) ProcessSwitches(org *Org, topic, payload string) {
 	t.log.Debugf("Processing MQTT message with topic \"%s\" for switches in org \"%s\"", topic, org.Name)
 
 	// look for sensors attached to this topic from active org
-	switches, err := t.things.GetFiltered(bson.M{"org_id": org.Id, "type": THING_TYPE_SWITCH, "switch.state_topic": topic})
+	switches, err := t.index.Things(org.Id, topic, TOPIC_ROLE_SWITCH)
 	if err != nil {
 		t.log.Errorf("MQTT processing error, falied fetching of org \"%s\" switches: %s", org.Name, err.Error())
 		return
@@ -449,6 +1128,13 @@ func (t *Mqtt) ProcessSwitches(org *Org, topic, payload string) {
 			t.log.Warningf("Issue with processing of switch %s MQTT state messsage: %s", thing.Name, err.Error())
 		}
 
+		// confirm pending request for change of state
+		if dbValue != "" {
+			if _, err := t.things.CompleteSwitchRequest(thing.Id, dbValue == "1"); err != nil {
+				t.log.Errorf("MQTT processing error: %s", err.Error())
+			}
+		}
+
 		// store it to influx db if configured
 		if thing.StoreInfluxDb {
 			t.influxDb.PostSwitchState(thing, dbValue)
@@ -481,15 +1167,21 @@ func (t *Mqtt) ProcessMessage(topic, payload string) {
 	topicThing := strings.Join(topicParts[2:], "/")
 
 	// get org ID
-	org, err := t.orgs.GetByName(topicParts[1])
+	org, err := t.index.Org(topicParts[1])
 	if err != nil {
 		// unknown organization
 		t.log.Warningf("MQTT processing error, unknown org: %s (%s)", topicParts[1], err.Error())
 		return
 	}
 
-	t.ProcessAll(org, topicThing, payload)
-	t.ProcessDevices(org, topicThing, payload)
-	t.ProcessSensors(org, topicThing, payload)
-	t.ProcessSwitches(org, topicThing, payload)
+	t.processOrgMessage(org, topicThing, payload, time.Now())
+}
+
+// processOrgMessage processes message of org topic, the ts parameter holds
+// time of the value carried by message
+func (t *Mqtt) processOrgMessage(org *Org, topic, payload string, ts time.Time) {
+	t.ProcessAll(org, topic, payload)
+	t.ProcessDevices(org, topic, payload)
+	t.ProcessSensors(org, topic, payload, ts)
+	t.ProcessSwitches(org, topic, payload)
 }
@@ -1,7 +1,10 @@
 package main_test
 
 import (
+	"crypto/tls"
 	main "piot-server"
+	"piot-server/config"
+	"time"
 
 	"github.com/op/go-logging"
 )
@@ -10,12 +13,19 @@ type call struct {
 	Topic string
 	Value string
 	Thing *main.Thing
+	Time  time.Time
 }
 
 // implements IMqtt interface
 type MqttMock struct {
 	Log   *logging.Logger
 	Calls []call
+
+	// error returned by PushCommand (e.g. failed publishing)
+	PushCommandErr error
+
+	// error returned by PushThingData
+	PushThingDataErr error
 }
 
 func (t *MqttMock) Connect(subscribe bool) error {
@@ -35,9 +45,49 @@ func (t *MqttMock) SetPassword(password string) {
 func (t *MqttMock) SetClient(id string) {
 }
 
-func (t *MqttMock) PushThingData(thing *main.Thing, topic, value string) error {
-	t.Log.Debugf("Push thing data: %s, topic: %s, value: %s", thing.Name, topic, value)
-	t.Calls = append(t.Calls, call{topic, value, thing})
+func (t *MqttMock) SetTLSConfig(config *tls.Config) {
+}
+
+func (t *MqttMock) SetOrgSessions(enabled bool) {
+}
+
+func (t *MqttMock) SetPublishOptions(options map[string]config.MqttPublishOptions) {
+}
+
+func (t *MqttMock) SetStatusTopic(topic string, interval time.Duration) {
+}
+
+func (t *MqttMock) Status() main.MqttStatus {
+	pipeline := main.MqttPipelineStats{Workers: 4, QueueDepth: 3, QueueCapacity: 4000, Processed: 100, Dropped: 5}
+	return main.MqttStatus{Connected: true, Sessions: 1, Reconnects: 2, LastError: "connection lost", LastErrorTime: time.Unix(1000, 0), Pipeline: &pipeline}
+}
+
+func (t *MqttMock) SetPipeline(pipeline *main.MqttPipeline) {
+}
+
+func (t *MqttMock) PushThingData(thing *main.Thing, topic, value string, ts time.Time) error {
+	t.Log.Debugf("Push thing data: %s, topic: %s, value: %s, ts: %s", thing.Name, topic, value, ts)
+	if t.PushThingDataErr != nil {
+		return t.PushThingDataErr
+	}
+	t.Calls = append(t.Calls, call{topic, value, thing, ts})
+
+	return nil
+}
+
+func (t *MqttMock) PushCommand(thing *main.Thing, topic, value string) error {
+	t.Log.Debugf("Push command: %s, topic: %s, value: %s", thing.Name, topic, value)
+	if t.PushCommandErr != nil {
+		return t.PushCommandErr
+	}
+	t.Calls = append(t.Calls, call{topic, value, thing, time.Time{}})
+
+	return nil
+}
+
+func (t *MqttMock) Publish(topic, payload string, retain bool) error {
+	t.Log.Debugf("Publish: %s, value: %s, retain: %v", topic, payload, retain)
+	t.Calls = append(t.Calls, call{topic, payload, nil, time.Time{}})
 
 	return nil
 }
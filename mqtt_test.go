@@ -2,8 +2,11 @@ package main_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	main "piot-server"
+	"piot-server/config"
 	"testing"
 	"time"
 
@@ -15,7 +18,7 @@ import (
 func getMqtt(t *testing.T, log *logging.Logger, db *mongo.Database, influxDb main.IInfluxDb, mysqlDb main.IMysqlDb) main.IMqtt {
 	orgs := GetOrgs(t, log, db)
 	things := GetThings(t, log, db)
-	return main.NewMqtt("uri", log, things, orgs, influxDb, mysqlDb)
+	return main.NewMqtt("uri", log, things, orgs, influxDb, mysqlDb, GetSensorClasses(t, log))
 }
 
 func TestMqttMsgNotSensor(t *testing.T) {
@@ -61,6 +64,110 @@ func TestMqttThingTelemetry(t *testing.T) {
 	Equals(t, "telemetry data", thing.Telemetry)
 }
 
+// fields of telemetry are extracted and stored as time series
+func TestMqttThingTelemetryFields(t *testing.T) {
+	const THING = "device1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+	things := GetThings(t, log, db)
+
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, THING)
+	SetThingTelemetryTopic(t, db, thingId, THING+"/"+"telemetry")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, THING)
+
+	fields := []main.TelemetryField{
+		{Name: "uptime", Path: "UptimeSec", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "rssi", Path: "Wifi.RSSI", Type: main.TELEMETRY_TYPE_FLOAT},
+	}
+	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{
+		"telemetry_fields":   fields,
+		"telemetry_tracking": true,
+		"telemetry_history":  true,
+	}})
+	Ok(t, err)
+
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/telemetry", ORG, THING), `{"UptimeSec": 60, "Wifi": {"RSSI": -70}}`)
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/telemetry", ORG, THING), `{"UptimeSec": 120, "Wifi": {}}`)
+
+	// raw payload is kept
+	thing, err := things.Get(thingId)
+	Ok(t, err)
+	Equals(t, `{"UptimeSec": 120, "Wifi": {}}`, thing.Telemetry)
+	Equals(t, []main.TelemetryValue{{Name: "uptime", Type: main.TELEMETRY_TYPE_INT, Value: "120"}}, thing.TelemetryValues)
+
+	Equals(t, 2, len(influxDb.Calls))
+	Equals(t, "telemetry:uptime:60,rssi:-70", influxDb.Calls[0].Value)
+	Equals(t, "telemetry:uptime:120", influxDb.Calls[1].Value)
+
+	samples, err := things.GetTelemetrySamples(thingId, 10)
+	Ok(t, err)
+	Equals(t, 2, len(samples))
+	Equals(t, "120", samples[0].Values[0].Value)
+	Equals(t, 2, len(samples[1].Values))
+
+	// payload without any field is not stored
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/telemetry", ORG, THING), "telemetry data")
+	Equals(t, 2, len(influxDb.Calls))
+	samples, err = things.GetTelemetrySamples(thingId, 10)
+	Ok(t, err)
+	Equals(t, 2, len(samples))
+}
+
+func TestMqttThingAvailability(t *testing.T) {
+	const THING = "device1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+	things := GetThings(t, log, db)
+
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, THING)
+	Ok(t, things.SetAvailabilityTopic(thingId, "available"))
+	Ok(t, things.SetAvailabilityYesNo(thingId, "yes", "no"))
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, THING)
+
+	topic := fmt.Sprintf("org/%s/%s/available", ORG, THING)
+
+	// device goes online
+	mqtt.ProcessMessage(topic, "yes")
+
+	thing, err := things.Get(thingId)
+	Ok(t, err)
+	Equals(t, true, thing.Available)
+	Assert(t, thing.AvailableChanged > 0, "time of availability change is not set")
+
+	// repeated state is not recorded as change
+	mqtt.ProcessMessage(topic, "yes")
+
+	// device goes offline
+	mqtt.ProcessMessage(topic, "no")
+
+	// unknown values are ignored
+	mqtt.ProcessMessage(topic, "maybe")
+
+	thing, err = things.Get(thingId)
+	Ok(t, err)
+	Equals(t, false, thing.Available)
+
+	events, err := things.GetAvailabilityEvents(thingId, 10)
+	Ok(t, err)
+	Equals(t, 2, len(events))
+	Equals(t, false, events[0].Available)
+	Equals(t, true, events[1].Available)
+}
+
 func TestMqttThingLocation(t *testing.T) {
 	const THING = "device1"
 	const THING2 = "device2"
@@ -163,6 +270,237 @@ func TestMqttMsgSensor(t *testing.T) {
 	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "23")
 }
 
+// retained values delivered on subscription are not processed again
+func TestMqttMsgSensorRetained(t *testing.T) {
+	const SENSOR = "sensor1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	orgs := GetOrgs(t, log, db)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/kitchen")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+
+	broker, uri := startBroker(t, orgs)
+	defer broker.Stop()
+
+	publisher := newBrokerClient(uri, "publisher", "server", "secret", nil)
+	Ok(t, publisher.connect())
+	defer publisher.client.Disconnect(0)
+	publisher.publish(t, fmt.Sprintf("org/%s/zigbee/kitchen", ORG), "23", 1, true)
+
+	mqtt := main.NewMqtt(uri, log, GetThings(t, log, db), orgs, influxDb, GetMysqlDb(t, log), GetSensorClasses(t, log))
+	mqtt.SetClient("piot-server")
+	mqtt.SetUsername("server")
+	mqtt.SetPassword("secret")
+	Ok(t, mqtt.Connect(true))
+	defer mqtt.Disconnect()
+
+	// live value is processed, retained one is not (live value is published
+	// until server subscription is completed)
+	processed := func() bool {
+		publisher.publish(t, fmt.Sprintf("org/%s/zigbee/kitchen", ORG), "24", 1, false)
+		return len(influxDb.Calls) > 0
+	}
+	Assert(t, waitFor(5*time.Second, processed), "live value is not processed")
+	for _, call := range influxDb.Calls {
+		Equals(t, "24", call.Value)
+	}
+}
+
+// sensor with wildcard in measurement topic materialises sensor for each
+// topic, values are stored under aliases given by captured segments
+func TestMqttMsgSensorPattern(t *testing.T) {
+	const SENSOR = "sensor1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/+/temperature")
+	SetThingAlias(t, db, sensorId, "{1}_temperature")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/zigbee/kitchen/temperature", ORG), "23")
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/zigbee/bedroom/temperature", ORG), "21")
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/zigbee/bedroom/humidity", ORG), "40")
+
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/zigbee/kitchen/temperature", ORG), "24")
+
+	Equals(t, 3, len(influxDb.Calls))
+	Equals(t, "23", influxDb.Calls[0].Value)
+	Equals(t, "kitchen_temperature", influxDb.Calls[0].Thing.Alias)
+	Equals(t, "21", influxDb.Calls[1].Value)
+	Equals(t, "bedroom_temperature", influxDb.Calls[1].Thing.Alias)
+	Equals(t, "24", influxDb.Calls[2].Value)
+	Equals(t, influxDb.Calls[0].Thing.Id, influxDb.Calls[2].Thing.Id)
+
+	Equals(t, 3, len(mysqlDb.Calls))
+	Assert(t, mysqlDb.Calls[1].Thing.Id != sensorId, "value shall not be stored by pattern thing")
+
+	// each topic keeps its own value, pattern thing has no value
+	things := GetThings(t, log, db)
+	kitchen, err := things.Get(influxDb.Calls[0].Thing.Id)
+	Ok(t, err)
+	Equals(t, "24", kitchen.Sensor.Value)
+	bedroom, err := things.Get(influxDb.Calls[1].Thing.Id)
+	Ok(t, err)
+	Equals(t, "21", bedroom.Sensor.Value)
+	pattern, err := things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "", pattern.Sensor.Value)
+}
+
+// sensor values are computed by expression of sensor before storing
+func TestMqttMsgSensorExpression(t *testing.T) {
+	const SENSOR = "sensor1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+	things := GetThings(t, log, db)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, SENSOR+"/value")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+
+	setExpression := func(value, expression string) {
+		_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{
+			"sensor.measurement_value":      value,
+			"sensor.measurement_expression": expression,
+		}})
+		Ok(t, err)
+		things.Changed()
+	}
+
+	// scaling of raw value
+	setExpression("adc", "round(value * 0.1 + 2, 1)")
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), `{"adc": 203}`)
+
+	thing, err := things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "22.3", thing.Sensor.Value)
+	Equals(t, 1, len(influxDb.Calls))
+	Equals(t, "22.3", influxDb.Calls[0].Value)
+
+	// multiple fields of payload
+	setExpression("", "(a.t + b.t) / 2")
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), `{"a": {"t": 20}, "b": {"t": 23}}`)
+	Equals(t, 2, len(influxDb.Calls))
+	Equals(t, "21.5", influxDb.Calls[1].Value)
+
+	// messages with missing fields are ignored
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), `{"a": {"t": 20}}`)
+	Equals(t, 2, len(influxDb.Calls))
+
+	thing, err = things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "21.5", thing.Sensor.Value)
+}
+
+// values of sensor in other than canonical unit are converted before storing
+// to persistent storages
+func TestMqttMsgSensorUnit(t *testing.T) {
+	const SENSOR = "sensor1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+	things := GetThings(t, log, db)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, SENSOR+"/"+"value")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+
+	// unit of values published to measurement topic
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value/unit", ORG, SENSOR), "F")
+
+	thing, err := things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "F", thing.Sensor.Unit)
+
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/value", ORG, SENSOR), "212")
+
+	// sensor keeps value in its unit
+	thing, err = things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "212", thing.Sensor.Value)
+
+	// storages get value in canonical unit of temperature class
+	Equals(t, 1, len(influxDb.Calls))
+	Equals(t, "100", influxDb.Calls[0].Value)
+	Equals(t, 1, len(mysqlDb.Calls))
+	Equals(t, "100", mysqlDb.Calls[0].Value)
+}
+
+// invalid values are not stored
+func TestMqttMsgSensorInvalidValue(t *testing.T) {
+	const SENSOR = "sensor1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	things := GetThings(t, log, db)
+	mqtt := main.NewMqtt("uri", log, things, GetOrgs(t, log, db), influxDb, mysqlDb, GetSensorClasses(t, log))
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, SENSOR+"/"+"value")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+
+	topic := fmt.Sprintf("org/%s/%s/value", ORG, SENSOR)
+
+	mqtt.ProcessMessage(topic, "23")
+
+	thing, err := things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "23", thing.Sensor.Value)
+	Equals(t, int32(time.Now().Unix()/60), thing.Sensor.MeasurementLast/60)
+
+	// not a number, out of range of temperature class, empty value
+	mqtt.ProcessMessage(topic, "hot")
+	mqtt.ProcessMessage(topic, "1000")
+	mqtt.ProcessMessage(topic, "")
+
+	// value missing in payload
+	_, err = db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{"sensor.measurement_value": "temp"}})
+	Ok(t, err)
+	things.Changed()
+
+	mqtt.ProcessMessage(topic, "{\"humidity\": 50}")
+
+	thing, err = things.Get(sensorId)
+	Ok(t, err)
+	Equals(t, "23", thing.Sensor.Value)
+
+	Equals(t, 1, len(influxDb.Calls))
+	Equals(t, 1, len(mysqlDb.Calls))
+}
+
 // this verifies that parsing json payloads works well
 func TestMqttMsgSensorWithComplexValue(t *testing.T) {
 	const SENSOR = "sensor1"
@@ -282,6 +620,56 @@ func TestMqttMsgSwitch(t *testing.T) {
 	Equals(t, THING, influxDb.Calls[1].Thing.Name)
 }
 
+// state message confirms pending request for change of switch state
+func TestMqttMsgSwitchRequest(t *testing.T) {
+	const THING = "THING1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+	mqtt := getMqtt(t, log, db, influxDb, mysqlDb)
+	things := GetThings(t, log, db)
+
+	CleanDb(t, db)
+	switchId := CreateSwitch(t, db, THING)
+	SetSwitchStateTopic(t, db, switchId, THING+"/"+"state", "ON", "OFF")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, THING)
+
+	_, err := things.SetSwitchRequest(switchId, true, time.Minute)
+	Ok(t, err)
+
+	// state that doesn't match request keeps request pending
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/state", ORG, THING), "OFF")
+
+	thing, err := things.Get(switchId)
+	Ok(t, err)
+	Equals(t, main.SWITCH_REQUEST_PENDING, thing.Switch.Request.Status)
+
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/state", ORG, THING), "ON")
+
+	thing, err = things.Get(switchId)
+	Ok(t, err)
+	Equals(t, main.SWITCH_REQUEST_DONE, thing.Switch.Request.Status)
+	Assert(t, thing.Switch.Request.Completed > 0, "time of completion is not set")
+
+	// request that is not confirmed in time is timed out
+	_, err = things.SetSwitchRequest(switchId, false, -time.Minute)
+	Ok(t, err)
+
+	thing, err = things.Get(switchId)
+	Ok(t, err)
+	Equals(t, main.SWITCH_REQUEST_TIMEOUT, thing.Switch.Request.CurrentStatus(int32(time.Now().Unix())))
+
+	mqtt.ProcessMessage(fmt.Sprintf("org/%s/%s/state", ORG, THING), "OFF")
+
+	thing, err = things.Get(switchId)
+	Ok(t, err)
+	Equals(t, main.SWITCH_REQUEST_TIMEOUT, thing.Switch.Request.Status)
+}
+
 func TestMqttMsgBatteryLevel(t *testing.T) {
 
 	/////////////////////////////////// prepare
@@ -327,3 +715,277 @@ func TestMqttMsgBatteryLevel(t *testing.T) {
 	Equals(t, THING, influxDb.Calls[0].Thing.Name)
 	Contains(t, influxDb.Calls[0].Value, "level:23")
 }
+
+func TestMqttTopicKind(t *testing.T) {
+	Equals(t, main.MQTT_TOPIC_KIND_AVAILABILITY, main.MqttTopicKind("available"))
+	Equals(t, main.MQTT_TOPIC_KIND_NET, main.MqttTopicKind("net/ip"))
+	Equals(t, main.MQTT_TOPIC_KIND_NET, main.MqttTopicKind("net/wifi/ssid"))
+	Equals(t, main.MQTT_TOPIC_KIND_UNIT, main.MqttTopicKind("temperature/unit"))
+	Equals(t, main.MQTT_TOPIC_KIND_UNIT, main.MqttTopicKind("value/unit"))
+	Equals(t, main.MQTT_TOPIC_KIND_VALUE, main.MqttTopicKind("temperature"))
+	Equals(t, main.MQTT_TOPIC_KIND_VALUE, main.MqttTopicKind("network"))
+}
+
+func TestParseMqttPublishOptions(t *testing.T) {
+	options := GetConfig().MqttPublish
+
+	// availability and values are retained by default
+	Equals(t, config.MqttPublishOptions{Qos: 0, Retain: true}, options[main.MQTT_TOPIC_KIND_AVAILABILITY])
+	Equals(t, config.MqttPublishOptions{Qos: 0, Retain: true}, options[main.MQTT_TOPIC_KIND_VALUE])
+
+	Ok(t, main.ParseMqttPublishOptions("", options))
+	Ok(t, main.ParseMqttPublishOptions("value:1, net:2:retain", options))
+	Equals(t, config.MqttPublishOptions{Qos: 1, Retain: false}, options[main.MQTT_TOPIC_KIND_VALUE])
+	Equals(t, config.MqttPublishOptions{Qos: 2, Retain: true}, options[main.MQTT_TOPIC_KIND_NET])
+	Equals(t, config.MqttPublishOptions{Qos: 0, Retain: true}, options[main.MQTT_TOPIC_KIND_AVAILABILITY])
+
+	Fail(t, main.ParseMqttPublishOptions("value", options))
+	Fail(t, main.ParseMqttPublishOptions("xyz:1", options))
+	Fail(t, main.ParseMqttPublishOptions("value:3", options))
+	Fail(t, main.ParseMqttPublishOptions("value:1:keep", options))
+}
+
+// thing data are published with options of topic kind
+func TestMqttPushThingData(t *testing.T) {
+	const THING = "device1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, THING)
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, THING)
+
+	thing, err := things.Get(thingId)
+	Ok(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := StartMqttBroker(t, listener)
+
+	options := GetConfig().MqttPublish
+	Ok(t, main.ParseMqttPublishOptions("value:1:retain", options))
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), log, things, GetOrgs(t, log, db), nil, nil, nil)
+	mqtt.SetClient("piot-server")
+	mqtt.SetPublishOptions(options)
+	Ok(t, mqtt.Connect(false))
+	defer mqtt.Disconnect()
+
+	Ok(t, mqtt.PushThingData(thing, "available", "yes", time.Time{}))
+	Ok(t, mqtt.PushThingData(thing, "temperature", "23", time.Time{}))
+	Ok(t, mqtt.PushThingData(thing, "temperature/unit", "C", time.Time{}))
+	Ok(t, mqtt.PushThingData(thing, "net/ip", "192.168.1.1", time.Time{}))
+
+	Equals(t, []brokerMessage{
+		{"org/org1/device1/available", "yes", 0, true},
+		{"org/org1/device1/temperature", "23", 1, true},
+		{"org/org1/device1/temperature/unit", "C", 0, false},
+		{"org/org1/device1/net/ip", "192.168.1.1", 0, false},
+	}, broker.Messages())
+
+	// publishing fails once connection is closed
+	mqtt.Disconnect()
+	Fail(t, mqtt.PushThingData(thing, "temperature", "24", time.Time{}))
+}
+
+// values published with device time (e.g. batch of buffered readings) are
+// stored with their times
+func TestMqttPushThingDataTime(t *testing.T) {
+	const SENSOR = "sensor1"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	influxDb := GetInfluxDb(t, log)
+	mysqlDb := GetMysqlDb(t, log)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, SENSOR+"/value")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+
+	sensor, err := things.Get(sensorId)
+	Ok(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	StartMqttBroker(t, listener)
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), log, things, GetOrgs(t, log, db), influxDb, mysqlDb, GetSensorClasses(t, log))
+	mqtt.SetClient("piot-server")
+	Ok(t, mqtt.Connect(false))
+	defer mqtt.Disconnect()
+
+	// two reading sets with the same value and one with different value
+	ts1 := time.Unix(1000, 0)
+	ts2 := time.Unix(1060, 0)
+	ts3 := time.Unix(1120, 0)
+	Ok(t, mqtt.PushThingData(sensor, "value", "23", ts1))
+	Ok(t, mqtt.PushThingData(sensor, "value", "23", ts2))
+	Ok(t, mqtt.PushThingData(sensor, "value", "24", ts3))
+
+	// value without time is current
+	Ok(t, mqtt.PushThingData(sensor, "value", "23", time.Time{}))
+
+	Equals(t, 4, len(influxDb.Calls))
+	Equals(t, ts1, influxDb.Calls[0].Time)
+	Equals(t, ts2, influxDb.Calls[1].Time)
+	Equals(t, "24", influxDb.Calls[2].Value)
+	Equals(t, ts3, influxDb.Calls[2].Time)
+	Assert(t, time.Since(influxDb.Calls[3].Time) < time.Minute, "current time expected")
+
+	Equals(t, 4, len(mysqlDb.Calls))
+	Equals(t, ts1, mysqlDb.Calls[0].Time)
+	Equals(t, ts2, mysqlDb.Calls[1].Time)
+	Equals(t, ts3, mysqlDb.Calls[2].Time)
+}
+
+// values published on behalf of piot things are not processed again when
+// they are received back through subscription
+func TestMqttPushThingDataEcho(t *testing.T) {
+	const SENSOR = "sensor1"
+	const OTHER = "sensor2"
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	influxDb := GetInfluxDb(t, log)
+	orgs := GetOrgs(t, log, db)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, SENSOR)
+	SetSensorMeasurementTopic(t, db, sensorId, SENSOR+"/value")
+	otherId := CreateThing(t, db, OTHER)
+	SetSensorMeasurementTopic(t, db, otherId, "zigbee/kitchen")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, SENSOR)
+	AddOrgThing(t, db, orgId, OTHER)
+
+	sensor, err := things.Get(sensorId)
+	Ok(t, err)
+
+	broker, uri := startBroker(t, orgs)
+	defer broker.Stop()
+
+	mqtt := main.NewMqtt(uri, log, things, orgs, influxDb, GetMysqlDb(t, log), GetSensorClasses(t, log))
+	mqtt.SetClient("piot-server")
+	mqtt.SetUsername("server")
+	mqtt.SetPassword("secret")
+	Ok(t, mqtt.Connect(true))
+	defer mqtt.Disconnect()
+
+	ts := time.Unix(1000, 0)
+	Ok(t, mqtt.PushThingData(sensor, "value", "21.5", ts))
+
+	// message of other publisher is processed after echo of published value
+	publisher := newBrokerClient(uri, "publisher", "server", "secret", nil)
+	Ok(t, publisher.connect())
+	defer publisher.client.Disconnect(0)
+	processed := func() bool {
+		publisher.publish(t, fmt.Sprintf("org/%s/zigbee/kitchen", ORG), "21.5", 1, false)
+		return len(influxDb.Calls) > 1
+	}
+	Assert(t, waitFor(5*time.Second, processed), "message of other publisher is not processed")
+
+	Equals(t, SENSOR, influxDb.Calls[0].Thing.Name)
+	Equals(t, ts, influxDb.Calls[0].Time)
+	for _, call := range influxDb.Calls[1:] {
+		Equals(t, OTHER, call.Thing.Name)
+		Assert(t, time.Since(call.Time) < time.Minute, "current time expected")
+	}
+}
+
+// with single session copies of server status are published under topics of
+// each org
+func TestMqttServerStatusOrgs(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+
+	CleanDb(t, db)
+	CreateOrg(t, db, "org1")
+	CreateOrg(t, db, "org2")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := StartMqttBroker(t, listener)
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), log, GetThings(t, log, db), GetOrgs(t, log, db), nil, nil, nil)
+	mqtt.SetClient("piot-server")
+	mqtt.SetStatusTopic("piot/status", 0)
+	Ok(t, mqtt.Connect(false))
+
+	// single session carries last will of main status topic
+	conns := broker.Conns()
+	Equals(t, 1, len(conns))
+	Equals(t, "piot/status", conns[0].Will.Topic)
+
+	published := func() bool { return len(broker.Messages()) >= 3 }
+	Assert(t, waitFor(5*time.Second, published), "server status is not published")
+
+	topics := make(map[string]bool)
+	for _, msg := range broker.Messages() {
+		Equals(t, true, msg.Retain)
+		topics[msg.Topic] = true
+	}
+	Equals(t, map[string]bool{"piot/status": true, "org/org1/piot/status": true, "org/org2/piot/status": true}, topics)
+
+	// offline status is published to all topics on disconnection
+	Ok(t, mqtt.Disconnect())
+	offline := func() bool { return len(broker.Messages()) >= 6 }
+	Assert(t, waitFor(5*time.Second, offline), "offline status is not published")
+}
+
+func TestMqttServerStatus(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := StartMqttBroker(t, listener)
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), GetLogger(t), nil, nil, nil, nil, nil)
+	mqtt.SetClient("piot-server")
+	mqtt.SetStatusTopic("piot/status", 100*time.Millisecond)
+	Ok(t, mqtt.Connect(false))
+
+	status := func(msg brokerMessage) map[string]interface{} {
+		var result map[string]interface{}
+		Ok(t, json.Unmarshal([]byte(msg.Payload), &result))
+		return result
+	}
+
+	// offline status is configured as last will
+	conns := broker.Conns()
+	Equals(t, 1, len(conns))
+	Assert(t, conns[0].Will != nil, "last will is not configured")
+	Equals(t, "piot/status", conns[0].Will.Topic)
+	Equals(t, true, conns[0].Will.Retain)
+	Equals(t, "offline", status(*conns[0].Will)["status"])
+
+	// online status is published on connection and republished periodically
+	updated := func() bool { return len(broker.Messages()) >= 2 }
+	Assert(t, waitFor(5*time.Second, updated), "server status is not republished")
+
+	for _, msg := range broker.Messages() {
+		Equals(t, "piot/status", msg.Topic)
+		Equals(t, true, msg.Retain)
+		Equals(t, "online", status(msg)["status"])
+		Equals(t, config.VersionString(), status(msg)["version"])
+	}
+
+	s := mqtt.Status()
+	Equals(t, true, s.Connected)
+	Equals(t, 1, s.Sessions)
+	Equals(t, 0, s.Reconnects)
+	Equals(t, "", s.LastError)
+
+	// offline status is published on regular disconnection
+	Ok(t, mqtt.Disconnect())
+	messages := broker.Messages()
+	Equals(t, "offline", status(messages[len(messages)-1])["status"])
+	Equals(t, false, mqtt.Status().Connected)
+}
@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/op/go-logging"
+)
+
+// limits of embedded broker
+const MQTT_BROKER_MAX_PACKET_SIZE = 256 * 1024
+const MQTT_BROKER_QUEUE_SIZE = 1000
+const MQTT_BROKER_CONNECT_TIMEOUT = 10 * time.Second
+const MQTT_BROKER_WRITE_TIMEOUT = 10 * time.Second
+
+// qos of messages delivered by broker is limited, qos 2 subscriptions are
+// granted with qos 1
+const MQTT_BROKER_MAX_QOS = 1
+
+// Minimal MQTT 3.1.1 broker embedded into server, so server can run without
+// external broker. Clients authenticate either by credentials of server
+// (full access) or by MQTT credentials of orgs. Clients of orgs can publish
+// and subscribe to topics of their org only (org/<name>/#), they can also
+// subscribe to server status topic. Sessions are not persisted (all sessions
+// are clean), messages are delivered with qos 0 or 1.
+type MqttBroker struct {
+	log      *logging.Logger
+	orgs     *Orgs
+	username string
+	password string
+
+	// topic of server status readable by clients of all orgs
+	statusTopic string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mutex    sync.RWMutex
+	clients  map[string]*mqttBrokerClient
+	retained map[string]*packets.PublishPacket
+}
+
+type mqttBrokerClient struct {
+	broker *MqttBroker
+	conn   net.Conn
+	id     string
+
+	// org of client, empty for server (full access)
+	org string
+
+	// subscriptions (filter -> granted qos), guarded by broker mutex
+	subscriptions map[string]byte
+
+	will     *packets.PublishPacket
+	received map[uint16]bool
+	nextId   uint16
+
+	out       chan packets.ControlPacket
+	done      chan bool
+	closeOnce sync.Once
+}
+
+// NewMqttBroker creates broker, username and password are credentials of
+// server (e.g. credentials used by server itself to connect)
+func NewMqttBroker(log *logging.Logger, orgs *Orgs, username, password string) *MqttBroker {
+	return &MqttBroker{
+		log:      log,
+		orgs:     orgs,
+		username: username,
+		password: password,
+		clients:  make(map[string]*mqttBrokerClient),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+}
+
+// SetStatusTopic sets topic of server status (see Mqtt.SetStatusTopic),
+// clients of orgs can subscribe to it
+func (b *MqttBroker) SetStatusTopic(topic string) {
+	b.statusTopic = topic
+}
+
+// NewMqttBrokerPassword returns random password, e.g. for server connecting
+// to embedded broker without configured credentials
+func NewMqttBrokerPassword() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+// Start starts accepting connections on address (e.g. :1883)
+func (b *MqttBroker) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	b.Serve(listener)
+
+	return nil
+}
+
+// Serve starts accepting connections from listener
+func (b *MqttBroker) Serve(listener net.Listener) {
+	b.log.Infof("Embedded MQTT broker listening on %s", listener.Addr().String())
+
+	b.listener = listener
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				b.serve(conn)
+			}()
+		}
+	}()
+}
+
+// Stop stops accepting connections and closes all connections
+func (b *MqttBroker) Stop() {
+	if b.listener == nil {
+		return
+	}
+	b.listener.Close()
+
+	b.mutex.RLock()
+	clients := []*mqttBrokerClient{}
+	for _, client := range b.clients {
+		clients = append(clients, client)
+	}
+	b.mutex.RUnlock()
+
+	for _, client := range clients {
+		client.close()
+	}
+
+	b.wg.Wait()
+	b.log.Infof("Embedded MQTT broker stopped")
+}
+
+// authenticate returns org of client with given credentials, empty org
+// means server
+func (b *MqttBroker) authenticate(username string, password []byte) (string, error) {
+	if username == "" {
+		return "", errors.New("missing username")
+	}
+
+	if b.username != "" && username == b.username {
+		if subtle.ConstantTimeCompare([]byte(b.password), password) == 1 {
+			return "", nil
+		}
+		return "", errors.New("bad password")
+	}
+
+	orgs, err := b.orgs.GetAll()
+	if err != nil {
+		return "", err
+	}
+
+	for _, org := range orgs {
+		if org.MqttUsername != username {
+			continue
+		}
+		// org without password cannot connect
+		if org.MqttPassword == "" {
+			return "", errors.New("org has no password")
+		}
+		if subtle.ConstantTimeCompare([]byte(org.MqttPassword), password) == 1 {
+			return org.Name, nil
+		}
+		return "", errors.New("bad password")
+	}
+
+	return "", errors.New("unknown user")
+}
+
+// statusFilter checks if filter is server status topic, clients can
+// subscribe to it but they cannot publish to it
+func (c *mqttBrokerClient) statusFilter(filter string) bool {
+	return c.broker.statusTopic != "" && filter == c.broker.statusTopic
+}
+
+// allowed checks if client can publish to topic or subscribe to filter
+func (c *mqttBrokerClient) allowed(topic string) bool {
+	if c.org == "" {
+		return true
+	}
+
+	levels := strings.Split(topic, "/")
+
+	return len(levels) >= 3 && levels[0] == TOPIC_ROOT && levels[1] == c.org
+}
+
+// readPacket reads packet of limited size from connection
+func readPacket(r *bufio.Reader) (packets.ControlPacket, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errors.New("malformed remaining length")
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length += int(c&127) * multiplier
+		multiplier *= 128
+		if c&128 == 0 {
+			break
+		}
+	}
+
+	if length > MQTT_BROKER_MAX_PACKET_SIZE {
+		return nil, fmt.Errorf("packet of %d bytes exceeds limit", length)
+	}
+
+	fh := packets.FixedHeader{
+		MessageType:     header >> 4,
+		Dup:             header&0x08 != 0,
+		Qos:             (header >> 1) & 0x03,
+		Retain:          header&0x01 != 0,
+		RemainingLength: length,
+	}
+
+	cp, err := packets.NewControlPacketWithHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	if err := cp.Unpack(bytes.NewBuffer(body)); err != nil {
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func (b *MqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+
+	// first packet has to be CONNECT
+	conn.SetReadDeadline(time.Now().Add(MQTT_BROKER_CONNECT_TIMEOUT))
+	cp, err := readPacket(reader)
+	if err != nil {
+		b.log.Debugf("MQTT broker: failed to read connect packet from %s (%v)", conn.RemoteAddr().String(), err)
+		return
+	}
+	connect, ok := cp.(*packets.ConnectPacket)
+	if !ok {
+		b.log.Warningf("MQTT broker: first packet from %s is not connect packet", conn.RemoteAddr().String())
+		return
+	}
+
+	client, code := b.connect(conn, connect)
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = code
+	conn.SetWriteDeadline(time.Now().Add(MQTT_BROKER_WRITE_TIMEOUT))
+	if err := connack.Write(conn); err != nil {
+		b.log.Debugf("MQTT broker: failed to write connack to %s (%v)", conn.RemoteAddr().String(), err)
+		// accepted client is already registered
+		if client != nil {
+			b.disconnect(client, false)
+		}
+		return
+	}
+	if code != packets.Accepted {
+		return
+	}
+
+	go client.write()
+
+	// clients are disconnected if they don't send anything in 1.5 times of
+	// keep alive interval
+	timeout := time.Duration(connect.Keepalive) * time.Second * 3 / 2
+
+	clean := false
+	for {
+		if timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+
+		cp, err := readPacket(reader)
+		if err != nil {
+			b.log.Debugf("MQTT broker: connection of client %s closed (%v)", client.id, err)
+			break
+		}
+
+		if _, ok := cp.(*packets.DisconnectPacket); ok {
+			clean = true
+			break
+		}
+
+		if err := client.handle(cp); err != nil {
+			b.log.Warningf("MQTT broker: closing connection of client %s (%v)", client.id, err)
+			break
+		}
+	}
+
+	b.disconnect(client, clean)
+}
+
+// connect authenticates client and registers it, existing client with the
+// same id is disconnected
+func (b *MqttBroker) connect(conn net.Conn, connect *packets.ConnectPacket) (*mqttBrokerClient, byte) {
+	if code := connect.Validate(); code != packets.Accepted {
+		return nil, code
+	}
+
+	org, err := b.authenticate(connect.Username, connect.Password)
+	if err != nil {
+		b.log.Warningf("MQTT broker: authentication of client %s (user %s) from %s failed (%v)", connect.ClientIdentifier, connect.Username, conn.RemoteAddr().String(), err)
+		return nil, packets.ErrRefusedBadUsernameOrPassword
+	}
+
+	client := &mqttBrokerClient{
+		broker:        b,
+		conn:          conn,
+		id:            connect.ClientIdentifier,
+		org:           org,
+		subscriptions: make(map[string]byte),
+		received:      make(map[uint16]bool),
+		out:           make(chan packets.ControlPacket, MQTT_BROKER_QUEUE_SIZE),
+		done:          make(chan bool),
+	}
+
+	if client.id == "" {
+		id, err := NewMqttBrokerPassword()
+		if err != nil {
+			return nil, packets.ErrRefusedServerUnavailable
+		}
+		client.id = "auto-" + id
+	}
+
+	if connect.WillFlag {
+		if !validPublishTopic(connect.WillTopic) || !client.allowed(connect.WillTopic) {
+			b.log.Warningf("MQTT broker: will topic %s of client %s is not allowed", connect.WillTopic, client.id)
+			return nil, packets.ErrRefusedNotAuthorised
+		}
+		will := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		will.TopicName = connect.WillTopic
+		will.Payload = connect.WillMessage
+		will.Qos = connect.WillQos
+		will.Retain = connect.WillRetain
+		client.will = will
+	}
+
+	b.mutex.Lock()
+	previous := b.clients[client.id]
+	b.clients[client.id] = client
+	b.mutex.Unlock()
+
+	if previous != nil {
+		b.log.Infof("MQTT broker: client %s took over existing connection", client.id)
+		previous.close()
+	}
+
+	b.log.Infof("MQTT broker: client %s (user %s) connected from %s", client.id, connect.Username, conn.RemoteAddr().String())
+
+	return client, packets.Accepted
+}
+
+// disconnect unregisters client, will is published if client didn't
+// disconnect cleanly
+func (b *MqttBroker) disconnect(client *mqttBrokerClient, clean bool) {
+	b.mutex.Lock()
+	if b.clients[client.id] == client {
+		delete(b.clients, client.id)
+	}
+	b.mutex.Unlock()
+
+	client.close()
+
+	if !clean && client.will != nil {
+		b.publish(client.will)
+	}
+
+	b.log.Infof("MQTT broker: client %s disconnected", client.id)
+}
+
+// publish stores retained message and delivers message to subscribers
+func (b *MqttBroker) publish(msg *packets.PublishPacket) {
+	if msg.Retain {
+		b.mutex.Lock()
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.TopicName)
+		} else {
+			b.retained[msg.TopicName] = msg
+		}
+		b.mutex.Unlock()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, client := range b.clients {
+		qos, ok := client.subscribed(msg.TopicName)
+		if !ok {
+			continue
+		}
+		if msg.Qos < qos {
+			qos = msg.Qos
+		}
+
+		// retain flag is set only for retained messages delivered on
+		// subscription
+		client.deliver(msg.TopicName, msg.Payload, qos, false)
+	}
+}
+
+// subscribed returns max qos of client subscriptions matching topic, must be
+// called with broker mutex held
+func (c *mqttBrokerClient) subscribed(topic string) (byte, bool) {
+	var qos byte
+	found := false
+
+	for filter, granted := range c.subscriptions {
+		if !matchFilter(filter, topic) {
+			continue
+		}
+		if !found || granted > qos {
+			qos = granted
+		}
+		found = true
+	}
+
+	return qos, found
+}
+
+// matchFilter matches topic against subscription filter, topics starting
+// with $ are not matched by wildcards at first level
+func matchFilter(filter, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, TOPIC_WILDCARD_SINGLE) || strings.HasPrefix(filter, TOPIC_WILDCARD_MULTI)) {
+		return false
+	}
+
+	_, ok := MatchTopic(filter, topic)
+
+	return ok
+}
+
+func validPublishTopic(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, TOPIC_WILDCARD_SINGLE+TOPIC_WILDCARD_MULTI)
+}
+
+func validFilter(filter string) bool {
+	return filter != "" && ValidateTopicPattern(filter) == nil
+}
+
+// handle processes packet received from client
+func (c *mqttBrokerClient) handle(cp packets.ControlPacket) error {
+	switch p := cp.(type) {
+	case *packets.PublishPacket:
+		return c.handlePublish(p)
+
+	case *packets.PubrelPacket:
+		delete(c.received, p.MessageID)
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = p.MessageID
+		c.send(pubcomp)
+
+	case *packets.PubackPacket, *packets.PubrecPacket, *packets.PubcompPacket:
+		// delivery of qos 1 messages is not tracked, qos 2 is not used for
+		// delivery
+
+	case *packets.SubscribePacket:
+		c.handleSubscribe(p)
+
+	case *packets.UnsubscribePacket:
+		c.broker.mutex.Lock()
+		for _, filter := range p.Topics {
+			delete(c.subscriptions, filter)
+		}
+		c.broker.mutex.Unlock()
+		unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		unsuback.MessageID = p.MessageID
+		c.send(unsuback)
+
+	case *packets.PingreqPacket:
+		c.send(packets.NewControlPacket(packets.Pingresp))
+
+	default:
+		return fmt.Errorf("unexpected packet %s", cp.String())
+	}
+
+	return nil
+}
+
+func (c *mqttBrokerClient) handlePublish(p *packets.PublishPacket) error {
+	if !validPublishTopic(p.TopicName) {
+		return fmt.Errorf("invalid topic %s", p.TopicName)
+	}
+	if p.Qos > 2 {
+		return errors.New("invalid qos")
+	}
+
+	// MQTT 3.1.1 cannot reject publishing, message is acknowledged and
+	// dropped
+	allowed := c.allowed(p.TopicName)
+	if !allowed {
+		c.broker.log.Warningf("MQTT broker: client %s is not allowed to publish to topic %s", c.id, p.TopicName)
+	}
+
+	switch p.Qos {
+	case 0:
+		if allowed {
+			c.broker.publish(p)
+		}
+	case 1:
+		if allowed {
+			c.broker.publish(p)
+		}
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		c.send(puback)
+	case 2:
+		// message is delivered on first reception, retransmissions (before
+		// release) are only acknowledged
+		if allowed && !c.received[p.MessageID] {
+			c.broker.publish(p)
+		}
+		c.received[p.MessageID] = true
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		c.send(pubrec)
+	}
+
+	return nil
+}
+
+func (c *mqttBrokerClient) handleSubscribe(p *packets.SubscribePacket) {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = p.MessageID
+
+	granted := []string{}
+
+	c.broker.mutex.Lock()
+	for i, filter := range p.Topics {
+		qos := p.Qoss[i]
+		if !validFilter(filter) || qos > 2 || !(c.allowed(filter) || c.statusFilter(filter)) {
+			c.broker.log.Warningf("MQTT broker: client %s is not allowed to subscribe to %s", c.id, filter)
+			suback.ReturnCodes = append(suback.ReturnCodes, 0x80)
+			continue
+		}
+		if qos > MQTT_BROKER_MAX_QOS {
+			qos = MQTT_BROKER_MAX_QOS
+		}
+		c.subscriptions[filter] = qos
+		suback.ReturnCodes = append(suback.ReturnCodes, qos)
+		granted = append(granted, filter)
+	}
+	c.broker.mutex.Unlock()
+
+	c.send(suback)
+
+	// retained messages matching new subscriptions
+	c.broker.mutex.RLock()
+	defer c.broker.mutex.RUnlock()
+
+	for topic, msg := range c.broker.retained {
+		for _, filter := range granted {
+			if !matchFilter(filter, topic) {
+				continue
+			}
+			qos := c.subscriptions[filter]
+			if msg.Qos < qos {
+				qos = msg.Qos
+			}
+			c.deliver(topic, msg.Payload, qos, true)
+			break
+		}
+	}
+}
+
+// deliver queues message for client, message is dropped if queue is full
+func (c *mqttBrokerClient) deliver(topic string, payload []byte, qos byte, retain bool) {
+	p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	p.TopicName = topic
+	p.Payload = payload
+	p.Qos = qos
+	p.Retain = retain
+
+	select {
+	case c.out <- p:
+	case <-c.done:
+	default:
+		c.broker.log.Warningf("MQTT broker: queue of client %s is full, dropping message (topic: %s)", c.id, topic)
+	}
+}
+
+// send queues packet for client, it waits for free space in queue
+func (c *mqttBrokerClient) send(p packets.ControlPacket) {
+	select {
+	case c.out <- p:
+	case <-c.done:
+	}
+}
+
+// write writes queued packets to connection
+func (c *mqttBrokerClient) write() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case p := <-c.out:
+			// ids of delivered messages are assigned in order of writing
+			if publish, ok := p.(*packets.PublishPacket); ok && publish.Qos > 0 {
+				c.nextId++
+				if c.nextId == 0 {
+					c.nextId = 1
+				}
+				publish.MessageID = c.nextId
+			}
+
+			c.conn.SetWriteDeadline(time.Now().Add(MQTT_BROKER_WRITE_TIMEOUT))
+			if err := p.Write(c.conn); err != nil {
+				c.broker.log.Debugf("MQTT broker: writing to client %s failed (%v)", c.id, err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *mqttBrokerClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
@@ -0,0 +1,266 @@
+package main_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+type brokerConn struct {
+	ClientId      string
+	Username      string
+	Password      string
+	Subscriptions []string
+	Connected     bool
+	Will          *brokerMessage
+}
+
+type brokerMessage struct {
+	Topic   string
+	Payload string
+	Qos     byte
+	Retain  bool
+}
+
+// minimal MQTT broker, it accepts all connections and records identities and
+// subscriptions of clients and published messages, messages are not delivered
+type MqttBrokerMock struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	conns    []*brokerConn
+	messages []brokerMessage
+}
+
+// StartMqttBroker serves MQTT connections accepted by listener until end of
+// the test
+func StartMqttBroker(t *testing.T, listener net.Listener) *MqttBrokerMock {
+	broker := &MqttBrokerMock{listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+
+	return broker
+}
+
+// Conns returns copy of connections (including closed ones)
+func (b *MqttBrokerMock) Conns() []brokerConn {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result := []brokerConn{}
+	for _, c := range b.conns {
+		copied := *c
+		copied.Subscriptions = append([]string{}, c.Subscriptions...)
+		if c.Will != nil {
+			will := *c.Will
+			copied.Will = &will
+		}
+		result = append(result, copied)
+	}
+
+	return result
+}
+
+// Messages returns published messages
+func (b *MqttBrokerMock) Messages() []brokerMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]brokerMessage{}, b.messages...)
+}
+
+// ActiveUsers returns usernames of connected clients
+func (b *MqttBrokerMock) ActiveUsers() map[string]int {
+	result := make(map[string]int)
+	for _, c := range b.Conns() {
+		if c.Connected {
+			result[c.Username]++
+		}
+	}
+
+	return result
+}
+
+func (b *MqttBrokerMock) serve(conn net.Conn) {
+	defer conn.Close()
+
+	bc := &brokerConn{}
+	defer func() {
+		b.mutex.Lock()
+		bc.Connected = false
+		b.mutex.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		// fixed header: packet type and variable length encoded remaining length
+		header, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+
+		length, multiplier := 0, 1
+		for {
+			c, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			length += int(c&127) * multiplier
+			multiplier *= 128
+			if c&128 == 0 {
+				break
+			}
+		}
+
+		body := make([]byte, length)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT -> CONNACK (accepted)
+			if err := parseConnect(body, bc); err != nil {
+				return
+			}
+			b.mutex.Lock()
+			bc.Connected = true
+			b.conns = append(b.conns, bc)
+			b.mutex.Unlock()
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH -> PUBACK (qos 1), PUBREC (qos 2)
+			msg, packetId, err := parsePublish(header, body)
+			if err != nil {
+				return
+			}
+			b.mutex.Lock()
+			b.messages = append(b.messages, msg)
+			b.mutex.Unlock()
+			switch msg.Qos {
+			case 1:
+				conn.Write([]byte{0x40, 0x02, packetId[0], packetId[1]})
+			case 2:
+				conn.Write([]byte{0x50, 0x02, packetId[0], packetId[1]})
+			}
+		case 6: // PUBREL -> PUBCOMP
+			conn.Write([]byte{0x70, 0x02, body[0], body[1]})
+		case 8: // SUBSCRIBE -> SUBACK
+			packetId, topics := parseSubscribe(body)
+			b.mutex.Lock()
+			bc.Subscriptions = append(bc.Subscriptions, topics...)
+			b.mutex.Unlock()
+			ack := []byte{0x90, byte(2 + len(topics)), packetId[0], packetId[1]}
+			for range topics {
+				ack = append(ack, 0x00)
+			}
+			conn.Write(ack)
+		case 12: // PINGREQ -> PINGRESP
+			conn.Write([]byte{0xd0, 0x00})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// readString reads length prefixed string from packet
+func readString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, fmt.Errorf("malformed packet")
+	}
+	size := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+size {
+		return "", nil, fmt.Errorf("malformed packet")
+	}
+
+	return string(data[2 : 2+size]), data[2+size:], nil
+}
+
+func parseConnect(data []byte, bc *brokerConn) error {
+	// protocol name, level, flags, keep alive
+	_, data, err := readString(data)
+	if err != nil || len(data) < 4 {
+		return fmt.Errorf("malformed connect packet")
+	}
+	flags := data[1]
+	data = data[4:]
+
+	if bc.ClientId, data, err = readString(data); err != nil {
+		return err
+	}
+
+	// will topic and message
+	if flags&0x04 != 0 {
+		will := &brokerMessage{Qos: (flags >> 3) & 0x03, Retain: flags&0x20 != 0}
+		if will.Topic, data, err = readString(data); err != nil {
+			return err
+		}
+		if will.Payload, data, err = readString(data); err != nil {
+			return err
+		}
+		bc.Will = will
+	}
+
+	if flags&0x80 != 0 {
+		if bc.Username, data, err = readString(data); err != nil {
+			return err
+		}
+	}
+
+	if flags&0x40 != 0 {
+		if bc.Password, _, err = readString(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parsePublish(header byte, data []byte) (brokerMessage, []byte, error) {
+	msg := brokerMessage{Qos: (header >> 1) & 0x03, Retain: header&0x01 != 0}
+
+	topic, data, err := readString(data)
+	if err != nil {
+		return msg, nil, err
+	}
+	msg.Topic = topic
+
+	var packetId []byte
+	if msg.Qos > 0 {
+		if len(data) < 2 {
+			return msg, nil, fmt.Errorf("malformed publish packet")
+		}
+		packetId, data = data[:2], data[2:]
+	}
+	msg.Payload = string(data)
+
+	return msg, packetId, nil
+}
+
+func parseSubscribe(data []byte) ([]byte, []string) {
+	packetId := data[:2]
+	data = data[2:]
+
+	topics := []string{}
+	for len(data) > 0 {
+		topic, rest, err := readString(data)
+		if err != nil || len(rest) < 1 {
+			break
+		}
+		topics = append(topics, topic)
+		data = rest[1:]
+	}
+
+	return packetId, topics
+}
@@ -0,0 +1,297 @@
+package main_test
+
+import (
+	"fmt"
+	"net"
+	main "piot-server"
+	"sync"
+	"testing"
+	"time"
+
+	mqttclient "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startBroker starts embedded broker with server credentials on random port
+func startBroker(t *testing.T, orgs *main.Orgs) (*main.MqttBroker, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+
+	broker := main.NewMqttBroker(GetLogger(t), orgs, "server", "secret")
+	broker.Serve(listener)
+
+	return broker, fmt.Sprintf("tcp://%s", listener.Addr().String())
+}
+
+type receivedMessage struct {
+	Topic   string
+	Payload string
+	Retain  bool
+}
+
+type brokerClient struct {
+	client   mqttclient.Client
+	mutex    sync.Mutex
+	messages []receivedMessage
+}
+
+func newBrokerClient(uri, id, username, password string, configure func(*mqttclient.ClientOptions)) *brokerClient {
+	c := &brokerClient{}
+
+	opts := mqttclient.NewClientOptions().AddBroker(uri)
+	opts.SetClientID(id)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(false)
+	opts.SetDefaultPublishHandler(func(client mqttclient.Client, msg mqttclient.Message) {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.messages = append(c.messages, receivedMessage{msg.Topic(), string(msg.Payload()), msg.Retained()})
+	})
+	if configure != nil {
+		configure(opts)
+	}
+	c.client = mqttclient.NewClient(opts)
+
+	return c
+}
+
+func (c *brokerClient) connect() error {
+	token := c.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (c *brokerClient) subscribe(t *testing.T, filter string, qos byte) byte {
+	token := c.client.Subscribe(filter, qos, nil)
+	token.Wait()
+	Ok(t, token.Error())
+	return token.(*mqttclient.SubscribeToken).Result()[filter]
+}
+
+func (c *brokerClient) publish(t *testing.T, topic, payload string, qos byte, retain bool) {
+	token := c.client.Publish(topic, qos, retain, payload)
+	token.Wait()
+	Ok(t, token.Error())
+}
+
+func (c *brokerClient) Messages() []receivedMessage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]receivedMessage{}, c.messages...)
+}
+
+func (c *brokerClient) waitMessages(count int) []receivedMessage {
+	waitFor(5*time.Second, func() bool { return len(c.Messages()) >= count })
+	return c.Messages()
+}
+
+func TestMqttBrokerPublishSubscribe(t *testing.T) {
+	broker, uri := startBroker(t, nil)
+	defer broker.Stop()
+
+	sub := newBrokerClient(uri, "sub", "server", "secret", nil)
+	Ok(t, sub.connect())
+	defer sub.client.Disconnect(0)
+
+	Equals(t, byte(0), sub.subscribe(t, "org/+/sensor/#", 0))
+	// qos 2 is downgraded
+	Equals(t, byte(1), sub.subscribe(t, "org/org1/value", 2))
+
+	pub := newBrokerClient(uri, "pub", "server", "secret", nil)
+	Ok(t, pub.connect())
+	defer pub.client.Disconnect(0)
+
+	pub.publish(t, "org/org1/sensor/t1", "23.5", 0, false)
+	pub.publish(t, "org/org1/value", "1", 1, false)
+	pub.publish(t, "org/org1/value", "2", 2, false)
+	pub.publish(t, "org/org1/other", "x", 1, false)
+
+	messages := sub.waitMessages(3)
+	Equals(t, []receivedMessage{
+		{"org/org1/sensor/t1", "23.5", false},
+		{"org/org1/value", "1", false},
+		{"org/org1/value", "2", false},
+	}, messages)
+
+	// no more messages after unsubscribe
+	token := sub.client.Unsubscribe("org/org1/value")
+	token.Wait()
+	Ok(t, token.Error())
+	pub.publish(t, "org/org1/value", "3", 1, false)
+	pub.publish(t, "org/org1/sensor/t2", "10", 1, false)
+
+	messages = sub.waitMessages(4)
+	Equals(t, 4, len(messages))
+	Equals(t, receivedMessage{"org/org1/sensor/t2", "10", false}, messages[3])
+}
+
+func TestMqttBrokerAuthentication(t *testing.T) {
+	broker, uri := startBroker(t, nil)
+	defer broker.Stop()
+
+	c := newBrokerClient(uri, "client", "server", "bad", nil)
+	Assert(t, c.connect() != nil, "connect with bad password must fail")
+
+	c = newBrokerClient(uri, "client", "", "", nil)
+	Assert(t, c.connect() != nil, "connect without credentials must fail")
+
+	c = newBrokerClient(uri, "client", "server", "secret", nil)
+	Ok(t, c.connect())
+	c.client.Disconnect(0)
+}
+
+func TestMqttBrokerRetained(t *testing.T) {
+	broker, uri := startBroker(t, nil)
+	defer broker.Stop()
+
+	pub := newBrokerClient(uri, "pub", "server", "secret", nil)
+	Ok(t, pub.connect())
+	defer pub.client.Disconnect(0)
+
+	pub.publish(t, "org/org1/status", "online", 1, true)
+	pub.publish(t, "org/org1/available", "yes", 1, true)
+	pub.publish(t, "org/org1/available", "", 1, true) // removes retained message
+
+	sub := newBrokerClient(uri, "sub", "server", "secret", nil)
+	Ok(t, sub.connect())
+	defer sub.client.Disconnect(0)
+	sub.subscribe(t, "org/org1/#", 1)
+
+	messages := sub.waitMessages(1)
+	Equals(t, []receivedMessage{{"org/org1/status", "online", true}}, messages)
+
+	// retained flag is not set for messages delivered to existing
+	// subscriptions
+	pub.publish(t, "org/org1/status", "offline", 1, true)
+	messages = sub.waitMessages(2)
+	Equals(t, receivedMessage{"org/org1/status", "offline", false}, messages[1])
+}
+
+func TestMqttBrokerWill(t *testing.T) {
+	broker, uri := startBroker(t, nil)
+	defer broker.Stop()
+
+	sub := newBrokerClient(uri, "sub", "server", "secret", nil)
+	Ok(t, sub.connect())
+	defer sub.client.Disconnect(0)
+	sub.subscribe(t, "piot/status", 1)
+
+	// will of cleanly disconnected client is not published
+	c := newBrokerClient(uri, "client1", "server", "secret", func(opts *mqttclient.ClientOptions) {
+		opts.SetWill("piot/status", "offline1", 1, false)
+	})
+	Ok(t, c.connect())
+	c.client.Disconnect(250)
+
+	// will is published when connection is lost (here client id is taken
+	// over by new connection)
+	c = newBrokerClient(uri, "client2", "server", "secret", func(opts *mqttclient.ClientOptions) {
+		opts.SetWill("piot/status", "offline2", 1, false)
+	})
+	Ok(t, c.connect())
+	takeover := newBrokerClient(uri, "client2", "server", "secret", nil)
+	Ok(t, takeover.connect())
+	defer takeover.client.Disconnect(0)
+
+	messages := sub.waitMessages(1)
+	Equals(t, []receivedMessage{{"piot/status", "offline2", false}}, messages)
+}
+
+func TestMqttBrokerOrgAcl(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+	orgs := GetOrgs(t, log, db)
+
+	CleanDb(t, db)
+	org1Id := CreateOrg(t, db, "org1")
+	SetOrgMqttCredentials(t, db, org1Id, "user1", "pass1")
+	org2Id := CreateOrg(t, db, "org2")
+	SetOrgMqttCredentials(t, db, org2Id, "user2", "pass2")
+	org3Id := CreateOrg(t, db, "org3")
+	SetOrgMqttCredentials(t, db, org3Id, "user3", "")
+
+	broker, uri := startBroker(t, orgs)
+	defer broker.Stop()
+
+	c := newBrokerClient(uri, "org1-bad", "user1", "pass2", nil)
+	Assert(t, c.connect() != nil, "connect with password of other org must fail")
+
+	c = newBrokerClient(uri, "org3", "user3", "", nil)
+	Assert(t, c.connect() != nil, "connect of org without password must fail")
+
+	// will outside of org is refused
+	c = newBrokerClient(uri, "org1-will", "user1", "pass1", func(opts *mqttclient.ClientOptions) {
+		opts.SetWill("org/org2/status", "offline", 1, false)
+	})
+	Assert(t, c.connect() != nil, "connect with will outside of org must fail")
+
+	org1 := newBrokerClient(uri, "org1", "user1", "pass1", nil)
+	Ok(t, org1.connect())
+	defer org1.client.Disconnect(0)
+
+	org2 := newBrokerClient(uri, "org2", "user2", "pass2", nil)
+	Ok(t, org2.connect())
+	defer org2.client.Disconnect(0)
+
+	server := newBrokerClient(uri, "server", "server", "secret", nil)
+	Ok(t, server.connect())
+	defer server.client.Disconnect(0)
+
+	// orgs can subscribe to their topics only
+	Equals(t, byte(1), org1.subscribe(t, "org/org1/#", 1))
+	Equals(t, byte(0x80), org1.subscribe(t, "org/org2/#", 1))
+	Equals(t, byte(0x80), org1.subscribe(t, "org/#", 1))
+	Equals(t, byte(0x80), org1.subscribe(t, "#", 1))
+	Equals(t, byte(0x80), org1.subscribe(t, "org/+/value", 1))
+	Equals(t, byte(1), org2.subscribe(t, "org/org2/+", 1))
+	Equals(t, byte(1), server.subscribe(t, "#", 1))
+
+	// publishing outside of org is dropped
+	org2.publish(t, "org/org1/value", "from org2", 1, false)
+	org2.publish(t, "homeassistant/sensor/x/config", "{}", 1, false)
+	org2.publish(t, "org/org2/value", "2", 1, false)
+	org1.publish(t, "org/org1/value", "1", 1, false)
+
+	Equals(t, []receivedMessage{{"org/org1/value", "1", false}}, org1.waitMessages(1))
+	Equals(t, []receivedMessage{{"org/org2/value", "2", false}}, org2.waitMessages(1))
+	Equals(t, []receivedMessage{
+		{"org/org2/value", "2", false},
+		{"org/org1/value", "1", false},
+	}, server.waitMessages(2))
+}
+
+// clients of orgs can subscribe to server status topic, but they cannot
+// publish to it
+func TestMqttBrokerStatusAcl(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+	orgs := GetOrgs(t, log, db)
+
+	CleanDb(t, db)
+	org1Id := CreateOrg(t, db, "org1")
+	SetOrgMqttCredentials(t, db, org1Id, "user1", "pass1")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := main.NewMqttBroker(log, orgs, "server", "secret")
+	broker.SetStatusTopic("piot/status")
+	broker.Serve(listener)
+	defer broker.Stop()
+	uri := fmt.Sprintf("tcp://%s", listener.Addr().String())
+
+	org1 := newBrokerClient(uri, "org1", "user1", "pass1", nil)
+	Ok(t, org1.connect())
+	defer org1.client.Disconnect(0)
+
+	server := newBrokerClient(uri, "server", "server", "secret", nil)
+	Ok(t, server.connect())
+	defer server.client.Disconnect(0)
+
+	Equals(t, byte(1), org1.subscribe(t, "piot/status", 1))
+	Equals(t, byte(0x80), org1.subscribe(t, "piot/#", 1))
+
+	org1.publish(t, "piot/status", "forged", 1, false)
+	server.publish(t, "piot/status", "online", 1, false)
+
+	Equals(t, []receivedMessage{{"piot/status", "online", false}}, org1.waitMessages(1))
+}
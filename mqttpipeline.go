@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"piot-server/config"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+// policies applied to incoming messages when queue of worker is full
+const MQTT_QUEUE_POLICY_BLOCK = "block"
+const MQTT_QUEUE_POLICY_DROP = "drop"
+
+// default time for which block policy waits for free space in the queue,
+// reception of all messages is paused while waiting (the wait runs in
+// callback of mqtt client)
+const MQTT_QUEUE_BLOCK_TIMEOUT = time.Second
+
+type pipelineMessage struct {
+	topic    string
+	payload  string
+	received time.Time
+}
+
+// Summary of pipeline state, latencies are measured from reception of
+// message to end of its processing
+type MqttPipelineStats struct {
+	Workers       int
+	QueueDepth    int
+	QueueCapacity int
+	Processed     uint64
+	Dropped       uint64
+
+	// latencies of messages processed since previous call of Stats
+	LatencyAvg time.Duration
+	LatencyMax time.Duration
+}
+
+func (s MqttPipelineStats) String() string {
+	return fmt.Sprintf("workers: %d, queue: %d/%d, processed: %d, dropped: %d, latency avg: %s, latency max: %s",
+		s.Workers, s.QueueDepth, s.QueueCapacity, s.Processed, s.Dropped, s.LatencyAvg, s.LatencyMax)
+}
+
+// Processes MQTT messages concurrently by pool of workers. Each worker has
+// its own bounded queue, messages of the same thing (topics sharing org and
+// first segment of thing topic) are always processed by the same worker, so
+// their order is preserved.
+type MqttPipeline struct {
+	log     *logging.Logger
+	process func(topic, payload string)
+	policy  string
+	queues  []chan pipelineMessage
+	wg      sync.WaitGroup
+
+	// maximal wait for free space in queue (block policy)
+	BlockTimeout time.Duration
+
+	// guards queues against submission of messages after stop
+	stopMutex sync.RWMutex
+	stopped   bool
+
+	mutex        sync.Mutex
+	processed    uint64
+	dropped      uint64
+	latencySum   time.Duration
+	latencyCount int64
+	latencyMax   time.Duration
+}
+
+func NewMqttPipeline(log *logging.Logger, params *config.Parameters, process func(topic, payload string)) (*MqttPipeline, error) {
+
+	if params.MqttWorkers < 1 || params.MqttQueueSize < 1 {
+		return nil, fmt.Errorf("invalid mqtt pipeline size (workers: %d, queue: %d)", params.MqttWorkers, params.MqttQueueSize)
+	}
+
+	if params.MqttQueuePolicy != MQTT_QUEUE_POLICY_BLOCK && params.MqttQueuePolicy != MQTT_QUEUE_POLICY_DROP {
+		return nil, fmt.Errorf("unknown mqtt queue policy %s", params.MqttQueuePolicy)
+	}
+
+	p := &MqttPipeline{log: log, process: process, policy: params.MqttQueuePolicy, BlockTimeout: MQTT_QUEUE_BLOCK_TIMEOUT}
+
+	for i := 0; i < params.MqttWorkers; i++ {
+		p.queues = append(p.queues, make(chan pipelineMessage, params.MqttQueueSize))
+	}
+
+	return p, nil
+}
+
+// Start runs workers
+func (p *MqttPipeline) Start() {
+	for _, queue := range p.queues {
+		p.wg.Add(1)
+		go p.work(queue)
+	}
+}
+
+// Stop waits until all queued messages are processed and stops workers,
+// messages submitted after stop are dropped
+func (p *MqttPipeline) Stop() {
+	p.stopMutex.Lock()
+	if p.stopped {
+		p.stopMutex.Unlock()
+		return
+	}
+	p.stopped = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.stopMutex.Unlock()
+
+	p.wg.Wait()
+}
+
+// Submit queues message for processing. If queue of the worker is full,
+// the call waits for free space at most BlockTimeout (block policy) or the
+// message is dropped immediately (drop policy). Returns false if message
+// was dropped.
+func (p *MqttPipeline) Submit(topic, payload string) bool {
+	p.stopMutex.RLock()
+	defer p.stopMutex.RUnlock()
+
+	if p.stopped {
+		p.drop(topic, "pipeline is stopped")
+		return false
+	}
+
+	queue := p.queues[p.worker(topic)]
+	msg := pipelineMessage{topic, payload, time.Now()}
+
+	select {
+	case queue <- msg:
+		return true
+	default:
+	}
+
+	if p.policy == MQTT_QUEUE_POLICY_BLOCK {
+		timer := time.NewTimer(p.BlockTimeout)
+		defer timer.Stop()
+
+		select {
+		case queue <- msg:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	p.drop(topic, "queue is full")
+	return false
+}
+
+func (p *MqttPipeline) drop(topic, reason string) {
+	p.mutex.Lock()
+	p.dropped++
+	p.mutex.Unlock()
+	p.log.Debugf("Dropping MQTT message (topic: %s), %s", topic, reason)
+}
+
+// Counters returns summary of pipeline state without latencies, it doesn't
+// affect latencies reported by Stats
+func (p *MqttPipeline) Counters() MqttPipelineStats {
+	stats := MqttPipelineStats{Workers: len(p.queues)}
+
+	for _, queue := range p.queues {
+		stats.QueueDepth += len(queue)
+		stats.QueueCapacity += cap(queue)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stats.Processed = p.processed
+	stats.Dropped = p.dropped
+
+	return stats
+}
+
+// Stats returns summary of pipeline state
+func (p *MqttPipeline) Stats() MqttPipelineStats {
+	stats := p.Counters()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.latencyCount > 0 {
+		stats.LatencyAvg = p.latencySum / time.Duration(p.latencyCount)
+	}
+	stats.LatencyMax = p.latencyMax
+
+	p.latencySum = 0
+	p.latencyCount = 0
+	p.latencyMax = 0
+
+	return stats
+}
+
+func (p *MqttPipeline) work(queue chan pipelineMessage) {
+	defer p.wg.Done()
+
+	for msg := range queue {
+		p.process(msg.topic, msg.payload)
+
+		latency := time.Since(msg.received)
+
+		p.mutex.Lock()
+		p.processed++
+		p.latencySum += latency
+		p.latencyCount++
+		if latency > p.latencyMax {
+			p.latencyMax = latency
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// worker returns index of worker responsible for topic, topics are
+// distributed according to org and thing part (e.g. org/org1/thing1)
+func (p *MqttPipeline) worker(topic string) int {
+	parts := strings.SplitN(topic, "/", 4)
+	if len(parts) > 3 {
+		parts = parts[:3]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(parts, "/")))
+
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
@@ -0,0 +1,190 @@
+package main_test
+
+import (
+	"fmt"
+	main "piot-server"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getPipeline(t *testing.T, workers, queueSize int, policy string, process func(topic, payload string)) *main.MqttPipeline {
+	cfg := GetConfig()
+	cfg.MqttWorkers = workers
+	cfg.MqttQueueSize = queueSize
+	cfg.MqttQueuePolicy = policy
+
+	pipeline, err := main.NewMqttPipeline(GetLogger(t), cfg, process)
+	Ok(t, err)
+
+	return pipeline
+}
+
+func TestMqttPipelineInvalidParams(t *testing.T) {
+	cfg := GetConfig()
+	cfg.MqttWorkers = 0
+	_, err := main.NewMqttPipeline(GetLogger(t), cfg, func(topic, payload string) {})
+	Fail(t, err)
+
+	cfg = GetConfig()
+	cfg.MqttQueuePolicy = "xyz"
+	_, err = main.NewMqttPipeline(GetLogger(t), cfg, func(topic, payload string) {})
+	Fail(t, err)
+}
+
+// messages of the same thing are processed in order of reception
+func TestMqttPipelineOrder(t *testing.T) {
+	var mutex sync.Mutex
+	received := make(map[string][]int)
+
+	pipeline := getPipeline(t, 4, 10, main.MQTT_QUEUE_POLICY_BLOCK, func(topic, payload string) {
+		thing := strings.Split(topic, "/")[2]
+		value, _ := strconv.Atoi(payload)
+
+		mutex.Lock()
+		received[thing] = append(received[thing], value)
+		mutex.Unlock()
+	})
+	pipeline.Start()
+
+	// value and unit topics of the same thing are interleaved
+	for i := 0; i < 100; i++ {
+		for thing := 0; thing < 10; thing++ {
+			topic := fmt.Sprintf("org/org1/thing%d/value", thing)
+			if i%2 == 1 {
+				topic += "/unit"
+			}
+			pipeline.Submit(topic, strconv.Itoa(i))
+		}
+	}
+
+	pipeline.Stop()
+
+	Equals(t, 10, len(received))
+	for thing, values := range received {
+		Equals(t, 100, len(values))
+		for i, value := range values {
+			Assert(t, value == i, "message %d of thing %s processed out of order (%d)", i, thing, value)
+		}
+	}
+
+	stats := pipeline.Stats()
+	Equals(t, uint64(1000), stats.Processed)
+	Equals(t, uint64(0), stats.Dropped)
+	Equals(t, 0, stats.QueueDepth)
+	Equals(t, 40, stats.QueueCapacity)
+}
+
+// slow processing of one thing doesn't stall processing of other things
+func TestMqttPipelineConcurrency(t *testing.T) {
+	release := make(chan bool)
+
+	pipeline := getPipeline(t, 4, 10, main.MQTT_QUEUE_POLICY_BLOCK, func(topic, payload string) {
+		if payload == "slow" {
+			<-release
+		}
+	})
+	pipeline.Start()
+
+	pipeline.Submit("org/org1/slow/value", "slow")
+
+	// things are distributed to all workers, messages of things that share
+	// worker with slow thing wait in queue
+	for i := 0; i < 20; i++ {
+		pipeline.Submit(fmt.Sprintf("org/org1/thing%d/value", i), "fast")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for pipeline.Stats().Processed == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	Assert(t, pipeline.Stats().Processed > 0, "no messages processed while one worker is busy")
+
+	close(release)
+	pipeline.Stop()
+
+	Equals(t, uint64(21), pipeline.Stats().Processed)
+}
+
+// messages are dropped when queue is full and drop policy is configured
+func TestMqttPipelineDrop(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	pipeline := getPipeline(t, 1, 1, main.MQTT_QUEUE_POLICY_DROP, func(topic, payload string) {
+		if payload == "1" {
+			started <- true
+			<-release
+		}
+	})
+	pipeline.Start()
+
+	// first message is processed by worker
+	Equals(t, true, pipeline.Submit("org/org1/thing1/value", "1"))
+	<-started
+
+	// second message waits in queue, third one is dropped
+	Equals(t, true, pipeline.Submit("org/org1/thing1/value", "2"))
+	Equals(t, false, pipeline.Submit("org/org1/thing1/value", "3"))
+
+	stats := pipeline.Stats()
+	Equals(t, 1, stats.QueueDepth)
+	Equals(t, uint64(1), stats.Dropped)
+
+	close(release)
+	pipeline.Stop()
+
+	stats = pipeline.Stats()
+	Equals(t, uint64(2), stats.Processed)
+	Equals(t, uint64(1), stats.Dropped)
+	Assert(t, stats.LatencyMax > 0, "latency of processed messages is not measured")
+}
+
+// block policy waits for free space in queue for limited time only, the
+// message is dropped then
+func TestMqttPipelineBlockTimeout(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+
+	pipeline := getPipeline(t, 1, 1, main.MQTT_QUEUE_POLICY_BLOCK, func(topic, payload string) {
+		if payload == "1" {
+			started <- true
+			<-release
+		}
+	})
+	pipeline.BlockTimeout = 100 * time.Millisecond
+	pipeline.Start()
+
+	Equals(t, true, pipeline.Submit("org/org1/thing1/value", "1"))
+	<-started
+	Equals(t, true, pipeline.Submit("org/org1/thing1/value", "2"))
+
+	start := time.Now()
+	Equals(t, false, pipeline.Submit("org/org1/thing1/value", "3"))
+	Assert(t, time.Since(start) >= 100*time.Millisecond, "message is dropped without waiting")
+	Equals(t, uint64(1), pipeline.Counters().Dropped)
+
+	close(release)
+	pipeline.Stop()
+
+	Equals(t, uint64(2), pipeline.Counters().Processed)
+}
+
+// messages submitted after stop are dropped, stop can be called repeatedly
+func TestMqttPipelineSubmitStopped(t *testing.T) {
+	pipeline := getPipeline(t, 2, 10, main.MQTT_QUEUE_POLICY_BLOCK, func(topic, payload string) {})
+	pipeline.Start()
+
+	Equals(t, true, pipeline.Submit("org/org1/thing1/value", "1"))
+	pipeline.Stop()
+	pipeline.Stop()
+
+	Equals(t, false, pipeline.Submit("org/org1/thing1/value", "2"))
+
+	stats := pipeline.Counters()
+	Equals(t, uint64(1), stats.Processed)
+	Equals(t, uint64(1), stats.Dropped)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/op/go-logging"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// how often changes of orgs are checked and how often sessions are
+// reconciled with database regardless of changes (e.g. orgs removed
+// directly in database, failed connections)
+const MQTT_SESSIONS_CHECK_INTERVAL = time.Second
+const MQTT_SESSIONS_RESYNC_INTERVAL = time.Minute
+
+// connects client to broker with given identity, client subscribes to topic
+// (if not empty) on each connection and publishes server status to status
+// topic (if not empty)
+type mqttConnectFunc func(clientId string, username, password *string, topic, statusTopic string) (mqtt.Client, error)
+
+type mqttSession struct {
+	orgName     string
+	username    string
+	password    string
+	statusTopic string
+	client      mqtt.Client
+}
+
+// Manages MQTT sessions of orgs. Each org with MQTT credentials has its own
+// connection to broker authenticated by org credentials and subscribed to
+// topics of the org only, so broker ACLs isolate orgs from each other.
+// Sessions are opened, reopened (e.g. credentials were changed) and closed
+// as orgs are created, updated and removed.
+type MqttSessions struct {
+	log       *logging.Logger
+	orgs      *Orgs
+	clientId  string
+	subscribe bool
+	status    string
+	connect   mqttConnectFunc
+
+	mutex    sync.RWMutex
+	sessions map[primitive.ObjectID]*mqttSession
+
+	syncMutex  sync.Mutex
+	generation uint64
+	synced     time.Time
+
+	stop chan bool
+	wg   sync.WaitGroup
+}
+
+// NewMqttSessions creates sessions manager, status is topic of server status
+// relative to org root (empty value disables status)
+func NewMqttSessions(log *logging.Logger, orgs *Orgs, clientId string, subscribe bool, status string, connect mqttConnectFunc) *MqttSessions {
+	return &MqttSessions{
+		log:       log,
+		orgs:      orgs,
+		clientId:  clientId,
+		subscribe: subscribe,
+		status:    status,
+		connect:   connect,
+		sessions:  make(map[primitive.ObjectID]*mqttSession),
+	}
+}
+
+// Start opens sessions of all orgs and starts watching changes of orgs
+func (s *MqttSessions) Start() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+
+	s.stop = make(chan bool)
+	s.wg.Add(1)
+	go s.watch()
+
+	return nil
+}
+
+// Stop stops watching changes of orgs and closes all sessions
+func (s *MqttSessions) Stop() {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+		s.stop = nil
+	}
+
+	s.mutex.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[primitive.ObjectID]*mqttSession)
+	s.mutex.Unlock()
+
+	for _, session := range sessions {
+		s.close(session)
+	}
+}
+
+// Client returns client of org session or nil if org has no session
+func (s *MqttSessions) Client(orgId primitive.ObjectID) mqtt.Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if session, ok := s.sessions[orgId]; ok {
+		return session.client
+	}
+
+	return nil
+}
+
+// Clients returns clients of all sessions
+func (s *MqttSessions) Clients() []mqtt.Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := []mqtt.Client{}
+	for _, session := range s.sessions {
+		result = append(result, session.client)
+	}
+
+	return result
+}
+
+// StatusClients returns clients of sessions by their status topics
+func (s *MqttSessions) StatusClients() map[string]mqtt.Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := make(map[string]mqtt.Client)
+	for _, session := range s.sessions {
+		if session.statusTopic != "" {
+			result[session.statusTopic] = session.client
+		}
+	}
+
+	return result
+}
+
+// Sync reconciles sessions with orgs stored in database. Sessions that
+// failed to connect are retried on next sync.
+func (s *MqttSessions) Sync() error {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	generation := s.orgs.Generation()
+
+	orgs, err := s.orgs.GetAll()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[primitive.ObjectID]*Org)
+	for _, org := range orgs {
+		if org.MqttUsername == "" {
+			s.log.Debugf("Org %s has no MQTT credentials, MQTT session is not opened", org.Name)
+			continue
+		}
+		wanted[org.Id] = org
+	}
+
+	// close sessions of removed orgs and sessions with outdated identity
+	var outdated []*mqttSession
+	s.mutex.Lock()
+	for id, session := range s.sessions {
+		org, ok := wanted[id]
+		if !ok || org.Name != session.orgName || org.MqttUsername != session.username || org.MqttPassword != session.password {
+			outdated = append(outdated, session)
+			delete(s.sessions, id)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, session := range outdated {
+		s.close(session)
+	}
+
+	// open sessions of new orgs
+	for id, org := range wanted {
+		if s.Client(id) != nil {
+			continue
+		}
+
+		topic := ""
+		if s.subscribe {
+			topic = fmt.Sprintf("%s/%s/#", TOPIC_ROOT, org.Name)
+		}
+
+		statusTopic := ""
+		if s.status != "" {
+			statusTopic = fmt.Sprintf("%s/%s/%s", TOPIC_ROOT, org.Name, s.status)
+		}
+
+		s.log.Infof("Opening MQTT session of org %s (user %s)", org.Name, org.MqttUsername)
+
+		username, password := org.MqttUsername, org.MqttPassword
+		client, err := s.connect(fmt.Sprintf("%s-%s", s.clientId, org.Name), &username, &password, topic, statusTopic)
+		if err != nil {
+			s.log.Errorf("Opening MQTT session of org %s failed (%v)", org.Name, err)
+			continue
+		}
+
+		s.mutex.Lock()
+		s.sessions[id] = &mqttSession{org.Name, username, password, statusTopic, client}
+		s.mutex.Unlock()
+	}
+
+	s.generation = generation
+	s.synced = time.Now()
+
+	return nil
+}
+
+func (s *MqttSessions) watch() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(MQTT_SESSIONS_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.syncMutex.Lock()
+			outdated := s.generation != s.orgs.Generation() || time.Since(s.synced) >= MQTT_SESSIONS_RESYNC_INTERVAL
+			s.syncMutex.Unlock()
+
+			if !outdated {
+				continue
+			}
+
+			if err := s.Sync(); err != nil {
+				s.log.Errorf("Synchronization of MQTT sessions failed (%v)", err)
+			}
+		}
+	}
+}
+
+func (s *MqttSessions) close(session *mqttSession) {
+	s.log.Infof("Closing MQTT session of org %s", session.orgName)
+	session.client.Disconnect(250)
+}
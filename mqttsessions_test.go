@@ -0,0 +1,177 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	main "piot-server"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// waitFor polls condition until it is met or timeout expires
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return true
+}
+
+func TestMqttOrgSessions(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+	orgs := GetOrgs(t, log, db)
+
+	CleanDb(t, db)
+	org1Id := CreateOrg(t, db, "org1")
+	SetOrgMqttCredentials(t, db, org1Id, "user1", "pass1")
+	org2Id := CreateOrg(t, db, "org2")
+	SetOrgMqttCredentials(t, db, org2Id, "user2", "pass2")
+	CreateOrg(t, db, "org3") // org without credentials has no session
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := StartMqttBroker(t, listener)
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), log, GetThings(t, log, db), orgs, nil, nil, nil)
+	mqtt.SetClient("piot-server")
+	mqtt.SetOrgSessions(true)
+	Ok(t, mqtt.Connect(true))
+	defer mqtt.Disconnect()
+
+	// each session is authenticated by org credentials and subscribed to
+	// topics of its org only
+	subscribed := func() bool {
+		for _, c := range broker.Conns() {
+			if c.Connected && len(c.Subscriptions) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	Assert(t, waitFor(5*time.Second, subscribed), "sessions are not subscribed")
+
+	Equals(t, map[string]int{"user1": 1, "user2": 1}, broker.ActiveUsers())
+	for _, c := range broker.Conns() {
+		switch c.Username {
+		case "user1":
+			Equals(t, "piot-server-org1", c.ClientId)
+			Equals(t, "pass1", c.Password)
+			Equals(t, []string{"org/org1/#"}, c.Subscriptions)
+		case "user2":
+			Equals(t, "piot-server-org2", c.ClientId)
+			Equals(t, []string{"org/org2/#"}, c.Subscriptions)
+		}
+	}
+
+	// password of org1 is changed, org2 is removed
+	SetOrgMqttCredentials(t, db, org1Id, "user1", "pass1new")
+	_, err = db.Collection("orgs").DeleteOne(context.TODO(), bson.M{"_id": org2Id})
+	Ok(t, err)
+	orgs.Changed()
+
+	reconnected := func() bool {
+		for _, c := range broker.Conns() {
+			if c.Connected && (c.Username != "user1" || c.Password != "pass1new") {
+				return false
+			}
+		}
+		return len(broker.ActiveUsers()) == 1
+	}
+	Assert(t, waitFor(5*time.Second, reconnected), "sessions are not synchronized with orgs")
+}
+
+// messages outside of org topics are published with identity of server
+func TestMqttOrgSessionsPublish(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+	orgs := GetOrgs(t, log, db)
+
+	CleanDb(t, db)
+	orgId := CreateOrg(t, db, "org1")
+	SetOrgMqttCredentials(t, db, orgId, "user1", "pass1")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := StartMqttBroker(t, listener)
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), log, GetThings(t, log, db), orgs, nil, nil, nil)
+	mqtt.SetClient("piot-server")
+	mqtt.SetUsername("server")
+	mqtt.SetPassword("secret")
+	mqtt.SetOrgSessions(true)
+	Ok(t, mqtt.Connect(true))
+	defer mqtt.Disconnect()
+
+	Ok(t, mqtt.Publish("homeassistant/sensor/piot/1/config", "{}", true))
+
+	Equals(t, map[string]int{"user1": 1, "server": 1}, broker.ActiveUsers())
+	for _, c := range broker.Conns() {
+		if c.Username == "server" {
+			Equals(t, "piot-server", c.ClientId)
+			Equals(t, "secret", c.Password)
+			Equals(t, 0, len(c.Subscriptions))
+		}
+	}
+
+	published := func() bool {
+		for _, msg := range broker.Messages() {
+			if msg.Topic == "homeassistant/sensor/piot/1/config" {
+				return true
+			}
+		}
+		return false
+	}
+	Assert(t, waitFor(5*time.Second, published), "message is not published")
+}
+
+// with sessions of orgs server status is published under topics of each org
+// and it is configured as last will of org sessions
+func TestMqttOrgSessionsStatus(t *testing.T) {
+	log := GetLogger(t)
+	db := GetDb(t)
+
+	CleanDb(t, db)
+	org1Id := CreateOrg(t, db, "org1")
+	SetOrgMqttCredentials(t, db, org1Id, "user1", "pass1")
+	org2Id := CreateOrg(t, db, "org2")
+	SetOrgMqttCredentials(t, db, org2Id, "user2", "pass2")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Ok(t, err)
+	broker := StartMqttBroker(t, listener)
+
+	mqtt := main.NewMqtt(fmt.Sprintf("tcp://%s", listener.Addr().String()), log, GetThings(t, log, db), GetOrgs(t, log, db), nil, nil, nil)
+	mqtt.SetClient("piot-server")
+	mqtt.SetOrgSessions(true)
+	mqtt.SetStatusTopic("piot/status", 0)
+	Ok(t, mqtt.Connect(false))
+	defer mqtt.Disconnect()
+
+	wills := make(map[string]string)
+	for _, c := range broker.Conns() {
+		Assert(t, c.Will != nil, "last will is not configured")
+		Equals(t, true, c.Will.Retain)
+		wills[c.ClientId] = c.Will.Topic
+	}
+	Equals(t, map[string]string{
+		"piot-server-org1": "org/org1/piot/status",
+		"piot-server-org2": "org/org2/piot/status",
+	}, wills)
+
+	published := func() bool { return len(broker.Messages()) >= 2 }
+	Assert(t, waitFor(5*time.Second, published), "server status is not published")
+
+	topics := make(map[string]bool)
+	for _, msg := range broker.Messages() {
+		Equals(t, true, msg.Retain)
+		topics[msg.Topic] = true
+	}
+	Equals(t, map[string]bool{"org/org1/piot/status": true, "org/org2/piot/status": true}, topics)
+}
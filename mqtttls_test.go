@@ -0,0 +1,153 @@
+package main_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	main "piot-server"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// createCert generates certificate signed by parent (self-signed if parent
+// is nil) and stores it with its key to PEM files
+func createCert(t *testing.T, dir, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Ok(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	Ok(t, err)
+	cert, err := x509.ParseCertificate(der)
+	Ok(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Ok(t, err)
+
+	result := &testCert{cert: cert, key: key}
+	result.certFile = filepath.Join(dir, name+".crt")
+	result.keyFile = filepath.Join(dir, name+".key")
+	Ok(t, ioutil.WriteFile(result.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	Ok(t, ioutil.WriteFile(result.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return result
+}
+
+// startTLSBroker runs MQTT broker with TLS listener requiring client
+// certificates signed by ca
+func startTLSBroker(t *testing.T, ca, server *testCert) string {
+	cert, err := tls.LoadX509KeyPair(server.certFile, server.keyFile)
+	Ok(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	Ok(t, err)
+
+	StartMqttBroker(t, listener)
+
+	return fmt.Sprintf("tls://%s", listener.Addr().String())
+}
+
+func connectTLS(t *testing.T, uri string, config *tls.Config) error {
+	mqtt := main.NewMqtt(uri, GetLogger(t), nil, nil, nil, nil, nil)
+	mqtt.SetClient("piot-server-test")
+	mqtt.SetTLSConfig(config)
+
+	err := mqtt.Connect(false)
+	if err == nil {
+		mqtt.Disconnect()
+	}
+
+	return err
+}
+
+func TestMqttTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := createCert(t, dir, "ca", nil, true)
+	server := createCert(t, dir, "broker.local", ca, false)
+	client := createCert(t, dir, "client", ca, false)
+
+	uri := startTLSBroker(t, ca, server)
+
+	// mutual authentication, broker certificate is verified for server name
+	config, err := main.NewMqttTLSConfig(ca.certFile, client.certFile, client.keyFile, "broker.local")
+	Ok(t, err)
+	Ok(t, connectTLS(t, uri, config))
+
+	// broker requires client certificate
+	config, err = main.NewMqttTLSConfig(ca.certFile, "", "", "broker.local")
+	Ok(t, err)
+	Fail(t, connectTLS(t, uri, config))
+
+	// server name doesn't match broker certificate
+	config, err = main.NewMqttTLSConfig(ca.certFile, client.certFile, client.keyFile, "other.local")
+	Ok(t, err)
+	Fail(t, connectTLS(t, uri, config))
+
+	// broker certificate is not signed by trusted CA
+	otherCa := createCert(t, dir, "otherca", nil, true)
+	config, err = main.NewMqttTLSConfig(otherCa.certFile, client.certFile, client.keyFile, "broker.local")
+	Ok(t, err)
+	Fail(t, connectTLS(t, uri, config))
+}
+
+func TestMqttTLSInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := createCert(t, dir, "ca", nil, true)
+	client := createCert(t, dir, "client", ca, false)
+
+	// missing files
+	_, err := main.NewMqttTLSConfig(filepath.Join(dir, "missing.crt"), "", "", "")
+	Fail(t, err)
+	_, err = main.NewMqttTLSConfig("", filepath.Join(dir, "missing.crt"), client.keyFile, "")
+	Fail(t, err)
+
+	// file without certificates
+	_, err = main.NewMqttTLSConfig(client.keyFile, "", "", "")
+	Fail(t, err)
+
+	// certificate without key
+	_, err = main.NewMqttTLSConfig("", client.certFile, "", "")
+	Fail(t, err)
+}
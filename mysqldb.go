@@ -13,7 +13,7 @@ import (
 type IMysqlDb interface {
 	Open() error
 	Close()
-	StoreMeasurement(thing *Thing, value string)
+	StoreMeasurement(thing *Thing, value string, ts time.Time)
 	StoreSwitchState(thing *Thing, value string)
 }
 
@@ -94,9 +94,9 @@ func (db *MysqlDb) verifyOrg(thing *Thing) *Org {
 	return org
 }
 
-func (db *MysqlDb) getTimestamp(thing *Thing) int32 {
+func (db *MysqlDb) getTimestamp(thing *Thing, t time.Time) int32 {
 	// generate unix timestamp
-	ts := int32(time.Now().Unix())
+	ts := int32(t.Unix())
 
 	// alter timestamp to match low boundary of configured interval
 	if thing.StoreMysqlDbInterval > 0 {
@@ -106,8 +106,8 @@ func (db *MysqlDb) getTimestamp(thing *Thing) int32 {
 	return ts
 }
 
-func (db *MysqlDb) StoreMeasurement(thing *Thing, value string) {
-	db.log.Debugf("Storing measurement to mysql db, thing: %s, val: %s", thing.Name, value)
+func (db *MysqlDb) StoreMeasurement(thing *Thing, value string, t time.Time) {
+	db.log.Debugf("Storing measurement to mysql db, thing: %s, val: %s, ts: %s", thing.Name, value, t)
 
 	// verify if all preconditions are met
 	org := db.verifyOrg(thing)
@@ -122,7 +122,7 @@ func (db *MysqlDb) StoreMeasurement(thing *Thing, value string) {
 		return
 	}
 
-	ts := db.getTimestamp(thing)
+	ts := db.getTimestamp(thing, t)
 
 	query := "INSERT IGNORE INTO piot_sensors (`id`, `org`, `class`, `value`, `time`) VALUES (?, ?, ?, ?, ?)"
 
@@ -157,7 +157,7 @@ func (db *MysqlDb) StoreSwitchState(thing *Thing, value string) {
 		return
 	}
 
-	ts := db.getTimestamp(thing)
+	ts := db.getTimestamp(thing, time.Now())
 
 	query := "INSERT IGNORE INTO piot_switches (`id`, `org`, `value`, `time`) VALUES (?, ?, ?, ?)"
 
@@ -2,6 +2,7 @@ package main_test
 
 import (
 	main "piot-server"
+	"time"
 
 	"github.com/op/go-logging"
 )
@@ -9,6 +10,7 @@ import (
 type mysqlDbMockCall struct {
 	Thing *main.Thing
 	Value string
+	Time  time.Time
 }
 
 // implements IMysqlDb interface
@@ -24,12 +26,12 @@ func (db *MysqlDbMock) Open() error {
 func (db *MysqlDbMock) Close() {
 }
 
-func (db *MysqlDbMock) StoreMeasurement(thing *main.Thing, value string) {
+func (db *MysqlDbMock) StoreMeasurement(thing *main.Thing, value string, ts time.Time) {
 	db.Log.Debugf("Mysqldb mock - store measurement, thing: %s, val: %s", thing.Name, value)
-	db.Calls = append(db.Calls, mysqlDbMockCall{thing, value})
+	db.Calls = append(db.Calls, mysqlDbMockCall{thing, value, ts})
 }
 
 func (db *MysqlDbMock) StoreSwitchState(thing *main.Thing, value string) {
 	db.Log.Debugf("Mysqldb mock - store switch state, thing: %s, val: %s", thing.Name, value)
-	db.Calls = append(db.Calls, mysqlDbMockCall{thing, value})
+	db.Calls = append(db.Calls, mysqlDbMockCall{Thing: thing, Value: value})
 }
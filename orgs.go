@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"sync/atomic"
 
 	"github.com/op/go-logging"
 	"go.mongodb.org/mongo-driver/bson"
@@ -11,6 +12,10 @@ import (
 )
 
 type Orgs struct {
+	// counter of changes of orgs, it has to be first field to be aligned
+	// for atomic operations on 32 bit platforms
+	generation uint64
+
 	log *logging.Logger
 	db  *mongo.Database
 }
@@ -19,6 +24,16 @@ func NewOrgs(log *logging.Logger, db *mongo.Database) *Orgs {
 	return &Orgs{log: log, db: db}
 }
 
+// Changed notifies that orgs were created or modified
+func (t *Orgs) Changed() {
+	atomic.AddUint64(&t.generation, 1)
+}
+
+// Generation returns counter of changes of orgs
+func (t *Orgs) Generation() uint64 {
+	return atomic.LoadUint64(&t.generation)
+}
+
 func (t *Orgs) Get(id primitive.ObjectID) (*Org, error) {
 	t.log.Debugf("Get org: %s", id.Hex())
 
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// encodings of PIOT packets identified by http content type
+const PIOT_CONTENT_JSON = "application/json"
+const PIOT_CONTENT_CBOR = "application/cbor"
+const PIOT_CONTENT_MSGPACK = "application/msgpack"
+
+// PiotContentType maps value of http Content-Type header to one of supported
+// packet encodings, JSON is used if header is missing or unknown
+func PiotContentType(header string) string {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return PIOT_CONTENT_JSON
+	}
+
+	switch mediaType {
+	case PIOT_CONTENT_CBOR:
+		return PIOT_CONTENT_CBOR
+	case PIOT_CONTENT_MSGPACK, "application/x-msgpack", "application/vnd.msgpack":
+		return PIOT_CONTENT_MSGPACK
+	}
+
+	return PIOT_CONTENT_JSON
+}
+
+// PiotDetectContentType guesses encoding of packet from its first byte for
+// transports without content type (e.g. udp). Packet is always map, so it
+// can be distinguished in all supported encodings.
+func PiotDetectContentType(data []byte) string {
+	if len(data) == 0 {
+		return PIOT_CONTENT_JSON
+	}
+
+	b := data[0]
+
+	// cbor map (major type 5)
+	if b>>5 == 5 {
+		return PIOT_CONTENT_CBOR
+	}
+
+	// msgpack fixmap, map16, map32
+	if (b >= 0x80 && b <= 0x8f) || b == 0xde || b == 0xdf {
+		return PIOT_CONTENT_MSGPACK
+	}
+
+	return PIOT_CONTENT_JSON
+}
+
+// PiotDecode decodes packet content of given encoding. Binary encodings are
+// converted to JSON first, so all encodings share the same packet model
+// (field names, short notation, reading values).
+func PiotDecode(contentType string, data []byte, v interface{}) error {
+	if contentType == PIOT_CONTENT_JSON {
+		return json.Unmarshal(data, v)
+	}
+
+	var generic interface{}
+	var err error
+
+	switch contentType {
+	case PIOT_CONTENT_CBOR:
+		err = cbor.Unmarshal(data, &generic)
+	case PIOT_CONTENT_MSGPACK:
+		err = msgpack.Unmarshal(data, &generic)
+	default:
+		return fmt.Errorf("unsupported content type %s", contentType)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	generic, err = piotNormalize(generic)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, v)
+}
+
+// PiotEncode encodes response to device in given encoding
+func PiotEncode(contentType string, v interface{}) ([]byte, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType == PIOT_CONTENT_JSON {
+		return content, nil
+	}
+
+	var generic interface{}
+	if err := json.Unmarshal(content, &generic); err != nil {
+		return nil, err
+	}
+
+	switch contentType {
+	case PIOT_CONTENT_CBOR:
+		return cbor.Marshal(generic)
+	case PIOT_CONTENT_MSGPACK:
+		return msgpack.Marshal(generic)
+	}
+
+	return nil, fmt.Errorf("unsupported content type %s", contentType)
+}
+
+// piotNormalize converts decoded binary content to structures that can be
+// encoded to JSON (maps with string keys)
+func piotNormalize(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("map key %v is not a string", k)
+			}
+			normalized, err := piotNormalize(item)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = normalized
+		}
+		return result, nil
+	case map[string]interface{}:
+		for key, item := range value {
+			normalized, err := piotNormalize(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = normalized
+		}
+		return value, nil
+	case []interface{}:
+		for i, item := range value {
+			normalized, err := piotNormalize(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = normalized
+		}
+		return value, nil
+	}
+
+	return v, nil
+}
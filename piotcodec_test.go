@@ -0,0 +1,101 @@
+package main_test
+
+import (
+	"encoding/json"
+	main "piot-server"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// packet model shared by all encodings
+func getCodecPacket() map[string]interface{} {
+	return map[string]interface{}{
+		"d":       "Device123",
+		"ip":      "192.168.1.1",
+		"time":    1600000000,
+		"c":       12,
+		"ack":     []interface{}{"5f3a1c2e9d1e8a0001a1b2c3"},
+		"r":       []interface{}{map[string]interface{}{"a": "SensorXYZ", "t": 23.5, "h": 40}},
+		"b":       []interface{}{map[string]interface{}{"time": 1600000000, "r": []interface{}{map[string]interface{}{"a": "SensorXYZ", "co2": 450}}}},
+		"unknown": true,
+	}
+}
+
+func TestPiotContentType(t *testing.T) {
+	Equals(t, main.PIOT_CONTENT_JSON, main.PiotContentType(""))
+	Equals(t, main.PIOT_CONTENT_JSON, main.PiotContentType("application/json; charset=utf-8"))
+	Equals(t, main.PIOT_CONTENT_JSON, main.PiotContentType("application/octet-stream"))
+	Equals(t, main.PIOT_CONTENT_CBOR, main.PiotContentType("application/cbor"))
+	Equals(t, main.PIOT_CONTENT_MSGPACK, main.PiotContentType("application/msgpack"))
+	Equals(t, main.PIOT_CONTENT_MSGPACK, main.PiotContentType("application/x-msgpack"))
+}
+
+func TestPiotDetectContentType(t *testing.T) {
+	packet := getCodecPacket()
+
+	cborData, err := cbor.Marshal(packet)
+	Ok(t, err)
+	msgpackData, err := msgpack.Marshal(packet)
+	Ok(t, err)
+
+	Equals(t, main.PIOT_CONTENT_JSON, main.PiotDetectContentType([]byte(`{"d": "Device123"}`)))
+	Equals(t, main.PIOT_CONTENT_JSON, main.PiotDetectContentType([]byte{}))
+	Equals(t, main.PIOT_CONTENT_CBOR, main.PiotDetectContentType(cborData))
+	Equals(t, main.PIOT_CONTENT_MSGPACK, main.PiotDetectContentType(msgpackData))
+}
+
+// binary encodings are decoded to the same packet as json
+func TestPiotDecodeEquivalence(t *testing.T) {
+	packet := getCodecPacket()
+
+	jsonData, err := json.Marshal(packet)
+	Ok(t, err)
+	cborData, err := cbor.Marshal(packet)
+	Ok(t, err)
+	msgpackData, err := msgpack.Marshal(packet)
+	Ok(t, err)
+
+	var fromJson, fromCbor, fromMsgpack main.PiotDevicePacket
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_JSON, jsonData, &fromJson))
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_CBOR, cborData, &fromCbor))
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_MSGPACK, msgpackData, &fromMsgpack))
+
+	Equals(t, fromJson, fromCbor)
+	Equals(t, fromJson, fromMsgpack)
+
+	Equals(t, "Device123", fromCbor.DeviceShort)
+	Equals(t, int32(12), *fromCbor.CounterShort)
+	Equals(t, 23.5, fromCbor.ReadingsShort[0].Values["t"])
+	Equals(t, 450.0, fromMsgpack.BatchShort[0].ReadingsShort[0].Values["co2"])
+
+	// binary content is smaller than json
+	Assert(t, len(cborData) < len(jsonData), "CBOR shall be more compact than JSON")
+	Assert(t, len(msgpackData) < len(jsonData), "MessagePack shall be more compact than JSON")
+}
+
+func TestPiotDecodeInvalid(t *testing.T) {
+	var packet main.PiotDevicePacket
+
+	Assert(t, main.PiotDecode(main.PIOT_CONTENT_CBOR, []byte("Device123:xxx"), &packet) != nil, "Invalid CBOR shall be rejected")
+	Assert(t, main.PiotDecode(main.PIOT_CONTENT_MSGPACK, []byte("Device123:xxx"), &packet) != nil, "Invalid MessagePack shall be rejected")
+
+	// maps with non string keys
+	data, err := cbor.Marshal(map[int]string{1: "Device123"})
+	Ok(t, err)
+	Assert(t, main.PiotDecode(main.PIOT_CONTENT_CBOR, data, &packet) != nil, "Map with integer keys shall be rejected")
+}
+
+func TestPiotEncode(t *testing.T) {
+	response := main.PiotDeviceResponse{Commands: []main.PiotDeviceCommand{{Id: "1", Name: "led", Value: "on"}}}
+
+	for _, contentType := range []string{main.PIOT_CONTENT_JSON, main.PIOT_CONTENT_CBOR, main.PIOT_CONTENT_MSGPACK} {
+		data, err := main.PiotEncode(contentType, response)
+		Ok(t, err)
+
+		var decoded main.PiotDeviceResponse
+		Ok(t, main.PiotDecode(contentType, data, &decoded))
+		Equals(t, response, decoded)
+	}
+}
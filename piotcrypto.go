@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// separator of device id and encrypted content in sealed packet
+const PIOT_ENVELOPE_SEPARATOR = ':'
+
+// maximal length of device id in sealed packet
+const PIOT_ENVELOPE_MAX_DEVICE_LEN = 64
+
+// PiotParseKey decodes hex encoded device key, the key length must match
+// one of AES variants (128, 192 or 256 bits)
+func PiotParseKey(key string) ([]byte, error) {
+	k, err := hex.DecodeString(key)
+	if err != nil {
+		return nil, errors.New("key is not hex encoded")
+	}
+
+	if len(k) != 16 && len(k) != 24 && len(k) != 32 {
+		return nil, errors.New("key must have 16, 24 or 32 bytes")
+	}
+
+	return k, nil
+}
+
+// PiotOpenEnvelope splits sealed packet into cleartext device id and
+// encrypted content. Sealed packet has format:
+//
+//	<device id>:<nonce (12 bytes)><ciphertext><tag (16 bytes)>
+func PiotOpenEnvelope(data []byte) (string, []byte, bool) {
+
+	limit := len(data)
+	if limit > PIOT_ENVELOPE_MAX_DEVICE_LEN+1 {
+		limit = PIOT_ENVELOPE_MAX_DEVICE_LEN + 1
+	}
+
+	pos := bytes.IndexByte(data[:limit], PIOT_ENVELOPE_SEPARATOR)
+	if pos <= 0 {
+		return "", nil, false
+	}
+
+	// device id must be printable
+	for _, c := range data[:pos] {
+		if c < 0x21 || c > 0x7e {
+			return "", nil, false
+		}
+	}
+
+	return string(data[:pos]), data[pos+1:], true
+}
+
+// PiotSeal encrypts and authenticates content by AES-GCM, device id
+// is authenticated as additional data
+func PiotSeal(key []byte, device string, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	result := append([]byte(device), PIOT_ENVELOPE_SEPARATOR)
+	result = append(result, nonce...)
+
+	return gcm.Seal(result, nonce, plain, []byte(device)), nil
+}
+
+// PiotOpen verifies and decrypts content encrypted by AES-GCM
+func PiotOpen(key []byte, device string, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, errors.New("encrypted content is too short")
+	}
+
+	nonce := data[:gcm.NonceSize()]
+
+	plain, err := gcm.Open(nil, nonce, data[gcm.NonceSize():], []byte(device))
+	if err != nil {
+		return nil, errors.New("authentication of encrypted content failed")
+	}
+
+	return plain, nil
+}
+
+// PiotDecryptLegacy decrypts content encrypted by AES-128 in ECB mode with
+// PKCS#7 padding. This mode is kept for compatibility with older devices.
+func PiotDecryptLegacy(password string, data []byte) ([]byte, error) {
+
+	const size = 16
+
+	if len(password) != size {
+		return nil, errors.New("missing or wrong encryption configuration")
+	}
+
+	dataLen := len(data)
+
+	// body shall have length which is multiplication of cipher size (size constant)
+	if dataLen == 0 || dataLen%size != 0 {
+		return nil, errors.New("invalid length of body for decryption")
+	}
+
+	cipher, _ := aes.NewCipher([]byte(password))
+
+	decrypted := make([]byte, dataLen)
+
+	// decrypt by individual blocks
+	for bs, be := 0, size; bs < dataLen; bs, be = bs+size, be+size {
+		cipher.Decrypt(decrypted[bs:be], data[bs:be])
+	}
+
+	// strip pkcs7 padding of the last block
+	stripped, err := pkcs7strip(decrypted, size)
+	if err != nil {
+		return nil, errors.New("wrong PKCS#7 padding of encrypted content")
+	}
+
+	return stripped, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// pkcs7strip remove pkcs7 padding
+func pkcs7strip(data []byte, blockSize int) ([]byte, error) {
+
+	length := len(data)
+
+	// no empty blocks can exist
+	if length == 0 {
+		return nil, errors.New("pkcs7: data is empty")
+	}
+
+	// all bytes are always filled (padding values are always non zero)
+	if length%blockSize != 0 {
+		return nil, errors.New("pkcs7: data is not block-aligned")
+	}
+
+	// get number of bytes used for padding from last block byte
+	padLen := int(data[length-1])
+
+	// generate sequence of bytes that should match end of the block
+	ref := bytes.Repeat([]byte{byte(padLen)}, padLen)
+
+	// check if padding is encoded correctly - it must be smaller than block size,
+	// non zero and match generated sequence
+	if padLen > blockSize || padLen == 0 || !bytes.HasSuffix(data, ref) {
+		return nil, errors.New("pkcs7: invalid padding")
+	}
+
+	return data[:length-padLen], nil
+}
@@ -0,0 +1,72 @@
+package main_test
+
+import (
+	"bytes"
+	main "piot-server"
+	"testing"
+)
+
+func TestPiotParseKey(t *testing.T) {
+	_, err := main.PiotParseKey("000102030405060708090a0b0c0d0e0f")
+	Ok(t, err)
+
+	_, err = main.PiotParseKey("000102030405060708090a0b0c0d0e0f1011121314151617")
+	Ok(t, err)
+
+	// wrong length
+	_, err = main.PiotParseKey("0001020304")
+	Fail(t, err)
+
+	// not hex
+	_, err = main.PiotParseKey("xx0102030405060708090a0b0c0d0e0f")
+	Fail(t, err)
+}
+
+func TestPiotSealOpen(t *testing.T) {
+	key, err := main.PiotParseKey("000102030405060708090a0b0c0d0e0f")
+	Ok(t, err)
+
+	plain := []byte(`{"device": "Device123"}`)
+
+	sealed, err := main.PiotSeal(key, "Device123", plain)
+	Ok(t, err)
+
+	device, content, ok := main.PiotOpenEnvelope(sealed)
+	Assert(t, ok, "Envelope shall be recognized")
+	Equals(t, "Device123", device)
+
+	opened, err := main.PiotOpen(key, device, content)
+	Ok(t, err)
+	Assert(t, bytes.Equal(plain, opened), "Opened content doesn't match")
+
+	// device id is authenticated
+	_, err = main.PiotOpen(key, "Device456", content)
+	Fail(t, err)
+
+	// wrong key
+	otherKey, err := main.PiotParseKey("0f0e0d0c0b0a09080706050403020100")
+	Ok(t, err)
+	_, err = main.PiotOpen(otherKey, device, content)
+	Fail(t, err)
+}
+
+func TestPiotOpenEnvelopeInvalid(t *testing.T) {
+	_, _, ok := main.PiotOpenEnvelope([]byte("no separator"))
+	Assert(t, !ok, "Envelope without separator shall not be recognized")
+
+	_, _, ok = main.PiotOpenEnvelope([]byte(":empty device"))
+	Assert(t, !ok, "Envelope with empty device shall not be recognized")
+
+	_, _, ok = main.PiotOpenEnvelope([]byte("dev ice:content"))
+	Assert(t, !ok, "Envelope with non printable device shall not be recognized")
+}
+
+func TestPiotDecryptLegacyInvalid(t *testing.T) {
+	// wrong password length
+	_, err := main.PiotDecryptLegacy("short", make([]byte, 16))
+	Fail(t, err)
+
+	// not block aligned
+	_, err = main.PiotDecryptLegacy("1234567890123456", make([]byte, 15))
+	Fail(t, err)
+}
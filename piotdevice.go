@@ -1,11 +1,83 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// names of commands that can be delivered to PIOT devices
+const PIOT_COMMAND_INTERVAL = "interval"
+const PIOT_COMMAND_LED = "led"
+const PIOT_COMMAND_REBOOT = "reboot"
+const PIOT_COMMAND_SWITCH = "switch"
+
+// max number of deliveries of command that is not acknowledged by device
+const PIOT_COMMAND_MAX_DELIVERIES = 3
+
+// Reading of single sensor, values are identified by keys of sensor
+// classes (e.g. "t" for temperature)
 type PiotSensorReading struct {
-	Address      string   `json:"address"`
-	AddressShort string   `json:"a"`
-	Temperature  *float32 `json:"t,omitempty"`
-	Humidity     *float32 `json:"h,omitempty"`
-	Pressure     *float32 `json:"p,omitempty"`
+	Address      string
+	AddressShort string
+	Values       map[string]float64
+}
+
+func (r *PiotSensorReading) UnmarshalJSON(data []byte) error {
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return err
+	}
+
+	r.Values = make(map[string]float64)
+
+	for key, raw := range attrs {
+		switch key {
+		case "address":
+			if err := json.Unmarshal(raw, &r.Address); err != nil {
+				return err
+			}
+		case "a":
+			if err := json.Unmarshal(raw, &r.AddressShort); err != nil {
+				return err
+			}
+		default:
+			// values which are not numbers are ignored
+			var value float64
+			if err := json.Unmarshal(raw, &value); err == nil {
+				r.Values[key] = value
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r PiotSensorReading) MarshalJSON() ([]byte, error) {
+	attrs := make(map[string]interface{})
+
+	for key, value := range r.Values {
+		attrs[key] = value
+	}
+
+	if r.Address != "" {
+		attrs["address"] = r.Address
+	}
+	if r.AddressShort != "" {
+		attrs["a"] = r.AddressShort
+	}
+
+	return json.Marshal(attrs)
+}
+
+// Set of sensor readings taken at the same time, used for delivery of
+// readings buffered by device
+type PiotReadingSet struct {
+	Time          *int64              `json:"time,omitempty"`
+	Readings      []PiotSensorReading `json:"readings"`
+	ReadingsShort []PiotSensorReading `json:"r"`
 }
 
 type PiotDevicePacket struct {
@@ -14,6 +86,112 @@ type PiotDevicePacket struct {
 	Ip            *string             `json:"ip,omitempty"`
 	WifiSSID      *string             `json:"wifi-ssid,omitempty"`
 	WifiStrength  *float32            `json:"wifi-strength,omitempty"`
+	Time          *int64              `json:"time,omitempty"`
+	Counter       *int32              `json:"counter,omitempty"`
+	CounterShort  *int32              `json:"c,omitempty"`
 	Readings      []PiotSensorReading `json:"readings"`
 	ReadingsShort []PiotSensorReading `json:"r"`
+	Batch         []PiotReadingSet    `json:"batch,omitempty"`
+	BatchShort    []PiotReadingSet    `json:"b,omitempty"`
+	Ack           []string            `json:"ack,omitempty"`
+}
+
+// deviceId returns device id regardless of notation used by device
+func (packet *PiotDevicePacket) deviceId() string {
+	if len(packet.DeviceShort) > 0 {
+		return packet.DeviceShort
+	}
+	return packet.Device
+}
+
+// Result of batch processing returned to device
+type PiotBatchResult struct {
+	Total    int              `json:"total"`
+	Accepted int              `json:"accepted"`
+	Partial  int              `json:"partial"`
+	Rejected int              `json:"rejected"`
+	Errors   []PiotBatchError `json:"errors,omitempty"`
+
+	// pending commands for device
+	Commands []PiotDeviceCommand `json:"commands,omitempty"`
+}
+
+type PiotBatchError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+func (r *PiotBatchResult) reject(index int, err error) {
+	r.Rejected++
+	r.Errors = append(r.Errors, PiotBatchError{index, err.Error()})
+}
+
+// partial records reading set with some failed readings
+func (r *PiotBatchResult) partial(index int, err error) {
+	r.Partial++
+	r.Errors = append(r.Errors, PiotBatchError{index, err.Error()})
+}
+
+// Command waiting in queue of PIOT device, command is delivered in response
+// to next packet sent by device
+type PiotCommand struct {
+	Id    primitive.ObjectID `json:"id" bson:"id"`
+	Name  string             `json:"name" bson:"name"`
+	Value string             `json:"value" bson:"value"`
+
+	// time of command creation (unix timestamp)
+	Created int32 `json:"created" bson:"created"`
+
+	// time of last delivery of command to device, 0 if not delivered yet
+	Delivered int32 `json:"delivered" bson:"delivered"`
+
+	// number of deliveries, command is delivered again until it is
+	// acknowledged (response to device could be lost)
+	Deliveries int32 `json:"deliveries" bson:"deliveries"`
+
+	// time when device acknowledged the command, 0 if not acknowledged yet
+	Acknowledged int32 `json:"acknowledged" bson:"acknowledged"`
+}
+
+// Command as it is sent to device
+type PiotDeviceCommand struct {
+	Id    string `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// Response sent to device
+type PiotDeviceResponse struct {
+	Commands []PiotDeviceCommand `json:"commands,omitempty"`
+
+	// result of processing for transports without status (udp)
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ValidatePiotCommand checks that command is known and its value is valid
+func ValidatePiotCommand(name, value string) error {
+	switch name {
+	case PIOT_COMMAND_INTERVAL:
+		interval, err := strconv.Atoi(value)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("value of %s command must be positive number of seconds", name)
+		}
+	case PIOT_COMMAND_LED:
+		if value != "on" && value != "off" {
+			return fmt.Errorf("value of %s command must be on or off", name)
+		}
+	case PIOT_COMMAND_REBOOT:
+		if value != "" {
+			return fmt.Errorf("%s command has no value", name)
+		}
+	case PIOT_COMMAND_SWITCH:
+		if value == "" {
+			return fmt.Errorf("value of %s command cannot be empty", name)
+		}
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+
+	return nil
 }
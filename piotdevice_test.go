@@ -0,0 +1,30 @@
+package main_test
+
+import (
+	main "piot-server"
+	"testing"
+)
+
+func TestPiotSensorReadingJson(t *testing.T) {
+	var reading main.PiotSensorReading
+
+	Ok(t, reading.UnmarshalJSON([]byte(`{"a": "Sensor1", "t": 21.5, "co2": 450, "note": "text"}`)))
+	Equals(t, "Sensor1", reading.AddressShort)
+	Equals(t, 2, len(reading.Values))
+	Equals(t, 21.5, reading.Values["t"])
+	Equals(t, 450.0, reading.Values["co2"])
+}
+
+func TestValidatePiotCommand(t *testing.T) {
+	Ok(t, main.ValidatePiotCommand(main.PIOT_COMMAND_INTERVAL, "60"))
+	Ok(t, main.ValidatePiotCommand(main.PIOT_COMMAND_LED, "on"))
+	Ok(t, main.ValidatePiotCommand(main.PIOT_COMMAND_REBOOT, ""))
+	Ok(t, main.ValidatePiotCommand(main.PIOT_COMMAND_SWITCH, "1:on"))
+
+	Assert(t, main.ValidatePiotCommand(main.PIOT_COMMAND_INTERVAL, "0") != nil, "Zero interval shall be rejected")
+	Assert(t, main.ValidatePiotCommand(main.PIOT_COMMAND_INTERVAL, "x") != nil, "Non numeric interval shall be rejected")
+	Assert(t, main.ValidatePiotCommand(main.PIOT_COMMAND_LED, "blink") != nil, "Unknown led state shall be rejected")
+	Assert(t, main.ValidatePiotCommand(main.PIOT_COMMAND_REBOOT, "now") != nil, "Reboot with value shall be rejected")
+	Assert(t, main.ValidatePiotCommand(main.PIOT_COMMAND_SWITCH, "") != nil, "Switch without value shall be rejected")
+	Assert(t, main.ValidatePiotCommand("format", "") != nil, "Unknown command shall be rejected")
+}
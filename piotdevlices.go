@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"piot-server/config"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/op/go-logging"
@@ -14,18 +15,35 @@ import (
 // topic name used for publishing sensor readings
 const PIOT_MEASUREMENT_TOPIC = "value"
 
+// error returned for packets that were already accepted (e.g. captured and
+// re-posted packets)
+var ErrPiotReplay = errors.New("packet counter is not greater than last accepted value")
+
+// error returned for packets exceeding allowed rate
+var ErrPiotRateLimit = errors.New("exceeded dos protection treshold")
+
+// errors returned for packets from devices that are not registered
+var ErrPiotDevicePending = errors.New("device registration is waiting for approval")
+var ErrPiotDeviceUnknown = errors.New("device is not registered")
+
+// policies of registration of unknown devices
+const PIOT_REGISTRATION_AUTO = "auto"
+const PIOT_REGISTRATION_PENDING = "pending"
+const PIOT_REGISTRATION_REJECT = "reject"
+
 type PiotDevices struct {
-	log    *logging.Logger
-	things *Things
-	mqtt   IMqtt
-	params *config.Parameters
-	cache  map[string]time.Time
+	log     *logging.Logger
+	things  *Things
+	mqtt    IMqtt
+	params  *config.Parameters
+	classes *SensorClasses
+	limiter *RateLimiter
 }
 
 // constructor
-func NewPiotDevices(logger *logging.Logger, things *Things, mqtt IMqtt, params *config.Parameters) *PiotDevices {
-	p := PiotDevices{log: logger, things: things, mqtt: mqtt, params: params}
-	p.cache = make(map[string]time.Time)
+func NewPiotDevices(logger *logging.Logger, things *Things, mqtt IMqtt, params *config.Parameters, classes *SensorClasses) *PiotDevices {
+	p := PiotDevices{log: logger, things: things, mqtt: mqtt, params: params, classes: classes}
+	p.limiter = NewRateLimiter(params.DOSInterval, params.DOSBurst, params.DOSMaxEntries)
 	return &p
 }
 
@@ -33,23 +51,14 @@ func (p *PiotDevices) ProcessPacket(packet PiotDevicePacket) error {
 	p.log.Debugf("Process PIOT device packet: %v", packet)
 
 	// handle short notation of attributes (assign short to long attributes)
-	if len(packet.DeviceShort) > 0 {
-		packet.Device = packet.DeviceShort
-	}
-	if len(packet.ReadingsShort) > 0 {
-		packet.Readings = packet.ReadingsShort
-	}
+	packet = p.expandShortNotation(packet)
 
 	// DOS Protection
-	// allow to process data from this packet only if it didn't come too close
-	// to previous packet from the same device (treshold in seconds is defined)
-	if lastSeen, ok := p.cache[packet.Device]; ok {
-		delta := time.Since(lastSeen)
-		p.log.Debugf("Time cache holds entry for device: %s, time diff is %f seconds", packet.Device, delta.Seconds())
-
-		if delta <= p.params.DOSInterval {
-			return errors.New("exceeded dos protection treshold")
-		}
+	// allow to process data from this packet only if device didn't exceed
+	// allowed rate of packets (token bucket per device)
+	if !p.limiter.Allow(packet.Device) {
+		p.log.Warningf("Rejecting packet from device %s, rate limit exceeded (rejected packets: %d)", packet.Device, p.limiter.Rejected())
+		return ErrPiotRateLimit
 	}
 
 	// name of the device cannot be empty
@@ -57,72 +66,364 @@ func (p *PiotDevices) ProcessPacket(packet PiotDevicePacket) error {
 		return errors.New("device name cannot be empty")
 	}
 
-	// store device name to cache together with date it was seen
-	p.cache[packet.Device] = time.Now()
+	// time of the measurement provided by device (optional), zero value
+	// means that readings are live and current time is used
+	ts, err := p.getTime(packet.Device, packet.Time)
+	if err != nil {
+		return err
+	}
 
-	// get instance of Things service and look for the device (chip),
-	// register it if it doesn't exist
-	thing, err := p.things.FindPiot(packet.Device)
+	thing, err := p.getDevice(packet.Device, packet.Ip)
 	if err != nil {
-		// register device
-		thing, err = p.things.RegisterPiot(packet.Device, THING_TYPE_DEVICE)
-		if err != nil {
-			return err
-		}
+		return err
+	}
 
-		// configure availability topic
-		if err := p.things.SetAvailabilityTopic(thing.Id, "available"); err != nil {
-			return err
-		}
-		if err := p.things.SetAvailabilityYesNo(thing.Id, "yes", "no"); err != nil {
-			return err
-		}
+	if err := p.checkCounter(thing, packet); err != nil {
+		return err
 	}
 
+	p.processAck(thing, packet.Ack)
+
 	// if thing is assigned to org
 	if thing.OrgId != primitive.NilObjectID {
 		// try to push data to mqtt
-		if err = p.processDevice(thing, packet); err != nil {
+		if err = p.processDevice(thing, packet, ts); err != nil {
 			return err
 		}
 	} else {
 		p.log.Debugf("Ignoring processing of data for thing <%s> that is not assigned to any organization", thing.Name)
 	}
 
-	// look for sensors and register those that doesn't exist
-	for _, reading := range packet.Readings {
+	// readings of live packet are not retransmitted by device, failed
+	// readings are only logged
+	if _, err := p.processReadings(thing, packet.Readings, ts); err != nil {
+		p.log.Warningf("Failed to process readings of device %s (%v)", packet.Device, err)
+	}
+
+	return p.saveCounter(thing, packet)
+}
+
+// RejectedPackets returns number of packets rejected by DOS protection
+func (p *PiotDevices) RejectedPackets() uint64 {
+	return p.limiter.Rejected()
+}
+
+// ProcessBatch processes packet carrying readings buffered by device (e.g.
+// during loss of connectivity). Reading sets are processed in order they
+// appear in the packet. Batch is charged to DOS protection of the device as
+// single packet, the number of reading sets is limited in addition.
+func (p *PiotDevices) ProcessBatch(packet PiotDevicePacket) (*PiotBatchResult, error) {
+	p.log.Debugf("Process PIOT device batch packet: %v", packet)
+
+	packet = p.expandShortNotation(packet)
+
+	// DOS Protection, batches share token bucket with live packets
+	if !p.limiter.Allow(packet.Device) {
+		p.log.Warningf("Rejecting batch from device %s, rate limit exceeded (rejected packets: %d)", packet.Device, p.limiter.Rejected())
+		return nil, ErrPiotRateLimit
+	}
+
+	// name of the device cannot be empty
+	if packet.Device == "" {
+		return nil, errors.New("device name cannot be empty")
+	}
+
+	if len(packet.Batch) > p.params.BatchMaxSize {
+		p.log.Warningf("Rejecting batch from device %s, size %d exceeds limit %d", packet.Device, len(packet.Batch), p.params.BatchMaxSize)
+		return nil, fmt.Errorf("batch size exceeds limit of %d reading sets", p.params.BatchMaxSize)
+	}
+
+	thing, err := p.getDevice(packet.Device, packet.Ip)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkCounter(thing, packet); err != nil {
+		return nil, err
+	}
+
+	p.processAck(thing, packet.Ack)
+
+	// device attributes (availability, network) are always current
+	if thing.OrgId != primitive.NilObjectID {
+		if err = p.processDevice(thing, packet, time.Time{}); err != nil {
+			return nil, err
+		}
+	} else {
+		p.log.Debugf("Ignoring processing of data for thing <%s> that is not assigned to any organization", thing.Name)
+	}
+
+	result := &PiotBatchResult{Total: len(packet.Batch)}
+
+	for i, set := range packet.Batch {
+
+		// handle short notation of readings attribute
+		if len(set.ReadingsShort) > 0 {
+			set.Readings = set.ReadingsShort
+		}
+
+		// each reading set in batch has to be timestamped
+		if set.Time == nil {
+			result.reject(i, errors.New("reading set time is missing"))
+			continue
+		}
+
+		ts, err := p.getTime(packet.Device, set.Time)
+		if err != nil {
+			result.reject(i, err)
+			continue
+		}
+
+		// set is rejected if none of its readings was processed, it is
+		// partially accepted if some of them failed
+		processed, err := p.processReadings(thing, set.Readings, ts)
+		if err != nil {
+			if processed == 0 {
+				result.reject(i, err)
+			} else {
+				result.partial(i, err)
+			}
+			continue
+		}
+		result.Accepted++
+	}
+
+	p.log.Debugf("Batch from device %s processed, accepted %d, partial %d, rejected %d", packet.Device, result.Accepted, result.Partial, result.Rejected)
+
+	if err := p.saveCounter(thing, packet); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// DeliverCommands returns commands waiting for delivery to device, returned
+// commands are marked as delivered. Commands are delivered again in
+// responses to next packets until device acknowledges them, number of
+// deliveries is limited for devices that don't acknowledge commands.
+func (p *PiotDevices) DeliverCommands(device string) ([]PiotDeviceCommand, error) {
+
+	thing, err := p.things.FindPiot(device)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []PiotDeviceCommand
+
+	for _, command := range thing.PiotCommands {
+		if command.Acknowledged != 0 || command.Deliveries >= PIOT_COMMAND_MAX_DELIVERIES {
+			continue
+		}
+
+		// command could be delivered by concurrent request
+		delivered, err := p.things.SetPiotCommandDelivered(thing.Id, command.Id, command.Deliveries)
+		if err != nil {
+			return nil, err
+		}
+		if !delivered {
+			continue
+		}
+
+		p.log.Debugf("Delivering command %s (%s=%s) to device %s", command.Id.Hex(), command.Name, command.Value, device)
+
+		result = append(result, PiotDeviceCommand{command.Id.Hex(), command.Name, command.Value})
+	}
+
+	return result, nil
+}
+
+// processAck marks commands acknowledged by device
+func (p *PiotDevices) processAck(thing *Thing, ack []string) {
+	for _, idHex := range ack {
+		id, err := primitive.ObjectIDFromHex(idHex)
+		if err != nil {
+			p.log.Warningf("Ignoring invalid command id <%s> acknowledged by device %s", idHex, thing.PiotId)
+			continue
+		}
+
+		acknowledged, err := p.things.SetPiotCommandAcknowledged(thing.Id, id)
+		if err != nil {
+			p.log.Errorf("Failed to acknowledge command %s of device %s (%v)", idHex, thing.PiotId, err)
+			continue
+		}
+		if !acknowledged {
+			p.log.Warningf("Device %s acknowledged unknown or already acknowledged command %s", thing.PiotId, idHex)
+		}
+	}
+}
+
+// expandShortNotation assigns short attributes to long attributes
+func (p *PiotDevices) expandShortNotation(packet PiotDevicePacket) PiotDevicePacket {
+	if len(packet.DeviceShort) > 0 {
+		packet.Device = packet.DeviceShort
+	}
+	if len(packet.ReadingsShort) > 0 {
+		packet.Readings = packet.ReadingsShort
+	}
+	if len(packet.BatchShort) > 0 {
+		packet.Batch = packet.BatchShort
+	}
+	if packet.CounterShort != nil {
+		packet.Counter = packet.CounterShort
+	}
+
+	return packet
+}
+
+// getDevice looks for the device (chip), unknown devices are registered,
+// queued for approval or rejected according to registration policy
+func (p *PiotDevices) getDevice(id string, ip *string) (*Thing, error) {
+
+	thing, err := p.things.FindPiot(id)
+	if err == nil {
+		return thing, nil
+	}
+
+	switch p.params.RegistrationPolicy {
+	case PIOT_REGISTRATION_REJECT:
+		p.log.Warningf("Rejecting packet from unknown device %s", id)
+		return nil, ErrPiotDeviceUnknown
+
+	case PIOT_REGISTRATION_PENDING:
+		deviceIp := ""
+		if ip != nil {
+			deviceIp = *ip
+		}
+
+		device, err := p.things.TouchPendingPiot(id, deviceIp)
+		if err != nil {
+			if err == ErrPiotPendingFull {
+				p.log.Warningf("Rejecting packet from unknown device %s, too many pending devices", id)
+				return nil, ErrPiotDeviceUnknown
+			}
+			return nil, err
+		}
+
+		if device.Rejected != 0 {
+			p.log.Warningf("Rejecting packet from device %s, registration was rejected", id)
+			return nil, ErrPiotDeviceUnknown
+		}
+
+		p.log.Infof("Device %s is waiting for approval of registration", id)
+		return nil, ErrPiotDevicePending
+	}
+
+	// register device
+	return p.things.RegisterPiotDevice(id)
+}
+
+// checkCounter protects against replay of packets. The message counter has
+// to be greater than the last accepted one. Once device starts sending
+// counter, packets without counter are rejected. Counter is checked only for
+// devices with key, since their packets are sealed (see Adapter) and counter
+// of plain packets could be forged to lock the device out.
+func (p *PiotDevices) checkCounter(thing *Thing, packet PiotDevicePacket) error {
+
+	if thing.PiotKey == "" {
+		return nil
+	}
+
+	if packet.Counter == nil {
+		if thing.PiotCounter != nil && *thing.PiotCounter >= 0 {
+			p.log.Warningf("Rejecting packet from device %s without counter, last accepted counter is %d", packet.Device, *thing.PiotCounter)
+			return ErrPiotReplay
+		}
+		return nil
+	}
+
+	if thing.PiotCounter != nil && *packet.Counter <= *thing.PiotCounter {
+		p.log.Warningf("Rejecting replayed packet from device %s, counter %d", packet.Device, *packet.Counter)
+		return ErrPiotReplay
+	}
+
+	return nil
+}
+
+// saveCounter stores counter of successfully processed packet, packet that
+// failed processing could be sent again with the same counter. Concurrent
+// packet with the same counter is rejected as replay.
+func (p *PiotDevices) saveCounter(thing *Thing, packet PiotDevicePacket) error {
+
+	if thing.PiotKey == "" || packet.Counter == nil {
+		return nil
+	}
+
+	err := p.things.SetPiotCounter(thing.Id, *packet.Counter)
+	if err == ErrPiotReplay {
+		p.log.Warningf("Rejecting replayed packet from device %s, counter %d", packet.Device, *packet.Counter)
+	}
+
+	return err
+}
+
+// processReadings looks for sensors, registers those that doesn't exist and
+// processes their readings. It returns number of processed readings and error
+// describing failed readings (e.g. values out of range, failed publishing).
+func (p *PiotDevices) processReadings(thing *Thing, readings []PiotSensorReading, ts time.Time) (int, error) {
+
+	processed := 0
+	failed := []string{}
+
+	for _, reading := range readings {
 
 		// handle short notation of address attribute
 		if len(reading.AddressShort) > 0 {
 			reading.Address = reading.AddressShort
 		}
 
-		if reading.Temperature != nil {
-			class := THING_CLASS_TEMPERATURE
-			if err = p.processReading(class, thing, reading); err != nil {
-				p.log.Debugf("Failed to process reading data for thing <%s>", thing.Name)
+		// process values of all known classes in order of registration
+		for _, class := range p.classes.GetAll() {
+			value, ok := reading.Values[class.Key]
+			if !ok {
+				continue
 			}
-		}
-
-		if reading.Humidity != nil {
-			class := THING_CLASS_HUMIDITY
-			if err = p.processReading(class, thing, reading); err != nil {
-				p.log.Debugf("Failed to process humidity reading data for thing <%s>", thing.Name)
+			if err := p.processReading(class, thing, reading.Address, value, ts); err != nil {
+				p.log.Debugf("Failed to process %s reading data for thing <%s> (%v)", class.Name, thing.Name, err)
+				failed = append(failed, fmt.Sprintf("%s of sensor %s: %v", class.Key, reading.Address, err))
+				continue
 			}
+			processed++
 		}
 
-		if reading.Pressure != nil {
-			class := THING_CLASS_PRESSURE
-			if err = p.processReading(class, thing, reading); err != nil {
-				p.log.Debugf("Failed to process pressure reading data for thing <%s>", thing.Name)
+		for key := range reading.Values {
+			if p.classes.GetByKey(key) == nil {
+				p.log.Warningf("Ignoring unknown sensor reading key <%s> of sensor <%s>", key, reading.Address)
 			}
 		}
 	}
 
-	return nil
+	if len(failed) > 0 {
+		return processed, fmt.Errorf("failed readings: %s", strings.Join(failed, "; "))
+	}
+
+	return processed, nil
 }
 
-func (p *PiotDevices) processDevice(thing *Thing, packet PiotDevicePacket) error {
+// getTime validates time provided by device against configured
+// clock skew limits. Zero time is returned if device didn't provide time.
+func (p *PiotDevices) getTime(device string, t *int64) (time.Time, error) {
+
+	if t == nil {
+		return time.Time{}, nil
+	}
+
+	ts := time.Unix(*t, 0)
+	now := time.Now()
+
+	if ts.Before(now.Add(-p.params.TimeSkewPast)) {
+		p.log.Warningf("Rejecting packet from device %s, time %s is too far in the past", device, ts)
+		return time.Time{}, errors.New("packet time is too far in the past")
+	}
+
+	if ts.After(now.Add(p.params.TimeSkewFuture)) {
+		p.log.Warningf("Rejecting packet from device %s, time %s is in the future", device, ts)
+		return time.Time{}, errors.New("packet time is in the future")
+	}
+
+	return ts, nil
+}
+
+func (p *PiotDevices) processDevice(thing *Thing, packet PiotDevicePacket, ts time.Time) error {
 
 	p.log.Debugf("Process PIOT device data: %v", packet)
 
@@ -132,27 +433,27 @@ func (p *PiotDevices) processDevice(thing *Thing, packet PiotDevicePacket) error
 	}
 
 	// update avalibility channel
-	err := p.mqtt.PushThingData(thing, TOPIC_AVAILABLE, VALUE_YES)
+	err := p.mqtt.PushThingData(thing, TOPIC_AVAILABLE, VALUE_YES, ts)
 	if err != nil {
 		return err
 	}
 
 	if packet.Ip != nil {
-		err := p.mqtt.PushThingData(thing, TOPIC_IP, *packet.Ip)
+		err := p.mqtt.PushThingData(thing, TOPIC_IP, *packet.Ip, ts)
 		if err != nil {
 			return err
 		}
 	}
 
 	if packet.WifiSSID != nil {
-		err := p.mqtt.PushThingData(thing, TOPIC_WIFI_SSID, *packet.WifiSSID)
+		err := p.mqtt.PushThingData(thing, TOPIC_WIFI_SSID, *packet.WifiSSID, ts)
 		if err != nil {
 			return err
 		}
 	}
 
 	if packet.WifiStrength != nil {
-		if err := p.mqtt.PushThingData(thing, TOPIC_WIFI_STRENGTH, fmt.Sprintf("%f", *packet.WifiStrength)); err != nil {
+		if err := p.mqtt.PushThingData(thing, TOPIC_WIFI_STRENGTH, fmt.Sprintf("%f", *packet.WifiStrength), ts); err != nil {
 			return err
 		}
 	}
@@ -160,35 +461,17 @@ func (p *PiotDevices) processDevice(thing *Thing, packet PiotDevicePacket) error
 	return nil
 }
 
-func (p *PiotDevices) processReading(class string, thing *Thing, reading PiotSensorReading) error {
-	p.log.Debugf("Process PIOT device reading data of class \"%s\": %v", class, reading)
+func (p *PiotDevices) processReading(class *SensorClass, thing *Thing, address string, value float64, ts time.Time) error {
+	p.log.Debugf("Process PIOT device reading data of class \"%s\": %s=%v", class.Name, address, value)
 
-	var address string = reading.Address
-	var value string
-	var unit string
+	if !class.InRange(value) {
+		p.log.Warningf("Rejecting %s reading %v of sensor <%s>, value is out of range", class.Name, value, address)
+		return fmt.Errorf("%s value %v is out of range", class.Name, value)
+	}
 
 	// determine address from class
 	// this is necessary to have separate things for all sensor measurements
-	switch class {
-	case THING_CLASS_TEMPERATURE:
-		address = "T" + address
-		unit = "C"
-		if reading.Temperature != nil {
-			value = strconv.FormatFloat(float64(*reading.Temperature), 'f', -1, 32)
-		}
-	case THING_CLASS_HUMIDITY:
-		address = "H" + address
-		unit = "%"
-		if reading.Humidity != nil {
-			value = strconv.FormatFloat(float64(*reading.Humidity), 'f', -1, 32)
-		}
-	case THING_CLASS_PRESSURE:
-		address = "P" + address
-		unit = "mPa"
-		if reading.Pressure != nil {
-			value = strconv.FormatFloat(float64(*reading.Pressure), 'f', -1, 32)
-		}
-	}
+	address = class.Prefix + address
 
 	// look for thing representing sensor
 	sensor_thing, err := p.things.Find(address)
@@ -208,9 +491,15 @@ func (p *PiotDevices) processReading(class string, thing *Thing, reading PiotSen
 		}
 
 		// set proper device class according to received measurement type
-		if err := p.things.SetSensorClass(sensor_thing.Id, class); err != nil {
+		if err := p.things.SetSensorClass(sensor_thing.Id, class.Name); err != nil {
+			return err
+		}
+
+		// values are published in canonical unit of the class by default
+		if err := p.things.SetSensorUnit(sensor_thing.Id, class.Unit); err != nil {
 			return err
 		}
+		sensor_thing.Sensor.Unit = class.Unit
 	}
 
 	// update parent thing (this can happen any time since sensor can be
@@ -236,22 +525,39 @@ func (p *PiotDevices) processReading(class string, thing *Thing, reading PiotSen
 	}
 
 	// update avalibility channel
-	err = p.mqtt.PushThingData(sensor_thing, TOPIC_AVAILABLE, VALUE_YES)
+	err = p.mqtt.PushThingData(sensor_thing, TOPIC_AVAILABLE, VALUE_YES, ts)
 	if err != nil {
 		return err
 	}
 
-	if value != "" {
+	value, unit := p.displayValue(class, sensor_thing, value)
 
-		if err := p.mqtt.PushThingData(sensor_thing, PIOT_MEASUREMENT_TOPIC, value); err != nil {
-			return err
-		}
-		if err := p.mqtt.PushThingData(sensor_thing, fmt.Sprintf("%s/%s", PIOT_MEASUREMENT_TOPIC, TOPIC_UNIT), unit); err != nil {
-			return err
-		}
-	} else {
-		p.log.Warningf("Processing unkonwn sensor reading data <%v>", reading)
+	if err := p.mqtt.PushThingData(sensor_thing, PIOT_MEASUREMENT_TOPIC, strconv.FormatFloat(value, 'f', -1, 64), ts); err != nil {
+		return err
+	}
+	if err := p.mqtt.PushThingData(sensor_thing, fmt.Sprintf("%s/%s", PIOT_MEASUREMENT_TOPIC, TOPIC_UNIT), unit, ts); err != nil {
+		return err
 	}
 
 	return nil
 }
+
+// displayValue converts reading from canonical unit of sensor class to unit
+// configured for sensor thing, sensors without unit get the canonical one
+func (p *PiotDevices) displayValue(class *SensorClass, thing *Thing, value float64) (float64, string) {
+
+	if thing.Sensor.Unit == "" {
+		if err := p.things.SetSensorUnit(thing.Id, class.Unit); err != nil {
+			p.log.Errorf("Failed to set unit of sensor %s (%s)", thing.Name, err.Error())
+		}
+		return value, class.Unit
+	}
+
+	converted, err := ConvertUnit(value, class.Unit, thing.Sensor.Unit)
+	if err != nil {
+		p.log.Warningf("Publishing %s value of sensor %s in unit %s (%s)", class.Name, thing.Name, class.Unit, err.Error())
+		return value, class.Unit
+	}
+
+	return converted, thing.Sensor.Unit
+}
@@ -2,8 +2,11 @@ package main_test
 
 import (
 	"context"
+	"errors"
+	"math"
 	main "piot-server"
 	"testing"
+	"time"
 
 	"github.com/op/go-logging"
 	"go.mongodb.org/mongo-driver/bson"
@@ -49,9 +52,8 @@ func TestPacketDeviceReg(t *testing.T) {
 	packet.Device = DEVICE
 
 	var reading main.PiotSensorReading
-	var temp float32 = 4.5
 	reading.Address = SENSOR
-	reading.Temperature = &temp
+	reading.Values = map[string]float64{"t": 4.5}
 	packet.Readings = append(packet.Readings, reading)
 
 	err := s.pdevices.ProcessPacket(packet)
@@ -93,14 +95,7 @@ func TestPacketDeviceRegMultiple(t *testing.T) {
 
 	var reading main.PiotSensorReading
 	reading.Address = SENSOR
-	var temp float32 = 4.5
-	reading.Temperature = &temp
-
-	var press float32 = 900
-	reading.Pressure = &press
-
-	var hum float32 = 20
-	reading.Humidity = &hum
+	reading.Values = map[string]float64{"t": 4.5, "p": 900, "h": 20}
 
 	packet.Readings = append(packet.Readings, reading)
 
@@ -159,9 +154,8 @@ func TestPacketDeviceUpdateParent(t *testing.T) {
 	packet.Device = DEVICE
 
 	var reading main.PiotSensorReading
-	var temp float32 = 4.5
 	reading.Address = SENSOR
-	reading.Temperature = &temp
+	reading.Values = map[string]float64{"t": 4.5}
 	packet.Readings = append(packet.Readings, reading)
 
 	err := s.pdevices.ProcessPacket(packet)
@@ -272,10 +266,9 @@ func TestPacketDeviceReadingTempUnassigned(t *testing.T) {
 	CreateThing(t, s.db, DEVICE)
 
 	// process packet for know device
-	var temp float32 = 4.5
 	var reading main.PiotSensorReading
 	reading.Address = "SensorAddr"
-	reading.Temperature = &temp
+	reading.Values = map[string]float64{"t": 4.5}
 
 	var packet main.PiotDevicePacket
 	packet.Device = DEVICE
@@ -304,14 +297,9 @@ func TestPacketDeviceReadingTempAssigned(t *testing.T) {
 	AddOrgThing(t, s.db, orgId, "T"+SENSOR) // SENSOR is registered for temperature
 
 	// process packet for know device
-	var temp float32 = 4.5
-	//var pressure float32 = 20.8
-	//var humidity float32 = 95.5
 	var reading main.PiotSensorReading
 	reading.Address = SENSOR
-	reading.Temperature = &temp
-	//reading.Pressure= &pressure
-	//reading.Humidity = &humidity
+	reading.Values = map[string]float64{"t": 4.5}
 
 	var packet main.PiotDevicePacket
 	packet.Device = DEVICE
@@ -340,6 +328,96 @@ func TestPacketDeviceReadingTempAssigned(t *testing.T) {
 	Equals(t, "TSensorAddr", s.mqtt.Calls[3].Thing.Name)
 }
 
+// VALID packet + ASSIGNED device + sensor with display unit -> value is
+// converted from canonical unit of sensor class
+func TestPacketDeviceReadingUnit(t *testing.T) {
+
+	const DEVICE = "device01"
+	const SENSOR = "SensorAddr"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	CreateThing(t, s.db, DEVICE)
+	sensorId := CreateThing(t, s.db, "T"+SENSOR)
+	orgId := CreateOrg(t, s.db, "org1")
+	AddOrgThing(t, s.db, orgId, DEVICE)
+	AddOrgThing(t, s.db, orgId, "T"+SENSOR)
+
+	_, err := s.db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{"sensor.unit": "F"}})
+	Ok(t, err)
+
+	var reading main.PiotSensorReading
+	reading.Address = SENSOR
+	reading.Values = map[string]float64{"t": 23}
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Readings = append(packet.Readings, reading)
+
+	err = s.pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	Equals(t, 4, len(s.mqtt.Calls))
+
+	Equals(t, "value", s.mqtt.Calls[2].Topic)
+	Equals(t, "73.4", s.mqtt.Calls[2].Value)
+
+	Equals(t, "value/unit", s.mqtt.Calls[3].Topic)
+	Equals(t, "F", s.mqtt.Calls[3].Value)
+
+	// sensor without unit gets canonical unit of the class
+	reading.Address = "Sensor2"
+	packet.Readings = []main.PiotSensorReading{reading}
+
+	err = s.pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	thing, err := s.things.Find("TSensor2")
+	Ok(t, err)
+	Equals(t, "C", thing.Sensor.Unit)
+}
+
+// VALID packet + ASSIGNED device + CO2 and out of range TEMPERATURE -> only
+// co2 measurement is published
+func TestPacketDeviceReadingClasses(t *testing.T) {
+
+	const DEVICE = "device01"
+	const SENSOR = "SensorAddr"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	CreateThing(t, s.db, DEVICE)
+	CreateThing(t, s.db, "C"+SENSOR)
+	CreateThing(t, s.db, "T"+SENSOR)
+	orgId := CreateOrg(t, s.db, "org1")
+	AddOrgThing(t, s.db, orgId, DEVICE)
+	AddOrgThing(t, s.db, orgId, "C"+SENSOR)
+	AddOrgThing(t, s.db, orgId, "T"+SENSOR)
+
+	var reading main.PiotSensorReading
+	reading.Address = SENSOR
+	reading.Values = map[string]float64{"co2": 450, "t": 1000, "unknown": 1}
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Readings = append(packet.Readings, reading)
+
+	err := s.pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	// device availability + sensor availability, value, unit
+	Equals(t, 4, len(s.mqtt.Calls))
+
+	Equals(t, "value", s.mqtt.Calls[2].Topic)
+	Equals(t, "450", s.mqtt.Calls[2].Value)
+	Equals(t, "CSensorAddr", s.mqtt.Calls[2].Thing.Name)
+
+	Equals(t, "value/unit", s.mqtt.Calls[3].Topic)
+	Equals(t, "ppm", s.mqtt.Calls[3].Value)
+}
+
 // Test DOS (Denial Of Service) protection
 func TestDOS(t *testing.T) {
 
@@ -356,10 +434,583 @@ func TestDOS(t *testing.T) {
 
 	// check that sending same packet in short time frame is not possible
 	err = s.pdevices.ProcessPacket(packet)
-	Assert(t, err != nil, "DOS protection doesn't work")
+	Equals(t, main.ErrPiotRateLimit, err)
+	Equals(t, uint64(1), s.pdevices.RejectedPackets())
 
 	// check that sending packet for different device is possible
 	packet.Device = "device02"
 	err = s.pdevices.ProcessPacket(packet)
 	Ok(t, err)
 }
+
+// Test DOS protection with burst of packets
+func TestDOSBurst(t *testing.T) {
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	params := GetConfig()
+	params.DOSBurst = 3
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	packet := main.PiotDevicePacket{Device: "device01"}
+
+	for i := 0; i < 3; i++ {
+		Ok(t, pdevices.ProcessPacket(packet))
+	}
+
+	Equals(t, main.ErrPiotRateLimit, pdevices.ProcessPacket(packet))
+}
+
+// batches share DOS protection with live packets
+func TestDOSBatch(t *testing.T) {
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	params := GetConfig()
+	params.DOSBurst = 2
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	packet := main.PiotDevicePacket{Device: "device01"}
+
+	Ok(t, pdevices.ProcessPacket(packet))
+	_, err := pdevices.ProcessBatch(packet)
+	Ok(t, err)
+
+	_, err = pdevices.ProcessBatch(packet)
+	Equals(t, main.ErrPiotRateLimit, err)
+	Equals(t, main.ErrPiotRateLimit, pdevices.ProcessPacket(packet))
+}
+
+// VALID packet with time + ASSIGNED device -> time is passed to mqtt
+func TestPacketDeviceTime(t *testing.T) {
+
+	const DEVICE = "device01"
+	const SENSOR = "SensorAddr"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	CreateThing(t, s.db, DEVICE)
+	CreateThing(t, s.db, "T"+SENSOR)
+	orgId := CreateOrg(t, s.db, "org1")
+	AddOrgThing(t, s.db, orgId, DEVICE)
+	AddOrgThing(t, s.db, orgId, "T"+SENSOR)
+
+	var reading main.PiotSensorReading
+	reading.Address = SENSOR
+	reading.Values = map[string]float64{"t": 4.5}
+
+	// reading is one hour old
+	ts := time.Now().Add(-time.Hour).Unix()
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Time = &ts
+	packet.Readings = append(packet.Readings, reading)
+
+	err := s.pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	Equals(t, 4, len(s.mqtt.Calls))
+	for _, call := range s.mqtt.Calls {
+		Equals(t, ts, call.Time.Unix())
+	}
+}
+
+// packet without time -> zero time (current) is passed to mqtt
+func TestPacketDeviceNoTime(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	CreateThing(t, s.db, DEVICE)
+	orgId := CreateOrg(t, s.db, "org1")
+	AddOrgThing(t, s.db, orgId, DEVICE)
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+
+	err := s.pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	Equals(t, 1, len(s.mqtt.Calls))
+	Assert(t, s.mqtt.Calls[0].Time.IsZero(), "Time shall not be set for live packet")
+}
+
+// packet with time out of allowed clock skew limits -> rejected
+func TestPacketDeviceTimeSkew(t *testing.T) {
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	var packet main.PiotDevicePacket
+
+	// time too far in the past
+	past := time.Now().Add(-GetConfig().TimeSkewPast - time.Hour).Unix()
+	packet.Device = "device01"
+	packet.Time = &past
+	err := s.pdevices.ProcessPacket(packet)
+	Fail(t, err)
+
+	// time in the future
+	future := time.Now().Add(GetConfig().TimeSkewFuture + time.Hour).Unix()
+	packet.Device = "device02"
+	packet.Time = &future
+	err = s.pdevices.ProcessPacket(packet)
+	Fail(t, err)
+
+	Equals(t, 0, len(s.mqtt.Calls))
+}
+
+// batch of buffered readings + ASSIGNED device -> reading sets are processed
+// in order, invalid sets are reported in result
+func TestPacketBatch(t *testing.T) {
+
+	const DEVICE = "device01"
+	const SENSOR = "SensorAddr"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	CreateThing(t, s.db, DEVICE)
+	CreateThing(t, s.db, "T"+SENSOR)
+	orgId := CreateOrg(t, s.db, "org1")
+	AddOrgThing(t, s.db, orgId, DEVICE)
+	AddOrgThing(t, s.db, orgId, "T"+SENSOR)
+
+	ts1 := time.Now().Add(-2 * time.Hour).Unix()
+	ts2 := time.Now().Add(-time.Hour).Unix()
+	tsInvalid := time.Now().Add(time.Hour).Unix()
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Batch = []main.PiotReadingSet{
+		{Time: &ts1, Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 4.5}}}},
+		{Time: &ts2, Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 5.5}}}},
+		{Time: &tsInvalid, Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 5.5}}}},
+		{Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 5.5}}}},
+	}
+
+	result, err := s.pdevices.ProcessBatch(packet)
+	Ok(t, err)
+	Equals(t, 4, result.Total)
+	Equals(t, 2, result.Accepted)
+	Equals(t, 2, result.Rejected)
+	Equals(t, 2, len(result.Errors))
+	Equals(t, 2, result.Errors[0].Index)
+	Equals(t, 3, result.Errors[1].Index)
+
+	// device availability + 2x (sensor availability, value, unit)
+	Equals(t, 7, len(s.mqtt.Calls))
+
+	Equals(t, "available", s.mqtt.Calls[0].Topic)
+	Equals(t, DEVICE, s.mqtt.Calls[0].Thing.Name)
+	Assert(t, s.mqtt.Calls[0].Time.IsZero(), "Device availability shall be current")
+
+	Equals(t, "value", s.mqtt.Calls[2].Topic)
+	Equals(t, "4.5", s.mqtt.Calls[2].Value)
+	Equals(t, ts1, s.mqtt.Calls[2].Time.Unix())
+
+	Equals(t, "value", s.mqtt.Calls[5].Topic)
+	Equals(t, "5.5", s.mqtt.Calls[5].Value)
+	Equals(t, ts2, s.mqtt.Calls[5].Time.Unix())
+
+	// live packet right after batch is not affected by DOS protection
+	err = s.pdevices.ProcessPacket(main.PiotDevicePacket{Device: DEVICE})
+	Ok(t, err)
+}
+
+// reading sets with failed readings are reported as partially accepted or
+// rejected
+func TestPacketBatchFailedReadings(t *testing.T) {
+
+	const DEVICE = "device01"
+	const SENSOR = "SensorAddr"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	CreateThing(t, s.db, DEVICE)
+	CreateThing(t, s.db, "T"+SENSOR)
+	CreateThing(t, s.db, "C"+SENSOR)
+	orgId := CreateOrg(t, s.db, "org1")
+	AddOrgThing(t, s.db, orgId, DEVICE)
+	AddOrgThing(t, s.db, orgId, "T"+SENSOR)
+	AddOrgThing(t, s.db, orgId, "C"+SENSOR)
+
+	ts := time.Now().Add(-time.Hour).Unix()
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Batch = []main.PiotReadingSet{
+		{Time: &ts, Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 4.5}}}},
+		{Time: &ts, Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 1000, "co2": 450}}}},
+		{Time: &ts, Readings: []main.PiotSensorReading{{Address: SENSOR, Values: map[string]float64{"t": 1000}}}},
+	}
+
+	result, err := s.pdevices.ProcessBatch(packet)
+	Ok(t, err)
+	Equals(t, 3, result.Total)
+	Equals(t, 1, result.Accepted)
+	Equals(t, 1, result.Partial)
+	Equals(t, 1, result.Rejected)
+	Equals(t, 2, len(result.Errors))
+	Equals(t, 1, result.Errors[0].Index)
+	Contains(t, result.Errors[0].Error, "out of range")
+	Equals(t, 2, result.Errors[1].Index)
+}
+
+// batch exceeding size limit is rejected
+func TestPacketBatchSizeLimit(t *testing.T) {
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	var packet main.PiotDevicePacket
+	packet.Device = "device01"
+	ts := time.Now().Unix()
+	for i := 0; i <= GetConfig().BatchMaxSize; i++ {
+		packet.Batch = append(packet.Batch, main.PiotReadingSet{Time: &ts})
+	}
+
+	_, err := s.pdevices.ProcessBatch(packet)
+	Fail(t, err)
+}
+
+// packets with message counter -> replayed packets are rejected
+func TestPacketReplay(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	thingId := CreateDevice(t, s.db, DEVICE)
+	SetThingPiotKey(t, s.db, thingId, "000102030405060708090a0b0c0d0e0f")
+	params := GetConfig()
+	params.DOSInterval = 0
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+
+	// first packet with counter is accepted
+	var counter int32 = 5
+	packet.Counter = &counter
+	err := pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	thing, err := s.things.FindPiot(DEVICE)
+	Ok(t, err)
+	Equals(t, int32(5), *thing.PiotCounter)
+
+	// replayed packet is rejected
+	err = pdevices.ProcessPacket(packet)
+	Equals(t, main.ErrPiotReplay, err)
+
+	// packet with lower counter is rejected
+	var lower int32 = 4
+	packet.Counter = &lower
+	err = pdevices.ProcessPacket(packet)
+	Equals(t, main.ErrPiotReplay, err)
+
+	// packet without counter is rejected
+	packet.Counter = nil
+	err = pdevices.ProcessPacket(packet)
+	Equals(t, main.ErrPiotReplay, err)
+
+	// packet with greater counter (short notation) is accepted
+	var greater int32 = 6
+	packet.CounterShort = &greater
+	err = pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	thing, err = s.things.FindPiot(DEVICE)
+	Ok(t, err)
+	Equals(t, int32(6), *thing.PiotCounter)
+}
+
+// two concurrent first packets of device -> one of them is rejected as replay
+func TestPacketReplayConcurrentFirst(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	params := GetConfig()
+	params.DOSInterval = 0
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	CleanDb(t, s.db)
+	thingId := CreateDevice(t, s.db, DEVICE)
+	SetThingPiotKey(t, s.db, thingId, "000102030405060708090a0b0c0d0e0f")
+
+	var counter int32 = 1
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Counter = &counter
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pdevices.ProcessBatch(packet)
+			errs <- err
+		}()
+	}
+
+	accepted := 0
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err == nil {
+			accepted++
+			continue
+		}
+		Equals(t, main.ErrPiotReplay, err)
+	}
+	Equals(t, 1, accepted)
+
+	thing, err := s.things.FindPiot(DEVICE)
+	Ok(t, err)
+	Equals(t, int32(1), *thing.PiotCounter)
+}
+
+// counter of device without key is ignored, plain packets could be forged
+func TestPacketReplayWithoutKey(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	params := GetConfig()
+	params.DOSInterval = 0
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	CleanDb(t, s.db)
+	CreateDevice(t, s.db, DEVICE)
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+
+	var counter int32 = math.MaxInt32
+	packet.Counter = &counter
+	_, err := pdevices.ProcessBatch(packet)
+	Ok(t, err)
+
+	var lower int32 = 1
+	packet.Counter = &lower
+	_, err = pdevices.ProcessBatch(packet)
+	Ok(t, err)
+
+	thing, err := s.things.FindPiot(DEVICE)
+	Ok(t, err)
+	Assert(t, thing.PiotCounter == nil, "Counter of device without key shall not be stored")
+}
+
+// counter of packet that failed processing is not stored, device can send
+// the packet again
+func TestPacketReplayFailed(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	params := GetConfig()
+	params.DOSInterval = 0
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	CleanDb(t, s.db)
+	orgId := CreateOrg(t, s.db, "org1")
+	thingId := CreateDevice(t, s.db, DEVICE)
+	AddOrgThing(t, s.db, orgId, DEVICE)
+	SetThingPiotKey(t, s.db, thingId, "000102030405060708090a0b0c0d0e0f")
+
+	var counter int32 = 5
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Counter = &counter
+
+	s.mqtt.PushThingDataErr = errors.New("publishing failed")
+	_, err := pdevices.ProcessBatch(packet)
+	Equals(t, s.mqtt.PushThingDataErr, err)
+
+	thing, err := s.things.FindPiot(DEVICE)
+	Ok(t, err)
+	Assert(t, thing.PiotCounter == nil, "Counter of failed packet shall not be stored")
+
+	s.mqtt.PushThingDataErr = nil
+	_, err = pdevices.ProcessBatch(packet)
+	Ok(t, err)
+
+	thing, err = s.things.FindPiot(DEVICE)
+	Ok(t, err)
+	Equals(t, int32(5), *thing.PiotCounter)
+}
+
+// pending commands are delivered until they are acknowledged by next packet
+func TestPacketCommands(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+	thingId := CreateDevice(t, s.db, DEVICE)
+
+	cmd, err := s.things.AddPiotCommand(thingId, main.PIOT_COMMAND_INTERVAL, "120")
+	Ok(t, err)
+
+	commands, err := s.pdevices.DeliverCommands(DEVICE)
+	Ok(t, err)
+	Equals(t, 1, len(commands))
+	Equals(t, cmd.Id.Hex(), commands[0].Id)
+	Equals(t, main.PIOT_COMMAND_INTERVAL, commands[0].Name)
+	Equals(t, "120", commands[0].Value)
+
+	// command is delivered again, response could be lost
+	commands, err = s.pdevices.DeliverCommands(DEVICE)
+	Ok(t, err)
+	Equals(t, 1, len(commands))
+	Equals(t, cmd.Id.Hex(), commands[0].Id)
+
+	var packet main.PiotDevicePacket
+	packet.Device = DEVICE
+	packet.Ack = []string{cmd.Id.Hex()}
+	err = s.pdevices.ProcessPacket(packet)
+	Ok(t, err)
+
+	thing, err := s.things.Get(thingId)
+	Ok(t, err)
+	Assert(t, thing.PiotCommands[0].Acknowledged > 0, "Command shall be acknowledged")
+
+	// acknowledged command is not delivered again
+	commands, err = s.pdevices.DeliverCommands(DEVICE)
+	Ok(t, err)
+	Equals(t, 0, len(commands))
+
+	// command that is never acknowledged is delivered limited number of
+	// times
+	_, err = s.things.AddPiotCommand(thingId, main.PIOT_COMMAND_LED, "on")
+	Ok(t, err)
+	for i := 0; i < main.PIOT_COMMAND_MAX_DELIVERIES; i++ {
+		commands, err = s.pdevices.DeliverCommands(DEVICE)
+		Ok(t, err)
+		Equals(t, 1, len(commands))
+	}
+	commands, err = s.pdevices.DeliverCommands(DEVICE)
+	Ok(t, err)
+	Equals(t, 0, len(commands))
+}
+
+// packets from unknown devices are queued for approval by pending policy
+func TestPacketRegistrationPending(t *testing.T) {
+
+	const DEVICE = "device01"
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	params := GetConfig()
+	params.DOSInterval = 0
+	params.RegistrationPolicy = main.PIOT_REGISTRATION_PENDING
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	ip := "192.168.1.10"
+	packet := main.PiotDevicePacket{Device: DEVICE, Ip: &ip}
+
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(packet))
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(packet))
+
+	_, err := s.things.FindPiot(DEVICE)
+	Assert(t, err != nil, "Pending device shall not be registered")
+
+	pending, err := s.things.FindPendingPiot(DEVICE)
+	Ok(t, err)
+	Equals(t, int32(2), pending.Packets)
+	Equals(t, ip, pending.Ip)
+
+	// rejection is remembered, packets of rejected device are rejected
+	Ok(t, s.things.RejectPendingPiot(DEVICE))
+	Equals(t, main.ErrPiotDeviceUnknown, pdevices.ProcessPacket(packet))
+	pending, err = s.things.FindPendingPiot(DEVICE)
+	Ok(t, err)
+	Assert(t, pending.Rejected != 0, "Device shall be rejected")
+
+	// device is pending again when rejection expires
+	_, err = s.db.Collection("piot_pending").UpdateOne(context.TODO(), bson.M{"piot_id": DEVICE}, bson.M{"$set": bson.M{"rejected": int32(time.Now().Add(-main.PIOT_PENDING_REJECT_TTL - time.Hour).Unix())}})
+	Ok(t, err)
+	_, err = s.things.GetPendingPiots()
+	Ok(t, err)
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(packet))
+	pending, err = s.things.FindPendingPiot(DEVICE)
+	Ok(t, err)
+	Equals(t, int32(1), pending.Packets)
+	Equals(t, int32(0), pending.Rejected)
+
+	// registered devices are processed
+	CreateDevice(t, s.db, "device02")
+	Ok(t, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device02"}))
+}
+
+// number of pending devices is limited, expired devices make room for new ones
+func TestPacketRegistrationPendingLimit(t *testing.T) {
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	params := GetConfig()
+	params.DOSInterval = 0
+	params.RegistrationPolicy = main.PIOT_REGISTRATION_PENDING
+	s.things.PendingMaxEntries = 2
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device01"}))
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device02"}))
+
+	// list is full, new device is rejected without recording
+	Equals(t, main.ErrPiotDeviceUnknown, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device03"}))
+	_, err := s.things.FindPendingPiot("device03")
+	Assert(t, err != nil, "Device over limit shall not be pending")
+
+	// devices already pending are still recorded
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device01"}))
+
+	// expired device makes room for new one
+	_, err = s.db.Collection("piot_pending").UpdateOne(context.TODO(), bson.M{"piot_id": "device02"}, bson.M{"$set": bson.M{"last_seen": int32(time.Now().Add(-main.PIOT_PENDING_TTL - time.Hour).Unix())}})
+	Ok(t, err)
+	Equals(t, main.ErrPiotDevicePending, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device03"}))
+	_, err = s.things.FindPendingPiot("device02")
+	Assert(t, err != nil, "Expired device shall be removed")
+
+	devices, err := s.things.GetPendingPiots()
+	Ok(t, err)
+	Equals(t, 2, len(devices))
+}
+
+// packets from unknown devices are rejected by reject policy
+func TestPacketRegistrationReject(t *testing.T) {
+
+	s := getServices(t)
+
+	CleanDb(t, s.db)
+
+	params := GetConfig()
+	params.RegistrationPolicy = main.PIOT_REGISTRATION_REJECT
+	pdevices := main.NewPiotDevices(s.log, s.things, s.mqtt, params, GetSensorClasses(t, s.log))
+
+	Equals(t, main.ErrPiotDeviceUnknown, pdevices.ProcessPacket(main.PiotDevicePacket{Device: "device01"}))
+
+	_, err := s.things.FindPiot("device01")
+	Assert(t, err != nil, "Unknown device shall not be registered")
+	_, err = s.things.FindPendingPiot("device01")
+	Assert(t, err != nil, "Unknown device shall not be pending")
+}
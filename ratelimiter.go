@@ -0,0 +1,124 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Token bucket of single key (device, ip address)
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter limits rate of events per key by token buckets. Each bucket
+// holds up to burst tokens, one token is refilled per interval and every
+// allowed event consumes one token. Number of tracked keys is limited,
+// least recently used bucket is evicted when limit is reached.
+type RateLimiter struct {
+	interval time.Duration
+	burst    int
+	size     int
+	buckets  map[string]*list.Element
+	// buckets ordered by last use, most recently used first
+	lru      *list.List
+	rejected uint64
+	mutex    sync.Mutex
+}
+
+// NewRateLimiter creates limiter, zero interval disables limiting
+func NewRateLimiter(interval time.Duration, burst, size int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	if size < 1 {
+		size = 1
+	}
+
+	return &RateLimiter{
+		interval: interval,
+		burst:    burst,
+		size:     size,
+		buckets:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Allow checks if event for given key is allowed at current time
+func (l *RateLimiter) Allow(key string) bool {
+	return l.AllowAt(key, time.Now())
+}
+
+// AllowAt checks if event for given key is allowed at given time
+func (l *RateLimiter) AllowAt(key string, now time.Time) bool {
+	if l.interval <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var bucket *tokenBucket
+	if element, ok := l.buckets[key]; ok {
+		bucket = element.Value.(*tokenBucket)
+		l.lru.MoveToFront(element)
+	} else {
+		if len(l.buckets) >= l.size {
+			l.evict()
+		}
+		bucket = &tokenBucket{key: key, tokens: float64(l.burst), last: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+	}
+
+	bucket.tokens = l.refill(bucket, now)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		l.rejected++
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// Rejected returns number of events rejected since creation of limiter
+func (l *RateLimiter) Rejected() uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rejected
+}
+
+// Len returns number of tracked keys
+func (l *RateLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.buckets)
+}
+
+func (l *RateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	tokens := bucket.tokens
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		tokens += float64(elapsed) / float64(l.interval)
+	}
+
+	if tokens > float64(l.burst) {
+		tokens = float64(l.burst)
+	}
+
+	return tokens
+}
+
+// evict removes the least recently used bucket
+func (l *RateLimiter) evict() {
+	if element := l.lru.Back(); element != nil {
+		l.lru.Remove(element)
+		delete(l.buckets, element.Value.(*tokenBucket).key)
+	}
+}
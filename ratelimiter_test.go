@@ -0,0 +1,104 @@
+package main_test
+
+import (
+	"fmt"
+	main "piot-server"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	limiter := main.NewRateLimiter(time.Second, 3, 100)
+	now := time.Now()
+
+	// burst of packets is allowed
+	for i := 0; i < 3; i++ {
+		Assert(t, limiter.AllowAt("dev1", now), "Packet within burst shall be allowed")
+	}
+	Assert(t, !limiter.AllowAt("dev1", now), "Packet over burst shall be rejected")
+	Equals(t, uint64(1), limiter.Rejected())
+
+	// other keys are not affected
+	Assert(t, limiter.AllowAt("dev2", now), "Packet of other device shall be allowed")
+
+	// one token is refilled per interval
+	Assert(t, !limiter.AllowAt("dev1", now.Add(time.Millisecond*500)), "Packet before refill shall be rejected")
+	Assert(t, limiter.AllowAt("dev1", now.Add(time.Second)), "Packet after refill shall be allowed")
+	Assert(t, !limiter.AllowAt("dev1", now.Add(time.Second)), "Packet over refill shall be rejected")
+
+	// bucket is not filled over burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		Assert(t, limiter.AllowAt("dev1", later), "Packet within burst shall be allowed")
+	}
+	Assert(t, !limiter.AllowAt("dev1", later), "Packet over burst shall be rejected")
+	Equals(t, uint64(4), limiter.Rejected())
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := main.NewRateLimiter(0, 1, 100)
+
+	for i := 0; i < 100; i++ {
+		Assert(t, limiter.Allow("dev1"), "Packets shall be allowed if limiter is disabled")
+	}
+	Equals(t, 0, limiter.Len())
+}
+
+func TestRateLimiterBounded(t *testing.T) {
+	limiter := main.NewRateLimiter(time.Minute, 1, 10)
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		Assert(t, limiter.AllowAt(fmt.Sprintf("dev%d", i), now.Add(time.Duration(i)*time.Millisecond)), "First packet shall be allowed")
+	}
+	Equals(t, 10, limiter.Len())
+
+	// recently seen device is still tracked
+	Assert(t, !limiter.AllowAt("dev99", now.Add(time.Second)), "Recent device shall be limited")
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	limiter := main.NewRateLimiter(time.Hour, 10, 5)
+
+	var wg sync.WaitGroup
+	allowed := make(chan bool, 1000)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				allowed <- limiter.Allow("dev1")
+			}
+		}()
+	}
+	wg.Wait()
+	close(allowed)
+
+	count := 0
+	for a := range allowed {
+		if a {
+			count++
+		}
+	}
+
+	Equals(t, 10, count)
+	Equals(t, uint64(990), limiter.Rejected())
+}
+
+func TestRateLimiterLeastRecentlyUsed(t *testing.T) {
+	limiter := main.NewRateLimiter(time.Minute, 1, 2)
+	now := time.Now()
+
+	Assert(t, limiter.AllowAt("dev1", now), "First packet shall be allowed")
+	Assert(t, limiter.AllowAt("dev2", now), "First packet shall be allowed")
+
+	// use of dev1 makes dev2 least recently used
+	Assert(t, !limiter.AllowAt("dev1", now), "Second packet shall be limited")
+	Assert(t, limiter.AllowAt("dev3", now), "First packet shall be allowed")
+	Equals(t, 2, limiter.Len())
+
+	Assert(t, !limiter.AllowAt("dev1", now), "Recently used device shall be still tracked")
+	Assert(t, limiter.AllowAt("dev2", now), "Evicted device shall start with full bucket")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+)
+
+/////////// Adapter Status Resolver
+
+type AdapterStatusResolver struct {
+	log *logging.Logger
+	s   AdapterStatus
+}
+
+func (r *AdapterStatusResolver) RejectedPackets() int32 {
+	return counterInt32(r.s.RejectedPackets)
+}
+
+func (r *AdapterStatusResolver) RejectedDevicePackets() int32 {
+	return counterInt32(r.s.RejectedDevicePackets)
+}
+
+// counterInt32 converts counter to graphql integer, counters exceeding its
+// range are saturated
+func counterInt32(counter uint64) int32 {
+	if counter > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(counter)
+}
+
+/////////// Resolver
+
+func (r *Resolver) AdapterStatus(ctx context.Context) (*AdapterStatusResolver, error) {
+
+	if err := r.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	status := AdapterStatus{}
+	if r.adapter != nil {
+		status = r.adapter.Status()
+	}
+
+	return &AdapterStatusResolver{r.log, status}, nil
+}
@@ -0,0 +1,66 @@
+package main_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	main "piot-server"
+	"piot-server/schema"
+	"strings"
+	"testing"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/gqltesting"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestAdapterStatusGet(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	adminId := CreateAdmin(t, db, "admin@test.com", "passwd")
+	userId := CreateUser(t, db, "test@test.com", "passwd")
+
+	log := GetLogger(t)
+	things := GetThings(t, log, db)
+	params := GetConfig()
+	params.DOSInterval = 0
+	params.DOSIpInterval = time.Hour
+	params.DOSIpBurst = 1
+	pdevices := main.NewPiotDevices(log, things, GetMqtt(t, log), params, GetSensorClasses(t, log))
+	adapter := main.NewAdapter(log, pdevices, things, params, "", false)
+
+	// second packet from the same address is rejected
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("POST", "/", strings.NewReader(`{"device": "Device1"}`))
+		Ok(t, err)
+		adapter.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	resolver := getResolver(t, db)
+	resolver.SetAdapter(adapter)
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), resolver)
+
+	gqltesting.RunTests(t, []*gqltesting.Test{
+		{
+			Context: AuthContext(t, adminId, primitive.NilObjectID),
+			Schema:  schema,
+			Query: `
+                {
+                    adapterStatus { rejected_packets, rejected_device_packets }
+                }
+            `,
+			ExpectedResult: `
+                {
+                    "adapterStatus": {
+                        "rejected_packets": 1,
+                        "rejected_device_packets": 0
+                    }
+                }
+            `,
+		},
+	})
+
+	// only admin can see counters of rejected packets
+	result := schema.Exec(AuthContext(t, userId, primitive.NilObjectID), `{ adapterStatus { rejected_packets } }`, "", nil)
+	Assert(t, len(result.Errors) > 0, "Adapter status shall be available only to admin")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+)
+
+/////////// MQTT Status Resolver
+
+type MqttStatusResolver struct {
+	log *logging.Logger
+	s   MqttStatus
+}
+
+func (r *MqttStatusResolver) Connected() bool {
+	return r.s.Connected
+}
+
+func (r *MqttStatusResolver) Sessions() int32 {
+	return int32(r.s.Sessions)
+}
+
+func (r *MqttStatusResolver) Reconnects() int32 {
+	return int32(r.s.Reconnects)
+}
+
+func (r *MqttStatusResolver) LastError() string {
+	return r.s.LastError
+}
+
+func (r *MqttStatusResolver) LastErrorTime() int32 {
+	if r.s.LastErrorTime.IsZero() {
+		return 0
+	}
+	return int32(r.s.LastErrorTime.Unix())
+}
+
+func (r *MqttStatusResolver) Pipeline() *MqttPipelineStatusResolver {
+	if r.s.Pipeline == nil {
+		return nil
+	}
+	return &MqttPipelineStatusResolver{r.log, *r.s.Pipeline}
+}
+
+/////////// MQTT Pipeline Status Resolver
+
+type MqttPipelineStatusResolver struct {
+	log *logging.Logger
+	s   MqttPipelineStats
+}
+
+func (r *MqttPipelineStatusResolver) Workers() int32 {
+	return int32(r.s.Workers)
+}
+
+func (r *MqttPipelineStatusResolver) QueueDepth() int32 {
+	return int32(r.s.QueueDepth)
+}
+
+func (r *MqttPipelineStatusResolver) QueueCapacity() int32 {
+	return int32(r.s.QueueCapacity)
+}
+
+func (r *MqttPipelineStatusResolver) Processed() int32 {
+	return counterInt32(r.s.Processed)
+}
+
+func (r *MqttPipelineStatusResolver) Dropped() int32 {
+	return counterInt32(r.s.Dropped)
+}
+
+/////////// Resolver
+
+func (r *Resolver) MqttStatus(ctx context.Context) (*MqttStatusResolver, error) {
+
+	if err := r.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	return &MqttStatusResolver{r.log, r.mqtt.Status()}, nil
+}
@@ -0,0 +1,56 @@
+package main_test
+
+import (
+	"piot-server/schema"
+	"testing"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/gqltesting"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMqttStatusGet(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	adminId := CreateAdmin(t, db, "admin@test.com", "passwd")
+	userId := CreateUser(t, db, "test@test.com", "passwd")
+
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTests(t, []*gqltesting.Test{
+		{
+			Context: AuthContext(t, adminId, primitive.NilObjectID),
+			Schema:  schema,
+			Query: `
+                {
+                    mqttStatus {
+                        connected, sessions, reconnects, last_error, last_error_time
+                        pipeline { workers, queue_depth, queue_capacity, processed, dropped }
+                    }
+                }
+            `,
+			ExpectedResult: `
+                {
+                    "mqttStatus": {
+                        "connected": true,
+                        "sessions": 1,
+                        "reconnects": 2,
+                        "last_error": "connection lost",
+                        "last_error_time": 1000,
+                        "pipeline": {
+                            "workers": 4,
+                            "queue_depth": 3,
+                            "queue_capacity": 4000,
+                            "processed": 100,
+                            "dropped": 5
+                        }
+                    }
+                }
+            `,
+		},
+	})
+
+	// only admin can see state of mqtt connection
+	result := schema.Exec(AuthContext(t, userId, primitive.NilObjectID), `{ mqttStatus { connected } }`, "", nil)
+	Assert(t, len(result.Errors) > 0, "MQTT status shall be available only to admin")
+}
@@ -219,6 +219,8 @@ func (r *Resolver) CreateOrg(args *struct {
 		return nil, errors.New("error while creating organizaton")
 	}
 
+	r.orgs.Changed()
+
 	r.log.Debugf("Created organization: %v", *org)
 
 	return &OrgResolver{r.log, r.db, r.users, org}, nil
@@ -293,6 +295,8 @@ func (r *Resolver) UpdateOrg(args struct{ Org orgUpdateInput }) (*OrgResolver, e
 		return nil, errors.New("error while updating org")
 	}
 
+	r.orgs.Changed()
+
 	// read org
 	err = collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&org)
 	if err != nil {
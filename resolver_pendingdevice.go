@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/op/go-logging"
+	"golang.org/x/net/context"
+)
+
+/////////// Pending Device Resolver
+
+type PendingDeviceResolver struct {
+	log *logging.Logger
+	d   *PiotPendingDevice
+}
+
+func (r *PendingDeviceResolver) PiotId() string {
+	return r.d.PiotId
+}
+
+func (r *PendingDeviceResolver) FirstSeen() int32 {
+	return r.d.FirstSeen
+}
+
+func (r *PendingDeviceResolver) LastSeen() int32 {
+	return r.d.LastSeen
+}
+
+func (r *PendingDeviceResolver) Packets() int32 {
+	return r.d.Packets
+}
+
+func (r *PendingDeviceResolver) Ip() string {
+	return r.d.Ip
+}
+
+func (r *PendingDeviceResolver) Rejected() *int32 {
+	if r.d.Rejected == 0 {
+		return nil
+	}
+	return &r.d.Rejected
+}
+
+/////////// Resolver
+
+// checkAdmin verifies that caller is administrator
+func (r *Resolver) checkAdmin(ctx context.Context) error {
+	profileValue := ctx.Value("profile")
+	if profileValue == nil {
+		r.log.Errorf("GQL: Missing user profile")
+		return errors.New("missing user profile")
+	}
+
+	if !profileValue.(*UserProfile).IsAdmin {
+		r.log.Errorf("GQL: No authorization for administration")
+		return errors.New("no authorization for administration")
+	}
+
+	return nil
+}
+
+func (r *Resolver) PendingDevices(ctx context.Context) ([]*PendingDeviceResolver, error) {
+
+	if err := r.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	devices, err := r.things.GetPendingPiots()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*PendingDeviceResolver{}
+	for _, device := range devices {
+		result = append(result, &PendingDeviceResolver{r.log, device})
+	}
+
+	return result, nil
+}
+
+func (r *Resolver) ApprovePendingDevice(ctx context.Context, args struct{ PiotId string }) (*ThingResolver, error) {
+
+	if err := r.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	r.log.Debugf("Approving registration of device %s", args.PiotId)
+
+	if _, err := r.things.FindPiot(args.PiotId); err == nil {
+		r.log.Errorf("Device %s is already registered", args.PiotId)
+		return nil, fmt.Errorf("device %s is already registered", args.PiotId)
+	}
+
+	// removal of pending device claims its registration, concurrent
+	// approval of the same device fails
+	if err := r.things.DeletePendingPiot(args.PiotId); err != nil {
+		return nil, err
+	}
+
+	thing, err := r.things.RegisterPiotDevice(args.PiotId)
+	if err != nil {
+		r.log.Errorf("Registration of device %s failed %v", args.PiotId, err)
+		return nil, err
+	}
+
+	r.log.Debugf("Device %s registered", args.PiotId)
+	return &ThingResolver{r.log, r.orgs, r.things, r.users, r.db, thing}, nil
+}
+
+func (r *Resolver) RejectPendingDevice(ctx context.Context, args struct{ PiotId string }) (*bool, error) {
+
+	if err := r.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	r.log.Debugf("Rejecting registration of device %s", args.PiotId)
+
+	if err := r.things.RejectPendingPiot(args.PiotId); err != nil {
+		return nil, err
+	}
+
+	result := true
+	return &result, nil
+}
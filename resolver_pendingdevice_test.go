@@ -0,0 +1,128 @@
+package main_test
+
+import (
+	"context"
+	"piot-server/schema"
+	"strings"
+	"testing"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/gqltesting"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPendingDevicesGet(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	adminId := CreateAdmin(t, db, "admin@test.com", "passwd")
+	userId := CreateUser(t, db, "test@test.com", "passwd")
+	things := GetThings(t, GetLogger(t), db)
+	_, err := things.TouchPendingPiot("device1", "192.168.1.10")
+	Ok(t, err)
+
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTests(t, []*gqltesting.Test{
+		{
+			Context: AuthContext(t, adminId, primitive.NilObjectID),
+			Schema:  schema,
+			Query: `
+                {
+                    pendingDevices { piot_id, packets, ip }
+                }
+            `,
+			ExpectedResult: `
+                {
+                    "pendingDevices": [
+                        {
+                            "piot_id": "device1",
+                            "packets": 1,
+                            "ip": "192.168.1.10"
+                        }
+                    ]
+                }
+            `,
+		},
+	})
+
+	// only admin can see pending devices
+	result := schema.Exec(AuthContext(t, userId, primitive.NilObjectID), `{ pendingDevices { piot_id } }`, "", nil)
+	Assert(t, len(result.Errors) > 0, "Pending devices shall be available only to admin")
+}
+
+func TestPendingDeviceApprove(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	adminId := CreateAdmin(t, db, "admin@test.com", "passwd")
+	things := GetThings(t, GetLogger(t), db)
+	_, err := things.TouchPendingPiot("device1", "")
+	Ok(t, err)
+	_, err = things.TouchPendingPiot("device2", "")
+	Ok(t, err)
+
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTests(t, []*gqltesting.Test{
+		{
+			Context: AuthContext(t, adminId, primitive.NilObjectID),
+			Schema:  schema,
+			Query: `
+                mutation {
+                    approvePendingDevice(piotId: "device1") { piot_id, type, availability_topic }
+                }
+            `,
+			ExpectedResult: `
+                {
+                    "approvePendingDevice": {
+                        "piot_id": "device1",
+                        "type": "device",
+                        "availability_topic": "available"
+                    }
+                }
+            `,
+		},
+		{
+			Context: AuthContext(t, adminId, primitive.NilObjectID),
+			Schema:  schema,
+			Query: `
+                mutation {
+                    rejectPendingDevice(piotId: "device2")
+                }
+            `,
+			ExpectedResult: `
+                {
+                    "rejectPendingDevice": true
+                }
+            `,
+		},
+	})
+
+	// anonymous caller cannot approve devices
+	result := schema.Exec(context.TODO(), `mutation { approvePendingDevice(piotId: "device2") { piot_id } }`, "", nil)
+	Assert(t, len(result.Errors) > 0, "Pending devices shall be approved only by admin")
+
+	_, err = things.FindPiot("device1")
+	Ok(t, err)
+	_, err = things.FindPiot("device2")
+	Assert(t, err != nil, "Rejected device shall not be registered")
+	_, err = things.FindPendingPiot("device1")
+	Assert(t, err != nil, "Approved device shall not be pending")
+	pending, err := things.FindPendingPiot("device2")
+	Ok(t, err)
+	Assert(t, pending.Rejected != 0, "Rejected device shall be marked as rejected")
+
+	// rejected device is listed until it is approved
+	result = schema.Exec(AuthContext(t, adminId, primitive.NilObjectID), `{ pendingDevices { piot_id, rejected } }`, "", nil)
+	Equals(t, 0, len(result.Errors))
+	Assert(t, strings.Contains(string(result.Data), `"rejected":`), "Rejection shall be reported")
+
+	// device cannot be registered twice
+	_, err = things.TouchPendingPiot("device1", "")
+	Ok(t, err)
+	result = schema.Exec(AuthContext(t, adminId, primitive.NilObjectID), `mutation { approvePendingDevice(piotId: "device1") { piot_id } }`, "", nil)
+	Assert(t, len(result.Errors) > 0, "Registered device shall not be approved again")
+	count, err := db.Collection("things").CountDocuments(context.TODO(), bson.M{"piot_id": "device1"})
+	Ok(t, err)
+	Equals(t, int64(1), count)
+}
@@ -11,8 +11,22 @@ type Resolver struct{
     orgs *Orgs
     things *Things
     users *Users
+    mqtt IMqtt
+    adapter *Adapter
+    classes *SensorClasses
 }
 
-func NewResolver(log *logging.Logger, db *mongo.Database, orgs *Orgs, users *Users, things *Things) *Resolver {
-    return &Resolver{log: log, db: db, orgs: orgs, things: things, users: users}
+func NewResolver(log *logging.Logger, db *mongo.Database, orgs *Orgs, users *Users, things *Things, mqtt IMqtt) *Resolver {
+    return &Resolver{log: log, db: db, orgs: orgs, things: things, users: users, mqtt: mqtt, classes: NewSensorClasses(log)}
+}
+
+// SetSensorClasses sets sensor classes used for validation of sensor units
+// (default classes are used if not set)
+func (r *Resolver) SetSensorClasses(classes *SensorClasses) {
+    r.classes = classes
+}
+
+// SetAdapter sets adapter providing counters of rejected packets
+func (r *Resolver) SetAdapter(adapter *Adapter) {
+    r.adapter = adapter
 }
@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
-	//"fmt"
+	"fmt"
+	"math"
+	"time"
 
 	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/op/go-logging"
@@ -16,6 +18,8 @@ import (
 type thingUpdateInput struct {
 	Id                    graphql.ID
 	PiotId                *string
+	PiotKey               *string
+	PiotCounter           *int32
 	Name                  *string
 	Type                  *string
 	Description           *string
@@ -26,6 +30,9 @@ type thingUpdateInput struct {
 	OrgId                 *graphql.ID
 	AvailabilityTopic     *string
 	TelemetryTopic        *string
+	TelemetryFields       *[]telemetryFieldInput
+	TelemetryTracking     *bool
+	TelemetryHistory      *bool
 	StoreInfluxDb         *bool
 	StoreMysqlDb          *bool
 	StoreMysqlDbInterval  *int32
@@ -42,11 +49,20 @@ type thingUpdateInput struct {
 	BatteryMqttLevelValue *string
 }
 
+type telemetryFieldInput struct {
+	Name string
+	Path string
+	Type string
+}
+
 type thingSensorDataUpdateInput struct {
-	Id               graphql.ID
-	Class            *string
-	MeasurementTopic *string
-	MeasurementValue *string
+	Id                    graphql.ID
+	Class                 *string
+	MeasurementTopic      *string
+	MeasurementValue      *string
+	MeasurementExpression *string
+	Unit                  *string
+	Validity              *int32
 }
 
 type thingSwitchDataUpdateInput struct {
@@ -77,6 +93,24 @@ func (r *ThingResolver) PiotId() string {
 	return r.t.PiotId
 }
 
+// HasPiotKey tells if device has key for authenticated encryption, the key
+// itself is write only
+func (r *ThingResolver) HasPiotKey() bool {
+	return r.t.PiotKey != ""
+}
+
+func (r *ThingResolver) PiotCounter() *int32 {
+	return r.t.PiotCounter
+}
+
+func (r *ThingResolver) PiotCommands() []*PiotCommandResolver {
+	result := make([]*PiotCommandResolver, 0, len(r.t.PiotCommands))
+	for i := range r.t.PiotCommands {
+		result = append(result, &PiotCommandResolver{r.log, &r.t.PiotCommands[i]})
+	}
+	return result
+}
+
 func (r *ThingResolver) Name() string {
 	return r.t.Name
 }
@@ -147,6 +181,52 @@ func (r *ThingResolver) Parent() *ThingResolver {
 	return nil
 }
 
+// Pattern returns thing with topic patterns the thing was materialised from
+func (r *ThingResolver) Pattern() *ThingResolver {
+
+	if r.t.PatternId != primitive.NilObjectID {
+
+		patternThing, err := r.things.Get(r.t.PatternId)
+		if err != nil {
+			r.log.Errorf("GQL: Fetching pattern %v for thing %v failed", r.t.PatternId, r.t.Id)
+		} else {
+			return &ThingResolver{r.log, r.orgs, r.things, r.users, r.db, patternThing}
+		}
+	}
+
+	return nil
+}
+
+func (r *ThingResolver) Available() bool {
+	return r.t.Available
+}
+
+func (r *ThingResolver) AvailableChanged() int32 {
+	return r.t.AvailableChanged
+}
+
+func (r *ThingResolver) AvailabilityEvents(args struct{ Limit *int32 }) ([]*AvailabilityEventResolver, error) {
+	limit := int64(AVAILABILITY_EVENTS_LIMIT)
+	if args.Limit != nil {
+		if *args.Limit <= 0 {
+			return nil, errors.New("limit has to be positive number")
+		}
+		limit = int64(*args.Limit)
+	}
+
+	events, err := r.things.GetAvailabilityEvents(r.t.Id, limit)
+	if err != nil {
+		return nil, errors.New("cannot fetch availability events")
+	}
+
+	result := []*AvailabilityEventResolver{}
+	for _, e := range events {
+		result = append(result, &AvailabilityEventResolver{r.log, e})
+	}
+
+	return result, nil
+}
+
 func (r *ThingResolver) AvailabilityTopic() string {
 	return r.t.AvailabilityTopic
 }
@@ -167,6 +247,54 @@ func (r *ThingResolver) Telemetry() string {
 	return r.t.Telemetry
 }
 
+func (r *ThingResolver) TelemetryFields() []*TelemetryFieldResolver {
+	result := []*TelemetryFieldResolver{}
+	for i := range r.t.TelemetryFields {
+		result = append(result, &TelemetryFieldResolver{r.log, &r.t.TelemetryFields[i]})
+	}
+
+	return result
+}
+
+func (r *ThingResolver) TelemetryValues() []*TelemetryValueResolver {
+	result := []*TelemetryValueResolver{}
+	for i := range r.t.TelemetryValues {
+		result = append(result, &TelemetryValueResolver{r.log, &r.t.TelemetryValues[i]})
+	}
+
+	return result
+}
+
+func (r *ThingResolver) TelemetryTracking() bool {
+	return r.t.TelemetryTracking
+}
+
+func (r *ThingResolver) TelemetryHistory() bool {
+	return r.t.TelemetryHistory
+}
+
+func (r *ThingResolver) TelemetrySamples(args struct{ Limit *int32 }) ([]*TelemetrySampleResolver, error) {
+	limit := int64(TELEMETRY_SAMPLES_LIMIT)
+	if args.Limit != nil {
+		if *args.Limit <= 0 {
+			return nil, errors.New("limit has to be positive number")
+		}
+		limit = int64(*args.Limit)
+	}
+
+	samples, err := r.things.GetTelemetrySamples(r.t.Id, limit)
+	if err != nil {
+		return nil, errors.New("cannot fetch telemetry samples")
+	}
+
+	result := []*TelemetrySampleResolver{}
+	for _, s := range samples {
+		result = append(result, &TelemetrySampleResolver{r.log, s})
+	}
+
+	return result, nil
+}
+
 func (r *ThingResolver) StoreInfluxDb() bool {
 	return r.t.StoreInfluxDb
 }
@@ -277,6 +405,10 @@ func (r *SensorResolver) MeasurementValue() string {
 	return r.t.Sensor.MeasurementValue
 }
 
+func (r *SensorResolver) MeasurementExpression() string {
+	return r.t.Sensor.MeasurementExpression
+}
+
 func (r *SensorResolver) Value() string {
 	return r.t.Sensor.Value
 }
@@ -289,6 +421,18 @@ func (r *SensorResolver) Class() string {
 	return r.t.Sensor.Class
 }
 
+func (r *SensorResolver) MeasurementLast() int32 {
+	return r.t.Sensor.MeasurementLast
+}
+
+func (r *SensorResolver) Validity() int32 {
+	return r.t.Sensor.Validity
+}
+
+func (r *SensorResolver) Stale() bool {
+	return r.t.Sensor.Stale(int32(time.Now().Unix()))
+}
+
 /////////////// Switch Data Resolver
 
 type SwitchResolver struct {
@@ -324,6 +468,186 @@ func (r *SwitchResolver) CommandOff() string {
 	return r.t.Switch.CommandOff
 }
 
+func (r *SwitchResolver) Request() *SwitchRequestResolver {
+	if r.t.Switch.Request == nil {
+		return nil
+	}
+
+	return &SwitchRequestResolver{r.log, r.t.Switch.Request}
+}
+
+/////////////// Switch Request Resolver
+
+type SwitchRequestResolver struct {
+	log *logging.Logger
+	r   *SwitchRequest
+}
+
+func (r *SwitchRequestResolver) State() bool {
+	return r.r.State
+}
+
+func (r *SwitchRequestResolver) Status() string {
+	return r.r.CurrentStatus(int32(time.Now().Unix()))
+}
+
+func (r *SwitchRequestResolver) Created() int32 {
+	return r.r.Created
+}
+
+func (r *SwitchRequestResolver) Deadline() int32 {
+	return r.r.Deadline
+}
+
+func (r *SwitchRequestResolver) Completed() int32 {
+	return r.r.Completed
+}
+
+/////////////// Availability Event Resolver
+
+// default number of availability events returned for thing
+const AVAILABILITY_EVENTS_LIMIT = 100
+
+type AvailabilityEventResolver struct {
+	log *logging.Logger
+	e   *AvailabilityEvent
+}
+
+func (r *AvailabilityEventResolver) Available() bool {
+	return r.e.Available
+}
+
+func (r *AvailabilityEventResolver) Time() int32 {
+	return r.e.Time
+}
+
+/////////////// Telemetry Resolvers
+
+// default number of telemetry samples returned for thing
+const TELEMETRY_SAMPLES_LIMIT = 100
+
+type TelemetryFieldResolver struct {
+	log *logging.Logger
+	f   *TelemetryField
+}
+
+func (r *TelemetryFieldResolver) Name() string {
+	return r.f.Name
+}
+
+func (r *TelemetryFieldResolver) Path() string {
+	return r.f.Path
+}
+
+func (r *TelemetryFieldResolver) Type() string {
+	return r.f.Type
+}
+
+type TelemetryValueResolver struct {
+	log *logging.Logger
+	v   *TelemetryValue
+}
+
+func (r *TelemetryValueResolver) Name() string {
+	return r.v.Name
+}
+
+func (r *TelemetryValueResolver) Type() string {
+	return r.v.Type
+}
+
+func (r *TelemetryValueResolver) Value() string {
+	return r.v.Value
+}
+
+// FloatValue returns value of numeric fields
+func (r *TelemetryValueResolver) FloatValue() *float64 {
+	var result float64
+	switch value := r.v.Typed().(type) {
+	case float64:
+		result = value
+	case int64:
+		result = float64(value)
+	default:
+		return nil
+	}
+
+	return &result
+}
+
+// IntValue returns value of integer fields that fit into GraphQL Int
+func (r *TelemetryValueResolver) IntValue() *int32 {
+	value, ok := r.v.Typed().(int64)
+	if !ok || value < math.MinInt32 || value > math.MaxInt32 {
+		return nil
+	}
+
+	result := int32(value)
+	return &result
+}
+
+func (r *TelemetryValueResolver) BoolValue() *bool {
+	value, ok := r.v.Typed().(bool)
+	if !ok {
+		return nil
+	}
+
+	return &value
+}
+
+type TelemetrySampleResolver struct {
+	log *logging.Logger
+	s   *TelemetrySample
+}
+
+func (r *TelemetrySampleResolver) Time() int32 {
+	return r.s.Time
+}
+
+func (r *TelemetrySampleResolver) Values() []*TelemetryValueResolver {
+	result := []*TelemetryValueResolver{}
+	for i := range r.s.Values {
+		result = append(result, &TelemetryValueResolver{r.log, &r.s.Values[i]})
+	}
+
+	return result
+}
+
+/////////////// Piot Command Resolver
+
+type PiotCommandResolver struct {
+	log *logging.Logger
+	c   *PiotCommand
+}
+
+func (r *PiotCommandResolver) Id() graphql.ID {
+	return graphql.ID(r.c.Id.Hex())
+}
+
+func (r *PiotCommandResolver) Name() string {
+	return r.c.Name
+}
+
+func (r *PiotCommandResolver) Value() string {
+	return r.c.Value
+}
+
+func (r *PiotCommandResolver) Created() int32 {
+	return r.c.Created
+}
+
+func (r *PiotCommandResolver) Delivered() int32 {
+	return r.c.Delivered
+}
+
+func (r *PiotCommandResolver) Deliveries() int32 {
+	return r.c.Deliveries
+}
+
+func (r *PiotCommandResolver) Acknowledged() int32 {
+	return r.c.Acknowledged
+}
+
 /////////////// Resolver
 
 type ThingFilter struct {
@@ -468,6 +792,8 @@ func (r *Resolver) CreateThing(args *struct {
 		return nil, err
 	}
 
+	r.things.Changed()
+
 	return &ThingResolver{r.log, r.orgs, r.things, r.users, r.db, thing}, nil
 }
 
@@ -503,6 +829,23 @@ func (r *Resolver) UpdateThing(args struct{ Thing thingUpdateInput }) (*ThingRes
 	if args.Thing.PiotId != nil {
 		updateFields["piot_id"] = *args.Thing.PiotId
 	}
+	if args.Thing.PiotKey != nil {
+		// empty key disables authenticated encryption for the thing
+		if *args.Thing.PiotKey != "" {
+			if _, err := PiotParseKey(*args.Thing.PiotKey); err != nil {
+				return nil, err
+			}
+		}
+		updateFields["piot_key"] = *args.Thing.PiotKey
+	}
+	if args.Thing.PiotCounter != nil {
+		// allows to reset counter e.g. after reflashing of the device, -1
+		// allows device to start with counter 0
+		if *args.Thing.PiotCounter < -1 {
+			return nil, errors.New("piot counter cannot be less than -1")
+		}
+		updateFields["piot_counter"] = *args.Thing.PiotCounter
+	}
 	if args.Thing.Name != nil {
 		updateFields["name"] = *args.Thing.Name
 	}
@@ -525,11 +868,33 @@ func (r *Resolver) UpdateThing(args struct{ Thing thingUpdateInput }) (*ThingRes
 		updateFields["voltage"] = *args.Thing.Voltage
 	}
 	if args.Thing.AvailabilityTopic != nil {
+		if err := ValidateTopicPattern(*args.Thing.AvailabilityTopic); err != nil {
+			return nil, err
+		}
 		updateFields["availability_topic"] = *args.Thing.AvailabilityTopic
 	}
 	if args.Thing.TelemetryTopic != nil {
+		if err := ValidateTopicPattern(*args.Thing.TelemetryTopic); err != nil {
+			return nil, err
+		}
 		updateFields["telemetry_topic"] = *args.Thing.TelemetryTopic
 	}
+	if args.Thing.TelemetryFields != nil {
+		fields := []TelemetryField{}
+		for _, f := range *args.Thing.TelemetryFields {
+			fields = append(fields, TelemetryField{Name: f.Name, Path: f.Path, Type: f.Type})
+		}
+		if err := ValidateTelemetryFields(fields); err != nil {
+			return nil, err
+		}
+		updateFields["telemetry_fields"] = fields
+	}
+	if args.Thing.TelemetryTracking != nil {
+		updateFields["telemetry_tracking"] = *args.Thing.TelemetryTracking
+	}
+	if args.Thing.TelemetryHistory != nil {
+		updateFields["telemetry_history"] = *args.Thing.TelemetryHistory
+	}
 	if args.Thing.StoreInfluxDb != nil {
 		updateFields["store_influxdb"] = *args.Thing.StoreInfluxDb
 	}
@@ -540,6 +905,9 @@ func (r *Resolver) UpdateThing(args struct{ Thing thingUpdateInput }) (*ThingRes
 		updateFields["store_mysqldb_interval"] = *args.Thing.StoreMysqlDbInterval
 	}
 	if args.Thing.LocationMqttTopic != nil {
+		if err := ValidateTopicPattern(*args.Thing.LocationMqttTopic); err != nil {
+			return nil, err
+		}
 		updateFields["loc_mqtt_topic"] = *args.Thing.LocationMqttTopic
 	}
 	if args.Thing.LocationMqttLatValue != nil {
@@ -567,6 +935,9 @@ func (r *Resolver) UpdateThing(args struct{ Thing thingUpdateInput }) (*ThingRes
 		updateFields["battery_level_tracking"] = *args.Thing.BatteryLevelTracking
 	}
 	if args.Thing.BatteryMqttTopic != nil {
+		if err := ValidateTopicPattern(*args.Thing.BatteryMqttTopic); err != nil {
+			return nil, err
+		}
 		updateFields["battery_mqtt_topic"] = *args.Thing.BatteryMqttTopic
 	}
 	if args.Thing.BatteryMqttLevelValue != nil {
@@ -589,12 +960,19 @@ func (r *Resolver) UpdateThing(args struct{ Thing thingUpdateInput }) (*ThingRes
 		return nil, errors.New("error while updating thing")
 	}
 
+	r.things.Changed()
+
 	// read thing
 	err = collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&thing)
 	if err != nil {
 		return nil, errors.New("cannot fetch thing data")
 	}
 
+	// things materialised from topic patterns follow their template
+	if err := r.things.UpdatePatternThings(&thing); err != nil {
+		return nil, err
+	}
+
 	r.log.Debugf("Thing updated %v", thing)
 	return &ThingResolver{r.log, r.orgs, r.things, r.users, r.db, &thing}, nil
 }
@@ -623,11 +1001,45 @@ func (r *Resolver) UpdateThingSensorData(args struct{ Data thingSensorDataUpdate
 		updateFields["sensor.class"] = *args.Data.Class
 	}
 	if args.Data.MeasurementTopic != nil {
+		if err := ValidateTopicPattern(*args.Data.MeasurementTopic); err != nil {
+			return nil, err
+		}
 		updateFields["sensor.measurement_topic"] = *args.Data.MeasurementTopic
 	}
 	if args.Data.MeasurementValue != nil {
 		updateFields["sensor.measurement_value"] = *args.Data.MeasurementValue
 	}
+	if args.Data.MeasurementExpression != nil {
+		// empty expression disables computation of value
+		if *args.Data.MeasurementExpression != "" {
+			if _, err := ParseExpression(*args.Data.MeasurementExpression); err != nil {
+				return nil, err
+			}
+		}
+		updateFields["sensor.measurement_expression"] = *args.Data.MeasurementExpression
+	}
+	if args.Data.Unit != nil {
+		updateFields["sensor.unit"] = *args.Data.Unit
+	}
+	if args.Data.Class != nil || args.Data.Unit != nil {
+		class := thing.Sensor.Class
+		if args.Data.Class != nil {
+			class = *args.Data.Class
+		}
+		unit := thing.Sensor.Unit
+		if args.Data.Unit != nil {
+			unit = *args.Data.Unit
+		}
+		if err := r.validateSensorUnit(class, unit); err != nil {
+			return nil, err
+		}
+	}
+	if args.Data.Validity != nil {
+		if *args.Data.Validity < 0 {
+			return nil, errors.New("sensor validity cannot be negative")
+		}
+		updateFields["sensor.validity"] = *args.Data.Validity
+	}
 	update := bson.M{"$set": updateFields}
 
 	_, err = collection.UpdateOne(context.TODO(), bson.M{"_id": id}, update)
@@ -636,16 +1048,42 @@ func (r *Resolver) UpdateThingSensorData(args struct{ Data thingSensorDataUpdate
 		return nil, errors.New("error while updating thing")
 	}
 
+	r.things.Changed()
+
 	// read thing
 	err = collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&thing)
 	if err != nil {
 		return nil, errors.New("cannot fetch thing data")
 	}
 
+	// things materialised from topic patterns follow their template
+	if err := r.things.UpdatePatternThings(&thing); err != nil {
+		return nil, err
+	}
+
 	r.log.Debugf("Thing sensor data updated %v", thing)
 	return &ThingResolver{r.log, r.orgs, r.things, r.users, r.db, &thing}, nil
 }
 
+// validateSensorUnit checks that values of sensor class can be converted to
+// unit, sensors of unknown classes can have any unit
+func (r *Resolver) validateSensorUnit(className, unit string) error {
+	if unit == "" {
+		return nil
+	}
+
+	class := r.classes.GetByName(className)
+	if class == nil {
+		return nil
+	}
+
+	if !UnitsCompatible(class.Unit, unit) {
+		return fmt.Errorf("unit %s is not compatible with %s sensor", unit, class.Name)
+	}
+
+	return nil
+}
+
 func (r *Resolver) UpdateThingSwitchData(args struct{ Data thingSwitchDataUpdateInput }) (*ThingResolver, error) {
 
 	r.log.Debugf("Updating thing %s switch data", args.Data.Id)
@@ -667,6 +1105,9 @@ func (r *Resolver) UpdateThingSwitchData(args struct{ Data thingSwitchDataUpdate
 	// thing exists -> update it
 	updateFields := bson.M{}
 	if args.Data.StateTopic != nil {
+		if IsTopicPattern(*args.Data.StateTopic) {
+			return nil, errTopicPattern
+		}
 		updateFields["switch.state_topic"] = *args.Data.StateTopic
 	}
 	if args.Data.StateOn != nil {
@@ -676,6 +1117,9 @@ func (r *Resolver) UpdateThingSwitchData(args struct{ Data thingSwitchDataUpdate
 		updateFields["switch.state_off"] = *args.Data.StateOff
 	}
 	if args.Data.CommandTopic != nil {
+		if IsTopicPattern(*args.Data.CommandTopic) {
+			return nil, errTopicPattern
+		}
 		updateFields["switch.command_topic"] = *args.Data.CommandTopic
 	}
 	if args.Data.CommandOn != nil {
@@ -692,6 +1136,8 @@ func (r *Resolver) UpdateThingSwitchData(args struct{ Data thingSwitchDataUpdate
 		return nil, errors.New("error while updating thing")
 	}
 
+	r.things.Changed()
+
 	// read thing
 	err = collection.FindOne(context.TODO(), bson.M{"_id": id}).Decode(&thing)
 	if err != nil {
@@ -727,6 +1173,156 @@ func (r *Resolver) SetThingAlarm(args *struct {
 	return &args.Active, nil
 }
 
+func (r *Resolver) SetSwitchState(ctx context.Context, args *struct {
+	Id      graphql.ID
+	On      bool
+	Timeout *int32
+}) (*ThingResolver, error) {
+
+	r.log.Debugf("Setting switch %s state to %v", args.Id, args.On)
+
+	// authorization checks
+	profileValue := ctx.Value("profile")
+	if profileValue == nil {
+		r.log.Errorf("GQL: Missing user profile")
+		return nil, errors.New("missing user profile")
+	}
+	profile := profileValue.(*UserProfile)
+
+	// create ObjectID from string
+	id, err := primitive.ObjectIDFromHex(string(args.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	thing, err := r.things.Get(id)
+	if err != nil {
+		return nil, errors.New("thing does not exist")
+	}
+
+	// only members of thing org (or admins) can control it
+	authorized := profile.IsAdmin
+	for _, orgId := range profile.OrgIds {
+		if !thing.OrgId.IsZero() && orgId == thing.OrgId {
+			authorized = true
+		}
+	}
+	if !authorized {
+		r.log.Errorf("GQL: No authorization to control thing %s", thing.Name)
+		return nil, errors.New("no authorization to control thing")
+	}
+
+	if thing.Type != THING_TYPE_SWITCH {
+		return nil, errors.New("thing is not a switch")
+	}
+
+	command := thing.Switch.CommandOff
+	if args.On {
+		command = thing.Switch.CommandOn
+	}
+
+	if thing.Switch.CommandTopic == "" || command == "" {
+		return nil, errors.New("switch command is not configured")
+	}
+
+	timeout := SWITCH_REQUEST_TIMEOUT_DEFAULT
+	if args.Timeout != nil {
+		if *args.Timeout <= 0 {
+			return nil, errors.New("timeout has to be positive number of seconds")
+		}
+		timeout = time.Duration(*args.Timeout) * time.Second
+	}
+
+	// request is stored before the command is published, switch could
+	// report its new state before publishing is confirmed
+	request, err := r.things.SetSwitchRequest(id, args.On, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.mqtt.PushCommand(thing, thing.Switch.CommandTopic, command); err != nil {
+		r.log.Errorf("Publishing switch command failed %v", err)
+		if err := r.things.ClearSwitchRequest(id, request); err != nil {
+			r.log.Errorf("Clearing switch request failed %v", err)
+		}
+		return nil, errors.New("error while sending command to switch")
+	}
+
+	thing.Switch.Request = request
+
+	r.log.Debugf("Switch command sent")
+	return &ThingResolver{r.log, r.orgs, r.things, r.users, r.db, thing}, nil
+}
+
+func (r *Resolver) CreatePiotCommand(args *struct {
+	ThingId graphql.ID
+	Name    string
+	Value   *string
+}) (*PiotCommandResolver, error) {
+
+	r.log.Debugf("Creating command %s for thing %s", args.Name, args.ThingId)
+
+	// create ObjectID from string
+	id, err := primitive.ObjectIDFromHex(string(args.ThingId))
+	if err != nil {
+		return nil, err
+	}
+
+	value := ""
+	if args.Value != nil {
+		value = *args.Value
+	}
+
+	if err := ValidatePiotCommand(args.Name, value); err != nil {
+		return nil, err
+	}
+
+	thing, err := r.things.Get(id)
+	if err != nil {
+		return nil, errors.New("thing does not exist")
+	}
+
+	if thing.Type != THING_TYPE_DEVICE {
+		return nil, errors.New("commands can be sent only to devices")
+	}
+
+	command, err := r.things.AddPiotCommand(id, args.Name, value)
+	if err != nil {
+		r.log.Errorf("Creating thing command failed %v", err)
+		return nil, err
+	}
+
+	r.log.Debugf("Thing command created")
+	return &PiotCommandResolver{r.log, command}, nil
+}
+
+func (r *Resolver) DeletePiotCommand(args *struct {
+	ThingId graphql.ID
+	Id      graphql.ID
+}) (*bool, error) {
+
+	r.log.Debugf("Delete command %s of thing %s", args.Id, args.ThingId)
+
+	// create ObjectIDs from strings
+	thingId, err := primitive.ObjectIDFromHex(string(args.ThingId))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := primitive.ObjectIDFromHex(string(args.Id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.things.DeletePiotCommand(thingId, id); err != nil {
+		r.log.Errorf("Delete thing command failed %v", err)
+		return nil, err
+	}
+
+	r.log.Debugf("Thing command deleted")
+	return nil, nil
+}
+
 func (r *Resolver) DeleteThing(args *struct{ Id graphql.ID }) (*bool, error) {
 
 	r.log.Debugf("Delete thing %s", args.Id)
@@ -2,9 +2,12 @@ package main_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	main "piot-server"
 	"piot-server/schema"
 	"testing"
+	"time"
 
 	graphql "github.com/graph-gophers/graphql-go"
 	"github.com/graph-gophers/graphql-go/gqltesting"
@@ -312,6 +315,134 @@ func TestThingUpdate(t *testing.T) {
 	})
 }
 
+// key of device can be set, but it is not readable
+func TestThingPiotKeyUpdate(t *testing.T) {
+	const KEY = "000102030405060708090a0b0c0d0e0f"
+
+	db := GetDb(t)
+	CleanDb(t, db)
+	id := CreateDevice(t, db, "device1")
+	orgId := CreateOrg(t, db, "org1")
+	AddOrgThing(t, db, orgId, "device1")
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query:   fmt.Sprintf(`{ thing(id: "%s") { has_piot_key } }`, id.Hex()),
+		ExpectedResult: `
+            {
+                "thing": {"has_piot_key": false}
+            }
+        `,
+	})
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query:   fmt.Sprintf(`mutation { updateThing(thing: {id: "%s", piot_key: "%s"}) { has_piot_key } }`, id.Hex(), KEY),
+		ExpectedResult: `
+            {
+                "updateThing": {"has_piot_key": true}
+            }
+        `,
+	})
+
+	thing, err := GetThings(t, GetLogger(t), db).Get(id)
+	Ok(t, err)
+	Equals(t, KEY, thing.PiotKey)
+
+	// invalid key is refused
+	result := schema.Exec(context.TODO(), fmt.Sprintf(`mutation { updateThing(thing: {id: "%s", piot_key: "xyz"}) { has_piot_key } }`, id.Hex()), "", nil)
+	Assert(t, len(result.Errors) > 0, "invalid key shall be refused")
+
+	// key cannot be queried
+	result = schema.Exec(context.TODO(), fmt.Sprintf(`{ thing(id: "%s") { piot_key } }`, id.Hex()), "", nil)
+	Assert(t, len(result.Errors) > 0, "key shall not be readable")
+}
+
+func TestThingTelemetryUpdate(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	id := CreateDevice(t, db, "device1")
+	things := GetThings(t, GetLogger(t), db)
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query: fmt.Sprintf(`
+            mutation {
+                updateThing(
+                    thing: {
+                        id: "%s",
+                        telemetry_fields: [
+                            {name: "uptime", path: "UptimeSec", type: "int"},
+                            {name: "rssi", path: "Wifi.RSSI", type: "float"}
+                        ],
+                        telemetry_tracking: true,
+                        telemetry_history: true
+                    }
+                ) {
+                    telemetry_fields {name, path, type},
+                    telemetry_tracking,
+                    telemetry_history
+                }
+            }
+        `, id.Hex()),
+		ExpectedResult: `
+            {
+                "updateThing": {
+                    "telemetry_fields": [
+                        {"name": "uptime", "path": "UptimeSec", "type": "int"},
+                        {"name": "rssi", "path": "Wifi.RSSI", "type": "float"}
+                    ],
+                    "telemetry_tracking": true,
+                    "telemetry_history": true
+                }
+            }
+        `,
+	})
+
+	// invalid fields are rejected
+	query := fmt.Sprintf(`mutation {updateThing(thing: {id: "%s", telemetry_fields: [{name: "uptime", path: "UptimeSec", type: "duration"}]}) {name}}`, id.Hex())
+	result := schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "invalid telemetry field accepted")
+
+	// typed values and history
+	values := []main.TelemetryValue{
+		{Name: "uptime", Type: main.TELEMETRY_TYPE_INT, Value: "3600"},
+		{Name: "rssi", Type: main.TELEMETRY_TYPE_FLOAT, Value: "-60.5"},
+	}
+	Ok(t, things.SetTelemetryValues(id, values, time.Unix(1000, 0), true))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query: fmt.Sprintf(`
+            {
+                thing(id: "%s") {
+                    telemetry_values {name, value, float_value, int_value, bool_value},
+                    telemetry_samples(limit: 10) {time, values {name, value}}
+                }
+            }
+        `, id.Hex()),
+		ExpectedResult: `
+            {
+                "thing": {
+                    "telemetry_values": [
+                        {"name": "uptime", "value": "3600", "float_value": 3600, "int_value": 3600, "bool_value": null},
+                        {"name": "rssi", "value": "-60.5", "float_value": -60.5, "int_value": null, "bool_value": null}
+                    ],
+                    "telemetry_samples": [
+                        {"time": 1000, "values": [{"name": "uptime", "value": "3600"}, {"name": "rssi", "value": "-60.5"}]}
+                    ]
+                }
+            }
+        `,
+	})
+}
+
 func TestThingSensorDataUpdate(t *testing.T) {
 	db := GetDb(t)
 	CleanDb(t, db)
@@ -325,17 +456,102 @@ func TestThingSensorDataUpdate(t *testing.T) {
 		Schema:  schema,
 		Query: fmt.Sprintf(`
             mutation {
-                updateThingSensorData(data: {id: "%s", measurement_topic: "xyz"}) {sensor {measurement_topic}}
+                updateThingSensorData(data: {id: "%s", measurement_topic: "xyz", unit: "F", validity: 60}) {sensor {measurement_topic, unit, validity, stale}}
             }
         `, id.Hex()),
 		ExpectedResult: `
             {
                 "updateThingSensorData": {
-                    "sensor": {"measurement_topic": "xyz"}
+                    "sensor": {"measurement_topic": "xyz", "unit": "F", "validity": 60, "stale": true}
                 }
             }
         `,
 	})
+
+	// unit has to be compatible with class of sensor
+	query := fmt.Sprintf(`mutation {updateThingSensorData(data: {id: "%s", unit: "Pa"}) {name}}`, id.Hex())
+	result := schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "unit of other quantity accepted")
+
+	query = fmt.Sprintf(`mutation {updateThingSensorData(data: {id: "%s", class: "pressure"}) {name}}`, id.Hex())
+	result = schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "class incompatible with unit accepted")
+
+	query = fmt.Sprintf(`mutation {updateThingSensorData(data: {id: "%s", class: "pressure", unit: "Pa"}) {name}}`, id.Hex())
+	result = schema.Exec(context.TODO(), query, "", nil)
+	Equals(t, 0, len(result.Errors))
+}
+
+func TestThingSensorExpressionUpdate(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	id := CreateThing(t, db, "thing1")
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query: fmt.Sprintf(`
+            mutation {
+                updateThingSensorData(data: {id: "%s", measurement_expression: "value * 0.1 + 2"}) {sensor {measurement_expression}}
+            }
+        `, id.Hex()),
+		ExpectedResult: `
+            {
+                "updateThingSensorData": {
+                    "sensor": {"measurement_expression": "value * 0.1 + 2"}
+                }
+            }
+        `,
+	})
+
+	// invalid expressions are rejected
+	query := fmt.Sprintf(`mutation {updateThingSensorData(data: {id: "%s", measurement_expression: "value * "}) {name}}`, id.Hex())
+	result := schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "invalid expression accepted")
+
+	query = fmt.Sprintf(`mutation {updateThingSensorData(data: {id: "%s", measurement_expression: "system(value)"}) {name}}`, id.Hex())
+	result = schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "unknown function accepted")
+}
+
+func TestThingTopicPatternUpdate(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, "thing1")
+	switchId := CreateSwitch(t, db, "thing2")
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query: fmt.Sprintf(`
+            mutation {
+                updateThingSensorData(data: {id: "%s", measurement_topic: "zigbee/+/temperature"}) {sensor {measurement_topic}}
+            }
+        `, sensorId.Hex()),
+		ExpectedResult: `
+            {
+                "updateThingSensorData": {
+                    "sensor": {"measurement_topic": "zigbee/+/temperature"}
+                }
+            }
+        `,
+	})
+
+	// multi level wildcard must be last level of topic
+	query := fmt.Sprintf(`mutation {updateThingSensorData(data: {id: "%s", measurement_topic: "zigbee/#/temperature"}) {name}}`, sensorId.Hex())
+	result := schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "invalid topic pattern accepted")
+
+	query = fmt.Sprintf(`mutation {updateThing(thing: {id: "%s", battery_mqtt_topic: "zigbee/dev+/battery"}) {name}}`, sensorId.Hex())
+	result = schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "invalid topic pattern accepted")
+
+	// state of switch is not shared by many topics
+	query = fmt.Sprintf(`mutation {updateThingSwitchData(data: {id: "%s", state_topic: "zigbee/+/state"}) {name}}`, switchId.Hex())
+	result = schema.Exec(context.TODO(), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "wildcard in switch topic accepted")
 }
 
 func TestThingSwitchDataUpdate(t *testing.T) {
@@ -387,3 +603,118 @@ func TestThingSetAlarm(t *testing.T) {
         `,
 	})
 }
+
+func TestPiotCommandCreate(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	id := CreateDevice(t, db, "device1")
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), getResolver(t, db))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query: fmt.Sprintf(`
+            mutation {
+                createPiotCommand(thingId: "%s", name: "interval", value: "60") { name, value, delivered }
+            }
+        `, id.Hex()),
+		ExpectedResult: `
+            {
+                "createPiotCommand": {
+                    "name": "interval",
+                    "value": "60",
+                    "delivered": 0
+                }
+            }
+        `,
+	})
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: context.TODO(),
+		Schema:  schema,
+		Query: fmt.Sprintf(`
+            {
+                thing(id: "%s") { piot_commands { name, value, acknowledged } }
+            }
+        `, id.Hex()),
+		ExpectedResult: `
+            {
+                "thing": {
+                    "piot_commands": [
+                        {
+                            "name": "interval",
+                            "value": "60",
+                            "acknowledged": 0
+                        }
+                    ]
+                }
+            }
+        `,
+	})
+}
+
+func TestSwitchSetState(t *testing.T) {
+	db := GetDb(t)
+	log := GetLogger(t)
+	CleanDb(t, db)
+	userId := CreateUser(t, db, "test@test.com", "passwd")
+	switchId := CreateSwitch(t, db, "switch1")
+	orgId := CreateOrg(t, db, "org1")
+	otherOrgId := CreateOrg(t, db, "org2")
+	AddOrgThing(t, db, orgId, "switch1")
+
+	mqtt := GetMqtt(t, log)
+	resolver := main.NewResolver(log, db, GetOrgs(t, log, db), GetUsers(t, log, db), GetThings(t, log, db), mqtt)
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), resolver)
+
+	query := fmt.Sprintf(`mutation {setSwitchState(id: "%s", on: true) {switch {request {state, status}}}}`, switchId.Hex())
+
+	// user of other org is not authorized to control switch
+	result := schema.Exec(AuthContext(t, userId, otherOrgId), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "switch controlled by user of other org")
+	Equals(t, 0, len(mqtt.Calls))
+
+	gqltesting.RunTest(t, &gqltesting.Test{
+		Context: AuthContext(t, userId, orgId),
+		Schema:  schema,
+		Query:   query,
+		ExpectedResult: `
+            {
+                "setSwitchState": {
+                    "switch": {"request": {"state": true, "status": "pending"}}
+                }
+            }
+        `,
+	})
+
+	// command was published to command topic
+	Equals(t, 1, len(mqtt.Calls))
+	Equals(t, "cmnd", mqtt.Calls[0].Topic)
+	Equals(t, "ON", mqtt.Calls[0].Value)
+}
+
+// switch request is not kept pending if command was not sent
+func TestSwitchSetStateFailed(t *testing.T) {
+	db := GetDb(t)
+	log := GetLogger(t)
+	CleanDb(t, db)
+	userId := CreateUser(t, db, "test@test.com", "passwd")
+	switchId := CreateSwitch(t, db, "switch1")
+	orgId := CreateOrg(t, db, "org1")
+	AddOrgThing(t, db, orgId, "switch1")
+
+	mqtt := GetMqtt(t, log)
+	mqtt.PushCommandErr = errors.New("timeout publishing to topic")
+	things := GetThings(t, log, db)
+	resolver := main.NewResolver(log, db, GetOrgs(t, log, db), GetUsers(t, log, db), things, mqtt)
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), resolver)
+
+	query := fmt.Sprintf(`mutation {setSwitchState(id: "%s", on: true) {switch {request {state, status}}}}`, switchId.Hex())
+
+	result := schema.Exec(AuthContext(t, userId, orgId), query, "", nil)
+	Assert(t, len(result.Errors) > 0, "failed command shall be reported")
+
+	thing, err := things.Get(switchId)
+	Ok(t, err)
+	Assert(t, thing.Switch.Request == nil, "request of failed command shall not be pending")
+}
@@ -12,5 +12,5 @@ func getResolver(t *testing.T, db *mongo.Database) *main.Resolver{
     orgs := GetOrgs(t, log, db)
     things := GetThings(t, log, db)
 
-    return main.NewResolver(log, db, orgs, users, things)
+    return main.NewResolver(log, db, orgs, users, things, GetMqtt(t, log))
 }
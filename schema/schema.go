@@ -16,6 +16,9 @@ func GetRootSchema() string {
             org(id: ID!): Org
             things(sort: ThingSort, filter: ThingFilter, all: Boolean): [Thing]!
             thing(id: ID!): Thing
+            pendingDevices(): [PendingDevice!]!
+            mqttStatus(): MqttStatus
+            adapterStatus(): AdapterStatus
         }
 
         type Mutation {
@@ -34,6 +37,11 @@ func GetRootSchema() string {
             updateThingSensorData(data: ThingSensorDataUpdate!): Thing
             updateThingSwitchData(data: ThingSwitchDataUpdate!): Thing
             setThingAlarm(id: ID!, active: Boolean!): Boolean
+            setSwitchState(id: ID!, on: Boolean!, timeout: Int): Thing
+            createPiotCommand(thingId: ID!, name: String!, value: String): PiotCommand
+            deletePiotCommand(thingId: ID!, id: ID!): Boolean
+            approvePendingDevice(piotId: String!): Thing
+            rejectPendingDevice(piotId: String!): Boolean
             deleteThing(id: ID!): Boolean
         }
 
@@ -95,6 +103,10 @@ func GetRootSchema() string {
             class: String!
             measurement_topic: String!
             measurement_value: String!
+            measurement_expression: String!
+            measurement_last: Int!
+            validity: Int!
+            stale: Boolean!
         }
 
         type SwitchData {
@@ -105,11 +117,89 @@ func GetRootSchema() string {
             command_topic: String!
             command_on: String!
             command_off: String!
+            request: SwitchRequest
+        }
+
+        type AvailabilityEvent {
+            available: Boolean!
+            time: Int!
+        }
+
+        type TelemetryField {
+            name: String!
+            path: String!
+            type: String!
+        }
+
+        type TelemetryValue {
+            name: String!
+            type: String!
+            value: String!
+            float_value: Float
+            int_value: Int
+            bool_value: Boolean
+        }
+
+        type TelemetrySample {
+            time: Int!
+            values: [TelemetryValue!]!
+        }
+
+        type SwitchRequest {
+            state: Boolean!
+            status: String!
+            created: Int!
+            deadline: Int!
+            completed: Int!
+        }
+
+        type PendingDevice {
+            piot_id: String!
+            first_seen: Int!
+            last_seen: Int!
+            packets: Int!
+            ip: String!
+            rejected: Int
+        }
+
+        type AdapterStatus {
+            rejected_packets: Int!
+            rejected_device_packets: Int!
+        }
+
+        type MqttStatus {
+            connected: Boolean!
+            sessions: Int!
+            reconnects: Int!
+            last_error: String!
+            last_error_time: Int!
+            pipeline: MqttPipelineStatus
+        }
+
+        type MqttPipelineStatus {
+            workers: Int!
+            queue_depth: Int!
+            queue_capacity: Int!
+            processed: Int!
+            dropped: Int!
+        }
+
+        type PiotCommand {
+            id: ID!
+            name: String!
+            value: String!
+            created: Int!
+            delivered: Int!
+            deliveries: Int!
+            acknowledged: Int!
         }
 
         type Thing {
             id: ID!
             piot_id: String!
+            has_piot_key: Boolean!
+            piot_counter: Int
+            piot_commands: [PiotCommand!]!
             name: String!
             description: String!
             alias: String!
@@ -121,11 +211,20 @@ func GetRootSchema() string {
             voltage: Float!
             org: Org
             parent: Thing
+            pattern: Thing
+            available: Boolean!
+            available_changed: Int!
+            availability_events(limit: Int): [AvailabilityEvent!]!
             availability_topic: String!
             availability_yes: String!
             availability_no: String!
             telemetry_topic: String!
             telemetry: String!
+            telemetry_fields: [TelemetryField!]!
+            telemetry_values: [TelemetryValue!]!
+            telemetry_tracking: Boolean!
+            telemetry_history: Boolean!
+            telemetry_samples(limit: Int): [TelemetrySample!]!
             store_influxdb: Boolean!
             store_mysqldb: Boolean!
             store_mysqldb_interval: Int!
@@ -163,6 +262,8 @@ func GetRootSchema() string {
         input ThingUpdate {
             id: ID!
             piotId: String
+            piot_key: String
+            piot_counter: Int
             name: String
             type: String
             description: String
@@ -173,6 +274,9 @@ func GetRootSchema() string {
             voltage: Float
             availability_topic: String
             telemetry_topic: String
+            telemetry_fields: [TelemetryFieldInput!]
+            telemetry_tracking: Boolean
+            telemetry_history: Boolean
             store_influxdb: Boolean
             store_mysqldb: Boolean
             store_mysqldb_interval: Int
@@ -189,11 +293,20 @@ func GetRootSchema() string {
             battery_mqtt_level_value: String
         }
 
+        input TelemetryFieldInput {
+            name: String!
+            path: String!
+            type: String!
+        }
+
         input ThingSensorDataUpdate {
             id: ID!
             class: String
             measurement_topic: String
             measurement_value: String
+            measurement_expression: String
+            unit: String
+            validity: Int
         }
 
         input ThingSwitchDataUpdate {
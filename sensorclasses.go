@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/op/go-logging"
+)
+
+const THING_CLASS_CO2 = "carbon_dioxide"
+const THING_CLASS_ILLUMINANCE = "illuminance"
+const THING_CLASS_MOISTURE = "moisture"
+const THING_CLASS_VOLTAGE = "voltage"
+
+// Describes class of sensor measurements (e.g. temperature)
+type SensorClass struct {
+
+	// name of the class, it is stored as class of sensor things
+	Name string `json:"name"`
+
+	// key of the value in PIOT sensor reading
+	Key string `json:"key"`
+
+	// prefix of the sensor address, this is necessary to have separate
+	// things for all measurements of single sensor
+	Prefix string `json:"prefix"`
+
+	// canonical unit of the measurement, readings are received and values
+	// are stored to persistent storages in this unit
+	Unit string `json:"unit"`
+
+	// optional range of valid values
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+}
+
+// InRange checks if value is in range of valid values
+func (c *SensorClass) InRange(value float64) bool {
+	if c.Min != nil && value < *c.Min {
+		return false
+	}
+
+	if c.Max != nil && value > *c.Max {
+		return false
+	}
+
+	return true
+}
+
+// Registry of known sensor classes
+type SensorClasses struct {
+	log     *logging.Logger
+	classes []*SensorClass
+	mutex   sync.RWMutex
+}
+
+func NewSensorClasses(log *logging.Logger) *SensorClasses {
+	s := &SensorClasses{log: log}
+
+	defaults := defaultSensorClasses()
+	for i := range defaults {
+		s.classes = append(s.classes, &defaults[i])
+	}
+
+	return s
+}
+
+func defaultSensorClasses() []SensorClass {
+	rng := func(min, max float64) (*float64, *float64) { return &min, &max }
+
+	temperature := SensorClass{Name: THING_CLASS_TEMPERATURE, Key: "t", Prefix: "T", Unit: "C"}
+	temperature.Min, temperature.Max = rng(-100, 200)
+
+	humidity := SensorClass{Name: THING_CLASS_HUMIDITY, Key: "h", Prefix: "H", Unit: "%"}
+	humidity.Min, humidity.Max = rng(0, 100)
+
+	pressure := SensorClass{Name: THING_CLASS_PRESSURE, Key: "p", Prefix: "P", Unit: "hPa"}
+	pressure.Min, pressure.Max = rng(0, 2000)
+
+	co2 := SensorClass{Name: THING_CLASS_CO2, Key: "co2", Prefix: "C", Unit: "ppm"}
+	co2.Min, co2.Max = rng(0, 100000)
+
+	illuminance := SensorClass{Name: THING_CLASS_ILLUMINANCE, Key: "l", Prefix: "L", Unit: "lx"}
+	illuminance.Min, illuminance.Max = rng(0, 200000)
+
+	moisture := SensorClass{Name: THING_CLASS_MOISTURE, Key: "m", Prefix: "M", Unit: "%"}
+	moisture.Min, moisture.Max = rng(0, 100)
+
+	voltage := SensorClass{Name: THING_CLASS_VOLTAGE, Key: "v", Prefix: "V", Unit: "V"}
+
+	return []SensorClass{temperature, humidity, pressure, co2, illuminance, moisture, voltage}
+}
+
+// Add registers new sensor class or replaces existing class of same name
+func (s *SensorClasses) Add(class SensorClass) error {
+
+	if class.Name == "" || class.Key == "" || class.Prefix == "" {
+		return errors.New("sensor class name, key and prefix cannot be empty")
+	}
+
+	if class.Key == "address" || class.Key == "a" {
+		return fmt.Errorf("sensor class key %s is reserved", class.Key)
+	}
+
+	if class.Min != nil && class.Max != nil && *class.Min > *class.Max {
+		return fmt.Errorf("sensor class %s has invalid range", class.Name)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, c := range s.classes {
+		if c.Name == class.Name {
+			continue
+		}
+		if c.Key == class.Key {
+			return fmt.Errorf("sensor class %s has same key as class %s", class.Name, c.Name)
+		}
+		if c.Prefix == class.Prefix {
+			return fmt.Errorf("sensor class %s has same prefix as class %s", class.Name, c.Name)
+		}
+	}
+
+	for i, c := range s.classes {
+		if c.Name == class.Name {
+			s.classes[i] = &class
+			return nil
+		}
+	}
+
+	s.classes = append(s.classes, &class)
+
+	return nil
+}
+
+// Load reads sensor classes from json file (array of classes)
+func (s *SensorClasses) Load(path string) error {
+	s.log.Infof("Loading sensor classes from %s", path)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var classes []SensorClass
+	if err := json.Unmarshal(data, &classes); err != nil {
+		return fmt.Errorf("cannot decode sensor classes (%v)", err)
+	}
+
+	for _, c := range classes {
+		if err := s.Add(c); err != nil {
+			return err
+		}
+		s.log.Debugf("Sensor class %s registered", c.Name)
+	}
+
+	return nil
+}
+
+// GetAll returns all registered classes in order of registration
+func (s *SensorClasses) GetAll() []*SensorClass {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := make([]*SensorClass, len(s.classes))
+	copy(result, s.classes)
+
+	return result
+}
+
+func (s *SensorClasses) GetByKey(key string) *SensorClass {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, c := range s.classes {
+		if c.Key == key {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func (s *SensorClasses) GetByName(name string) *SensorClass {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, c := range s.classes {
+		if c.Name == name {
+			return c
+		}
+	}
+
+	return nil
+}
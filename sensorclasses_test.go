@@ -0,0 +1,66 @@
+package main_test
+
+import (
+	"io/ioutil"
+	"os"
+	main "piot-server"
+	"testing"
+)
+
+func TestSensorClassesDefaults(t *testing.T) {
+	classes := GetSensorClasses(t, GetLogger(t))
+
+	c := classes.GetByKey("t")
+	Assert(t, c != nil, "Temperature class shall be registered")
+	Equals(t, main.THING_CLASS_TEMPERATURE, c.Name)
+	Equals(t, "T", c.Prefix)
+	Equals(t, "C", c.Unit)
+	Assert(t, c.InRange(21.5), "Value shall be in range")
+	Assert(t, !c.InRange(1000), "Value shall be out of range")
+
+	c = classes.GetByName(main.THING_CLASS_CO2)
+	Assert(t, c != nil, "CO2 class shall be registered")
+	Equals(t, "co2", c.Key)
+
+	Assert(t, classes.GetByKey("x") == nil, "Unknown key shall not be found")
+}
+
+func TestSensorClassesAdd(t *testing.T) {
+	classes := GetSensorClasses(t, GetLogger(t))
+
+	min := 0.0
+	max := 14.0
+	Ok(t, classes.Add(main.SensorClass{Name: "ph", Key: "ph", Prefix: "PH", Unit: "pH", Min: &min, Max: &max}))
+	Equals(t, "PH", classes.GetByKey("ph").Prefix)
+
+	// replace existing class
+	Ok(t, classes.Add(main.SensorClass{Name: main.THING_CLASS_TEMPERATURE, Key: "t", Prefix: "T", Unit: "F"}))
+	Equals(t, "F", classes.GetByKey("t").Unit)
+
+	// invalid classes
+	Assert(t, classes.Add(main.SensorClass{Name: "x", Key: "x"}) != nil, "Missing prefix shall be rejected")
+	Assert(t, classes.Add(main.SensorClass{Name: "x", Key: "a", Prefix: "X"}) != nil, "Reserved key shall be rejected")
+	Assert(t, classes.Add(main.SensorClass{Name: "x", Key: "t", Prefix: "X"}) != nil, "Duplicate key shall be rejected")
+	Assert(t, classes.Add(main.SensorClass{Name: "x", Key: "x", Prefix: "T"}) != nil, "Duplicate prefix shall be rejected")
+	Assert(t, classes.Add(main.SensorClass{Name: "x", Key: "x", Prefix: "X", Min: &max, Max: &min}) != nil, "Invalid range shall be rejected")
+}
+
+func TestSensorClassesLoad(t *testing.T) {
+	classes := GetSensorClasses(t, GetLogger(t))
+
+	f, err := ioutil.TempFile("", "classes*.json")
+	Ok(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[{"name": "wind_speed", "key": "ws", "prefix": "W", "unit": "m/s", "min": 0}]`)
+	Ok(t, err)
+	f.Close()
+
+	Ok(t, classes.Load(f.Name()))
+
+	c := classes.GetByKey("ws")
+	Assert(t, c != nil, "Loaded class shall be registered")
+	Equals(t, "wind_speed", c.Name)
+	Assert(t, !c.InRange(-1), "Negative value shall be out of range")
+	Assert(t, c.InRange(1000), "Value without upper limit shall be in range")
+}
@@ -5,8 +5,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"piot-server/config"
 	"piot-server/schema"
+	"syscall"
 	"time"
 
 	graphql "github.com/graph-gophers/graphql-go"
@@ -18,12 +20,28 @@ import (
 
 const LOG_FORMAT = "%{color}%{time:2006/01/02 15:04:05 -07:00 MST} [%{level:.6s}] %{shortfile} : %{color:reset}%{message}"
 
+// time given to running http requests on shutdown
+const SERVER_SHUTDOWN_TIMEOUT = 10 * time.Second
+
 func runServer(c *cli.Context) {
 
 	cfg := config.NewParameters()
 	cfg.DbUri = c.GlobalString("mongodb-uri")
 	cfg.DbName = "piot"
 	cfg.LogLevel = c.GlobalString("log-level")
+	cfg.DOSInterval = c.GlobalDuration("dos-interval")
+	cfg.DOSBurst = c.GlobalInt("dos-burst")
+	cfg.DOSIpInterval = c.GlobalDuration("dos-ip-interval")
+	cfg.DOSIpBurst = c.GlobalInt("dos-ip-burst")
+	cfg.DOSMaxEntries = c.GlobalInt("dos-max-entries")
+	cfg.TimeSkewPast = c.GlobalDuration("time-skew-past")
+	cfg.TimeSkewFuture = c.GlobalDuration("time-skew-future")
+	cfg.BatchMaxSize = c.GlobalInt("batch-max-size")
+	cfg.RegistrationPolicy = c.GlobalString("piot-registration")
+	cfg.RequireSealed = c.GlobalBool("piot-require-sealed")
+	cfg.MqttWorkers = c.GlobalInt("mqtt-workers")
+	cfg.MqttQueueSize = c.GlobalInt("mqtt-queue-size")
+	cfg.MqttQueuePolicy = c.GlobalString("mqtt-queue-policy")
 
 	cfg.SmtpHost = c.GlobalString("smtp-host")
 	cfg.SmtpPort = c.GlobalInt("smtp-port")
@@ -38,6 +56,16 @@ func runServer(c *cli.Context) {
 		os.Exit(1)
 	}
 
+	if err := ParseMqttPublishOptions(c.GlobalString("mqtt-publish"), cfg.MqttPublish); err != nil {
+		logger.Fatalf("Cannot configure mqtt publishing (%v)", err)
+	}
+
+	switch cfg.RegistrationPolicy {
+	case PIOT_REGISTRATION_AUTO, PIOT_REGISTRATION_PENDING, PIOT_REGISTRATION_REJECT:
+	default:
+		logger.Fatalf("Unknown registration policy %s", cfg.RegistrationPolicy)
+	}
+
 	/////////////// DB (mongo)
 	dbUri := c.GlobalString("mongodb-uri")
 
@@ -96,23 +124,90 @@ func runServer(c *cli.Context) {
 	//////////////// THINGS service instance
 	things := NewThings(db, logger)
 
+	/////////////// PIOT SENSOR CLASSES
+	sensorClasses := NewSensorClasses(logger)
+	if sensorClassesPath := c.GlobalString("sensor-classes"); sensorClassesPath != "" {
+		if err := sensorClasses.Load(sensorClassesPath); err != nil {
+			logger.Fatalf("Failed to load sensor classes from %s (%v)", sensorClassesPath, err)
+		}
+	}
+
 	/////////////// PIOT MQTT service instance
 	mqttUri := c.GlobalString("mqtt-uri")
 	mqttUsername := c.GlobalString("mqtt-user")
 	mqttPassword := c.GlobalString("mqtt-password")
 	mqttClient := c.GlobalString("mqtt-client")
-	mqtt := NewMqtt(mqttUri, logger, things, orgs, influxDb, mysqlDb)
+
+	// embedded broker makes external broker optional, server connects to it
+	// as any other client
+	if c.GlobalBool("mqtt-broker") {
+		if mqttUsername == "" {
+			mqttUsername = mqttClient
+			if mqttPassword, err = NewMqttBrokerPassword(); err != nil {
+				logger.Fatalf("Cannot generate password for embedded mqtt broker (%v)", err)
+			}
+		}
+
+		mqttBroker := NewMqttBroker(logger, orgs, mqttUsername, mqttPassword)
+		mqttBroker.SetStatusTopic(c.GlobalString("mqtt-status-topic"))
+		mqttBrokerAddress := c.GlobalString("mqtt-broker-address")
+		if err := mqttBroker.Start(mqttBrokerAddress); err != nil {
+			logger.Fatalf("Cannot start embedded mqtt broker on %s (%v)", mqttBrokerAddress, err)
+		}
+		defer mqttBroker.Stop()
+	}
+
+	mqtt := NewMqtt(mqttUri, logger, things, orgs, influxDb, mysqlDb, sensorClasses)
 	mqtt.SetUsername(mqttUsername)
 	mqtt.SetPassword(mqttPassword)
 	mqtt.SetClient(mqttClient)
+	mqtt.SetOrgSessions(c.GlobalBool("mqtt-org-sessions"))
+	mqtt.SetPublishOptions(cfg.MqttPublish)
+	mqtt.SetStatusTopic(c.GlobalString("mqtt-status-topic"), c.GlobalDuration("mqtt-status-interval"))
+
+	mqttCaFile := c.GlobalString("mqtt-ca-file")
+	mqttCertFile := c.GlobalString("mqtt-cert-file")
+	mqttKeyFile := c.GlobalString("mqtt-key-file")
+	mqttServerName := c.GlobalString("mqtt-server-name")
+	if mqttCaFile != "" || mqttCertFile != "" || mqttKeyFile != "" || mqttServerName != "" {
+		tlsConfig, err := NewMqttTLSConfig(mqttCaFile, mqttCertFile, mqttKeyFile, mqttServerName)
+		if err != nil {
+			logger.Fatalf("Cannot configure mqtt tls (%v)", err)
+		}
+		mqtt.SetTLSConfig(tlsConfig)
+	}
+
+	// incoming messages are processed concurrently by pool of workers
+	mqttPipeline, err := NewMqttPipeline(logger, cfg, mqtt.ProcessMessage)
+	if err != nil {
+		logger.Fatalf("Cannot create mqtt pipeline (%v)", err)
+	}
+	mqttPipeline.Start()
+	mqtt.SetPipeline(mqttPipeline)
+
+	if interval := c.GlobalDuration("mqtt-stats-interval"); interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				logger.Infof("MQTT pipeline %s", mqttPipeline.Stats())
+			}
+		}()
+	}
+
 	err = mqtt.Connect(true)
 	if err != nil {
 		logger.Fatalf("Connect to mqtt server failed %v", err)
 		os.Exit(1)
 	}
 
+	/////////////// Home Assistant MQTT discovery
+	if c.GlobalBool("hass-discovery") {
+		homeAssistant := NewHomeAssistant(logger, things, orgs, mqtt, sensorClasses, c.GlobalString("hass-discovery-prefix"))
+		homeAssistant.SetOrgSessions(c.GlobalBool("mqtt-org-sessions"))
+		homeAssistant.Start()
+	}
+
 	/////////////// PIOT DEVICES service instance
-	piotDevices := NewPiotDevices(logger, things, mqtt, cfg)
+	piotDevices := NewPiotDevices(logger, things, mqtt, cfg, sensorClasses)
 
 	// Auto disconnect from mongo
 	//defer ctx.Value("dbClient").(*mongo.Client).Disconnect(ctx)
@@ -141,7 +236,8 @@ func runServer(c *cli.Context) {
 	//r.HandleFunc("/refresh", handler.RefreshHandler)
 
 	// create GraphQL schema together with resolver
-	gqlResolver := NewResolver(logger, db, orgs, users, things)
+	gqlResolver := NewResolver(logger, db, orgs, users, things, mqtt)
+	gqlResolver.SetSensorClasses(sensorClasses)
 	gqlSchema := graphql.MustParseSchema(schema.GetRootSchema(), gqlResolver)
 	http.Handle(
 		"/query",
@@ -163,16 +259,33 @@ func runServer(c *cli.Context) {
 		http.ServeFile(w, r, "graphiql.html")
 	}))
 
+	adapter := NewAdapter(logger, piotDevices, things, cfg, c.GlobalString("piot-password"), c.GlobalBool("piot-legacy-encryption"))
+	gqlResolver.SetAdapter(adapter)
+
 	http.Handle(
 		"/adapter",
 		NewCORSHandler(
 			NewLoggingHandler(
 				logger,
-				NewAdapter(logger, piotDevices, c.GlobalString("piot-password")),
+				adapter,
 			),
 		),
 	)
 
+	///////////////////// UDP ADAPTER ///////////
+	// Optional listener for PIOT packets delivered over UDP
+	if udpAddress := c.GlobalString("udp-bind-address"); udpAddress != "" {
+		udpAdapter := NewUdpAdapter(logger, adapter)
+		err = udpAdapter.Listen(udpAddress)
+		FatalOnError(err, "Failed to bind udp on %s: ", udpAddress)
+
+		logger.Infof("Listening for udp packets on %s...", udpAddress)
+		go func() {
+			err := udpAdapter.Serve()
+			FatalOnError(err, "Failed to receive udp packets on %s: ", udpAddress)
+		}()
+	}
+
 	///////////////////// MONITOR ///////////
 	// Start monitor if configured. Instance of monitor is wrapped
 	// by go scheduled routine
@@ -216,9 +329,36 @@ func runServer(c *cli.Context) {
 		}()
 	}
 
+	server := &http.Server{Addr: c.GlobalString("bind-address")}
+
+	// shutdown on signal, messages already received from mqtt broker are
+	// processed before exit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Shutting down PIOT server (%s)", sig)
+
+		ctx, cancel := context.WithTimeout(context.Background(), SERVER_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Errorf("Shutdown of http server failed (%v)", err)
+		}
+	}()
+
 	logger.Infof("Listening on %s...", c.GlobalString("bind-address"))
-	err = http.ListenAndServe(c.GlobalString("bind-address"), nil)
-	FatalOnError(err, "Failed to bind on %s: ", c.GlobalString("bind-address"))
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		FatalOnError(err, "Failed to bind on %s: ", c.GlobalString("bind-address"))
+	}
+
+	// no more messages are submitted to pipeline after disconnection
+	if err := mqtt.Disconnect(); err != nil {
+		logger.Errorf("Disconnection from mqtt broker failed (%v)", err)
+	}
+	mqttPipeline.Stop()
+
+	logger.Infof("MQTT pipeline stopped, %s", mqttPipeline.Stats())
 }
 
 func FatalOnError(err error, msg string, args ...interface{}) {
@@ -254,6 +394,11 @@ func main() {
 			Value:  "0.0.0.0:9096",
 			EnvVar: "BIND_ADDRESS",
 		},
+		cli.StringFlag{
+			Name:   "udp-bind-address",
+			Usage:  "Listen address for PIOT packets delivered over UDP, empty value disables UDP",
+			EnvVar: "UDP_BIND_ADDRESS",
+		},
 		cli.StringFlag{
 			Name:   "mongodb-uri,m",
 			Usage:  "URI for the mongo database",
@@ -282,12 +427,148 @@ func main() {
 			Value:  "piot-server",
 			EnvVar: "MQTT_CLIENT",
 		},
+		cli.BoolFlag{
+			Name:   "mqtt-broker",
+			Usage:  "Run embedded mqtt broker authenticating orgs by their mqtt credentials, mqtt-uri has to point to it (e.g. tcp://localhost:1883)",
+			EnvVar: "MQTT_BROKER",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-broker-address",
+			Usage:  "Listen address of embedded mqtt broker",
+			Value:  ":1883",
+			EnvVar: "MQTT_BROKER_ADDRESS",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-publish",
+			Usage:  "Quality of service and retain flag of published mqtt messages by topic kind (availability, value, unit, net), e.g. value:1:retain,net:0",
+			EnvVar: "MQTT_PUBLISH",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-status-topic",
+			Usage:  "Topic for retained server status (online, offline) published also as mqtt last will, relative to org root in mode with sessions of orgs, empty value disables status",
+			Value:  "piot/status",
+			EnvVar: "MQTT_STATUS_TOPIC",
+		},
+		cli.DurationFlag{
+			Name:   "mqtt-status-interval",
+			Usage:  "The interval for republishing of server status with current uptime, zero value disables updates",
+			Value:  time.Minute,
+			EnvVar: "MQTT_STATUS_INTERVAL",
+		},
+		cli.BoolFlag{
+			Name:   "mqtt-org-sessions",
+			Usage:  "Open separate mqtt session for each org using org mqtt credentials instead of single session",
+			EnvVar: "MQTT_ORG_SESSIONS",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-ca-file",
+			Usage:  "CA bundle (PEM) for verification of mqtt broker certificate (tls:// broker uri)",
+			EnvVar: "MQTT_CA_FILE",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-cert-file",
+			Usage:  "Client certificate (PEM) for mqtt authentication",
+			EnvVar: "MQTT_CERT_FILE",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-key-file",
+			Usage:  "Private key (PEM) of mqtt client certificate",
+			EnvVar: "MQTT_KEY_FILE",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-server-name",
+			Usage:  "Server name used for verification of mqtt broker certificate, host of broker uri is used by default",
+			EnvVar: "MQTT_SERVER_NAME",
+		},
+		cli.IntFlag{
+			Name:   "mqtt-workers",
+			Usage:  "The number of workers processing incoming mqtt messages",
+			Value:  4,
+			EnvVar: "MQTT_WORKERS",
+		},
+		cli.IntFlag{
+			Name:   "mqtt-queue-size",
+			Usage:  "The capacity of queue of incoming mqtt messages for each worker",
+			Value:  1000,
+			EnvVar: "MQTT_QUEUE_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "mqtt-queue-policy",
+			Usage:  "Policy applied to incoming mqtt messages when queue is full (block, drop)",
+			Value:  "drop",
+			EnvVar: "MQTT_QUEUE_POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "hass-discovery",
+			Usage:  "Publish Home Assistant mqtt discovery configs of things",
+			EnvVar: "HASS_DISCOVERY",
+		},
+		cli.StringFlag{
+			Name:   "hass-discovery-prefix",
+			Usage:  "Topic prefix of Home Assistant mqtt discovery",
+			Value:  "homeassistant",
+			EnvVar: "HASS_DISCOVERY_PREFIX",
+		},
+		cli.DurationFlag{
+			Name:   "mqtt-stats-interval",
+			Usage:  "The interval for logging of mqtt processing statistics, zero value disables logging",
+			Value:  time.Minute * 5,
+			EnvVar: "MQTT_STATS_INTERVAL",
+		},
 		cli.DurationFlag{
 			Name:   "dos-interval",
-			Usage:  "The minimal allowed time interval between two packets from the same device",
+			Usage:  "The interval for refill of one packet to allowance of device, zero value disables protection",
 			Value:  time.Second * 1,
 			EnvVar: "DOS_INTERVAL",
 		},
+		cli.IntFlag{
+			Name:   "dos-burst",
+			Usage:  "The maximal number of packets from the same device accepted in row",
+			Value:  1,
+			EnvVar: "DOS_BURST",
+		},
+		cli.DurationFlag{
+			Name:   "dos-ip-interval",
+			Usage:  "The interval for refill of one packet to allowance of source ip address, zero value disables protection",
+			Value:  time.Millisecond * 100,
+			EnvVar: "DOS_IP_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "dos-ip-burst",
+			Usage:  "The maximal number of packets from the same ip address accepted in row",
+			Value:  20,
+			EnvVar: "DOS_IP_BURST",
+		},
+		cli.IntFlag{
+			Name:   "dos-max-entries",
+			Usage:  "The maximal number of devices and ip addresses tracked by DOS protection",
+			Value:  10000,
+			EnvVar: "DOS_MAX_ENTRIES",
+		},
+		cli.DurationFlag{
+			Name:   "time-skew-past",
+			Usage:  "The maximal age of time provided by device in packet",
+			Value:  time.Hour * 24 * 7,
+			EnvVar: "TIME_SKEW_PAST",
+		},
+		cli.DurationFlag{
+			Name:   "time-skew-future",
+			Usage:  "The maximal allowed difference of time provided by device in packet that is ahead of server time",
+			Value:  time.Minute * 5,
+			EnvVar: "TIME_SKEW_FUTURE",
+		},
+		cli.IntFlag{
+			Name:   "batch-max-size",
+			Usage:  "The maximal number of reading sets in single batch packet",
+			Value:  100,
+			EnvVar: "BATCH_MAX_SIZE",
+		},
+		cli.StringFlag{
+			Name:   "piot-registration",
+			Usage:  "Policy of registration of unknown PIOT devices (auto, pending, reject)",
+			Value:  "auto",
+			EnvVar: "PIOT_REGISTRATION",
+		},
 		cli.StringFlag{
 			Name:   "jwt-password",
 			Usage:  "Password for jwt communication",
@@ -337,9 +618,24 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "piot-password",
-			Usage:  "PIOT device protocol encryption password",
+			Usage:  "PIOT device protocol legacy encryption password",
 			EnvVar: "PIOT_PASSWORD",
 		},
+		cli.BoolFlag{
+			Name:   "piot-require-sealed",
+			Usage:  "Accept only PIOT packets sealed by device key (devices without key are locked out)",
+			EnvVar: "PIOT_REQUIRE_SEALED",
+		},
+		cli.BoolFlag{
+			Name:   "piot-legacy-encryption",
+			Usage:  "Accept PIOT packets encrypted by legacy AES-ECB with global password",
+			EnvVar: "PIOT_LEGACY_ENCRYPTION",
+		},
+		cli.StringFlag{
+			Name:   "sensor-classes",
+			Usage:  "Path to JSON file with definitions of additional sensor classes",
+			EnvVar: "SENSOR_CLASSES",
+		},
 		cli.DurationFlag{
 			Name:   "monitor-interval",
 			Usage:  "The interval for monitoring active piot devices",
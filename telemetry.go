@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+
+	"github.com/tidwall/gjson"
+)
+
+// types of telemetry fields
+const TELEMETRY_TYPE_FLOAT = "float"
+const TELEMETRY_TYPE_INT = "int"
+const TELEMETRY_TYPE_BOOL = "bool"
+const TELEMETRY_TYPE_STRING = "string"
+
+// max number of samples of telemetry history kept for each thing
+const TELEMETRY_HISTORY_SIZE = 1000
+
+var telemetryFieldName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidateTelemetryFields checks names (unique identifiers), paths and types
+// of telemetry fields
+func ValidateTelemetryFields(fields []TelemetryField) error {
+	names := make(map[string]bool)
+
+	for _, field := range fields {
+		if !telemetryFieldName.MatchString(field.Name) {
+			return fmt.Errorf("invalid name of telemetry field \"%s\"", field.Name)
+		}
+		if names[field.Name] {
+			return fmt.Errorf("duplicate telemetry field \"%s\"", field.Name)
+		}
+		names[field.Name] = true
+
+		if field.Path == "" {
+			return fmt.Errorf("missing path of telemetry field \"%s\"", field.Name)
+		}
+
+		switch field.Type {
+		case TELEMETRY_TYPE_FLOAT, TELEMETRY_TYPE_INT, TELEMETRY_TYPE_BOOL, TELEMETRY_TYPE_STRING:
+		default:
+			return fmt.Errorf("unknown type \"%s\" of telemetry field \"%s\"", field.Type, field.Name)
+		}
+	}
+
+	return nil
+}
+
+// ExtractTelemetryValues extracts values of fields from telemetry payload.
+// Fields missing in payload or with values not convertible to field type
+// are skipped and reported by returned error.
+func ExtractTelemetryValues(fields []TelemetryField, payload string) ([]TelemetryValue, error) {
+	values := []TelemetryValue{}
+	var result error
+
+	for _, field := range fields {
+		parsed := gjson.Get(payload, field.Path)
+		if !parsed.Exists() {
+			result = fmt.Errorf("telemetry field \"%s\" not found in payload", field.Name)
+			continue
+		}
+
+		value, err := telemetryValue(field.Type, parsed)
+		if err != nil {
+			result = fmt.Errorf("telemetry field \"%s\": %s", field.Name, err.Error())
+			continue
+		}
+
+		values = append(values, TelemetryValue{Name: field.Name, Type: field.Type, Value: value})
+	}
+
+	return values, result
+}
+
+// telemetryValue converts JSON value to canonical string form of type
+func telemetryValue(fieldType string, parsed gjson.Result) (string, error) {
+	switch fieldType {
+	case TELEMETRY_TYPE_FLOAT:
+		value, err := strconv.ParseFloat(parsed.String(), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return "", fmt.Errorf("value \"%s\" is not a number", parsed.String())
+		}
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+
+	case TELEMETRY_TYPE_INT:
+		value, err := strconv.ParseInt(parsed.String(), 10, 64)
+		if err != nil {
+			// integers could be encoded as floats (e.g. 1e3)
+			valueFloat, err := strconv.ParseFloat(parsed.String(), 64)
+			if err != nil || valueFloat != math.Trunc(valueFloat) || math.Abs(valueFloat) > math.MaxInt64 {
+				return "", fmt.Errorf("value \"%s\" is not an integer", parsed.String())
+			}
+			value = int64(valueFloat)
+		}
+		return strconv.FormatInt(value, 10), nil
+
+	case TELEMETRY_TYPE_BOOL:
+		value, err := strconv.ParseBool(parsed.String())
+		if err != nil {
+			return "", fmt.Errorf("value \"%s\" is not a boolean", parsed.String())
+		}
+		return strconv.FormatBool(value), nil
+
+	case TELEMETRY_TYPE_STRING:
+		return parsed.String(), nil
+	}
+
+	return "", errors.New("unknown type")
+}
+
+// Typed returns value of telemetry field converted to its type (float64,
+// int64, bool or string)
+func (v *TelemetryValue) Typed() interface{} {
+	switch v.Type {
+	case TELEMETRY_TYPE_FLOAT:
+		if value, err := strconv.ParseFloat(v.Value, 64); err == nil {
+			return value
+		}
+	case TELEMETRY_TYPE_INT:
+		if value, err := strconv.ParseInt(v.Value, 10, 64); err == nil {
+			return value
+		}
+	case TELEMETRY_TYPE_BOOL:
+		if value, err := strconv.ParseBool(v.Value); err == nil {
+			return value
+		}
+	}
+
+	return v.Value
+}
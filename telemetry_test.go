@@ -0,0 +1,74 @@
+package main_test
+
+import (
+	main "piot-server"
+	"testing"
+)
+
+func TestValidateTelemetryFields(t *testing.T) {
+	Ok(t, main.ValidateTelemetryFields(nil))
+	Ok(t, main.ValidateTelemetryFields([]main.TelemetryField{
+		{Name: "uptime", Path: "Uptime", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "rssi", Path: "Wifi.RSSI", Type: main.TELEMETRY_TYPE_FLOAT},
+		{Name: "ssid", Path: "Wifi.SSId", Type: main.TELEMETRY_TYPE_STRING},
+		{Name: "power_on", Path: "POWER", Type: main.TELEMETRY_TYPE_BOOL},
+	}))
+
+	invalid := [][]main.TelemetryField{
+		{{Name: "", Path: "Uptime", Type: main.TELEMETRY_TYPE_INT}},
+		{{Name: "free heap", Path: "Heap", Type: main.TELEMETRY_TYPE_INT}},
+		{{Name: "uptime", Path: "", Type: main.TELEMETRY_TYPE_INT}},
+		{{Name: "uptime", Path: "Uptime", Type: "duration"}},
+		{
+			{Name: "uptime", Path: "Uptime", Type: main.TELEMETRY_TYPE_INT},
+			{Name: "uptime", Path: "UptimeSec", Type: main.TELEMETRY_TYPE_INT},
+		},
+	}
+	for _, fields := range invalid {
+		Fail(t, main.ValidateTelemetryFields(fields))
+	}
+}
+
+func TestExtractTelemetryValues(t *testing.T) {
+	const PAYLOAD = `{"UptimeSec": 3600, "Heap": 25.5, "Vcc": "3.3", "Big": 1e3, "Wifi": {"SSId": "home", "RSSI": -60}, "Sleep": true}`
+
+	fields := []main.TelemetryField{
+		{Name: "uptime", Path: "UptimeSec", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "heap", Path: "Heap", Type: main.TELEMETRY_TYPE_FLOAT},
+		{Name: "vcc", Path: "Vcc", Type: main.TELEMETRY_TYPE_FLOAT},
+		{Name: "big", Path: "Big", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "ssid", Path: "Wifi.SSId", Type: main.TELEMETRY_TYPE_STRING},
+		{Name: "rssi", Path: "Wifi.RSSI", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "sleep", Path: "Sleep", Type: main.TELEMETRY_TYPE_BOOL},
+	}
+
+	values, err := main.ExtractTelemetryValues(fields, PAYLOAD)
+	Ok(t, err)
+	Equals(t, []main.TelemetryValue{
+		{Name: "uptime", Type: main.TELEMETRY_TYPE_INT, Value: "3600"},
+		{Name: "heap", Type: main.TELEMETRY_TYPE_FLOAT, Value: "25.5"},
+		{Name: "vcc", Type: main.TELEMETRY_TYPE_FLOAT, Value: "3.3"},
+		{Name: "big", Type: main.TELEMETRY_TYPE_INT, Value: "1000"},
+		{Name: "ssid", Type: main.TELEMETRY_TYPE_STRING, Value: "home"},
+		{Name: "rssi", Type: main.TELEMETRY_TYPE_INT, Value: "-60"},
+		{Name: "sleep", Type: main.TELEMETRY_TYPE_BOOL, Value: "true"},
+	}, values)
+
+	Equals(t, int64(3600), values[0].Typed())
+	Equals(t, 25.5, values[1].Typed())
+	Equals(t, "home", values[4].Typed())
+	Equals(t, true, values[6].Typed())
+
+	// missing fields and values of other types are skipped
+	fields = []main.TelemetryField{
+		{Name: "uptime", Path: "UptimeSec", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "missing", Path: "Missing", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "heap", Path: "Heap", Type: main.TELEMETRY_TYPE_INT},
+		{Name: "ssid", Path: "Wifi.SSId", Type: main.TELEMETRY_TYPE_FLOAT},
+		{Name: "vcc", Path: "Vcc", Type: main.TELEMETRY_TYPE_BOOL},
+	}
+
+	values, err = main.ExtractTelemetryValues(fields, PAYLOAD)
+	Fail(t, err)
+	Equals(t, []main.TelemetryValue{{Name: "uptime", Type: main.TELEMETRY_TYPE_INT, Value: "3600"}}, values)
+}
@@ -31,6 +31,21 @@ type Thing struct {
 	// from PIOT chips via adapter
 	PiotId string `json:"piot_id" bson:"piot_id"`
 
+	// hex encoded AES key used for authenticated encryption of packets
+	// coming from PIOT chips, empty value means that device can send
+	// packets in plain or legacy encrypted form (the key is secret, it is
+	// never serialized to clients)
+	PiotKey string `json:"-" bson:"piot_key"`
+
+	// last accepted value of the message counter sent by PIOT chip, packets
+	// with counter that is not greater are rejected as replayed, nil means
+	// that chip didn't send any counter yet
+	PiotCounter *int32 `json:"piot_counter" bson:"piot_counter,omitempty"`
+
+	// queue of commands for PIOT chip (e.g. change of reporting interval),
+	// commands are delivered in responses to packets sent by chip
+	PiotCommands []PiotCommand `json:"piot_commands" bson:"piot_commands"`
+
 	// name of the thing
 	Name string `json:"name" bson:"name"`
 
@@ -58,9 +73,18 @@ type Thing struct {
 	// id of the parent thing (e.g. chip - sensor relation)
 	ParentId primitive.ObjectID `json:"parent_id" bson:"parent_id"`
 
+	// id of the thing with topic patterns this thing was materialised from
+	// and segments of topic captured by wildcards of the patterns (see
+	// TopicIndex)
+	PatternId       primitive.ObjectID `json:"pattern_id" bson:"pattern_id"`
+	PatternCaptures []string           `json:"pattern_captures" bson:"pattern_captures"`
+
 	// is thing available
 	Available bool `json:"available" bson:"available"`
 
+	// time of the last change of availability
+	AvailableChanged int32 `json:"available_changed" bson:"available_changed"`
+
 	// time the thing was seen last time
 	LastSeen int32 `json:"last_seen" bson:"last_seen"`
 
@@ -83,6 +107,15 @@ type Thing struct {
 	// time the thing was seen last time
 	Telemetry string `json:"telemetry" bson:"telemetry"`
 
+	// fields extracted from telemetry payload and their last values
+	TelemetryFields []TelemetryField `json:"telemetry_fields" bson:"telemetry_fields"`
+	TelemetryValues []TelemetryValue `json:"telemetry_values" bson:"telemetry_values"`
+
+	// persistency of telemetry values in influxdb (tracking) and in history
+	// of samples kept in database
+	TelemetryTracking bool `json:"telemetry_tracking" bson:"telemetry_tracking"`
+	TelemetryHistory  bool `json:"telemetry_history" bson:"telemetry_history"`
+
 	// Enable or Disable pushing values to organization assigned Influx database
 	StoreInfluxDb bool `json:"store_influxdb" bson:"store_influxdb"`
 
@@ -153,6 +186,11 @@ type SensorData struct {
 	// https://github.com/tidwall/gjson
 	MeasurementValue string `json:"measurement_value" bson:"measurement_value"`
 
+	// Optional expression computing sensor value (see Expression), variable
+	// value refers to value given by measurement value template, other
+	// variables are paths in JSON payload, e.g. (a.t + b.t) / 2
+	MeasurementExpression string `json:"measurement_expression" bson:"measurement_expression"`
+
 	// Time when last measurement was received
 	MeasurementLast int32 `json:"measurement_last" bson:"measurement_last"`
 
@@ -160,13 +198,25 @@ type SensorData struct {
 	Class string `json:"class" bson:"class"`
 
 	// Defines the number of seconds since last measurement for which the
-	// measurement is valid
+	// measurement is valid, zero means that measurement doesn't expire
 	Validity int32 `json:"validity" bson:"validity"`
 
-	// The unit of measurement that the sensor is expressed in.
+	// The unit of measurement that the sensor is expressed in. Values are
+	// published to MQTT and displayed in this unit, persistent storages
+	// get values converted to canonical unit of sensor class.
 	Unit string `json:"unit" bson:"unit"`
 }
 
+// Stale checks if last measurement is not valid at given time anymore,
+// sensor without any measurement is stale if validity is defined
+func (s *SensorData) Stale(now int32) bool {
+	if s.Validity <= 0 {
+		return false
+	}
+
+	return now-s.MeasurementLast > s.Validity
+}
+
 // Represents switch (e.g. high voltage power switch)
 type SwitchData struct {
 	State bool `json:"state" bson:"state"`
@@ -188,6 +238,96 @@ type SwitchData struct {
 
 	// Value that represents OFF state
 	StateOff string `json:"state_off" bson:"state_off"`
+
+	// Last request for change of state sent to command topic
+	Request *SwitchRequest `json:"request,omitempty" bson:"request,omitempty"`
+}
+
+const SWITCH_REQUEST_PENDING = "pending"
+const SWITCH_REQUEST_DONE = "done"
+const SWITCH_REQUEST_TIMEOUT = "timeout"
+
+// time to confirm requested state if not specified by caller
+const SWITCH_REQUEST_TIMEOUT_DEFAULT = 30 * time.Second
+
+// Represents request for change of switch state, the request is pending
+// until the requested state is received on state topic
+type SwitchRequest struct {
+
+	// requested state
+	State bool `json:"state" bson:"state"`
+
+	// status of the request (pending, done, timeout)
+	Status string `json:"status" bson:"status"`
+
+	// time of the request, time until the state has to be confirmed and
+	// time of the confirmation (unix timestamps)
+	Created   int32 `json:"created" bson:"created"`
+	Deadline  int32 `json:"deadline" bson:"deadline"`
+	Completed int32 `json:"completed" bson:"completed"`
+}
+
+// CurrentStatus returns status of the request at given time, pending request
+// that was not confirmed until deadline is timed out
+func (r *SwitchRequest) CurrentStatus(now int32) string {
+	if r.Status == SWITCH_REQUEST_PENDING && now > r.Deadline {
+		return SWITCH_REQUEST_TIMEOUT
+	}
+
+	return r.Status
+}
+
+// Represents change of thing availability
+type AvailabilityEvent struct {
+	Id        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ThingId   primitive.ObjectID `json:"thing_id" bson:"thing_id"`
+	Available bool               `json:"available" bson:"available"`
+	Time      int32              `json:"time" bson:"time"`
+}
+
+// Field extracted from telemetry payload of device, path is gjson path
+// (https://github.com/tidwall/gjson), type is one of TELEMETRY_TYPE_*
+type TelemetryField struct {
+	Name string `json:"name" bson:"name"`
+	Path string `json:"path" bson:"path"`
+	Type string `json:"type" bson:"type"`
+}
+
+// Value of telemetry field, value is kept in canonical string form of its
+// type (see ExtractTelemetryValues)
+type TelemetryValue struct {
+	Name  string `json:"name" bson:"name"`
+	Type  string `json:"type" bson:"type"`
+	Value string `json:"value" bson:"value"`
+}
+
+// Values of telemetry fields extracted from single telemetry payload
+type TelemetrySample struct {
+	Id      primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	ThingId primitive.ObjectID `json:"thing_id" bson:"thing_id"`
+	Time    int32              `json:"time" bson:"time"`
+	Values  []TelemetryValue   `json:"values" bson:"values"`
+}
+
+// Represents PIOT device that is waiting for approval of registration
+type PiotPendingDevice struct {
+
+	// PIOT identification of the device
+	PiotId string `json:"piot_id" bson:"piot_id"`
+
+	// time the device was seen first and last time (unix timestamp)
+	FirstSeen int32 `json:"first_seen" bson:"first_seen"`
+	LastSeen  int32 `json:"last_seen" bson:"last_seen"`
+
+	// number of packets received from device
+	Packets int32 `json:"packets" bson:"packets"`
+
+	// ip address reported by device in last packet
+	Ip string `json:"ip" bson:"ip"`
+
+	// time of rejection of registration (unix timestamp), zero for devices
+	// waiting for approval
+	Rejected int32 `json:"rejected" bson:"rejected,omitempty"`
 }
 
 func NewThing(db *mongo.Database, log *logging.Logger, name string, ttype string) (*Thing, error) {
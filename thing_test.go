@@ -76,3 +76,18 @@ func TestCreateThing(t *testing.T) {
 	Ok(t, err)
 	Assert(t, thing.Name == "thing1", "Wrong thing name")
 }
+
+func TestSensorStale(t *testing.T) {
+	sensor := main.SensorData{MeasurementLast: 1000}
+
+	// measurement without validity never expires
+	Equals(t, false, sensor.Stale(100000))
+
+	sensor.Validity = 60
+	Equals(t, false, sensor.Stale(1060))
+	Equals(t, true, sensor.Stale(1061))
+
+	// sensor without measurement
+	sensor.MeasurementLast = 0
+	Equals(t, true, sensor.Stale(1000))
+}
@@ -13,24 +13,72 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/op/go-logging"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type Things struct {
+	// counter of changes of things configuration, it has to be first
+	// field to be aligned for atomic operations on 32 bit platforms
+	generation uint64
+
 	Db  *mongo.Database
 	Log *logging.Logger
+
+	// limits of pending piot devices, the list could be filled by
+	// random scanners otherwise
+	PendingMaxEntries int
+	PendingTTL        time.Duration
+
+	// time for which rejection of pending piot device is remembered
+	PendingRejectTTL time.Duration
+
+	// limit of things materialised from single thing with topic patterns,
+	// any client publishing under org topics could create them otherwise
+	PatternMaxThings int
 }
 
+// default limits of pending piot devices
+const PIOT_PENDING_MAX_ENTRIES = 1000
+const PIOT_PENDING_TTL = 7 * 24 * time.Hour
+const PIOT_PENDING_REJECT_TTL = 30 * 24 * time.Hour
+
+var ErrPiotPendingFull = errors.New("too many pending devices")
+
+// default limit of things materialised from single thing with topic patterns
+const THING_PATTERN_MAX_THINGS = 100
+
+var ErrPatternThingsFull = errors.New("too many things materialised from topic patterns")
+
 func NewThings(db *mongo.Database, log *logging.Logger) *Things {
-	things := &Things{Db: db, Log: log}
+	things := &Things{
+		Db:                db,
+		Log:               log,
+		PendingMaxEntries: PIOT_PENDING_MAX_ENTRIES,
+		PendingTTL:        PIOT_PENDING_TTL,
+		PendingRejectTTL:  PIOT_PENDING_REJECT_TTL,
+		PatternMaxThings:  THING_PATTERN_MAX_THINGS,
+	}
 	return things
 }
 
+// Changed notifies that configuration of things (topics, org assignment,
+// etc.) was modified, e.g. by direct update of things collection
+func (t *Things) Changed() {
+	atomic.AddUint64(&t.generation, 1)
+}
+
+// Generation returns counter of configuration changes
+func (t *Things) Generation() uint64 {
+	return atomic.LoadUint64(&t.generation)
+}
+
 func (t *Things) Get(id primitive.ObjectID) (*Thing, error) {
 	t.Log.Debugf("Get thing: %s", id.Hex())
 
@@ -134,6 +182,272 @@ func (t *Things) RegisterPiot(id string, deviceType string) (*Thing, error) {
 	return &thing, nil
 }
 
+// RegisterPiotDevice registers new piot thing of type device with default
+// configuration of availability
+func (t *Things) RegisterPiotDevice(id string) (*Thing, error) {
+
+	thing, err := t.RegisterPiot(id, THING_TYPE_DEVICE)
+	if err != nil {
+		return nil, err
+	}
+
+	// configure availability topic
+	if err := t.SetAvailabilityTopic(thing.Id, "available"); err != nil {
+		return nil, err
+	}
+	if err := t.SetAvailabilityYesNo(thing.Id, "yes", "no"); err != nil {
+		return nil, err
+	}
+
+	thing.AvailabilityTopic = "available"
+	thing.AvailabilityYes = "yes"
+	thing.AvailabilityNo = "no"
+
+	return thing, nil
+}
+
+// TouchPendingPiot records packet from piot device that is not registered,
+// the device is added to pending devices if it was not seen before. Devices
+// that were not seen for PendingTTL are removed, new devices are not added
+// if there are PendingMaxEntries devices already (ErrPiotPendingFull).
+func (t *Things) TouchPendingPiot(id, ip string) (*PiotPendingDevice, error) {
+	t.Log.Debugf("Touching pending piot device: %s", id)
+
+	now := int32(time.Now().Unix())
+
+	set := bson.M{"last_seen": now}
+	if ip != "" {
+		set["ip"] = ip
+	}
+
+	update := bson.M{
+		"$set":         set,
+		"$inc":         bson.M{"packets": 1},
+		"$setOnInsert": bson.M{"first_seen": now},
+	}
+
+	var device PiotPendingDevice
+
+	err := t.Db.Collection("piot_pending").FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"piot_id": id},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&device)
+
+	if err == nil {
+		return &device, nil
+	}
+
+	if err != mongo.ErrNoDocuments {
+		t.Log.Errorf("Pending piot device %s cannot be stored (%v)", id, err)
+		return nil, errors.New("error while storing pending device")
+	}
+
+	// new device, make room by removal of expired devices
+	if err := t.expirePendingPiots(); err != nil {
+		return nil, err
+	}
+
+	count, err := t.Db.Collection("piot_pending").CountDocuments(context.TODO(), bson.M{})
+	if err != nil {
+		t.Log.Errorf("Counting of pending piot devices failed (%v)", err)
+		return nil, errors.New("error while storing pending device")
+	}
+
+	if count >= int64(t.PendingMaxEntries) {
+		return nil, ErrPiotPendingFull
+	}
+
+	err = t.Db.Collection("piot_pending").FindOneAndUpdate(
+		context.TODO(),
+		bson.M{"piot_id": id},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&device)
+
+	if err != nil {
+		t.Log.Errorf("Pending piot device %s cannot be stored (%v)", id, err)
+		return nil, errors.New("error while storing pending device")
+	}
+
+	return &device, nil
+}
+
+// expirePendingPiots removes pending piot devices not seen for PendingTTL
+// and rejected devices after PendingRejectTTL since their rejection
+func (t *Things) expirePendingPiots() error {
+	now := time.Now()
+	expired := int32(now.Add(-t.PendingTTL).Unix())
+	rejectExpired := int32(now.Add(-t.PendingRejectTTL).Unix())
+
+	filter := bson.M{"$or": bson.A{
+		bson.M{"rejected": bson.M{"$exists": false}, "last_seen": bson.M{"$lt": expired}},
+		bson.M{"rejected": bson.M{"$lt": rejectExpired}},
+	}}
+
+	_, err := t.Db.Collection("piot_pending").DeleteMany(context.TODO(), filter)
+	if err != nil {
+		t.Log.Errorf("Expiration of pending piot devices failed (%v)", err)
+		return errors.New("error while expiring pending devices")
+	}
+
+	return nil
+}
+
+// GetPendingPiots returns piot devices waiting for approval of registration
+// including rejected ones
+func (t *Things) GetPendingPiots() ([]*PiotPendingDevice, error) {
+
+	if err := t.expirePendingPiots(); err != nil {
+		return nil, err
+	}
+
+	cur, err := t.Db.Collection("piot_pending").Find(
+		context.TODO(),
+		bson.M{},
+		options.Find().SetSort(bson.D{{Key: "first_seen", Value: 1}}),
+	)
+	if err != nil {
+		t.Log.Errorf("Fetching of pending piot devices failed (%v)", err)
+		return nil, errors.New("error while fetching pending devices")
+	}
+	defer cur.Close(context.TODO())
+
+	result := []*PiotPendingDevice{}
+
+	if err := cur.All(context.TODO(), &result); err != nil {
+		t.Log.Errorf("Decoding of pending piot devices failed (%v)", err)
+		return nil, errors.New("error while fetching pending devices")
+	}
+
+	return result, nil
+}
+
+// FindPendingPiot looks for pending piot device
+func (t *Things) FindPendingPiot(id string) (*PiotPendingDevice, error) {
+	var device PiotPendingDevice
+
+	err := t.Db.Collection("piot_pending").FindOne(context.TODO(), bson.M{"piot_id": id}).Decode(&device)
+	if err != nil {
+		return nil, fmt.Errorf("pending device %s not found", id)
+	}
+
+	return &device, nil
+}
+
+// RejectPendingPiot marks pending piot device as rejected, packets of the
+// device are not recorded until the rejection expires (PendingRejectTTL) or
+// the device is approved
+func (t *Things) RejectPendingPiot(id string) error {
+	t.Log.Debugf("Rejecting pending piot device: %s", id)
+
+	res, err := t.Db.Collection("piot_pending").UpdateOne(
+		context.TODO(),
+		bson.M{"piot_id": id},
+		bson.M{"$set": bson.M{"rejected": int32(time.Now().Unix())}},
+	)
+	if err != nil {
+		t.Log.Errorf("Pending piot device %s cannot be rejected (%v)", id, err)
+		return errors.New("error while rejecting pending device")
+	}
+
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("pending device %s not found", id)
+	}
+
+	return nil
+}
+
+// DeletePendingPiot removes piot device from pending devices (after
+// approval of its registration)
+func (t *Things) DeletePendingPiot(id string) error {
+	t.Log.Debugf("Deleting pending piot device: %s", id)
+
+	res, err := t.Db.Collection("piot_pending").DeleteOne(context.TODO(), bson.M{"piot_id": id})
+	if err != nil {
+		t.Log.Errorf("Pending piot device %s cannot be deleted (%v)", id, err)
+		return errors.New("error while deleting pending device")
+	}
+
+	if res.DeletedCount == 0 {
+		return fmt.Errorf("pending device %s not found", id)
+	}
+
+	return nil
+}
+
+// GetPatternThing returns thing materialised from thing with topic patterns
+// for segments captured by wildcards, the thing is created if it doesn't
+// exist yet and there are less than PatternMaxThings things materialised
+// from the pattern thing (ErrPatternThingsFull otherwise). Creation of the
+// thing is not reported as change of things configuration, the caller is
+// responsible for routing of messages to the new thing (see TopicIndex).
+func (t *Things) GetPatternThing(pattern *Thing, captures []string) (*Thing, error) {
+	var thing Thing
+
+	collection := t.Db.Collection("things")
+
+	err := collection.FindOne(context.TODO(), bson.M{"pattern_id": pattern.Id, "pattern_captures": captures}).Decode(&thing)
+	if err == nil {
+		return &thing, nil
+	}
+
+	if err != mongo.ErrNoDocuments {
+		t.Log.Errorf("Fetching of thing materialised from %s failed (%v)", pattern.Name, err)
+		return nil, errors.New("error while fetching thing")
+	}
+
+	count, err := collection.CountDocuments(context.TODO(), bson.M{"pattern_id": pattern.Id})
+	if err != nil {
+		t.Log.Errorf("Counting of things materialised from %s failed (%v)", pattern.Name, err)
+		return nil, errors.New("error while fetching thing")
+	}
+
+	if count >= int64(t.PatternMaxThings) {
+		return nil, ErrPatternThingsFull
+	}
+
+	created := newPatternThing(pattern, captures)
+
+	t.Log.Infof("Creating thing %s materialised from topic patterns of thing %s", created.Name, pattern.Name)
+
+	if _, err := collection.InsertOne(context.TODO(), created); err != nil {
+		t.Log.Errorf("Thing %s cannot be created (%v)", created.Name, err)
+		return nil, errors.New("error while creating thing")
+	}
+
+	return created, nil
+}
+
+// UpdatePatternThings propagates configuration of thing with topic patterns
+// to things materialised from it (see newPatternThing), state of the
+// materialised things is preserved
+func (t *Things) UpdatePatternThings(pattern *Thing) error {
+	things, err := t.GetFiltered(bson.M{"pattern_id": pattern.Id})
+	if err != nil {
+		return err
+	}
+
+	for _, thing := range things {
+		t.Log.Debugf("Updating thing %s materialised from topic patterns of thing %s", thing.Name, pattern.Name)
+
+		fields := patternThingConfig(newPatternThing(pattern, thing.PatternCaptures))
+
+		_, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thing.Id}, bson.M{"$set": fields})
+		if err != nil {
+			t.Log.Errorf("Thing %s cannot be updated (%v)", thing.Id.Hex(), err)
+			return errors.New("error while updating thing attributes")
+		}
+	}
+
+	if len(things) > 0 {
+		t.Changed()
+	}
+
+	return nil
+}
+
 func (t *Things) SetParent(id primitive.ObjectID, id_parent primitive.ObjectID) error {
 	t.Log.Debugf("Setting thing <%v>, setting parent to <%s>", id.Hex(), id_parent.Hex())
 
@@ -158,6 +472,162 @@ func (t *Things) SetParent(id primitive.ObjectID, id_parent primitive.ObjectID)
 	return nil
 }
 
+// SetPiotCounter stores message counter of piot thing, the counter is
+// updated only if it is greater than last stored value (ErrPiotReplay
+// otherwise)
+func (t *Things) SetPiotCounter(id primitive.ObjectID, counter int32) error {
+	t.Log.Debugf("Setting thing <%s> piot counter to <%d>", id.Hex(), counter)
+
+	res, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{
+			"_id": id,
+			"$or": []interface{}{
+				bson.M{
+					"piot_counter": bson.M{
+						"$exists": false,
+					},
+				},
+				bson.M{
+					"piot_counter": bson.M{
+						"$lt": counter,
+					},
+				},
+			},
+		},
+		bson.M{"$set": bson.M{"piot_counter": counter}},
+	)
+
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return errors.New("error while updating thing attributes")
+	}
+
+	if res.MatchedCount == 0 {
+		// thing could be deleted in the meantime
+		count, err := t.Db.Collection("things").CountDocuments(context.TODO(), bson.M{"_id": id})
+		if err != nil {
+			t.Log.Errorf("Thing %s cannot be counted (%v)", id.Hex(), err)
+			return errors.New("error while updating thing attributes")
+		}
+		if count == 0 {
+			return errors.New("thing does not exist")
+		}
+		return ErrPiotReplay
+	}
+
+	return nil
+}
+
+// AddPiotCommand appends command to queue of commands for piot thing
+func (t *Things) AddPiotCommand(id primitive.ObjectID, name, value string) (*PiotCommand, error) {
+	t.Log.Debugf("Adding command <%s=%s> to thing <%s>", name, value, id.Hex())
+
+	command := PiotCommand{
+		Id:      primitive.NewObjectID(),
+		Name:    name,
+		Value:   value,
+		Created: int32(time.Now().Unix()),
+	}
+
+	res, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$push": bson.M{"piot_commands": command}},
+	)
+
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return nil, errors.New("error while adding thing command")
+	}
+
+	if res.MatchedCount == 0 {
+		return nil, errors.New("thing does not exist")
+	}
+
+	return &command, nil
+}
+
+// DeletePiotCommand removes command from queue of commands for piot thing
+func (t *Things) DeletePiotCommand(id, commandId primitive.ObjectID) error {
+	t.Log.Debugf("Deleting command <%s> of thing <%s>", commandId.Hex(), id.Hex())
+
+	_, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$pull": bson.M{"piot_commands": bson.M{"id": commandId}}},
+	)
+
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return errors.New("error while deleting thing command")
+	}
+
+	return nil
+}
+
+// SetPiotCommandDelivered marks command as delivered and increments number
+// of its deliveries, false is returned if command doesn't exist, it was
+// acknowledged or it was delivered since given number of deliveries was read
+func (t *Things) SetPiotCommandDelivered(id, commandId primitive.ObjectID, deliveries int32) (bool, error) {
+	t.Log.Debugf("Setting thing <%s> command <%s> as delivered", id.Hex(), commandId.Hex())
+
+	// commands created before counting of deliveries have no counter
+	var match interface{} = deliveries
+	if deliveries == 0 {
+		match = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	res, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{
+			"_id": id,
+			"piot_commands": bson.M{
+				"$elemMatch": bson.M{"id": commandId, "acknowledged": 0, "deliveries": match},
+			},
+		},
+		bson.M{
+			"$set": bson.M{"piot_commands.$.delivered": int32(time.Now().Unix())},
+			"$inc": bson.M{"piot_commands.$.deliveries": 1},
+		},
+	)
+
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return false, errors.New("error while updating thing command")
+	}
+
+	return res.MatchedCount > 0, nil
+}
+
+// SetPiotCommandAcknowledged marks command as acknowledged by device, false
+// is returned if command doesn't exist or it was already acknowledged
+func (t *Things) SetPiotCommandAcknowledged(id, commandId primitive.ObjectID) (bool, error) {
+	return t.setPiotCommandTime(id, commandId, "acknowledged")
+}
+
+func (t *Things) setPiotCommandTime(id, commandId primitive.ObjectID, attr string) (bool, error) {
+	t.Log.Debugf("Setting thing <%s> command <%s> as %s", id.Hex(), commandId.Hex(), attr)
+
+	res, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{
+			"_id": id,
+			"piot_commands": bson.M{
+				"$elemMatch": bson.M{"id": commandId, attr: 0},
+			},
+		},
+		bson.M{"$set": bson.M{"piot_commands.$." + attr: int32(time.Now().Unix())}},
+	)
+
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return false, errors.New("error while updating thing command")
+	}
+
+	return res.MatchedCount > 0, nil
+}
+
 func (t *Things) SetAvailabilityTopic(id primitive.ObjectID, topic string) error {
 	t.Log.Debugf("Setting thing <%s>, setting avalibility topic to <%s>", id.Hex(), topic)
 
@@ -167,6 +637,8 @@ func (t *Things) SetAvailabilityTopic(id primitive.ObjectID, topic string) error
 		return errors.New("error while updating thing attributes")
 	}
 
+	t.Changed()
+
 	return nil
 }
 
@@ -179,9 +651,82 @@ func (t *Things) SetAvailabilityYesNo(id primitive.ObjectID, yes, no string) err
 		return errors.New("error while updating thing attributes")
 	}
 
+	t.Changed()
+
+	return nil
+}
+
+// SetTelemetryValues sets last values of telemetry fields, values are also
+// stored as sample of telemetry history if history is enabled. Only the
+// newest TELEMETRY_HISTORY_SIZE samples of thing are kept.
+func (t *Things) SetTelemetryValues(id primitive.ObjectID, values []TelemetryValue, ts time.Time, history bool) error {
+	t.Log.Debugf("Setting thing <%s> telemetry values", id.Hex())
+
+	_, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"telemetry_values": values}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return errors.New("error while updating thing attributes")
+	}
+
+	if !history {
+		return nil
+	}
+
+	collection := t.Db.Collection("telemetry_samples")
+
+	sample := TelemetrySample{ThingId: id, Time: int32(ts.Unix()), Values: values}
+	if _, err := collection.InsertOne(context.TODO(), sample); err != nil {
+		t.Log.Errorf("Telemetry sample of thing %s cannot be stored (%v)", id.Hex(), err)
+		return errors.New("error while storing telemetry sample")
+	}
+
+	// remove samples exceeding size of history
+	opts := options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetSkip(TELEMETRY_HISTORY_SIZE)
+	var oldest TelemetrySample
+	err = collection.FindOne(context.TODO(), bson.M{"thing_id": id}, opts).Decode(&oldest)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err == nil {
+		_, err = collection.DeleteMany(context.TODO(), bson.M{"thing_id": id, "_id": bson.M{"$lte": oldest.Id}})
+	}
+	if err != nil {
+		t.Log.Errorf("Telemetry history of thing %s cannot be pruned (%v)", id.Hex(), err)
+	}
+
 	return nil
 }
 
+// GetTelemetrySamples returns the latest samples of telemetry history of
+// thing, the newest sample is the first one
+func (t *Things) GetTelemetrySamples(id primitive.ObjectID, limit int64) ([]*TelemetrySample, error) {
+	ctx := context.TODO()
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit)
+
+	cur, err := t.Db.Collection("telemetry_samples").Find(ctx, bson.M{"thing_id": id}, opts)
+	if err != nil {
+		t.Log.Errorf("Telemetry samples of thing %s cannot be fetched (%v)", id.Hex(), err)
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	result := []*TelemetrySample{}
+	for cur.Next(ctx) {
+		sample := TelemetrySample{}
+		if err := cur.Decode(&sample); err != nil {
+			return nil, err
+		}
+		result = append(result, &sample)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (t *Things) SetTelemetry(id primitive.ObjectID, telemetry string) error {
 	t.Log.Debugf("Setting thing <%s> telemetry", id.Hex())
 
@@ -203,6 +748,8 @@ func (t *Things) SetLocationMqttTopic(id primitive.ObjectID, topic string) error
 		return errors.New("error while updating thing attributes")
 	}
 
+	t.Changed()
+
 	return nil
 }
 
@@ -221,6 +768,8 @@ func (t *Things) SetLocationMqttValues(id primitive.ObjectID, lat, lng, sat, ts
 		return errors.New("error while updating thing attributes")
 	}
 
+	t.Changed()
+
 	return nil
 }
 
@@ -271,6 +820,8 @@ func (t *Things) SetSensorMeasurementTopic(id primitive.ObjectID, topic string)
 		return errors.New("error while updating thing attributes")
 	}
 
+	t.Changed()
+
 	return nil
 }
 
@@ -283,13 +834,33 @@ func (t *Things) SetSensorClass(id primitive.ObjectID, class string) error {
 		return errors.New("error while updating thing attributes")
 	}
 
+	t.Changed()
+
+	return nil
+}
+
+func (t *Things) SetSensorUnit(id primitive.ObjectID, unit string) error {
+	t.Log.Debugf("Setting thing <%s> sensor unit to <%s>", id.Hex(), unit)
+
+	_, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"sensor.unit": unit}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return errors.New("error while updating thing attributes")
+	}
+
+	t.Changed()
+
 	return nil
 }
 
-func (t *Things) SetSensorValue(id primitive.ObjectID, value string) error {
+// SetSensorValue sets sensor value and time of measurement
+func (t *Things) SetSensorValue(id primitive.ObjectID, value string, ts time.Time) error {
 	t.Log.Debugf("Setting thing <%s> sensor value to <%s>", id, value)
 
-	_, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"sensor.value": value}})
+	_, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"sensor.value": value, "sensor.measurement_last": int32(ts.Unix())}})
 	if err != nil {
 		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
 		return errors.New("error while updating thing attributes")
@@ -310,6 +881,137 @@ func (t *Things) SetSwitchState(id primitive.ObjectID, value bool) error {
 	return nil
 }
 
+// SetSwitchRequest stores new pending request for change of switch state,
+// previous request is replaced
+func (t *Things) SetSwitchRequest(id primitive.ObjectID, state bool, timeout time.Duration) (*SwitchRequest, error) {
+	t.Log.Debugf("Setting thing <%s> switch request to <%v>", id.Hex(), state)
+
+	now := time.Now()
+	request := &SwitchRequest{
+		State:    state,
+		Status:   SWITCH_REQUEST_PENDING,
+		Created:  int32(now.Unix()),
+		Deadline: int32(now.Add(timeout).Unix()),
+	}
+
+	_, err := t.Db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": id}, bson.M{"$set": bson.M{"switch.request": request}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return nil, errors.New("error while updating thing attributes")
+	}
+
+	return request, nil
+}
+
+// ClearSwitchRequest removes pending request for change of switch state
+// (e.g. if command was not sent), request is kept if it was completed or
+// replaced by newer request in the meantime
+func (t *Things) ClearSwitchRequest(id primitive.ObjectID, request *SwitchRequest) error {
+	t.Log.Debugf("Clearing thing <%s> switch request", id.Hex())
+
+	_, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id, "switch.request.status": SWITCH_REQUEST_PENDING, "switch.request.created": request.Created, "switch.request.state": request.State},
+		bson.M{"$unset": bson.M{"switch.request": ""}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return errors.New("error while updating thing attributes")
+	}
+
+	return nil
+}
+
+// CompleteSwitchRequest marks pending request as done if state matches
+// requested state, requests that were not confirmed until deadline are
+// marked as timed out. Returns true if request was completed.
+func (t *Things) CompleteSwitchRequest(id primitive.ObjectID, state bool) (bool, error) {
+	now := int32(time.Now().Unix())
+
+	res, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id, "switch.request.status": SWITCH_REQUEST_PENDING, "switch.request.state": state, "switch.request.deadline": bson.M{"$gte": now}},
+		bson.M{"$set": bson.M{"switch.request.status": SWITCH_REQUEST_DONE, "switch.request.completed": now}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return false, errors.New("error while updating thing attributes")
+	}
+
+	if res.ModifiedCount > 0 {
+		t.Log.Debugf("Switch request of thing <%s> completed", id.Hex())
+		return true, nil
+	}
+
+	_, err = t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id, "switch.request.status": SWITCH_REQUEST_PENDING, "switch.request.deadline": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"switch.request.status": SWITCH_REQUEST_TIMEOUT}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return false, errors.New("error while updating thing attributes")
+	}
+
+	return false, nil
+}
+
+// SetAvailable sets availability of thing, change of availability is
+// recorded as availability event. Returns true if availability changed.
+func (t *Things) SetAvailable(id primitive.ObjectID, available bool) (bool, error) {
+	now := int32(time.Now().Unix())
+
+	res, err := t.Db.Collection("things").UpdateOne(
+		context.TODO(),
+		bson.M{"_id": id, "available": bson.M{"$ne": available}},
+		bson.M{"$set": bson.M{"available": available, "available_changed": now}})
+	if err != nil {
+		t.Log.Errorf("Thing %s cannot be updated (%v)", id.Hex(), err)
+		return false, errors.New("error while updating thing attributes")
+	}
+
+	if res.ModifiedCount == 0 {
+		return false, nil
+	}
+
+	t.Log.Debugf("Thing <%s> availability changed to <%v>", id.Hex(), available)
+
+	event := AvailabilityEvent{ThingId: id, Available: available, Time: now}
+	if _, err := t.Db.Collection("availability_events").InsertOne(context.TODO(), event); err != nil {
+		t.Log.Errorf("Availability event of thing %s cannot be stored (%v)", id.Hex(), err)
+		return true, errors.New("error while storing availability event")
+	}
+
+	return true, nil
+}
+
+// GetAvailabilityEvents returns the latest availability events of thing,
+// the newest event is the first one
+func (t *Things) GetAvailabilityEvents(id primitive.ObjectID, limit int64) ([]*AvailabilityEvent, error) {
+	ctx := context.TODO()
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(limit)
+
+	cur, err := t.Db.Collection("availability_events").Find(ctx, bson.M{"thing_id": id}, opts)
+	if err != nil {
+		t.Log.Errorf("Availability events of thing %s cannot be fetched (%v)", id.Hex(), err)
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	result := []*AvailabilityEvent{}
+	for cur.Next(ctx) {
+		event := AvailabilityEvent{}
+		if err := cur.Decode(&event); err != nil {
+			return nil, err
+		}
+		result = append(result, &event)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (t *Things) TouchThing(id primitive.ObjectID) error {
 	t.Log.Debugf("Touch thing <%s>", id.Hex())
 
@@ -358,18 +1060,40 @@ func (t *Things) SetAlarm(id primitive.ObjectID, active bool) error {
 	return nil
 }
 
+// Delete deletes thing together with things materialised from its topic
+// patterns (see GetPatternThing)
 func (t *Things) Delete(id primitive.ObjectID) error {
 
 	t.Log.Debugf("Deleting thing <%s>", id.Hex())
 
+	ids := []primitive.ObjectID{id}
+
+	materialised, err := t.GetFiltered(bson.M{"pattern_id": id})
+	if err != nil {
+		return errors.New("error while deleting thing")
+	}
+	for _, thing := range materialised {
+		ids = append(ids, thing.Id)
+	}
+
 	collection := t.Db.Collection("things")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"_id": id})
+	_, err = collection.DeleteMany(context.TODO(), bson.M{"_id": bson.M{"$in": ids}})
 	if err != nil {
 		t.Log.Errorf("Cannot delete thing %s (%v)", id.Hex(), err)
 		return errors.New("error while deleting thing")
 	}
 
-	t.Log.Debugf("Thing %s deleted", id.Hex())
+	t.Changed()
+
+	if _, err := t.Db.Collection("availability_events").DeleteMany(context.TODO(), bson.M{"thing_id": bson.M{"$in": ids}}); err != nil {
+		t.Log.Errorf("Cannot delete availability events of thing %s (%v)", id.Hex(), err)
+	}
+
+	if _, err := t.Db.Collection("telemetry_samples").DeleteMany(context.TODO(), bson.M{"thing_id": bson.M{"$in": ids}}); err != nil {
+		t.Log.Errorf("Cannot delete telemetry samples of thing %s (%v)", id.Hex(), err)
+	}
+
+	t.Log.Debugf("Thing %s deleted (materialised things: %d)", id.Hex(), len(materialised))
 	return nil
 }
 
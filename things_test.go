@@ -3,7 +3,9 @@ package main_test
 import (
 	main "piot-server"
 	"testing"
+	"time"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -252,3 +254,197 @@ func TestSetBatteryLevel(t *testing.T) {
 	Equals(t, THING_NAME, thing.Name)
 	Equals(t, TEST_VAL, thing.BatteryLevel)
 }
+
+func TestSetPiotCounter(t *testing.T) {
+	const THING_NAME = "thing2"
+	db := GetDb(t)
+	CleanDb(t, db)
+	thingId := CreateThing(t, db, THING_NAME)
+	things := main.NewThings(GetDb(t), GetLogger(t))
+
+	err := things.SetPiotCounter(thingId, 10)
+	Ok(t, err)
+
+	// same or lower counter is not accepted
+	err = things.SetPiotCounter(thingId, 10)
+	Equals(t, main.ErrPiotReplay, err)
+	err = things.SetPiotCounter(thingId, 9)
+	Equals(t, main.ErrPiotReplay, err)
+
+	thing, err := things.Find(THING_NAME)
+	Ok(t, err)
+	Equals(t, int32(10), *thing.PiotCounter)
+}
+
+// first counter of registered device can be zero
+func TestSetPiotCounterZero(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	things := main.NewThings(GetDb(t), GetLogger(t))
+
+	thing, err := things.RegisterPiotDevice("device1")
+	Ok(t, err)
+	Assert(t, thing.PiotCounter == nil, "registered device shall have no counter")
+
+	Ok(t, things.SetPiotCounter(thing.Id, 0))
+	Equals(t, main.ErrPiotReplay, things.SetPiotCounter(thing.Id, 0))
+
+	thing, err = things.Get(thing.Id)
+	Ok(t, err)
+	Equals(t, int32(0), *thing.PiotCounter)
+}
+
+// counter of not existing thing is not reported as replay
+func TestSetPiotCounterNotExisting(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	things := main.NewThings(GetDb(t), GetLogger(t))
+
+	err := things.SetPiotCounter(primitive.NewObjectID(), 1)
+	Assert(t, err != nil, "counter of not existing thing shall not be accepted")
+	Assert(t, err != main.ErrPiotReplay, "not existing thing shall not be reported as replay")
+}
+
+func TestPiotCommands(t *testing.T) {
+	const THING_NAME = "device1"
+	db := GetDb(t)
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, THING_NAME)
+	things := main.NewThings(GetDb(t), GetLogger(t))
+
+	cmd1, err := things.AddPiotCommand(thingId, main.PIOT_COMMAND_INTERVAL, "60")
+	Ok(t, err)
+	cmd2, err := things.AddPiotCommand(thingId, main.PIOT_COMMAND_REBOOT, "")
+	Ok(t, err)
+
+	// command can be delivered only once by concurrent requests
+	delivered, err := things.SetPiotCommandDelivered(thingId, cmd1.Id, 0)
+	Ok(t, err)
+	Assert(t, delivered, "Command shall be delivered")
+	delivered, err = things.SetPiotCommandDelivered(thingId, cmd1.Id, 0)
+	Ok(t, err)
+	Assert(t, !delivered, "Command shall not be delivered twice")
+
+	// command is delivered again until it is acknowledged
+	delivered, err = things.SetPiotCommandDelivered(thingId, cmd1.Id, 1)
+	Ok(t, err)
+	Assert(t, delivered, "Command shall be delivered again")
+
+	acknowledged, err := things.SetPiotCommandAcknowledged(thingId, cmd1.Id)
+	Ok(t, err)
+	Assert(t, acknowledged, "Command shall be acknowledged")
+
+	delivered, err = things.SetPiotCommandDelivered(thingId, cmd1.Id, 2)
+	Ok(t, err)
+	Assert(t, !delivered, "Acknowledged command shall not be delivered")
+
+	err = things.DeletePiotCommand(thingId, cmd2.Id)
+	Ok(t, err)
+
+	thing, err := things.Find(THING_NAME)
+	Ok(t, err)
+	Equals(t, 1, len(thing.PiotCommands))
+	Equals(t, cmd1.Id, thing.PiotCommands[0].Id)
+	Equals(t, "60", thing.PiotCommands[0].Value)
+	Assert(t, thing.PiotCommands[0].Delivered > 0, "Delivery time shall be set")
+	Equals(t, int32(2), thing.PiotCommands[0].Deliveries)
+	Assert(t, thing.PiotCommands[0].Acknowledged > 0, "Acknowledge time shall be set")
+
+	// unknown thing
+	_, err = things.AddPiotCommand(primitive.NewObjectID(), main.PIOT_COMMAND_REBOOT, "")
+	Assert(t, err != nil, "Command for unknown thing shall be rejected")
+}
+
+func TestPendingPiot(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	things := main.NewThings(GetDb(t), GetLogger(t))
+
+	device, err := things.TouchPendingPiot("device1", "192.168.1.10")
+	Ok(t, err)
+	Equals(t, "device1", device.PiotId)
+	Equals(t, int32(1), device.Packets)
+	Assert(t, device.FirstSeen > 0, "First seen shall be set")
+
+	device, err = things.TouchPendingPiot("device1", "")
+	Ok(t, err)
+	Equals(t, int32(2), device.Packets)
+	Equals(t, "192.168.1.10", device.Ip)
+
+	_, err = things.TouchPendingPiot("device2", "")
+	Ok(t, err)
+
+	devices, err := things.GetPendingPiots()
+	Ok(t, err)
+	Equals(t, 2, len(devices))
+
+	// deleted devices are not listed
+	Ok(t, things.DeletePendingPiot("device2"))
+	devices, err = things.GetPendingPiots()
+	Ok(t, err)
+	Equals(t, 1, len(devices))
+	Equals(t, "device1", devices[0].PiotId)
+
+	Ok(t, things.DeletePendingPiot("device1"))
+	_, err = things.FindPendingPiot("device1")
+	Assert(t, err != nil, "Deleted device shall not be found")
+	Assert(t, things.DeletePendingPiot("device1") != nil, "Unknown device shall not be deleted")
+
+	// new devices are not added over limit
+	things.PendingMaxEntries = 1
+	_, err = things.TouchPendingPiot("device3", "")
+	Ok(t, err)
+	_, err = things.TouchPendingPiot("device4", "")
+	Equals(t, main.ErrPiotPendingFull, err)
+}
+
+// configuration of pattern thing is propagated to materialised things
+func TestUpdatePatternThings(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	things := main.NewThings(db, GetLogger(t))
+
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/+/temperature")
+
+	pattern, err := things.Get(sensorId)
+	Ok(t, err)
+	materialised, err := things.GetPatternThing(pattern, []string{"kitchen"})
+	Ok(t, err)
+	Ok(t, things.SetSensorValue(materialised.Id, "21.5", time.Now()))
+
+	Ok(t, things.SetSensorClass(sensorId, "humidity"))
+	pattern, err = things.Get(sensorId)
+	Ok(t, err)
+	Ok(t, things.UpdatePatternThings(pattern))
+
+	thing, err := things.Get(materialised.Id)
+	Ok(t, err)
+	Equals(t, "humidity", thing.Sensor.Class)
+	Equals(t, "zigbee/kitchen/temperature", thing.Sensor.MeasurementTopic)
+	Equals(t, materialised.Name, thing.Name)
+	Equals(t, "21.5", thing.Sensor.Value)
+}
+
+// things materialised from pattern thing are deleted together with it
+func TestDeletePatternThing(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+	things := main.NewThings(db, GetLogger(t))
+
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/+/temperature")
+	otherId := CreateThing(t, db, "sensor2")
+
+	pattern, err := things.Get(sensorId)
+	Ok(t, err)
+	_, err = things.GetPatternThing(pattern, []string{"kitchen"})
+	Ok(t, err)
+
+	Ok(t, things.Delete(sensorId))
+
+	remaining, err := things.GetFiltered(bson.M{})
+	Ok(t, err)
+	Equals(t, 1, len(remaining))
+	Equals(t, otherId, remaining[0].Id)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Roles of things in processing of MQTT messages
+const TOPIC_ROLE_BATTERY = "battery"
+const TOPIC_ROLE_AVAILABILITY = "availability"
+const TOPIC_ROLE_TELEMETRY = "telemetry"
+const TOPIC_ROLE_LOCATION = "location"
+const TOPIC_ROLE_SENSOR = "sensor"
+const TOPIC_ROLE_SWITCH = "switch"
+
+// default interval of rebuilding of index from database, it picks up changes
+// of things and orgs done directly in database
+const TOPIC_INDEX_REBUILD_INTERVAL = time.Minute
+
+type topicKey struct {
+	org   primitive.ObjectID
+	topic string
+	role  string
+}
+
+type topicPatternKey struct {
+	org  primitive.ObjectID
+	role string
+}
+
+type topicPatternRoute struct {
+	pattern string
+	thing   *Thing
+}
+
+type topicPatternMatch struct {
+	thing    *Thing
+	captures []string
+}
+
+// In-memory index of things interested in MQTT topics of orgs. The index
+// is built from database on first use and it is rebuilt once things or orgs
+// are changed (see Things.Changed, Orgs.Changed) or when it is older than
+// RebuildInterval, so changes done directly in database are not missed.
+// Things matched by the index are read again from database by single query
+// before they are returned, so their configuration is always current.
+// Topics with wildcards (see MatchTopic) are matched one by one. Things with
+// such topics are templates, each set of segments captured by wildcards
+// gets its own thing materialised from the template (see
+// Things.GetPatternThing), so state of things behind different topics is
+// not mixed. Materialised things are added to the index without its rebuild
+// and number of things materialised from single template is limited (see
+// Things.PatternMaxThings).
+type TopicIndex struct {
+	log    *logging.Logger
+	things *Things
+	orgs   *Orgs
+
+	// maximal age of index
+	RebuildInterval time.Duration
+
+	mutex            sync.RWMutex
+	built            bool
+	builtAt          time.Time
+	thingsGeneration uint64
+	orgsGeneration   uint64
+	orgsByName       map[string]*Org
+	routes           map[topicKey][]*Thing
+	patterns         map[topicPatternKey][]topicPatternRoute
+
+	// names of piot things by org names, topics of piot things are
+	// published by server
+	piotThings map[string]map[string]bool
+
+	// templates with maximal number of materialised things, they are not
+	// matched until index is rebuilt (e.g. after deletion of thing)
+	full map[primitive.ObjectID]bool
+
+	// serializes materialisation of things from patterns
+	materializeMutex sync.Mutex
+}
+
+func NewTopicIndex(log *logging.Logger, things *Things, orgs *Orgs) *TopicIndex {
+	return &TopicIndex{log: log, things: things, orgs: orgs, RebuildInterval: TOPIC_INDEX_REBUILD_INTERVAL}
+}
+
+// Org returns org of given name
+func (i *TopicIndex) Org(name string) (*Org, error) {
+	if err := i.ensure(); err != nil {
+		return nil, err
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	org, ok := i.orgsByName[name]
+	if !ok {
+		return nil, errors.New("Org not found")
+	}
+
+	return org, nil
+}
+
+// Things returns things of org that have given role for topic
+func (i *TopicIndex) Things(orgId primitive.ObjectID, topic, role string) ([]*Thing, error) {
+	if err := i.ensure(); err != nil {
+		return nil, err
+	}
+
+	i.mutex.RLock()
+	result := i.routes[topicKey{orgId, topic, role}]
+
+	// materialised things are routed by their own topics
+	var missing []topicPatternMatch
+	for _, route := range i.patterns[topicPatternKey{orgId, role}] {
+		if i.full[route.thing.Id] {
+			continue
+		}
+		captures, ok := MatchTopic(route.pattern, topic)
+		if !ok || materialized(result, route.thing) {
+			continue
+		}
+		missing = append(missing, topicPatternMatch{route.thing, captures})
+	}
+	i.mutex.RUnlock()
+
+	for _, match := range missing {
+		thing, err := i.materialize(match)
+		if err == ErrPatternThingsFull {
+			i.log.Warningf("Ignoring topic %s matched by patterns of thing %s (%s)", topic, match.thing.Name, err.Error())
+			i.setFull(match.thing)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		i.insert(thing)
+
+		// routes are shared, they must not be extended in place
+		result = append(result[:len(result):len(result)], thing)
+	}
+
+	return i.refresh(orgId, result)
+}
+
+// refresh reads matched things from database, things that were deleted or
+// moved to another org in the meantime are left out
+func (i *TopicIndex) refresh(orgId primitive.ObjectID, things []*Thing) ([]*Thing, error) {
+	if len(things) == 0 {
+		return things, nil
+	}
+
+	ids := make([]primitive.ObjectID, len(things))
+	for n, thing := range things {
+		ids[n] = thing.Id
+	}
+
+	current, err := i.things.GetFiltered(bson.M{"_id": bson.M{"$in": ids}, "org_id": orgId})
+	if err != nil {
+		return nil, err
+	}
+
+	byId := make(map[primitive.ObjectID]*Thing)
+	for _, thing := range current {
+		byId[thing.Id] = thing
+	}
+
+	result := make([]*Thing, 0, len(things))
+	for _, id := range ids {
+		if thing, ok := byId[id]; ok {
+			result = append(result, thing)
+		}
+	}
+
+	return result, nil
+}
+
+// IsPiotTopic checks if topic belongs to piot thing (org/<org>/<thing>/...),
+// values of piot things are published by server on behalf of devices
+func (i *TopicIndex) IsPiotTopic(topic string) bool {
+	parts := strings.SplitN(topic, "/", 4)
+	if len(parts) < 4 || parts[0] != TOPIC_ROOT {
+		return false
+	}
+
+	if err := i.ensure(); err != nil {
+		return false
+	}
+
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.piotThings[parts[1]][parts[2]]
+}
+
+// materialized checks if things contain thing materialised from pattern
+func materialized(things []*Thing, pattern *Thing) bool {
+	for _, thing := range things {
+		if thing.PatternId == pattern.Id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// materialize returns thing materialised from pattern thing for captured
+// segments, concurrent lookups of the same topic must not create duplicates
+func (i *TopicIndex) materialize(match topicPatternMatch) (*Thing, error) {
+	i.materializeMutex.Lock()
+	defer i.materializeMutex.Unlock()
+
+	return i.things.GetPatternThing(match.thing, match.captures)
+}
+
+// setFull stops matching of topics by patterns of given template
+func (i *TopicIndex) setFull(pattern *Thing) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.full[pattern.Id] = true
+}
+
+// insert adds routes of materialised thing to the index, thing is not added
+// again if the index was rebuilt since thing was materialised
+func (i *TopicIndex) insert(thing *Thing) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.indexThing(thing, func(topic, role string) {
+		// materialised things have no topics with wildcards
+		if topic == "" || IsTopicPattern(topic) {
+			return
+		}
+		key := topicKey{thing.OrgId, topic, role}
+		for _, t := range i.routes[key] {
+			if t.Id == thing.Id {
+				return
+			}
+		}
+		// routes are shared, they must not be extended in place
+		i.routes[key] = append(i.routes[key][:len(i.routes[key]):len(i.routes[key])], thing)
+	})
+}
+
+// indexThing calls add for all topics of thing and their roles
+func (i *TopicIndex) indexThing(thing *Thing, add func(topic, role string)) {
+	if thing.OrgId == primitive.NilObjectID {
+		return
+	}
+
+	add(thing.BatteryMqttTopic, TOPIC_ROLE_BATTERY)
+
+	switch thing.Type {
+	case THING_TYPE_DEVICE:
+		add(thing.AvailabilityTopic, TOPIC_ROLE_AVAILABILITY)
+		add(thing.TelemetryTopic, TOPIC_ROLE_TELEMETRY)
+		add(thing.LocationMqttTopic, TOPIC_ROLE_LOCATION)
+	case THING_TYPE_SENSOR:
+		add(thing.Sensor.MeasurementTopic, TOPIC_ROLE_SENSOR)
+	case THING_TYPE_SWITCH:
+		if IsTopicPattern(thing.Switch.StateTopic) {
+			i.log.Warningf("Ignoring state topic of switch %s (%s)", thing.Name, errTopicPattern.Error())
+			break
+		}
+		add(thing.Switch.StateTopic, TOPIC_ROLE_SWITCH)
+	}
+}
+
+// ensure rebuilds index if things or orgs were changed since last build
+func (i *TopicIndex) ensure() error {
+	thingsGeneration := i.things.Generation()
+	orgsGeneration := i.orgs.Generation()
+
+	i.mutex.RLock()
+	valid := i.valid(thingsGeneration, orgsGeneration)
+	i.mutex.RUnlock()
+
+	if valid {
+		return nil
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	// index could be rebuilt while waiting for lock
+	if i.valid(thingsGeneration, orgsGeneration) {
+		return nil
+	}
+
+	return i.rebuild(thingsGeneration, orgsGeneration)
+}
+
+func (i *TopicIndex) valid(thingsGeneration, orgsGeneration uint64) bool {
+	if i.RebuildInterval > 0 && time.Since(i.builtAt) > i.RebuildInterval {
+		return false
+	}
+
+	return i.built && i.thingsGeneration == thingsGeneration && i.orgsGeneration == orgsGeneration
+}
+
+func (i *TopicIndex) rebuild(thingsGeneration, orgsGeneration uint64) error {
+	i.log.Debugf("Rebuilding MQTT topic index")
+
+	orgs, err := i.orgs.GetAll()
+	if err != nil {
+		return err
+	}
+
+	things, err := i.things.GetFiltered(bson.M{"org_id": bson.M{"$ne": primitive.NilObjectID}})
+	if err != nil {
+		return err
+	}
+
+	orgsByName := make(map[string]*Org)
+	orgNames := make(map[primitive.ObjectID]string)
+	for _, org := range orgs {
+		orgsByName[org.Name] = org
+		orgNames[org.Id] = org.Name
+	}
+
+	piotThings := make(map[string]map[string]bool)
+	for _, thing := range things {
+		name, ok := orgNames[thing.OrgId]
+		if !ok || thing.PiotId == "" {
+			continue
+		}
+		if piotThings[name] == nil {
+			piotThings[name] = make(map[string]bool)
+		}
+		piotThings[name][thing.Name] = true
+	}
+
+	routes := make(map[topicKey][]*Thing)
+	patterns := make(map[topicPatternKey][]topicPatternRoute)
+
+	for _, thing := range things {
+		i.indexThing(thing, func(topic, role string) {
+			if topic == "" {
+				return
+			}
+			if IsTopicPattern(topic) {
+				if err := ValidateTopicPattern(topic); err != nil {
+					i.log.Warningf("Ignoring topic of thing %s (%s)", thing.Name, err.Error())
+					return
+				}
+				key := topicPatternKey{thing.OrgId, role}
+				patterns[key] = append(patterns[key], topicPatternRoute{topic, thing})
+				return
+			}
+			key := topicKey{thing.OrgId, topic, role}
+			routes[key] = append(routes[key], thing)
+		})
+	}
+
+	i.orgsByName = orgsByName
+	i.routes = routes
+	i.patterns = patterns
+	i.piotThings = piotThings
+	i.full = make(map[primitive.ObjectID]bool)
+	i.thingsGeneration = thingsGeneration
+	i.orgsGeneration = orgsGeneration
+	i.built = true
+	i.builtAt = time.Now()
+
+	i.log.Debugf("MQTT topic index rebuilt (orgs: %d, things: %d, routes: %d, patterns: %d)", len(orgs), len(things), len(routes), len(patterns))
+
+	return nil
+}
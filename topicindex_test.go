@@ -0,0 +1,339 @@
+package main_test
+
+import (
+	"context"
+	"fmt"
+	main "piot-server"
+	"piot-server/schema"
+	"testing"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestTopicIndex(t *testing.T) {
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	orgs := GetOrgs(t, log, db)
+	index := main.NewTopicIndex(log, things, orgs)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "sensor1/value")
+	CreateThing(t, db, "sensor2")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, "sensor1")
+
+	org, err := index.Org(ORG)
+	Ok(t, err)
+	Equals(t, orgId, org.Id)
+
+	_, err = index.Org("org2")
+	Fail(t, err)
+
+	sensors, err := index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+	Equals(t, "sensor1", sensors[0].Name)
+
+	// sensor role only
+	switches, err := index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SWITCH)
+	Ok(t, err)
+	Equals(t, 0, len(switches))
+
+	// change of topic through things service is reflected
+	err = things.SetSensorMeasurementTopic(sensorId, "sensor1/temperature")
+	Ok(t, err)
+
+	sensors, err = index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+
+	sensors, err = index.Things(orgId, "sensor1/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+
+	// new org is visible after notification
+	CreateOrg(t, db, "org2")
+	orgs.Changed()
+
+	_, err = index.Org("org2")
+	Ok(t, err)
+
+	// deleted thing is removed
+	err = things.Delete(sensorId)
+	Ok(t, err)
+
+	sensors, err = index.Things(orgId, "sensor1/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+}
+
+// changes done directly in database are reflected by index, configuration
+// of matched things immediately, routing after periodic rebuild
+func TestTopicIndexDirectChanges(t *testing.T) {
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	orgs := GetOrgs(t, log, db)
+	index := main.NewTopicIndex(log, things, orgs)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "sensor1/value")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, "sensor1")
+
+	sensors, err := index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+	Equals(t, "", sensors[0].Sensor.MeasurementValue)
+
+	_, err = db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": sensorId}, bson.M{"$set": bson.M{"sensor.measurement_value": "temp"}})
+	Ok(t, err)
+
+	sensors, err = index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+	Equals(t, "temp", sensors[0].Sensor.MeasurementValue)
+
+	// topic is changed without notification
+	index.RebuildInterval = 100 * time.Millisecond
+	SetSensorMeasurementTopic(t, db, sensorId, "sensor1/temperature")
+
+	sensors, err = index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+
+	time.Sleep(200 * time.Millisecond)
+
+	sensors, err = index.Things(orgId, "sensor1/value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+
+	sensors, err = index.Things(orgId, "sensor1/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+}
+
+// changes done through GraphQL API are reflected by index
+func TestTopicIndexResolver(t *testing.T) {
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	orgs := GetOrgs(t, log, db)
+	index := main.NewTopicIndex(log, things, orgs)
+	resolver := main.NewResolver(log, db, orgs, GetUsers(t, log, db), things, GetMqtt(t, log))
+	schema := graphql.MustParseSchema(schema.GetRootSchema(), resolver)
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, "sensor1")
+	orgId := CreateOrg(t, db, ORG)
+
+	// thing is not assigned to org yet
+	sensors, err := index.Things(orgId, "value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+
+	result := schema.Exec(context.TODO(), `mutation {updateThing(thing: {id: "`+sensorId.Hex()+`", org_id: "`+orgId.Hex()+`"}) {name}}`, "", nil)
+	Equals(t, 0, len(result.Errors))
+
+	sensors, err = index.Things(orgId, "value", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+
+	result = schema.Exec(context.TODO(), `mutation {updateThingSensorData(data: {id: "`+sensorId.Hex()+`", measurement_topic: "xyz"}) {name}}`, "", nil)
+	Equals(t, 0, len(result.Errors))
+
+	sensors, err = index.Things(orgId, "xyz", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+
+	result = schema.Exec(context.TODO(), `mutation {updateOrg(org: {id: "`+orgId.Hex()+`", name: "org2"}) {name}}`, "", nil)
+	Equals(t, 0, len(result.Errors))
+
+	org, err := index.Org("org2")
+	Ok(t, err)
+	Equals(t, orgId, org.Id)
+}
+
+// things with wildcards in topics are matched by things materialised for
+// captured segments
+func TestTopicIndexPatterns(t *testing.T) {
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	index := main.NewTopicIndex(log, things, GetOrgs(t, log, db))
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/+/temperature")
+	SetThingAlias(t, db, sensorId, "{1}_temperature")
+	exactId := CreateThing(t, db, "sensor2")
+	SetSensorMeasurementTopic(t, db, exactId, "zigbee/kitchen/temperature")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, "sensor1")
+	AddOrgThing(t, db, orgId, "sensor2")
+
+	sensors, err := index.Things(orgId, "zigbee/kitchen/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 2, len(sensors))
+	Equals(t, "sensor2", sensors[0].Name)
+	kitchen := sensors[1]
+	Assert(t, kitchen.Id != sensorId, "thing shall be materialised from pattern")
+	Equals(t, sensorId, kitchen.PatternId)
+	Equals(t, []string{"kitchen"}, kitchen.PatternCaptures)
+	Equals(t, "sensor1_kitchen", kitchen.Name)
+	Equals(t, "kitchen_temperature", kitchen.Alias)
+	Equals(t, "zigbee/kitchen/temperature", kitchen.Sensor.MeasurementTopic)
+	Equals(t, orgId, kitchen.OrgId)
+
+	sensors, err = index.Things(orgId, "zigbee/bedroom/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+	Equals(t, "bedroom_temperature", sensors[0].Alias)
+	Assert(t, sensors[0].Id != kitchen.Id, "topics shall have own things")
+
+	// materialised thing is routed by its own topic
+	sensors, err = index.Things(orgId, "zigbee/kitchen/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 2, len(sensors))
+	Equals(t, kitchen.Id, sensors[1].Id)
+
+	materialised, err := things.GetFiltered(bson.M{"pattern_id": sensorId})
+	Ok(t, err)
+	Equals(t, 2, len(materialised))
+
+	sensors, err = index.Things(orgId, "zigbee/kitchen/humidity", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+
+	// invalid patterns are ignored
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/#/temperature")
+	things.Changed()
+
+	sensors, err = index.Things(orgId, "zigbee/hall/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+}
+
+// number of things materialised from pattern is limited and their creation
+// doesn't force rebuild of index
+func TestTopicIndexPatternsLimit(t *testing.T) {
+	const ORG = "org1"
+
+	log := GetLogger(t)
+	db := GetDb(t)
+	things := GetThings(t, log, db)
+	things.PatternMaxThings = 2
+	index := main.NewTopicIndex(log, things, GetOrgs(t, log, db))
+
+	CleanDb(t, db)
+	sensorId := CreateThing(t, db, "sensor1")
+	SetSensorMeasurementTopic(t, db, sensorId, "zigbee/+/temperature")
+	orgId := CreateOrg(t, db, ORG)
+	AddOrgThing(t, db, orgId, "sensor1")
+
+	sensors, err := index.Things(orgId, "zigbee/kitchen/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+
+	generation := things.Generation()
+
+	sensors, err = index.Things(orgId, "zigbee/bedroom/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+	Equals(t, generation, things.Generation())
+
+	// limit is reached, new topics are ignored
+	sensors, err = index.Things(orgId, "zigbee/hall/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 0, len(sensors))
+
+	materialised, err := things.GetFiltered(bson.M{"pattern_id": sensorId})
+	Ok(t, err)
+	Equals(t, 2, len(materialised))
+
+	// already materialised things are still routed
+	sensors, err = index.Things(orgId, "zigbee/kitchen/temperature", main.TOPIC_ROLE_SENSOR)
+	Ok(t, err)
+	Equals(t, 1, len(sensors))
+	Equals(t, []string{"kitchen"}, sensors[0].PatternCaptures)
+}
+
+// prepares org with sensors for benchmarks of topic lookup
+func prepareTopicBenchmark(b *testing.B) (*main.Things, *main.Orgs) {
+	log := GetLogger(b)
+	db := GetDb(b)
+
+	CleanDb(b, db)
+	orgId := CreateOrg(b, db, "org1")
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("sensor%d", i)
+		id := CreateThing(b, db, name)
+		SetSensorMeasurementTopic(b, db, id, name+"/value")
+		AddOrgThing(b, db, orgId, name)
+	}
+
+	return GetThings(b, log, db), GetOrgs(b, log, db)
+}
+
+// lookup of things interested in topic by database queries (approach used
+// before introduction of topic index)
+func BenchmarkTopicLookupDb(b *testing.B) {
+	things, orgs := prepareTopicBenchmark(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		org, err := orgs.GetByName("org1")
+		Ok(b, err)
+
+		filters := []bson.M{
+			{"org_id": org.Id, "battery_mqtt_topic": "sensor42/value"},
+			{"org_id": org.Id, "type": main.THING_TYPE_DEVICE, "availability_topic": "sensor42/value"},
+			{"org_id": org.Id, "type": main.THING_TYPE_DEVICE, "telemetry_topic": "sensor42/value"},
+			{"org_id": org.Id, "type": main.THING_TYPE_DEVICE, "loc_mqtt_topic": "sensor42/value"},
+			{"org_id": org.Id, "type": main.THING_TYPE_SENSOR, "sensor.measurement_topic": "sensor42/value"},
+			{"org_id": org.Id, "type": main.THING_TYPE_SWITCH, "switch.state_topic": "sensor42/value"},
+		}
+		for _, filter := range filters {
+			_, err := things.GetFiltered(filter)
+			Ok(b, err)
+		}
+	}
+}
+
+// lookup of things interested in topic by topic index
+func BenchmarkTopicLookupIndex(b *testing.B) {
+	things, orgs := prepareTopicBenchmark(b)
+	index := main.NewTopicIndex(GetLogger(b), things, orgs)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		org, err := index.Org("org1")
+		Ok(b, err)
+
+		roles := []string{
+			main.TOPIC_ROLE_BATTERY,
+			main.TOPIC_ROLE_AVAILABILITY,
+			main.TOPIC_ROLE_TELEMETRY,
+			main.TOPIC_ROLE_LOCATION,
+			main.TOPIC_ROLE_SENSOR,
+			main.TOPIC_ROLE_SWITCH,
+		}
+		for _, role := range roles {
+			_, err := index.Things(org.Id, "sensor42/value", role)
+			Ok(b, err)
+		}
+	}
+}
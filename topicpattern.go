@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MQTT wildcards usable in topics of things, single level wildcard matches
+// one topic level, multi level wildcard matches all remaining levels
+const TOPIC_WILDCARD_SINGLE = "+"
+const TOPIC_WILDCARD_MULTI = "#"
+
+// IsTopicPattern returns true if topic contains wildcards
+func IsTopicPattern(topic string) bool {
+	for _, level := range strings.Split(topic, "/") {
+		if level == TOPIC_WILDCARD_SINGLE || level == TOPIC_WILDCARD_MULTI {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateTopicPattern checks that wildcards occupy whole topic levels and
+// that multi level wildcard is last level of topic
+func ValidateTopicPattern(topic string) error {
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		if level == TOPIC_WILDCARD_SINGLE {
+			continue
+		}
+		if level == TOPIC_WILDCARD_MULTI {
+			if i != len(levels)-1 {
+				return fmt.Errorf("wildcard %s must be last level of topic %s", TOPIC_WILDCARD_MULTI, topic)
+			}
+			continue
+		}
+		if strings.ContainsAny(level, TOPIC_WILDCARD_SINGLE+TOPIC_WILDCARD_MULTI) {
+			return fmt.Errorf("wildcard must occupy whole level of topic %s", topic)
+		}
+	}
+
+	return nil
+}
+
+// MatchTopic matches topic against pattern and returns segments captured by
+// wildcards, multi level wildcard captures all remaining levels (it also
+// matches parent level and captures empty string in such case)
+func MatchTopic(pattern, topic string) ([]string, bool) {
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	captures := []string{}
+	for i, level := range patternLevels {
+		if level == TOPIC_WILDCARD_MULTI && i == len(patternLevels)-1 {
+			if i > len(topicLevels) {
+				return nil, false
+			}
+			return append(captures, strings.Join(topicLevels[i:], "/")), true
+		}
+
+		if i >= len(topicLevels) {
+			return nil, false
+		}
+
+		switch level {
+		case TOPIC_WILDCARD_SINGLE:
+			captures = append(captures, topicLevels[i])
+		case topicLevels[i]:
+		default:
+			return nil, false
+		}
+	}
+
+	if len(patternLevels) != len(topicLevels) {
+		return nil, false
+	}
+
+	return captures, true
+}
+
+// ExpandTopicCaptures replaces placeholders {1}, {2}, ... in template by
+// segments captured by wildcards of topic pattern
+func ExpandTopicCaptures(template string, captures []string) string {
+	if len(captures) == 0 || !strings.Contains(template, "{") {
+		return template
+	}
+
+	replacements := []string{}
+	for i, capture := range captures {
+		replacements = append(replacements, fmt.Sprintf("{%d}", i+1), capture)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// ExpandTopicPattern replaces wildcards of topic pattern by segments
+// captured by wildcards (see MatchTopic), returns false if number of
+// wildcards doesn't match number of captured segments
+func ExpandTopicPattern(pattern string, captures []string) (string, bool) {
+	levels := strings.Split(pattern, "/")
+
+	n := 0
+	for i, level := range levels {
+		if level != TOPIC_WILDCARD_SINGLE && level != TOPIC_WILDCARD_MULTI {
+			continue
+		}
+		if n >= len(captures) {
+			return "", false
+		}
+		levels[i] = captures[n]
+		n++
+	}
+
+	if n != len(captures) {
+		return "", false
+	}
+
+	// multi level wildcard matching parent level captures nothing
+	if last := len(levels) - 1; last > 0 && levels[last] == "" && strings.HasSuffix(pattern, TOPIC_WILDCARD_MULTI) {
+		levels = levels[:last]
+	}
+
+	return strings.Join(levels, "/"), true
+}
+
+// newPatternThing returns thing materialised from thing with topic patterns
+// for segments captured by wildcards. The new thing gets configuration of
+// the pattern thing with captured segments expanded in name, alias and
+// topics with wildcards (topics without wildcards remain handled by the
+// pattern thing). It starts without any state.
+func newPatternThing(pattern *Thing, captures []string) *Thing {
+	topic := func(t string) string {
+		if !IsTopicPattern(t) {
+			return ""
+		}
+		expanded, ok := ExpandTopicPattern(t, captures)
+		if !ok {
+			return ""
+		}
+		return expanded
+	}
+
+	thing := &Thing{
+		Id:                    primitive.NewObjectID(),
+		Name:                  ExpandTopicCaptures(pattern.Name, captures),
+		Description:           pattern.Description,
+		Alias:                 ExpandTopicCaptures(pattern.Alias, captures),
+		Type:                  pattern.Type,
+		Enabled:               pattern.Enabled,
+		Created:               int32(time.Now().Unix()),
+		OrgId:                 pattern.OrgId,
+		ParentId:              pattern.ParentId,
+		PatternId:             pattern.Id,
+		PatternCaptures:       captures,
+		LastSeenInterval:      pattern.LastSeenInterval,
+		AvailabilityTopic:     topic(pattern.AvailabilityTopic),
+		AvailabilityYes:       pattern.AvailabilityYes,
+		AvailabilityNo:        pattern.AvailabilityNo,
+		TelemetryTopic:        topic(pattern.TelemetryTopic),
+		TelemetryFields:       pattern.TelemetryFields,
+		TelemetryTracking:     pattern.TelemetryTracking,
+		TelemetryHistory:      pattern.TelemetryHistory,
+		StoreInfluxDb:         pattern.StoreInfluxDb,
+		StoreMysqlDb:          pattern.StoreMysqlDb,
+		StoreMysqlDbInterval:  pattern.StoreMysqlDbInterval,
+		LocationMqttTopic:     topic(pattern.LocationMqttTopic),
+		LocationMqttLatValue:  pattern.LocationMqttLatValue,
+		LocationMqttLngValue:  pattern.LocationMqttLngValue,
+		LocationMqttTsValue:   pattern.LocationMqttTsValue,
+		LocationMqttSatValue:  pattern.LocationMqttSatValue,
+		LocationTracking:      pattern.LocationTracking,
+		BatteryMqttTopic:      topic(pattern.BatteryMqttTopic),
+		BatteryMqttLevelValue: pattern.BatteryMqttLevelValue,
+		BatteryLevelTracking:  pattern.BatteryLevelTracking,
+		Sensor: SensorData{
+			MeasurementTopic:      topic(pattern.Sensor.MeasurementTopic),
+			MeasurementValue:      pattern.Sensor.MeasurementValue,
+			MeasurementExpression: pattern.Sensor.MeasurementExpression,
+			Class:                 pattern.Sensor.Class,
+			Validity:              pattern.Sensor.Validity,
+			Unit:                  pattern.Sensor.Unit,
+		},
+	}
+
+	// names of things materialised from the same pattern differ
+	if thing.Name == pattern.Name {
+		thing.Name = fmt.Sprintf("%s_%s", pattern.Name, strings.Join(captures, "_"))
+	}
+
+	return thing
+}
+
+// patternThingConfig returns attributes of thing materialised from thing
+// with topic patterns that are derived from the pattern thing (see
+// newPatternThing), name and alias are kept since they could be changed by
+// user
+func patternThingConfig(thing *Thing) bson.M {
+	return bson.M{
+		"description":                   thing.Description,
+		"type":                          thing.Type,
+		"enabled":                       thing.Enabled,
+		"org_id":                        thing.OrgId,
+		"parent_id":                     thing.ParentId,
+		"last_seen_interval":            thing.LastSeenInterval,
+		"availability_topic":            thing.AvailabilityTopic,
+		"availability_yes":              thing.AvailabilityYes,
+		"availability_no":               thing.AvailabilityNo,
+		"telemetry_topic":               thing.TelemetryTopic,
+		"telemetry_fields":              thing.TelemetryFields,
+		"telemetry_tracking":            thing.TelemetryTracking,
+		"telemetry_history":             thing.TelemetryHistory,
+		"store_influxdb":                thing.StoreInfluxDb,
+		"store_mysqldb":                 thing.StoreMysqlDb,
+		"store_mysqldb_interval":        thing.StoreMysqlDbInterval,
+		"loc_mqtt_topic":                thing.LocationMqttTopic,
+		"loc_mqtt_lat_value":            thing.LocationMqttLatValue,
+		"loc_mqtt_lng_value":            thing.LocationMqttLngValue,
+		"loc_mqtt_ts_value":             thing.LocationMqttTsValue,
+		"loc_mqtt_sat_value":            thing.LocationMqttSatValue,
+		"loc_tracking":                  thing.LocationTracking,
+		"battery_mqtt_topic":            thing.BatteryMqttTopic,
+		"battery_mqtt_level_value":      thing.BatteryMqttLevelValue,
+		"battery_level_tracking":        thing.BatteryLevelTracking,
+		"sensor.measurement_topic":      thing.Sensor.MeasurementTopic,
+		"sensor.measurement_value":      thing.Sensor.MeasurementValue,
+		"sensor.measurement_expression": thing.Sensor.MeasurementExpression,
+		"sensor.class":                  thing.Sensor.Class,
+		"sensor.validity":               thing.Sensor.Validity,
+		"sensor.unit":                   thing.Sensor.Unit,
+	}
+}
+
+// errTopicPattern is returned for topics with wildcards where wildcards are
+// not supported
+var errTopicPattern = errors.New("wildcards are not supported in topic")
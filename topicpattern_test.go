@@ -0,0 +1,93 @@
+package main_test
+
+import (
+	main "piot-server"
+	"testing"
+)
+
+func TestIsTopicPattern(t *testing.T) {
+	Equals(t, false, main.IsTopicPattern("zigbee/kitchen/temperature"))
+	Equals(t, false, main.IsTopicPattern("zigbee/kitchen+/temperature"))
+	Equals(t, true, main.IsTopicPattern("zigbee/+/temperature"))
+	Equals(t, true, main.IsTopicPattern("zigbee/#"))
+	Equals(t, true, main.IsTopicPattern("#"))
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	Ok(t, main.ValidateTopicPattern(""))
+	Ok(t, main.ValidateTopicPattern("zigbee/kitchen/temperature"))
+	Ok(t, main.ValidateTopicPattern("zigbee/+/temperature"))
+	Ok(t, main.ValidateTopicPattern("zigbee/+/+"))
+	Ok(t, main.ValidateTopicPattern("zigbee/#"))
+
+	Fail(t, main.ValidateTopicPattern("zigbee/#/temperature"))
+	Fail(t, main.ValidateTopicPattern("zigbee/kitchen+/temperature"))
+	Fail(t, main.ValidateTopicPattern("zigbee/kitchen#"))
+}
+
+func TestMatchTopic(t *testing.T) {
+	captures, ok := main.MatchTopic("zigbee/+/temperature", "zigbee/kitchen/temperature")
+	Equals(t, true, ok)
+	Equals(t, []string{"kitchen"}, captures)
+
+	captures, ok = main.MatchTopic("zigbee/+/+", "zigbee/kitchen/humidity")
+	Equals(t, true, ok)
+	Equals(t, []string{"kitchen", "humidity"}, captures)
+
+	captures, ok = main.MatchTopic("zigbee/#", "zigbee/kitchen/temperature")
+	Equals(t, true, ok)
+	Equals(t, []string{"kitchen/temperature"}, captures)
+
+	// multi level wildcard matches also parent level
+	captures, ok = main.MatchTopic("zigbee/#", "zigbee")
+	Equals(t, true, ok)
+	Equals(t, []string{""}, captures)
+
+	captures, ok = main.MatchTopic("zigbee/kitchen", "zigbee/kitchen")
+	Equals(t, true, ok)
+	Equals(t, []string{}, captures)
+
+	_, ok = main.MatchTopic("zigbee/+/temperature", "zigbee/kitchen/humidity")
+	Equals(t, false, ok)
+	_, ok = main.MatchTopic("zigbee/+/temperature", "zigbee/temperature")
+	Equals(t, false, ok)
+	_, ok = main.MatchTopic("zigbee/+", "zigbee/kitchen/temperature")
+	Equals(t, false, ok)
+	_, ok = main.MatchTopic("zigbee/#", "zwave/kitchen")
+	Equals(t, false, ok)
+}
+
+func TestExpandTopicCaptures(t *testing.T) {
+	Equals(t, "kitchen_temperature", main.ExpandTopicCaptures("{1}_temperature", []string{"kitchen"}))
+	Equals(t, "kitchen humidity", main.ExpandTopicCaptures("{1} {2}", []string{"kitchen", "humidity"}))
+	Equals(t, "sensor", main.ExpandTopicCaptures("sensor", []string{"kitchen"}))
+
+	// unknown placeholders are kept
+	Equals(t, "kitchen {2}", main.ExpandTopicCaptures("{1} {2}", []string{"kitchen"}))
+	Equals(t, "{1}", main.ExpandTopicCaptures("{1}", nil))
+}
+
+func TestExpandTopicPattern(t *testing.T) {
+	topic, ok := main.ExpandTopicPattern("zigbee/+/temperature", []string{"kitchen"})
+	Equals(t, true, ok)
+	Equals(t, "zigbee/kitchen/temperature", topic)
+
+	topic, ok = main.ExpandTopicPattern("zigbee/+/+", []string{"kitchen", "humidity"})
+	Equals(t, true, ok)
+	Equals(t, "zigbee/kitchen/humidity", topic)
+
+	topic, ok = main.ExpandTopicPattern("zigbee/#", []string{"kitchen/temperature"})
+	Equals(t, true, ok)
+	Equals(t, "zigbee/kitchen/temperature", topic)
+
+	// multi level wildcard matching parent level
+	topic, ok = main.ExpandTopicPattern("zigbee/#", []string{""})
+	Equals(t, true, ok)
+	Equals(t, "zigbee", topic)
+
+	// number of wildcards doesn't match captured segments
+	_, ok = main.ExpandTopicPattern("zigbee/+/+", []string{"kitchen"})
+	Equals(t, false, ok)
+	_, ok = main.ExpandTopicPattern("zigbee/+/temperature", []string{"kitchen", "humidity"})
+	Equals(t, false, ok)
+}
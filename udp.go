@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/op/go-logging"
+)
+
+// maximal size of datagram carrying PIOT packet
+const PIOT_UDP_MAX_PACKET_SIZE = 4096
+
+// datagrams are processed by fixed number of workers, datagrams that don't
+// fit into queue are dropped
+const PIOT_UDP_WORKERS = 8
+const PIOT_UDP_QUEUE_SIZE = 256
+
+type udpDatagram struct {
+	body []byte
+	addr net.Addr
+}
+
+// Receives PIOT packets over UDP, each datagram carries single packet in
+// the same format as body of http request processed by adapter (plain or
+// encrypted). Datagrams carrying decoded and authenticated packets are
+// acknowledged by response datagram. Datagrams rejected before decoding
+// (e.g. by rate limit, failed decryption) are not answered, since source
+// address of datagram could be forged. For the same reason commands are
+// delivered only in response to packets sealed by device key and responses
+// to other packets are not sent if they are longer than the packet.
+type UdpAdapter struct {
+	log     *logging.Logger
+	adapter *Adapter
+	conn    net.PacketConn
+	queue   chan udpDatagram
+}
+
+func NewUdpAdapter(log *logging.Logger, adapter *Adapter) *UdpAdapter {
+	return &UdpAdapter{log: log, adapter: adapter}
+}
+
+// Listen opens udp socket on given address
+func (u *UdpAdapter) Listen(address string) error {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return err
+	}
+
+	u.conn = conn
+
+	return nil
+}
+
+// Addr returns address of opened socket
+func (u *UdpAdapter) Addr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+// Serve receives datagrams until the socket is closed
+func (u *UdpAdapter) Serve() error {
+	u.queue = make(chan udpDatagram, PIOT_UDP_QUEUE_SIZE)
+	defer close(u.queue)
+
+	for i := 0; i < PIOT_UDP_WORKERS; i++ {
+		go func() {
+			for datagram := range u.queue {
+				u.safeHandle(datagram)
+			}
+		}()
+	}
+
+	buf := make([]byte, PIOT_UDP_MAX_PACKET_SIZE)
+
+	for {
+		n, addr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		body := make([]byte, n)
+		copy(body, buf[:n])
+
+		select {
+		case u.queue <- udpDatagram{body, addr}:
+		default:
+			u.log.Warningf("Dropping udp packet from %s, queue is full", addr)
+		}
+	}
+}
+
+func (u *UdpAdapter) Close() error {
+	return u.conn.Close()
+}
+
+// safeHandle handles datagram and recovers from panic, so failure of single
+// packet doesn't stop the worker (and the whole server)
+func (u *UdpAdapter) safeHandle(datagram udpDatagram) {
+	defer func() {
+		if r := recover(); r != nil {
+			u.log.Errorf("Processing of udp packet from %s panicked (%v)", datagram.addr, r)
+		}
+	}()
+
+	u.handle(datagram.body, datagram.addr)
+}
+
+func (u *UdpAdapter) handle(body []byte, addr net.Addr) {
+	u.log.Debugf("Incoming udp packet from %s, length: %d", addr, len(body))
+
+	if u.log.IsEnabledFor(logging.DEBUG) {
+		u.log.Debugf("Packet body: %s", body)
+	}
+
+	result, status, err := u.adapter.process(body, "", hostOf(addr.String()))
+	if err != nil {
+		u.log.Warningf("Processing of udp packet from %s failed (%s)", addr, err.Error())
+
+		// packets that were not decoded and authenticated are not answered
+		// to avoid reflection of traffic to forged source addresses
+		if result == nil {
+			return
+		}
+
+		u.reply(result, &PiotDeviceResponse{Status: status, Error: err.Error()}, addr, len(body))
+		return
+	}
+
+	// commands are delivered only to device that proved its identity, reply
+	// to packet with forged source would mark them delivered otherwise
+	if result.authDevice != "" {
+		u.adapter.deliverCommands(result)
+	}
+
+	response := result.response()
+	if r, ok := response.(*PiotDeviceResponse); ok {
+		r.Status = http.StatusOK
+	}
+
+	u.reply(result, response, addr, len(body))
+}
+
+// reply sends response in encoding of the packet, response is sealed by
+// device key for sealed packets. Response to packet that is not sealed is
+// dropped if it is longer than the packet (limit), so it cannot amplify
+// traffic reflected to forged source address.
+func (u *UdpAdapter) reply(result *adapterResult, response interface{}, addr net.Addr, limit int) {
+	content, _, err := u.adapter.encodeResponse(result, response)
+	if err != nil {
+		u.log.Errorf("Failed to encode udp response (%s)", err.Error())
+		return
+	}
+
+	if result.authDevice == "" && len(content) > limit {
+		u.log.Warningf("Dropping udp response to %s, response to unsealed packet is longer than the packet (%d > %d)", addr, len(content), limit)
+		return
+	}
+
+	if _, err := u.conn.WriteTo(content, addr); err != nil {
+		u.log.Warningf("Failed to send udp response to %s (%s)", addr, err.Error())
+	}
+}
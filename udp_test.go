@@ -0,0 +1,196 @@
+package main_test
+
+import (
+	"net"
+	main "piot-server"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func getUdpAdapter(t *testing.T) *main.UdpAdapter {
+	udp := main.NewUdpAdapter(GetLogger(t), getSecureAdapter(t))
+	Ok(t, udp.Listen("127.0.0.1:0"))
+
+	go udp.Serve()
+
+	return udp
+}
+
+func sendDatagram(t *testing.T, udp *main.UdpAdapter, data []byte) []byte {
+	reply, err := exchangeDatagram(t, udp, data, 5*time.Second)
+	Ok(t, err)
+
+	return reply
+}
+
+// exchangeDatagram sends datagram and waits for reply
+func exchangeDatagram(t *testing.T, udp *main.UdpAdapter, data []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.Dial("udp", udp.Addr().String())
+	Ok(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(data)
+	Ok(t, err)
+
+	Ok(t, conn.SetReadDeadline(time.Now().Add(timeout)))
+
+	buf := make([]byte, main.PIOT_UDP_MAX_PACKET_SIZE)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+// packets delivered over udp are processed and acknowledged
+func TestUdpPacket(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+
+	udp := getUdpAdapter(t)
+	defer udp.Close()
+
+	reply := sendDatagram(t, udp, []byte(`{"device": "Device123", "readings": [{"address": "SensorXYZ", "t": 23}]}`))
+
+	var response main.PiotDeviceResponse
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_JSON, reply, &response))
+	Equals(t, 200, response.Status)
+
+	things := GetThings(t, GetLogger(t), db)
+	_, err := things.FindPiot("Device123")
+	Ok(t, err)
+}
+
+// binary encoding is detected, ack is sent in the same encoding
+func TestUdpPacketCbor(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+
+	udp := getUdpAdapter(t)
+	defer udp.Close()
+
+	data, err := cbor.Marshal(map[string]interface{}{"d": "Device123"})
+	Ok(t, err)
+
+	reply := sendDatagram(t, udp, data)
+	Equals(t, main.PIOT_CONTENT_CBOR, main.PiotDetectContentType(reply))
+
+	var response main.PiotDeviceResponse
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_CBOR, reply, &response))
+	Equals(t, 200, response.Status)
+}
+
+// invalid packets are dropped without reply, source address could be forged
+func TestUdpPacketInvalid(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+
+	udp := getUdpAdapter(t)
+	defer udp.Close()
+
+	_, err := exchangeDatagram(t, udp, []byte("garbage"), 500*time.Millisecond)
+	Assert(t, err != nil, "Invalid packet shall not be answered")
+}
+
+// sealDatagram seals packet by key of the device
+func sealDatagram(t *testing.T, key, device, packet string) []byte {
+	k, err := main.PiotParseKey(key)
+	Ok(t, err)
+
+	sealed, err := main.PiotSeal(k, device, []byte(packet))
+	Ok(t, err)
+
+	return sealed
+}
+
+// openReply opens reply sealed by key of the device
+func openReply(t *testing.T, key string, reply []byte) main.PiotDeviceResponse {
+	k, err := main.PiotParseKey(key)
+	Ok(t, err)
+
+	device, content, ok := main.PiotOpenEnvelope(reply)
+	Assert(t, ok, "Reply shall be sealed")
+
+	plain, err := main.PiotOpen(k, device, content)
+	Ok(t, err)
+
+	var response main.PiotDeviceResponse
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_JSON, plain, &response))
+
+	return response
+}
+
+// decoded packets that fail processing are answered with error
+func TestUdpPacketRejected(t *testing.T) {
+	const KEY = "000102030405060708090a0b0c0d0e0f"
+
+	db := GetDb(t)
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, "Device123")
+	SetThingPiotKey(t, db, thingId, KEY)
+
+	udp := getUdpAdapter(t)
+	defer udp.Close()
+
+	packet := sealDatagram(t, KEY, "Device123", `{"device": "Device123", "c": 5}`)
+
+	response := openReply(t, KEY, sendDatagram(t, udp, packet))
+	Equals(t, 200, response.Status)
+
+	// replayed packet
+	response = openReply(t, KEY, sendDatagram(t, udp, packet))
+	Equals(t, 409, response.Status)
+	Assert(t, response.Error != "", "Error shall be reported")
+}
+
+// commands are delivered only in reply to sealed packets, source address of
+// other packets could be forged
+func TestUdpPacketCommands(t *testing.T) {
+	const KEY = "000102030405060708090a0b0c0d0e0f"
+
+	db := GetDb(t)
+	CleanDb(t, db)
+	thingId := CreateDevice(t, db, "Device123")
+
+	things := GetThings(t, GetLogger(t), db)
+	_, err := things.AddPiotCommand(thingId, main.PIOT_COMMAND_REBOOT, "")
+	Ok(t, err)
+
+	udp := getUdpAdapter(t)
+	defer udp.Close()
+
+	reply := sendDatagram(t, udp, []byte(`{"device": "Device123"}`))
+
+	var response main.PiotDeviceResponse
+	Ok(t, main.PiotDecode(main.PIOT_CONTENT_JSON, reply, &response))
+	Equals(t, 200, response.Status)
+	Equals(t, 0, len(response.Commands))
+
+	thing, err := things.FindPiot("Device123")
+	Ok(t, err)
+	Equals(t, int32(0), thing.PiotCommands[0].Deliveries)
+
+	// device proves its identity by key
+	SetThingPiotKey(t, db, thingId, KEY)
+
+	response = openReply(t, KEY, sendDatagram(t, udp, sealDatagram(t, KEY, "Device123", `{"device": "Device123"}`)))
+	Equals(t, 200, response.Status)
+	Equals(t, 1, len(response.Commands))
+	Equals(t, main.PIOT_COMMAND_REBOOT, response.Commands[0].Name)
+}
+
+// reply to packet that is not sealed is not longer than the packet
+func TestUdpPacketReplyLimit(t *testing.T) {
+	db := GetDb(t)
+	CleanDb(t, db)
+
+	udp := getUdpAdapter(t)
+	defer udp.Close()
+
+	// summary of batch with errors is longer than the packet
+	_, err := exchangeDatagram(t, udp, []byte(`{"d":"Device123","b":[{}]}`), 500*time.Millisecond)
+	Assert(t, err != nil, "Reply longer than packet shall not be sent")
+}
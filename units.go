@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Describes unit of measurement as linear transformation to base unit of
+// the quantity (base = value * scale + offset)
+type unitDef struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+// known units, base units are C (temperature) and hPa (pressure)
+var units = map[string]unitDef{
+	"C":    {"temperature", 1, 0},
+	"°C":   {"temperature", 1, 0},
+	"F":    {"temperature", 5.0 / 9.0, -160.0 / 9.0},
+	"°F":   {"temperature", 5.0 / 9.0, -160.0 / 9.0},
+	"K":    {"temperature", 1, -273.15},
+	"hPa":  {"pressure", 1, 0},
+	"mbar": {"pressure", 1, 0},
+	"Pa":   {"pressure", 0.01, 0},
+	"kPa":  {"pressure", 10, 0},
+	"bar":  {"pressure", 1000, 0},
+	"inHg": {"pressure", 33.863886666667, 0},
+	"mmHg": {"pressure", 1.333223874, 0},
+}
+
+// number of decimal places of converted values, it hides rounding errors
+// of floating point arithmetic (e.g. 23.000000000000004)
+const UNIT_PRECISION = 6
+
+// UnitsCompatible checks if values can be converted between units
+func UnitsCompatible(from, to string) bool {
+	if from == to {
+		return true
+	}
+
+	f, ok := units[from]
+	if !ok {
+		return false
+	}
+
+	t, ok := units[to]
+	if !ok {
+		return false
+	}
+
+	return f.quantity == t.quantity
+}
+
+// ConvertUnit converts value between units of the same quantity, value is
+// returned unchanged if units are equal
+func ConvertUnit(value float64, from, to string) (float64, error) {
+	if from == to {
+		return value, nil
+	}
+
+	f, ok := units[from]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s", from)
+	}
+
+	t, ok := units[to]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s", to)
+	}
+
+	if f.quantity != t.quantity {
+		return 0, fmt.Errorf("cannot convert %s to %s", from, to)
+	}
+
+	base := value*f.scale + f.offset
+	result := (base - t.offset) / t.scale
+
+	precision := math.Pow(10, UNIT_PRECISION)
+
+	return math.Round(result*precision) / precision, nil
+}
@@ -0,0 +1,47 @@
+package main_test
+
+import (
+	main "piot-server"
+	"testing"
+)
+
+func TestConvertUnit(t *testing.T) {
+	cases := []struct {
+		value    float64
+		from, to string
+		expected float64
+	}{
+		{23, "C", "C", 23},
+		{100, "C", "F", 212},
+		{212, "F", "C", 100},
+		{23, "C", "F", 73.4},
+		{73.4, "°F", "°C", 23},
+		{0, "C", "K", 273.15},
+		{1013.25, "hPa", "Pa", 101325},
+		{101325, "Pa", "hPa", 1013.25},
+		{1013.25, "hPa", "inHg", 29.921255},
+		{1000, "mbar", "kPa", 100},
+	}
+
+	for _, c := range cases {
+		result, err := main.ConvertUnit(c.value, c.from, c.to)
+		Ok(t, err)
+		Equals(t, c.expected, result)
+	}
+}
+
+func TestConvertUnitInvalid(t *testing.T) {
+	_, err := main.ConvertUnit(23, "C", "hPa")
+	Fail(t, err)
+
+	_, err = main.ConvertUnit(23, "C", "xyz")
+	Fail(t, err)
+
+	_, err = main.ConvertUnit(23, "xyz", "C")
+	Fail(t, err)
+
+	Equals(t, true, main.UnitsCompatible("C", "F"))
+	Equals(t, true, main.UnitsCompatible("m/s", "m/s"))
+	Equals(t, false, main.UnitsCompatible("C", "Pa"))
+	Equals(t, false, main.UnitsCompatible("m/s", "km/h"))
+}
@@ -85,15 +85,17 @@ func AuthContext(t *testing.T, userId, orgId primitive.ObjectID) context.Context
 	return ctx
 }
 
-func CleanDb(t *testing.T, db *mongo.Database) {
+func CleanDb(t testing.TB, db *mongo.Database) {
 	db.Collection("orgs").DeleteMany(context.TODO(), bson.M{})
 	db.Collection("users").DeleteMany(context.TODO(), bson.M{})
 	db.Collection("orgusers").DeleteMany(context.TODO(), bson.M{})
 	db.Collection("things").DeleteMany(context.TODO(), bson.M{})
+	db.Collection("piot_pending").DeleteMany(context.TODO(), bson.M{})
+	db.Collection("availability_events").DeleteMany(context.TODO(), bson.M{})
 	t.Log("DB is clean")
 }
 
-func CreateDevice(t *testing.T, db *mongo.Database, name string) primitive.ObjectID {
+func CreateDevice(t testing.TB, db *mongo.Database, name string) primitive.ObjectID {
 	res, err := db.Collection("things").InsertOne(context.TODO(), bson.M{
 		"name":    name,
 		"piot_id": name,
@@ -132,7 +134,7 @@ func CreateSwitch(t *testing.T, db *mongo.Database, name string) primitive.Objec
 	return res.InsertedID.(primitive.ObjectID)
 }
 
-func CreateThing(t *testing.T, db *mongo.Database, name string) primitive.ObjectID {
+func CreateThing(t testing.TB, db *mongo.Database, name string) primitive.ObjectID {
 	res, err := db.Collection("things").InsertOne(context.TODO(), bson.M{
 		"name":           name,
 		"piot_id":        name,
@@ -186,7 +188,7 @@ func CreateAdmin(t *testing.T, db *mongo.Database, email, password string) primi
 	return res.InsertedID.(primitive.ObjectID)
 }
 
-func CreateOrg(t *testing.T, db *mongo.Database, name string) primitive.ObjectID {
+func CreateOrg(t testing.TB, db *mongo.Database, name string) primitive.ObjectID {
 	res, err := db.Collection("orgs").InsertOne(context.TODO(), bson.M{
 		"name":              name,
 		"created":           int32(time.Now().Unix()),
@@ -204,6 +206,11 @@ func CreateOrg(t *testing.T, db *mongo.Database, name string) primitive.ObjectID
 	return res.InsertedID.(primitive.ObjectID)
 }
 
+func SetOrgMqttCredentials(t testing.TB, db *mongo.Database, orgId primitive.ObjectID, username, password string) {
+	_, err := db.Collection("orgs").UpdateOne(context.TODO(), bson.M{"_id": orgId}, bson.M{"$set": bson.M{"mqtt_username": username, "mqtt_password": password}})
+	Ok(t, err)
+}
+
 func AddOrgUser(t *testing.T, db *mongo.Database, orgId, userId primitive.ObjectID) {
 	// assign user to org
 	_, err := db.Collection("orgusers").InsertOne(context.TODO(), bson.M{
@@ -223,18 +230,28 @@ func AddOrgUser(t *testing.T, db *mongo.Database, orgId, userId primitive.Object
 	t.Logf("User %v added to org %v", userId.Hex(), orgId.Hex())
 }
 
-func AddOrgThing(t *testing.T, db *mongo.Database, orgId primitive.ObjectID, thingName string) {
+func AddOrgThing(t testing.TB, db *mongo.Database, orgId primitive.ObjectID, thingName string) {
 	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"name": thingName}, bson.M{"$set": bson.M{"org_id": orgId}})
 	Ok(t, err)
 
 	t.Logf("Thing %s assigned to org %s", thingName, orgId.Hex())
 }
 
-func SetSensorMeasurementTopic(t *testing.T, db *mongo.Database, thingId primitive.ObjectID, topic string) {
+func SetSensorMeasurementTopic(t testing.TB, db *mongo.Database, thingId primitive.ObjectID, topic string) {
 	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{"sensor.measurement_topic": topic}})
 	Ok(t, err)
 }
 
+func SetThingAlias(t testing.TB, db *mongo.Database, thingId primitive.ObjectID, alias string) {
+	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{"alias": alias}})
+	Ok(t, err)
+}
+
+func SetThingPiotKey(t *testing.T, db *mongo.Database, thingId primitive.ObjectID, key string) {
+	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{"piot_key": key}})
+	Ok(t, err)
+}
+
 func SetThingTelemetryTopic(t *testing.T, db *mongo.Database, thingId primitive.ObjectID, topic string) {
 	_, err := db.Collection("things").UpdateOne(context.TODO(), bson.M{"_id": thingId}, bson.M{"$set": bson.M{"telemetry_topic": topic}})
 	Ok(t, err)
@@ -280,7 +297,7 @@ func GetConfig() *config.Parameters {
 	return cfg
 }
 
-func GetLogger(t *testing.T) *logging.Logger {
+func GetLogger(t testing.TB) *logging.Logger {
 
 	if logger == nil {
 		cfg := GetConfig()
@@ -293,7 +310,7 @@ func GetLogger(t *testing.T) *logging.Logger {
 	return logger
 }
 
-func GetDb(t *testing.T) *mongo.Database {
+func GetDb(t testing.TB) *mongo.Database {
 
 	if db == nil {
 
@@ -314,10 +331,14 @@ func GetDb(t *testing.T) *mongo.Database {
 
 func GetPiotDevices(t *testing.T, logger *logging.Logger, things *main.Things, mqtt main.IMqtt) *main.PiotDevices {
 	cfg := GetConfig()
-	return main.NewPiotDevices(logger, things, mqtt, cfg)
+	return main.NewPiotDevices(logger, things, mqtt, cfg, GetSensorClasses(t, logger))
+}
+
+func GetSensorClasses(t *testing.T, logger *logging.Logger) *main.SensorClasses {
+	return main.NewSensorClasses(logger)
 }
 
-func GetThings(t *testing.T, logger *logging.Logger, db *mongo.Database) *main.Things {
+func GetThings(t testing.TB, logger *logging.Logger, db *mongo.Database) *main.Things {
 	return main.NewThings(db, logger)
 }
 
@@ -329,7 +350,7 @@ func GetUsers(t *testing.T, logger *logging.Logger, db *mongo.Database) *main.Us
 	return main.NewUsers(logger, db)
 }
 
-func GetOrgs(t *testing.T, logger *logging.Logger, db *mongo.Database) *main.Orgs {
+func GetOrgs(t testing.TB, logger *logging.Logger, db *mongo.Database) *main.Orgs {
 	return main.NewOrgs(logger, db)
 }
 